@@ -25,6 +25,25 @@ func (e wrapperError) Error() string {
 	return e.msg
 }
 
+// Unwrap returns the original error wrapped by e, for use by the
+// standard library's errors.Is and errors.As. It is the same as
+// Root(e).
+func (e wrapperError) Unwrap() error {
+	return e.root
+}
+
+// Is reports whether err or any error it wraps is target,
+// as in the standard library's errors.Is.
+func Is(err, target error) bool {
+	return errors.Is(err, target)
+}
+
+// As finds the first error in err's chain that matches target,
+// as in the standard library's errors.As.
+func As(err error, target interface{}) bool {
+	return errors.As(err, target)
+}
+
 // Root returns the original error that was wrapped by one or more
 // calls to Wrap. If e does not wrap other errors, it will be returned
 // as-is.
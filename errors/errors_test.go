@@ -47,6 +47,30 @@ func TestWrap(t *testing.T) {
 	}
 }
 
+func TestUnwrap(t *testing.T) {
+	root := errors.New("0")
+	err := WithDetail(Wrap(root, "1"), "2")
+
+	if got := errors.Unwrap(err); got != root {
+		t.Errorf("Unwrap(%v) = %v want %v", err, got, root)
+	}
+	if !errors.Is(err, root) || !Is(err, root) {
+		t.Errorf("Is(%v, %v) = false want true", err, root)
+	}
+	if Is(err, errors.New("0")) {
+		t.Errorf("Is(%v, other) = true want false", err)
+	}
+
+	var target *testErr
+	if !As(Wrap(&testErr{"x"}, "1"), &target) || target.s != "x" {
+		t.Errorf("As did not find wrapped *testErr")
+	}
+}
+
+type testErr struct{ s string }
+
+func (e *testErr) Error() string { return e.s }
+
 func TestWrapNil(t *testing.T) {
 	var err error
 
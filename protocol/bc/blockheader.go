@@ -59,6 +59,47 @@ func (bh *BlockHeader) Hash() (hash Hash) {
 	return NewHash(txvm.VMHash("BlockID", txvm.Encode(tupleHeader)))
 }
 
+// StateRoot computes the state root committed to by bh, given the
+// blockchain's initial block ID. See StateRoot.
+func (bh *BlockHeader) StateRoot(initialBlockID Hash) Hash {
+	var contractsRoot, noncesRoot Hash
+	if bh.ContractsRoot != nil {
+		contractsRoot = *bh.ContractsRoot
+	}
+	if bh.NoncesRoot != nil {
+		noncesRoot = *bh.NoncesRoot
+	}
+	return StateRoot(initialBlockID, contractsRoot, noncesRoot)
+}
+
+// StateRoot computes the single commitment to a blockchain state:
+//   VMHash("StateRoot", serialize({initialBlockID, contractsRoot, noncesRoot}))
+// The tuple fields appear in that order, each as a 32-byte string.
+// A different hash function may be configured with
+// SetStateRootHasher.
+func StateRoot(initialBlockID, contractsRoot, noncesRoot Hash) Hash {
+	tuple := txvm.Tuple{
+		txvm.Bytes(initialBlockID.Bytes()),
+		txvm.Bytes(contractsRoot.Bytes()),
+		txvm.Bytes(noncesRoot.Bytes()),
+	}
+	return NewHash(stateRootHasher("StateRoot", txvm.Encode(tuple)))
+}
+
+var stateRootHasher = txvm.VMHash
+
+// SetStateRootHasher replaces the function StateRoot uses in place
+// of VMHash, for chains whose state commitments use a different
+// hash. (See also patricia.SetHasher.) A nil f restores VMHash.
+// It must be called before any state root is computed, such as from
+// an init function, and not concurrently with StateRoot.
+func SetStateRootHasher(f func(domain string, msg []byte) [32]byte) {
+	if f == nil {
+		f = txvm.VMHash
+	}
+	stateRootHasher = f
+}
+
 // Scan satisfies the database.sql.Scanner interface.
 func (bh *BlockHeader) Scan(val interface{}) error {
 	driverBuf, ok := val.([]byte)
@@ -2,6 +2,7 @@ package bc
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"testing"
 
 	"github.com/chain/txvm/testutil"
@@ -79,3 +80,50 @@ func TestBlockHeaderScanValue(t *testing.T) {
 }
 
 func hashPtr(hash Hash) *Hash { return &hash }
+
+func TestBlockHeaderStateRoot(t *testing.T) {
+	initialID := NewHash([32]byte{5})
+	got := filledBlock.StateRoot(initialID)
+	want := StateRoot(initialID, *filledBlock.ContractsRoot, *filledBlock.NoncesRoot)
+	if got != want {
+		t.Errorf("StateRoot = %x want %x", got.Bytes(), want.Bytes())
+	}
+	if StateRoot(initialID, *filledBlock.NoncesRoot, *filledBlock.ContractsRoot) == want {
+		t.Error("StateRoot does not depend on the order of its inputs")
+	}
+
+	empty := &BlockHeader{}
+	got = empty.StateRoot(initialID)
+	want = StateRoot(initialID, Hash{}, Hash{})
+	if got != want {
+		t.Errorf("StateRoot with nil roots = %x want %x", got.Bytes(), want.Bytes())
+	}
+}
+
+func TestSetStateRootHasher(t *testing.T) {
+	initialID := NewHash([32]byte{5})
+	def := StateRoot(initialID, Hash{}, Hash{})
+
+	var domains []string
+	SetStateRootHasher(func(domain string, msg []byte) [32]byte {
+		domains = append(domains, domain)
+		return sha256.Sum256(msg)
+	})
+	defer SetStateRootHasher(nil)
+	custom1 := StateRoot(initialID, Hash{}, Hash{})
+	custom2 := StateRoot(initialID, Hash{}, Hash{})
+	if custom1 != custom2 {
+		t.Error("custom hasher gives different state roots for the same state")
+	}
+	if custom1 == def {
+		t.Error("custom hasher gives the same state root as the default")
+	}
+	if len(domains) != 2 || domains[0] != "StateRoot" {
+		t.Errorf("hasher called with domains %q, want StateRoot twice", domains)
+	}
+
+	SetStateRootHasher(nil)
+	if got := StateRoot(initialID, Hash{}, Hash{}); got != def {
+		t.Errorf("after SetStateRootHasher(nil), StateRoot = %x want %x", got.Bytes(), def.Bytes())
+	}
+}
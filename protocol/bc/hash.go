@@ -42,6 +42,17 @@ func HashFromBytes(b []byte) Hash {
 	return NewHash(b32)
 }
 
+// HashFromBytesChecked is like HashFromBytes, but returns an error
+// unless b is exactly 32 bytes long. Use it for input, such as data
+// from storage or the network, whose length is not already known to
+// be right.
+func HashFromBytesChecked(b []byte) (Hash, error) {
+	if len(b) != 32 {
+		return Hash{}, fmt.Errorf("hash has length %d, want 32", len(b))
+	}
+	return HashFromBytes(b), nil
+}
+
 // MarshalText satisfies the TextMarshaler interface.
 // It returns the bytes of h encoded in hex,
 // for formats that can't hold arbitrary binary data.
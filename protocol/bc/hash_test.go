@@ -24,6 +24,27 @@ func TestHashBytes(t *testing.T) {
 	}
 }
 
+func TestHashFromBytesChecked(t *testing.T) {
+	b := make([]byte, 33)
+	for i := range b {
+		b[i] = byte(i + 1)
+	}
+	got, err := HashFromBytesChecked(b[:32])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := HashFromBytes(b[:32]); got != want {
+		t.Errorf("HashFromBytesChecked(%x) = %x want %x", b[:32], got.Bytes(), want.Bytes())
+	}
+
+	for _, n := range []int{31, 33, 0} {
+		_, err := HashFromBytesChecked(b[:n])
+		if err == nil {
+			t.Errorf("HashFromBytesChecked with %d bytes: expected error", n)
+		}
+	}
+}
+
 func TestHashMarshalText(t *testing.T) {
 	hash := NewHash([32]byte{1})
 	got, err := hash.MarshalText()
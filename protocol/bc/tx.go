@@ -200,7 +200,7 @@ func (tx *Tx) entryHook(vm *txvm.VM) {
 			tx.Nonces = append(tx.Nonces, Nonce{
 				ID:      NewHash(id),
 				BlockID: blockID,
-				ExpMS:   uint64(exp), // TODO: check signed-to-unsigned conversion
+				ExpMS:   uint64(exp), // negative values are rejected by state.Snapshot
 			})
 		}
 	}
@@ -0,0 +1,410 @@
+package patricia
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/chain/txvm/errors"
+)
+
+// InsertMany inserts each of items into t. The result is the same
+// as calling Insert for each item, but when t is empty the tree is
+// built bottom-up from the sorted items, which is much faster for
+// large inputs.
+//
+// As with Insert, it is an error for any item to be a prefix of
+// another item or of an element of t. On error, t is unchanged.
+func (t *Tree) InsertMany(items [][]byte) error {
+	sorted := make([][]byte, len(items))
+	copy(sorted, items)
+	sort.Slice(sorted, func(i, j int) bool { return bytes.Compare(sorted[i], sorted[j]) < 0 })
+
+	if t.root != nil {
+		tmp := *t
+		for _, item := range sorted {
+			err := tmp.Insert(item)
+			if err != nil {
+				return err
+			}
+		}
+		*t = tmp
+		return nil
+	}
+
+	uniq, err := uniqPrefixFree(sorted)
+	if err != nil {
+		return err
+	}
+	if len(uniq) > 0 {
+		t.root = build(uniq, nil)
+		t.n = len(uniq)
+	}
+	return nil
+}
+
+// uniqPrefixFree removes duplicates from sorted, in place, and checks
+// that no remaining item is a prefix of another.
+func uniqPrefixFree(sorted [][]byte) ([][]byte, error) {
+	uniq := sorted[:0]
+	for _, item := range sorted {
+		if len(uniq) > 0 {
+			last := uniq[len(uniq)-1]
+			if bytes.Equal(last, item) {
+				continue
+			}
+			// In sorted order, an item that is a prefix of
+			// others is immediately followed by one of them.
+			if bytes.HasPrefix(item, last) {
+				return nil, errors.Wrap(errors.New("key provided is a prefix to other keys"))
+			}
+		}
+		uniq = append(uniq, item)
+	}
+	return uniq, nil
+}
+
+// build constructs the subtree holding items, which must be
+// non-empty, sorted, unique, and prefix-free. If leaf is not nil, it
+// is used for its own item instead of a new node.
+func build(items [][]byte, leaf *node) *node {
+	if len(items) == 1 {
+		if leaf != nil && bytes.Equal(items[0], leaf.key) {
+			return leaf
+		}
+		hash := leafHash(items[0])
+		return &node{key: items[0], keybit: 7, hash: &hash, isLeaf: true}
+	}
+
+	first, last := items[0], items[len(items)-1]
+	common, bit := commonPrefix(first, last)
+	split := sort.Search(len(items), func(i int) bool {
+		return childIdx(items[i], common, bit) == 1
+	})
+	return &node{
+		key:      first[:common],
+		keybit:   bit,
+		children: [2]*node{build(items[:split], leaf), build(items[split:], leaf)},
+	}
+}
+
+// ContainsMany reports, for each of items, whether t contains it, as
+// Contains does. The items are looked up together in a single pass
+// over the tree, in sorted order, visiting each node at most once
+// rather than once per item that passes through it. The sort costs
+// about as much as it saves for an in-memory tree, so this mainly
+// pays off where visiting a node is expensive; compare
+// BenchmarkContainsMany and BenchmarkContainsLoop.
+func (t *Tree) ContainsMany(items [][]byte) []bool {
+	order := make([]int, len(items))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool { return bytes.Compare(items[order[i]], items[order[j]]) < 0 })
+	sorted := make([][]byte, len(items))
+	for i, k := range order {
+		sorted[i] = items[k]
+	}
+
+	found := make([]bool, len(items))
+	containsMany(t.root, sorted, found)
+	result := make([]bool, len(items))
+	for i, k := range order {
+		result[k] = found[i]
+	}
+	return result
+}
+
+// containsMany sets found[i] to whether the subtree n, which may be
+// nil, contains sorted[i]. The items must be sorted.
+func containsMany(n *node, sorted [][]byte, found []bool) {
+	if n == nil || len(sorted) == 0 {
+		return
+	}
+	if n.isLeaf {
+		for i, item := range sorted {
+			found[i] = bytes.Equal(item, n.key)
+		}
+		return
+	}
+	// Skip searching for the items under n's prefix when, as is
+	// usual, they are all of them.
+	if cmpPrefix(sorted[0], n) != 0 || cmpPrefix(sorted[len(sorted)-1], n) != 0 || n.keybit == 7 && len(sorted[0]) == len(n.key) {
+		lo, hi := prefixRange(sorted, n)
+		sorted, found = sorted[lo:hi], found[lo:hi]
+	}
+	split := sort.Search(len(sorted), func(i int) bool { return childIdx(sorted[i], len(n.key), n.keybit) == 1 })
+	containsMany(n.children[0], sorted[:split], found[:split])
+	containsMany(n.children[1], sorted[split:], found[split:])
+}
+
+// Update deletes each of remove from t and then inserts each of add.
+// The result is the same as calling Delete and then Insert for each
+// item, but t is updated in a single pass over the affected paths,
+// copying each changed node once rather than once per item that
+// passes through it. This is faster when there are many items.
+//
+// As with Insert, it is an error for an added item to be a prefix of
+// another added item or of an element of t that is not removed. On
+// error, t is unchanged. Like Insert and Delete, Update never
+// modifies the existing nodes of t.
+func (t *Tree) Update(remove, add [][]byte) error {
+	root, delta, err := update(t.root, sortedCopy(remove), sortedCopy(add))
+	if err != nil {
+		return err
+	}
+	t.root = root
+	t.n += delta
+	return nil
+}
+
+func sortedCopy(items [][]byte) [][]byte {
+	sorted := make([][]byte, len(items))
+	copy(sorted, items)
+	sort.Slice(sorted, func(i, j int) bool { return bytes.Compare(sorted[i], sorted[j]) < 0 })
+	return sorted
+}
+
+// update returns the subtree n, which may be nil, with the items of
+// remove deleted and then those of add inserted, and the resulting
+// change in its number of items. Both lists must be sorted. Items of
+// remove not in n are ignored; items of add need not fall under n's
+// prefix.
+func update(n *node, remove, add [][]byte) (*node, int, error) {
+	if len(remove) == 0 && len(add) == 0 {
+		return n, 0, nil
+	}
+
+	if n == nil || n.isLeaf {
+		items := add
+		var leaf *node
+		if n != nil && !containsSorted(remove, n.key) {
+			leaf = n
+			i := sort.Search(len(add), func(i int) bool { return bytes.Compare(add[i], n.key) >= 0 })
+			items = make([][]byte, 0, len(add)+1)
+			items = append(items, add[:i]...)
+			items = append(items, n.key)
+			items = append(items, add[i:]...)
+		}
+		items, err := uniqPrefixFree(items)
+		if err != nil {
+			return nil, 0, err
+		}
+		var before int
+		if n != nil {
+			before = 1
+		}
+		if len(items) == 0 {
+			return nil, -before, nil
+		}
+		return build(items, leaf), len(items) - before, nil
+	}
+
+	// Items under n's prefix go to one of its children. Added items
+	// outside it (including one equal to n's prefix, which is a
+	// prefix of n's items and so an error) are inserted one at a time
+	// afterward. In sorted order, the items under the prefix are
+	// contiguous.
+	rlo, rhi := prefixRange(remove, n)
+	remove = remove[rlo:rhi]
+	lo, hi := prefixRange(add, n)
+	outside := add[hi:]
+	if lo > 0 {
+		outside = append(append([][]byte(nil), add[:lo]...), outside...)
+	}
+	add = add[lo:hi]
+
+	var (
+		children [2]*node
+		delta    int
+	)
+	for bit := range children {
+		split := func(items [][]byte) int {
+			return sort.Search(len(items), func(i int) bool { return childIdx(items[i], len(n.key), n.keybit) == 1 })
+		}
+		rs, as := split(remove), split(add)
+		r, a := remove[:rs], add[:as]
+		if bit == 1 {
+			r, a = remove[rs:], add[as:]
+		}
+		child, d, err := update(n.children[bit], r, a)
+		if err != nil {
+			return nil, 0, err
+		}
+		children[bit] = child
+		delta += d
+	}
+
+	result := n
+	switch {
+	case children[0] == nil:
+		result = children[1]
+	case children[1] == nil:
+		result = children[0]
+	case children != n.children:
+		result = &node{
+			key:      children[0].key[:len(n.key)], // only use slices of leaf node keys
+			keybit:   n.keybit,
+			children: children,
+		}
+	}
+
+	tmp := Tree{root: result}
+	for _, item := range outside {
+		err := tmp.Insert(item)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	return tmp.root, delta + tmp.n, nil
+}
+
+func containsSorted(sorted [][]byte, item []byte) bool {
+	i := sort.Search(len(sorted), func(i int) bool { return bytes.Compare(sorted[i], item) >= 0 })
+	return i < len(sorted) && bytes.Equal(sorted[i], item)
+}
+
+// prefixRange returns the bounds of the items of sorted that extend
+// n's prefix, and so would belong to one of its children.
+func prefixRange(sorted [][]byte, n *node) (lo, hi int) {
+	lo = sort.Search(len(sorted), func(i int) bool { return cmpPrefix(sorted[i], n) >= 0 })
+	hi = sort.Search(len(sorted), func(i int) bool { return cmpPrefix(sorted[i], n) > 0 })
+	// Items equal to a whole-byte prefix sort first.
+	for lo < hi && n.keybit == 7 && len(sorted[lo]) == len(n.key) {
+		lo++
+	}
+	return lo, hi
+}
+
+// cmpPrefix returns 0 if item has n's prefix, and otherwise -1 or +1
+// as item sorts before or after all the items that have it.
+func cmpPrefix(item []byte, n *node) int {
+	if len(n.key) == 0 {
+		return 0
+	}
+	full := len(n.key) - 1 // bytes of the prefix before its last
+	head := item
+	if len(head) > full {
+		head = head[:full]
+	}
+	if c := bytes.Compare(head, n.key[:full]); c != 0 {
+		return c
+	}
+	if len(item) == full {
+		return -1
+	}
+	a, b := mask(item[full], n.keybit), mask(n.key[full], n.keybit)
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// ErrSharedKey is returned by Merge for trees with an item in common.
+var ErrSharedKey = errors.New("trees share a key")
+
+// Merge returns a new tree holding the items of both a and b, which
+// must have none in common. It is an error, too, for an item of one
+// to be a prefix of an item of the other. Merge grafts the subtrees
+// of a and b into the result where their prefixes diverge, so
+// merging trees holding different ranges of items, such as ones
+// built in parallel for different key prefixes, takes time
+// proportional only to the depth of the trees. Like Insert, it
+// never modifies the existing nodes of a or b.
+func Merge(a, b *Tree) (*Tree, error) {
+	root, err := merge(a.root, b.root)
+	if err != nil {
+		return nil, err
+	}
+	return &Tree{root: root, n: a.n + b.n}, nil
+}
+
+// merge returns the union of the subtrees a and b, either of which
+// may be nil.
+func merge(a, b *node) (*node, error) {
+	if a == nil {
+		return b, nil
+	}
+	if b == nil {
+		return a, nil
+	}
+	pa, pb := prefixBits(a), prefixBits(b)
+	shorter := pa
+	if pb < shorter {
+		shorter = pb
+	}
+	common := commonBits(a.key, b.key, shorter)
+	switch {
+	case common < pa && common < pb:
+		// The prefixes diverge, so a and b become siblings.
+		key, keybit := bitPrefix(a.key, common)
+		n := &node{key: key, keybit: keybit}
+		bit := keyBit(a.key, common)
+		n.children[bit], n.children[1-bit] = a, b
+		return n, nil
+
+	case pa == pb:
+		if a.isLeaf && b.isLeaf {
+			return nil, errors.WithDetailf(ErrSharedKey, "key %x", a.key)
+		}
+		if a.isLeaf || b.isLeaf {
+			return nil, errors.Wrap(errors.New("key provided is a prefix to other keys"))
+		}
+		n := &node{key: a.key, keybit: a.keybit}
+		for bit := range n.children {
+			child, err := merge(a.children[bit], b.children[bit])
+			if err != nil {
+				return nil, err
+			}
+			n.children[bit] = child
+		}
+		return n, nil
+
+	case pb < pa:
+		a, b, pa = b, a, pb
+	}
+
+	// a's prefix is a proper prefix of b's, so b goes under one of
+	// a's children.
+	if a.isLeaf {
+		return nil, errors.Wrap(errors.New("key provided is a prefix to other keys"))
+	}
+	bit := keyBit(b.key, pa)
+	child, err := merge(a.children[bit], b)
+	if err != nil {
+		return nil, err
+	}
+	n := &node{key: a.key, keybit: a.keybit, children: a.children}
+	n.children[bit] = child
+	return n, nil
+}
+
+// commonBits returns the number of leading bits, up to max, that a
+// and b have in common.
+func commonBits(a, b []byte, max int) int {
+	i := 0
+	for i+8 <= max && a[i/8] == b[i/8] {
+		i += 8
+	}
+	for i < max && keyBit(a, i) == keyBit(b, i) {
+		i++
+	}
+	return i
+}
+
+// keyBit returns bit i of key, counting from the most significant
+// bit of key[0].
+func keyBit(key []byte, i int) byte {
+	return bitAt(key[i/8], byte(i%8))
+}
+
+// bitPrefix returns the node key and keybit for the first bits bits
+// of key (see prefixBits).
+func bitPrefix(key []byte, bits int) ([]byte, byte) {
+	if bits%8 == 0 {
+		return key[:bits/8], 7
+	}
+	return key[:bits/8+1], byte(bits%8 - 1)
+}
@@ -0,0 +1,407 @@
+package patricia
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"testing"
+
+	"github.com/chain/txvm/errors"
+)
+
+func TestInsertMany(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, n := range []int{0, 1, 2, 3, 10, 1000} {
+		var items [][]byte
+		want := new(Tree)
+		for i := 0; i < n; i++ {
+			item := make([]byte, 32)
+			rng.Read(item)
+			items = append(items, item)
+			want.Insert(item)
+		}
+		if n > 1 {
+			items = append(items, items[0]) // duplicates are ignored
+		}
+
+		got := new(Tree)
+		err := got.InsertMany(items)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.RootHash() != want.RootHash() {
+			t.Errorf("%d items: InsertMany root %x, Insert root %x", n, got.RootHash(), want.RootHash())
+		}
+		for _, item := range items {
+			if !got.Contains(item) {
+				t.Fatalf("%d items: tree does not contain %x", n, item)
+			}
+		}
+
+		// Subsequent updates must see a well-formed tree.
+		if n > 0 {
+			got.Delete(items[0])
+			want.Delete(items[0])
+			extra := make([]byte, 32)
+			rng.Read(extra)
+			got.Insert(extra)
+			want.Insert(extra)
+			if got.RootHash() != want.RootHash() {
+				t.Errorf("%d items: roots differ after updates", n)
+			}
+		}
+	}
+}
+
+func TestInsertManyNonEmpty(t *testing.T) {
+	got, want := new(Tree), new(Tree)
+	got.Insert([]byte{5})
+	want.Insert([]byte{5})
+	for _, item := range [][]byte{{1}, {9}, {3}} {
+		want.Insert(item)
+	}
+	err := got.InsertMany([][]byte{{1}, {9}, {3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.RootHash() != want.RootHash() {
+		t.Errorf("InsertMany root %x, Insert root %x", got.RootHash(), want.RootHash())
+	}
+
+	before := got.RootHash()
+	err = got.InsertMany([][]byte{{2}, {5, 0}})
+	if err == nil {
+		t.Error("expected prefix error")
+	}
+	if got.RootHash() != before || got.Contains([]byte{2}) {
+		t.Error("failed InsertMany modified the tree")
+	}
+}
+
+func TestInsertManyPrefix(t *testing.T) {
+	tr := new(Tree)
+	err := tr.InsertMany([][]byte{{1, 2}, {0}, {1}})
+	if err == nil {
+		t.Error("expected prefix error")
+	}
+	if tr.root != nil {
+		t.Error("failed InsertMany modified the tree")
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	randItem := func() []byte {
+		// Short items over a small alphabet, so that prefixes,
+		// duplicates, and shared partial bytes are common.
+		item := make([]byte, 1+rng.Intn(3))
+		for i := range item {
+			item[i] = byte(rng.Intn(4)) << uint(6*rng.Intn(2))
+		}
+		return item
+	}
+
+	var failed, succeeded int
+	for i := 0; i < 2000; i++ {
+		orig := new(Tree)
+		for j := rng.Intn(30); j > 0; j-- {
+			orig.Insert(randItem()) // prefix errors are ignored
+		}
+		var existing [][]byte
+		Walk(orig, func(item []byte) error {
+			existing = append(existing, item)
+			return nil
+		})
+		origRoot := orig.RootHash()
+
+		var remove, add [][]byte
+		for _, item := range existing {
+			if rng.Intn(3) == 0 {
+				remove = append(remove, item)
+			}
+		}
+		for j := rng.Intn(3); j > 0; j-- {
+			remove = append(remove, randItem())
+		}
+		for j := rng.Intn(10); j > 0; j-- {
+			add = append(add, randItem())
+		}
+
+		want := *orig
+		var wantErr error
+		for _, item := range remove {
+			want.Delete(item)
+		}
+		for _, item := range add {
+			if err := want.Insert(item); err != nil {
+				wantErr = err
+			}
+		}
+
+		got := *orig
+		err := got.Update(remove, add)
+		if (err == nil) != (wantErr == nil) {
+			t.Fatalf("case %d: removing %x and adding %x to %x: got error %v, want %v", i, remove, add, existing, err, wantErr)
+		}
+		if orig.RootHash() != origRoot {
+			t.Fatalf("case %d: Update modified the original tree", i)
+		}
+		if err != nil {
+			failed++
+			if got.RootHash() != origRoot || got.Len() != orig.Len() {
+				t.Errorf("case %d: failed Update changed the tree", i)
+			}
+			continue
+		}
+		succeeded++
+		if got.RootHash() != want.RootHash() || got.Len() != want.Len() {
+			t.Errorf("case %d: removing %x and adding %x to %x: got root %x (%d items), want %x (%d items)",
+				i, remove, add, existing, got.RootHash(), got.Len(), want.RootHash(), want.Len())
+		}
+
+		// The result must be well-formed: rebuilding it from its
+		// items gives the same tree.
+		var items [][]byte
+		Walk(&got, func(item []byte) error {
+			items = append(items, item)
+			return nil
+		})
+		rebuilt := new(Tree)
+		err = rebuilt.InsertMany(items)
+		if err != nil || rebuilt.RootHash() != got.RootHash() || len(items) != got.Len() {
+			t.Errorf("case %d: Update produced a malformed tree", i)
+		}
+	}
+	if failed == 0 || succeeded == 0 {
+		t.Errorf("%d failed and %d successful updates, want some of each", failed, succeeded)
+	}
+}
+
+func TestContainsMany(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	tr := new(Tree)
+	var items [][]byte
+	for i := 0; i < 1000; i++ {
+		item := make([]byte, 32)
+		rng.Read(item)
+		if i%2 == 0 {
+			tr.Insert(item)
+		}
+		items = append(items, item)
+	}
+	// Also look up a duplicate, prefixes of an element, and an
+	// extension of one.
+	items = append(items, items[0], items[0][:31], items[0][:0], append(items[0][:32:32], 0))
+
+	got := tr.ContainsMany(items)
+	if len(got) != len(items) {
+		t.Fatalf("got %d results for %d items", len(got), len(items))
+	}
+	for i, item := range items {
+		if want := tr.Contains(item); got[i] != want {
+			t.Errorf("item %d (%x): got %v, want %v", i, item, got[i], want)
+		}
+	}
+
+	got = new(Tree).ContainsMany(items[:3])
+	for i, ok := range got {
+		if ok {
+			t.Errorf("empty tree contains item %d", i)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, n := range []int{0, 1, 2, 10, 1000} {
+		var items [][]byte
+		for i := 0; i < n; i++ {
+			item := make([]byte, 32)
+			rng.Read(item)
+			items = append(items, item)
+		}
+		want := new(Tree)
+		for _, item := range items {
+			err := want.Insert(item)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Split both by prefix, as when sharding, and at random.
+		split := map[string]func(item []byte) bool{
+			"prefix": func(item []byte) bool { return item[0] < 0x80 },
+			"random": func([]byte) bool { return rng.Intn(2) == 0 },
+		}
+		for name, left := range split {
+			a, b := new(Tree), new(Tree)
+			for _, item := range items {
+				if left(item) {
+					a.Insert(item)
+				} else {
+					b.Insert(item)
+				}
+			}
+			aRoot, bRoot := a.RootHash(), b.RootHash()
+			got, err := Merge(a, b)
+			if err != nil {
+				t.Fatalf("%d items, %s split: %v", n, name, err)
+			}
+			if got.RootHash() != want.RootHash() || got.Len() != want.Len() {
+				t.Errorf("%d items, %s split: got root %x, %d items, want %x, %d", n, name, got.RootHash(), got.Len(), want.RootHash(), want.Len())
+			}
+			if a.RootHash() != aRoot || b.RootHash() != bRoot {
+				t.Errorf("%d items, %s split: Merge modified its arguments", n, name)
+			}
+			// The result must be well formed for further updates.
+			for _, item := range items {
+				got.Delete(item)
+			}
+			if got.RootHash() != EmptyRootHash {
+				t.Errorf("%d items, %s split: deleting every item leaves root %x", n, name, got.RootHash())
+			}
+		}
+	}
+}
+
+func TestMergeConflict(t *testing.T) {
+	tree := func(items ...[]byte) *Tree {
+		tr := new(Tree)
+		for _, item := range items {
+			tr.Insert(item)
+		}
+		return tr
+	}
+	cases := []struct {
+		name   string
+		a, b   *Tree
+		shared bool
+	}{
+		{"shared leaf", tree([]byte{1}), tree([]byte{1}), true},
+		{"shared deep", tree([]byte{1, 1}, []byte{2, 1}), tree([]byte{1, 2}, []byte{2, 1}), true},
+		{"prefix of leaf", tree([]byte{1}), tree([]byte{1, 2}), false},
+		{"prefix of subtree", tree([]byte{1, 2}, []byte{1, 3}), tree([]byte{1}), false},
+	}
+	for _, c := range cases {
+		_, err := Merge(c.a, c.b)
+		if err == nil {
+			t.Errorf("%s: expected error", c.name)
+		} else if shared := errors.Root(err) == ErrSharedKey; shared != c.shared {
+			t.Errorf("%s: got error %v", c.name, err)
+		}
+	}
+}
+
+func bulkItems(n int) [][]byte {
+	items := make([][]byte, n)
+	for i := range items {
+		items[i] = make([]byte, 32)
+		binary.LittleEndian.PutUint64(items[i], uint64(i))
+	}
+	return items
+}
+
+func BenchmarkInsertMany(b *testing.B) {
+	items := bulkItems(100000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tr := new(Tree)
+		err := tr.InsertMany(items)
+		if err != nil {
+			b.Fatal(err)
+		}
+		tr.RootHash()
+	}
+}
+
+func BenchmarkInsertLoop(b *testing.B) {
+	items := bulkItems(100000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tr := new(Tree)
+		for _, item := range items {
+			err := tr.Insert(item)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		tr.RootHash()
+	}
+}
+
+// BenchmarkUpdate compares Update with the equivalent Delete and
+// Insert calls, removing and adding 1000 items in a tree of 100000.
+func BenchmarkUpdate(b *testing.B) {
+	rng := rand.New(rand.NewSource(1))
+	random := func(n int) [][]byte {
+		items := make([][]byte, n)
+		for i := range items {
+			items[i] = make([]byte, 40)
+			rng.Read(items[i])
+		}
+		return items
+	}
+	existing := random(100000)
+	tr := new(Tree)
+	err := tr.InsertMany(existing)
+	if err != nil {
+		b.Fatal(err)
+	}
+	tr.RootHash()
+	remove, add := existing[:1000], random(1000)
+
+	b.Run("Update", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			c := *tr
+			err := c.Update(remove, add)
+			if err != nil {
+				b.Fatal(err)
+			}
+			c.RootHash()
+		}
+	})
+	b.Run("Loop", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			c := *tr
+			for _, item := range remove {
+				c.Delete(item)
+			}
+			for _, item := range add {
+				err := c.Insert(item)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			c.RootHash()
+		}
+	})
+}
+
+func BenchmarkContainsMany(b *testing.B) {
+	tr := new(Tree)
+	err := tr.InsertMany(bulkItems(100000))
+	if err != nil {
+		b.Fatal(err)
+	}
+	queries := bulkItems(10000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tr.ContainsMany(queries)
+	}
+}
+
+func BenchmarkContainsLoop(b *testing.B) {
+	tr := new(Tree)
+	err := tr.InsertMany(bulkItems(100000))
+	if err != nil {
+		b.Fatal(err)
+	}
+	queries := bulkItems(10000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, q := range queries {
+			tr.Contains(q)
+		}
+	}
+}
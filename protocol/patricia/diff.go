@@ -0,0 +1,78 @@
+package patricia
+
+// Diff reports the items in new that are not in old (added) and the
+// items in old that are not in new (removed). Each list is in the
+// sorted order of Walk.
+//
+// Subtrees with the same hash in both trees are skipped without
+// being traversed, so when old and new share most of their nodes, as
+// when one is derived from the other by a few calls to Insert and
+// Delete, Diff takes time proportional to the number of differences
+// and the depth of the trees (once their hashes have been computed,
+// e.g. with RootHash), not to their size.
+func Diff(old, new *Tree) (added, removed [][]byte) {
+	var d differ
+	switch {
+	case old.root == nil && new.root == nil:
+	case old.root == nil:
+		d.added = appendItems(d.added, new.root)
+	case new.root == nil:
+		d.removed = appendItems(d.removed, old.root)
+	default:
+		d.diff(old.root, new.root)
+	}
+	return d.added, d.removed
+}
+
+type differ struct {
+	added, removed [][]byte
+}
+
+func (d *differ) diff(a, b *node) {
+	if a == b || a.Hash() == b.Hash() {
+		return
+	}
+
+	abits, bbits := prefixBits(a), prefixBits(b)
+	switch {
+	case abits == bbits && !a.isLeaf && !b.isLeaf && hasPrefix(b.key, a.key, a.keybit):
+		// Same region of the key space, split the same way.
+		d.diff(a.children[0], b.children[0])
+		d.diff(a.children[1], b.children[1])
+
+	case abits < bbits && !a.isLeaf && hasPrefix(b.key, a.key, a.keybit):
+		// b's region lies within one of a's children.
+		bit := childIdx(b.key, len(a.key), a.keybit)
+		if bit == 1 {
+			d.removed = appendItems(d.removed, a.children[0])
+			d.diff(a.children[1], b)
+		} else {
+			d.diff(a.children[0], b)
+			d.removed = appendItems(d.removed, a.children[1])
+		}
+
+	case bbits < abits && !b.isLeaf && hasPrefix(a.key, b.key, b.keybit):
+		// a's region lies within one of b's children.
+		bit := childIdx(a.key, len(b.key), b.keybit)
+		if bit == 1 {
+			d.added = appendItems(d.added, b.children[0])
+			d.diff(a, b.children[1])
+		} else {
+			d.diff(a, b.children[0])
+			d.added = appendItems(d.added, b.children[1])
+		}
+
+	default:
+		// a and b have no items in common.
+		d.removed = appendItems(d.removed, a)
+		d.added = appendItems(d.added, b)
+	}
+}
+
+func appendItems(items [][]byte, n *node) [][]byte {
+	walk(n, func(item []byte) error {
+		items = append(items, item)
+		return nil
+	})
+	return items
+}
@@ -0,0 +1,116 @@
+package patricia
+
+import (
+	"bytes"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/chain/txvm/testutil"
+)
+
+func TestDiff(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	randItems := func(n int) [][]byte {
+		var items [][]byte
+		for i := 0; i < n; i++ {
+			item := make([]byte, 1+rng.Intn(3))
+			rng.Read(item)
+			items = append(items, item)
+		}
+		return items
+	}
+	build := func(items [][]byte) (*Tree, map[string]bool) {
+		tr := new(Tree)
+		set := make(map[string]bool)
+		for _, item := range items {
+			if tr.Insert(item) == nil {
+				set[string(item)] = true
+			}
+		}
+		return tr, set
+	}
+
+	for i := 0; i < 200; i++ {
+		var oldItems, newItems [][]byte
+		switch i % 4 {
+		case 0: // disjoint
+			oldItems, newItems = randItems(rng.Intn(50)), randItems(rng.Intn(50))
+		case 1: // overlapping
+			common := randItems(rng.Intn(50))
+			oldItems = append(randItems(rng.Intn(10)), common...)
+			newItems = append(randItems(rng.Intn(10)), common...)
+		case 2: // new derived from old
+			oldItems = randItems(rng.Intn(50))
+		case 3: // identical
+			oldItems = randItems(rng.Intn(50))
+			newItems = oldItems
+		}
+		oldTree, oldSet := build(oldItems)
+		newTree, newSet := build(newItems)
+		if i%4 == 2 {
+			*newTree = *oldTree
+			for item := range oldSet {
+				newSet[item] = true
+			}
+			for _, item := range append(randItems(rng.Intn(5)), oldItems[:len(oldItems)/4]...) {
+				if rng.Intn(2) == 0 {
+					if newTree.Insert(item) == nil {
+						newSet[string(item)] = true
+					}
+				} else {
+					newTree.Delete(item)
+					newSet[string(item)] = false
+				}
+			}
+		}
+
+		var wantAdded, wantRemoved [][]byte
+		for item, ok := range newSet {
+			if ok && !oldSet[item] {
+				wantAdded = append(wantAdded, []byte(item))
+			}
+		}
+		for item, ok := range oldSet {
+			if ok && !newSet[item] {
+				wantRemoved = append(wantRemoved, []byte(item))
+			}
+		}
+		sortItems(wantAdded)
+		sortItems(wantRemoved)
+
+		added, removed := Diff(oldTree, newTree)
+		if !testutil.DeepEqual(added, wantAdded) {
+			t.Errorf("case %d: added = %x, want %x", i, added, wantAdded)
+		}
+		if !testutil.DeepEqual(removed, wantRemoved) {
+			t.Errorf("case %d: removed = %x, want %x", i, removed, wantRemoved)
+		}
+	}
+}
+
+func sortItems(items [][]byte) {
+	sort.Slice(items, func(i, j int) bool { return bytes.Compare(items[i], items[j]) < 0 })
+}
+
+func BenchmarkDiff(b *testing.B) {
+	old := new(Tree)
+	err := old.InsertMany(bulkItems(1000000))
+	if err != nil {
+		b.Fatal(err)
+	}
+	changed := *old
+	extra := make([]byte, 32)
+	extra[31] = 1
+	changed.Insert(extra)
+	old.RootHash()
+	changed.RootHash()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		added, removed := Diff(old, &changed)
+		if len(added) != 1 || len(removed) != 0 {
+			b.Fatalf("got %d added, %d removed, want 1, 0", len(added), len(removed))
+		}
+	}
+}
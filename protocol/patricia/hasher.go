@@ -0,0 +1,65 @@
+package patricia
+
+import (
+	"io"
+
+	"github.com/chain/txvm/crypto/sha3pool"
+)
+
+// Hasher computes the hashes of the nodes of a tree: a leaf's from
+// its item, and an interior node's from those of its children.
+// Implementations should not allocate, since they are called for
+// every node hashed.
+type Hasher interface {
+	HashLeaf(item []byte) [32]byte
+	HashInterior(left, right [32]byte) [32]byte
+}
+
+// DefaultHasher is the Hasher of the Chain Protocol spec, using
+// SHA3-256 with a one-byte prefix distinguishing leaves (0x00) from
+// interior nodes (0x01).
+var DefaultHasher Hasher = sha3Hasher{}
+
+var hasher = DefaultHasher
+
+// SetHasher sets the Hasher used by all trees, including for proofs
+// and StoredTrees. A nil h restores DefaultHasher.
+//
+// Node hashes are cached, so SetHasher must be called before any
+// tree is built, such as from an init function, and not
+// concurrently with any other use of the package.
+func SetHasher(h Hasher) {
+	if h == nil {
+		h = DefaultHasher
+	}
+	hasher = h
+}
+
+func leafHash(item []byte) [32]byte {
+	return hasher.HashLeaf(item)
+}
+
+func interiorHash(left, right [32]byte) [32]byte {
+	return hasher.HashInterior(left, right)
+}
+
+type sha3Hasher struct{}
+
+func (sha3Hasher) HashLeaf(item []byte) (hash [32]byte) {
+	h := sha3pool.Get256()
+	h.Write(leafPrefix)
+	h.Write(item)
+	io.ReadFull(h, hash[:])
+	sha3pool.Put256(h)
+	return hash
+}
+
+func (sha3Hasher) HashInterior(left, right [32]byte) (hash [32]byte) {
+	h := sha3pool.Get256()
+	h.Write(interiorPrefix)
+	h.Write(left[:])
+	h.Write(right[:])
+	io.ReadFull(h, hash[:])
+	sha3pool.Put256(h)
+	return hash
+}
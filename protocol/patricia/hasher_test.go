@@ -0,0 +1,68 @@
+package patricia
+
+import (
+	"crypto/sha256"
+	"testing"
+)
+
+type sha256Hasher struct{}
+
+func (sha256Hasher) HashLeaf(item []byte) [32]byte {
+	return sha256.Sum256(append([]byte{0}, item...))
+}
+
+func (sha256Hasher) HashInterior(left, right [32]byte) [32]byte {
+	var b [65]byte
+	b[0] = 1
+	copy(b[1:], left[:])
+	copy(b[33:], right[:])
+	return sha256.Sum256(b[:])
+}
+
+func TestSetHasher(t *testing.T) {
+	items := bulkItems(1000)
+	build := func() (*Tree, *Tree) {
+		t1, t2 := new(Tree), new(Tree)
+		for _, item := range items {
+			t1.Insert(item)
+		}
+		t2.InsertMany(items)
+		return t1, t2
+	}
+
+	def1, def2 := build()
+	defRoot := def1.RootHash()
+	if def2.RootHash() != defRoot {
+		t.Error("trees built with the default hasher disagree")
+	}
+
+	SetHasher(sha256Hasher{})
+	defer SetHasher(nil)
+	custom1, custom2 := build()
+
+	if custom1.RootHash() != custom2.RootHash() {
+		t.Error("trees built with the same custom hasher disagree")
+	}
+	if custom1.RootHash() == defRoot {
+		t.Error("custom hasher gives the same root as the default")
+	}
+	p, ok := custom1.Proof(items[17])
+	if !ok || !VerifyProof(custom1.RootHash(), items[17], p) {
+		t.Error("proof fails with custom hasher")
+	}
+
+	SetHasher(nil)
+	tr := new(Tree)
+	tr.Insert([]byte{1})
+	if got, want := tr.RootHash(), (sha3Hasher{}).HashLeaf([]byte{1}); got != want {
+		t.Errorf("after SetHasher(nil), root %x, want %x", got, want)
+	}
+}
+
+func BenchmarkLeafHash(b *testing.B) {
+	item := make([]byte, 32)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		leafHash(item)
+	}
+}
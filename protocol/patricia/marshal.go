@@ -0,0 +1,147 @@
+package patricia
+
+import (
+	"encoding/binary"
+
+	"github.com/chain/txvm/errors"
+)
+
+// ErrBadEncoding is returned by UnmarshalBinary for data that is not
+// a valid tree encoding.
+var ErrBadEncoding = errors.New("malformed tree encoding")
+
+// MarshalBinary encodes t, including its structure, so that
+// UnmarshalBinary can reconstruct it without inserting each item.
+//
+// The encoding begins with the tree's 32-byte root hash, so a
+// recipient can check it against the root it expects before
+// decoding the rest. Next is the number of items, as a uvarint.
+// Then the nodes follow in preorder: a leaf is 0x00, the length of
+// its item as a uvarint, and the item; an interior node is 0x01,
+// followed by its children. Interior nodes' prefixes are implied by
+// their leaves and are not encoded. The empty tree has a zero root
+// hash and no nodes.
+//
+// A tree's shape depends only on its items, not on the order in
+// which they were inserted or deleted, so equal trees have equal
+// encodings.
+func (t *Tree) MarshalBinary() ([]byte, error) {
+	root := t.RootHash()
+	b := append([]byte(nil), root[:]...)
+	b = appendUvarint(b, uint64(t.n))
+	if t.root != nil {
+		b = appendNode(b, t.root)
+	}
+	return b, nil
+}
+
+func appendNode(b []byte, n *node) []byte {
+	if n.isLeaf {
+		b = append(b, 0x00)
+		b = appendUvarint(b, uint64(len(n.key)))
+		return append(b, n.key...)
+	}
+	b = append(b, 0x01)
+	b = appendNode(b, n.children[0])
+	return appendNode(b, n.children[1])
+}
+
+func appendUvarint(b []byte, x uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], x)]...)
+}
+
+// UnmarshalBinary decodes data produced by MarshalBinary into t,
+// replacing its contents. It checks that the encoded nodes form a
+// valid tree whose root hash and size match those recorded in data.
+// On error, t is unchanged.
+func (t *Tree) UnmarshalBinary(data []byte) error {
+	if len(data) < 32 {
+		return errors.WithDetail(ErrBadEncoding, "missing root hash")
+	}
+	var want [32]byte
+	copy(want[:], data)
+	count, n := binary.Uvarint(data[32:])
+	if n <= 0 {
+		return errors.WithDetail(ErrBadEncoding, "bad item count")
+	}
+	d := &decoder{data: data[32+n:]}
+
+	var root *node
+	if len(d.data) > 0 {
+		var err error
+		root, _, err = d.node()
+		if err != nil {
+			return err
+		}
+	}
+	if len(d.data) > 0 {
+		return errors.WithDetailf(ErrBadEncoding, "%d bytes of trailing data", len(d.data))
+	}
+	if uint64(d.leaves) != count {
+		return errors.WithDetailf(ErrBadEncoding, "%d items, want %d", d.leaves, count)
+	}
+	result := Tree{root: root, n: d.leaves}
+	if got := result.RootHash(); got != want {
+		return errors.WithDetailf(ErrBadEncoding, "root hash %x, want %x", got[:], want[:])
+	}
+	*t = result
+	return nil
+}
+
+type decoder struct {
+	data   []byte
+	leaves int
+}
+
+// node decodes the subtree at the start of d.data, returning it and
+// the item of its leftmost leaf.
+func (d *decoder) node() (*node, []byte, error) {
+	if len(d.data) == 0 {
+		return nil, nil, errors.WithDetail(ErrBadEncoding, "unexpected end of data")
+	}
+	typ := d.data[0]
+	d.data = d.data[1:]
+
+	switch typ {
+	case 0x00:
+		size, n := binary.Uvarint(d.data)
+		if n <= 0 || size > uint64(len(d.data)-n) {
+			return nil, nil, errors.WithDetail(ErrBadEncoding, "bad leaf length")
+		}
+		key := append([]byte(nil), d.data[n:n+int(size)]...)
+		d.data = d.data[n+int(size):]
+		d.leaves++
+		hash := leafHash(key)
+		return &node{key: key, keybit: 7, hash: &hash, isLeaf: true}, key, nil
+
+	case 0x01:
+		left, first, err := d.node()
+		if err != nil {
+			return nil, nil, err
+		}
+		right, rightFirst, err := d.node()
+		if err != nil {
+			return nil, nil, err
+		}
+		common, bit := commonPrefix(first, rightFirst)
+		n := &node{
+			key:      first[:common],
+			keybit:   bit,
+			children: [2]*node{left, right},
+		}
+		// Each child's items must all extend n's prefix, on the
+		// correct side. Since each child's items share its own
+		// (longer) prefix, it is enough to check one item of each.
+		for _, c := range n.children {
+			if prefixBits(c) <= prefixBits(n) {
+				return nil, nil, errors.WithDetail(ErrBadEncoding, "items are not prefix-free")
+			}
+		}
+		if childIdx(first, common, bit) != 0 || childIdx(rightFirst, common, bit) != 1 {
+			return nil, nil, errors.WithDetail(ErrBadEncoding, "items out of order")
+		}
+		return n, first, nil
+	}
+	return nil, nil, errors.WithDetailf(ErrBadEncoding, "bad node type %d", typ)
+}
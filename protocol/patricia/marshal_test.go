@@ -0,0 +1,152 @@
+package patricia
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/chain/txvm/errors"
+)
+
+func TestMarshalBinary(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	random := func(n, size int) [][]byte {
+		var items [][]byte
+		for i := 0; i < n; i++ {
+			item := make([]byte, size)
+			rng.Read(item)
+			items = append(items, item)
+		}
+		return items
+	}
+
+	cases := []struct {
+		name  string
+		items [][]byte
+	}{
+		{"empty", nil},
+		{"single leaf", [][]byte{{1, 2, 3}}},
+		{"empty leaf", [][]byte{{}}},
+		{"two leaves", [][]byte{{0x00}, {0xff}}},
+		{"sharing a partial byte", [][]byte{{0x10, 1}, {0x11, 2}, {0x18}}},
+		{"unbalanced", [][]byte{{0}, {1}, {0x80, 0}, {0x80, 1, 1}, {0x80, 1, 2}, {0xff}}},
+		{"varying lengths", [][]byte{{1}, {2, 0}, {2, 1, 5}, {3, 0, 0, 0}}},
+		{"random", random(1000, 32)},
+	}
+	for _, c := range cases {
+		tree := new(Tree)
+		for _, item := range c.items {
+			err := tree.Insert(item)
+			if err != nil {
+				t.Fatalf("%s: %s", c.name, err)
+			}
+		}
+		b, err := tree.MarshalBinary()
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		root := tree.RootHash()
+		if !bytes.Equal(b[:32], root[:]) {
+			t.Errorf("%s: encoding begins with %x, want root %x", c.name, b[:32], root[:])
+		}
+
+		got := new(Tree)
+		err = got.UnmarshalBinary(b)
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		if got.RootHash() != root {
+			t.Errorf("%s: got root %x, want %x", c.name, got.RootHash(), root)
+		}
+		if got.Len() != tree.Len() {
+			t.Errorf("%s: got %d items, want %d", c.name, got.Len(), tree.Len())
+		}
+		for _, item := range c.items {
+			if !got.Contains(item) {
+				t.Errorf("%s: decoded tree lacks %x", c.name, item)
+			}
+		}
+
+		// The decoded tree must work like any other.
+		err = got.Insert([]byte{0x55, 0x55, 0x55, 0x55, 0x55})
+		if c.name != "empty leaf" && err != nil {
+			t.Errorf("%s: inserting into decoded tree: %s", c.name, err)
+		}
+	}
+}
+
+func TestMarshalBinaryDeterministic(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	var items [][]byte
+	for i := 0; i < 500; i++ {
+		item := make([]byte, 32)
+		rng.Read(item)
+		items = append(items, item)
+	}
+
+	var want []byte
+	for i := 0; i < 5; i++ {
+		rng.Shuffle(len(items), func(i, j int) { items[i], items[j] = items[j], items[i] })
+		tree := new(Tree)
+		for _, item := range items {
+			extra := make([]byte, 32)
+			rng.Read(extra)
+			err := tree.Insert(extra)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = tree.Insert(item)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tree.Delete(extra)
+		}
+		b, err := tree.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			want = b
+		} else if !bytes.Equal(b, want) {
+			t.Errorf("insertion order %d: encoding differs", i)
+		}
+	}
+}
+
+func TestUnmarshalBinaryErrors(t *testing.T) {
+	tree := new(Tree)
+	for _, item := range [][]byte{{1}, {2}, {3}} {
+		tree.Insert(item)
+	}
+	good, _ := tree.MarshalBinary()
+	root := tree.RootHash()
+
+	encode := func(count byte, nodes ...byte) []byte {
+		return append(append(root[:], count), nodes...)
+	}
+	cases := []struct {
+		name string
+		data []byte
+	}{
+		{"short", good[:20]},
+		{"truncated", good[:len(good)-1]},
+		{"trailing data", append(good, 0)},
+		{"wrong count", encode(2, good[33:]...)},
+		{"wrong root", append([]byte{1}, good[1:]...)},
+		{"bad node type", encode(1, 0x02)},
+		{"bad leaf length", encode(1, 0x00, 5, 1)},
+		{"out of order", encode(2, 0x01, 0x00, 1, 2, 0x00, 1, 1)},
+		{"duplicate", encode(2, 0x01, 0x00, 1, 1, 0x00, 1, 1)},
+		{"prefix", encode(2, 0x01, 0x00, 1, 1, 0x00, 2, 1, 1)},
+	}
+	for _, c := range cases {
+		got := new(Tree)
+		err := got.UnmarshalBinary(c.data)
+		if errors.Root(err) != ErrBadEncoding {
+			t.Errorf("%s: got error %v, want %v", c.name, err, ErrBadEncoding)
+		}
+		if got.root != nil {
+			t.Errorf("%s: tree modified on error", c.name)
+		}
+	}
+}
@@ -17,13 +17,20 @@
 // which contains the root of the tree, to obtain a new tree
 // with the same contents. The time to make such a copy is
 // independent of the size of the tree.
+//
+// Read-only methods (Contains, Walk, RootHash, Proof, Len) may be
+// called concurrently on the same tree and on copies sharing its
+// nodes, including while a copy is being modified. Insert and Delete
+// modify the Tree struct itself, so they require external
+// synchronization with any other use of that same Tree.
 package patricia
 
 import (
 	"bytes"
-	"io"
+	"context"
+	"sync/atomic"
+	"unsafe"
 
-	"github.com/chain/txvm/crypto/sha3pool"
 	"github.com/chain/txvm/errors"
 )
 
@@ -32,9 +39,124 @@ var (
 	interiorPrefix = []byte{0x01}
 )
 
+// EmptyRootHash is the root hash of an empty tree, which is all
+// zeros. It is a variable only because Go has no array constants;
+// it must not be modified.
+var EmptyRootHash [32]byte
+
 // Tree implements a patricia tree.
 type Tree struct {
 	root *node
+	n    int // number of items
+}
+
+// IsEmpty reports whether t has no items, in which case its root
+// hash is EmptyRootHash.
+func (t *Tree) IsEmpty() bool {
+	return t.root == nil
+}
+
+// Len returns the number of items in t.
+func (t *Tree) Len() int {
+	return t.n
+}
+
+// TreeStats describes the shape of a tree. See Tree.Stats.
+type TreeStats struct {
+	Nodes        int     // leaves and interior nodes
+	MaxDepth     int     // of any leaf
+	AvgLeafDepth float64 // zero for an empty tree
+}
+
+// Stats returns statistics on the shape of t, for monitoring how
+// balanced it is. A leaf's depth is the number of interior nodes
+// above it, so a tree of one item has depth 0. A tree of n items
+// has 2n-1 nodes; with random items its depth grows as log2(n).
+// Stats visits every node of t once.
+func (t *Tree) Stats() TreeStats {
+	var (
+		stats TreeStats
+		sum   int
+	)
+	var visit func(n *node, depth int)
+	visit = func(n *node, depth int) {
+		stats.Nodes++
+		if n.isLeaf {
+			sum += depth
+			if depth > stats.MaxDepth {
+				stats.MaxDepth = depth
+			}
+			return
+		}
+		visit(n.children[0], depth+1)
+		visit(n.children[1], depth+1)
+	}
+	if t.root != nil {
+		visit(t.root, 0)
+		stats.AvgLeafDepth = float64(sum) / float64(t.n)
+	}
+	return stats
+}
+
+// Clone returns a tree with the same contents as t that shares no
+// nodes with it. Copying the Tree struct is enough to obtain an
+// independent tree; Clone is for callers that also need independent
+// node memory. Its cost is proportional to the size of t.
+func (t *Tree) Clone() *Tree {
+	return &Tree{root: cloneNode(t.root), n: t.n}
+}
+
+func cloneNode(n *node) *node {
+	if n == nil {
+		return nil
+	}
+	c := &node{
+		key:    append([]byte(nil), n.key...),
+		keybit: n.keybit,
+		isLeaf: n.isLeaf,
+		stub:   n.stub,
+	}
+	if hash := n.cachedHash(); hash != nil {
+		h := *hash
+		c.hash = &h
+	}
+	c.children[0] = cloneNode(n.children[0])
+	c.children[1] = cloneNode(n.children[1])
+	return c
+}
+
+// Compact rebuilds t from its items with newly allocated nodes,
+// copying each item once and keeping the cached hashes, so the root
+// hash is unchanged. Afterward t shares no memory with other copies
+// of it, such as older snapshots, or with the buffers its items were
+// taken from. Either can keep alive memory holding items that t no
+// longer contains.
+//
+// The shape of a tree depends only on its items, and deleting an
+// item removes its leaf and parent, so a tree never holds more than
+// its 2n-1 nodes; Compact does not reduce the number of nodes. Unlike
+// Clone, it does not copy interior nodes' keys, which are slices of
+// their leaves' items.
+func (t *Tree) Compact() {
+	if t.root != nil {
+		t.root = compactNode(t.root)
+	}
+}
+
+func compactNode(n *node) *node {
+	c := &node{keybit: n.keybit, isLeaf: n.isLeaf}
+	if hash := n.cachedHash(); hash != nil {
+		h := *hash
+		c.hash = &h
+	}
+	if n.isLeaf {
+		c.key = append([]byte(nil), n.key...)
+		return c
+	}
+	c.children[0] = compactNode(n.children[0])
+	c.children[1] = compactNode(n.children[1])
+	c.key = c.children[0].key[:len(n.key)] // only use slices of leaf node keys
+	return c
 }
 
 // WalkFunc is the type of the function called for each item
@@ -42,6 +164,8 @@ type Tree struct {
 type WalkFunc func(item []byte) error
 
 // Walk walks t calling walkFn for each item.
+// Items are visited in ascending order, as
+// given by bytes.Compare.
 // If an error is returned by walkFn at any point,
 // processing is stopped and the error is returned.
 func Walk(t *Tree, walkFn WalkFunc) error {
@@ -51,6 +175,47 @@ func Walk(t *Tree, walkFn WalkFunc) error {
 	return walk(t.root, walkFn)
 }
 
+// ctxCheckInterval is the number of items WalkContext visits
+// between checks of its context.
+const ctxCheckInterval = 1000
+
+// WalkContext is like Walk, but stops early if ctx is canceled,
+// returning ctx.Err() (wrapped). It checks ctx before the first item
+// and then every ctxCheckInterval items, so a few more items may be
+// visited after cancellation.
+func WalkContext(ctx context.Context, t *Tree, walkFn WalkFunc) error {
+	var visited int
+	return Walk(t, func(item []byte) error {
+		if visited%ctxCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return errors.Wrap(err, "walking tree")
+			}
+		}
+		visited++
+		return walkFn(item)
+	})
+}
+
+// WalkPrefix is like Walk, but visits only the items of t that begin
+// with prefix. It descends directly to the subtree holding those
+// items. An empty prefix visits every item.
+func (t *Tree) WalkPrefix(prefix []byte, walkFn WalkFunc) error {
+	n := t.root
+	for n != nil {
+		if prefixBits(n) >= 8*len(prefix) {
+			if !hasPrefix(n.key, prefix, 7) {
+				return nil
+			}
+			return walk(n, walkFn)
+		}
+		if n.isLeaf || !hasPrefix(prefix, n.key, n.keybit) {
+			return nil
+		}
+		n = n.children[childIdx(prefix, len(n.key), n.keybit)]
+	}
+	return nil
+}
+
 func walk(n *node, walkFn WalkFunc) error {
 	if n.isLeaf {
 		return walkFn(n.key)
@@ -65,6 +230,63 @@ func walk(n *node, walkFn WalkFunc) error {
 	return err
 }
 
+// Find returns the first item of t, in ascending order, for which
+// match returns true, calling match for no items after it. It
+// reports false if there is no such item.
+func (t *Tree) Find(match func(key []byte) bool) ([]byte, bool) {
+	if t.root == nil {
+		return nil, false
+	}
+	return find(t.root, match)
+}
+
+func find(n *node, match func(key []byte) bool) ([]byte, bool) {
+	if n.isLeaf {
+		if match(n.key) {
+			return n.key, true
+		}
+		return nil, false
+	}
+	if key, ok := find(n.children[0], match); ok {
+		return key, true
+	}
+	return find(n.children[1], match)
+}
+
+// WalkFunc is like Walk, but also calls f at each interior node
+// before descending into it, so f can skip whole subtrees. At an
+// interior node, key is the longest whole-byte prefix shared by all
+// the items beneath it (possibly empty); if f returns skipSubtree,
+// none of those items is visited. At a leaf, key is the item itself
+// and skipSubtree is ignored. Nodes are visited in preorder, with
+// items in ascending order. If f returns an error, processing stops
+// and the error is returned.
+func (t *Tree) WalkFunc(f func(key []byte) (skipSubtree bool, err error)) error {
+	if t.root == nil {
+		return nil
+	}
+	return walkNodes(t.root, f)
+}
+
+func walkNodes(n *node, f func(key []byte) (bool, error)) error {
+	if n.isLeaf {
+		_, err := f(n.key)
+		return err
+	}
+
+	whole := prefixBits(n) / 8
+	skip, err := f(n.key[:whole:whole])
+	if err != nil || skip {
+		return err
+	}
+
+	err = walkNodes(n.children[0], f)
+	if err != nil {
+		return err
+	}
+	return walkNodes(n.children[1], f)
+}
+
 // Contains returns whether t contains item.
 func (t *Tree) Contains(item []byte) bool {
 	if t.root == nil {
@@ -83,7 +305,7 @@ func lookup(n *node, key []byte) *node {
 		}
 		return n
 	}
-	if !hasPrefix(key, n.key, n.keybit) {
+	if n.isLeaf || !hasPrefix(key, n.key, n.keybit) {
 		return nil
 	}
 
@@ -92,27 +314,31 @@ func lookup(n *node, key []byte) *node {
 }
 
 // Insert inserts item into t.
+// It never modifies the existing nodes of t, so other copies of t are
+// unaffected.
 //
 // It is an error for item to be a prefix of an element
 // in t or to contain an element in t as a prefix.
 // If item itself is already in t, Insert does nothing
 // (and this is not an error).
 func (t *Tree) Insert(item []byte) error {
-	var hash [32]byte
-	h := sha3pool.Get256()
-	h.Write(leafPrefix)
-	h.Write(item)
-	io.ReadFull(h, hash[:])
-	sha3pool.Put256(h)
+	hash := leafHash(item)
 
 	if t.root == nil {
 		t.root = &node{key: item, keybit: 7, hash: &hash, isLeaf: true}
+		t.n = 1
 		return nil
 	}
 
-	var err error
-	t.root, err = insert(t.root, item, &hash)
-	return err
+	root, err := insert(t.root, item, &hash)
+	if err != nil {
+		return err
+	}
+	if root != t.root {
+		t.root = root
+		t.n++
+	}
+	return nil
 }
 
 func insert(n *node, key []byte, hash *[32]byte) (*node, error) {
@@ -132,14 +358,17 @@ func insert(n *node, key []byte, hash *[32]byte) (*node, error) {
 		bit := childIdx(key, len(n.key), n.keybit)
 
 		child := n.children[bit]
-		child, err := insert(child, key, hash)
+		newChild, err := insert(child, key, hash)
 		if err != nil {
 			return n, err
 		}
-		newNode := new(node)
-		*newNode = *n
-		newNode.children[bit] = child // mutation is ok because newNode hasn't escaped yet
-		newNode.hash = nil
+		if newChild == child {
+			return n, nil // key was already present
+		}
+		// Copy n field by field, leaving out its hash, which
+		// may be concurrently cached by a reader of another tree.
+		newNode := &node{key: n.key, keybit: n.keybit, children: n.children}
+		newNode.children[bit] = newChild // mutation is ok because newNode hasn't escaped yet
 		return newNode, nil
 	}
 
@@ -163,11 +392,21 @@ func insert(n *node, key []byte, hash *[32]byte) (*node, error) {
 	return newNode, nil
 }
 
-// Delete removes item from t, if present.
-func (t *Tree) Delete(item []byte) {
-	if t.root != nil {
-		t.root = delete(t.root, item)
+// Delete removes item from t, if present,
+// and reports whether it was present.
+// It never modifies the existing nodes of t, so other copies of t are
+// unaffected.
+func (t *Tree) Delete(item []byte) bool {
+	if t.root == nil {
+		return false
+	}
+	root := delete(t.root, item)
+	if root == t.root {
+		return false
 	}
+	t.root = root
+	t.n--
+	return true
 }
 
 func delete(n *node, key []byte) *node {
@@ -178,7 +417,7 @@ func delete(n *node, key []byte) *node {
 		return nil
 	}
 
-	if !hasPrefix(key, n.key, n.keybit) {
+	if n.isLeaf || !hasPrefix(key, n.key, n.keybit) {
 		return n
 	}
 
@@ -193,20 +432,81 @@ func delete(n *node, key []byte) *node {
 		return n
 	}
 
-	newNode := new(node)
-	*newNode = *n
-	newNode.key = newChild.key[:len(n.key)] // only use slices of leaf node keys
+	newNode := &node{
+		key:      newChild.key[:len(n.key)], // only use slices of leaf node keys
+		keybit:   n.keybit,
+		children: n.children,
+	}
 	newNode.children[bit] = newChild
-	newNode.hash = nil
 
 	return newNode
 }
 
+// DeletePrefix removes every item of t that begins with prefix and
+// returns the number removed. An empty prefix removes every item.
+// The matching items form a single subtree, which is removed
+// whole, so only the path to it is rebuilt (though counting its
+// items visits each of them). The result is the same as deleting
+// the items one at a time.
+// Like Delete, it never modifies the existing nodes of t.
+func (t *Tree) DeletePrefix(prefix []byte) int {
+	if t.root == nil {
+		return 0
+	}
+	root, removed := deletePrefix(t.root, prefix)
+	t.root = root
+	t.n -= removed
+	return removed
+}
+
+func deletePrefix(n *node, prefix []byte) (*node, int) {
+	if prefixBits(n) >= 8*len(prefix) {
+		if !hasPrefix(n.key, prefix, 7) {
+			return n, 0
+		}
+		return nil, countItems(n)
+	}
+	if n.isLeaf || !hasPrefix(prefix, n.key, n.keybit) {
+		return n, 0
+	}
+
+	bit := childIdx(prefix, len(n.key), n.keybit)
+	newChild, removed := deletePrefix(n.children[bit], prefix)
+	if removed == 0 {
+		return n, 0
+	}
+	if newChild == nil {
+		return n.children[1-bit], removed
+	}
+
+	newNode := &node{
+		key:      newChild.key[:len(n.key)],
+		keybit:   n.keybit,
+		children: n.children,
+	}
+	newNode.children[bit] = newChild
+	return newNode, removed
+}
+
+// countItems returns the number of leaves under n.
+func countItems(n *node) int {
+	if n.isLeaf {
+		return 1
+	}
+	return countItems(n.children[0]) + countItems(n.children[1])
+}
+
 // RootHash returns the Merkle root of the tree.
+//
+// Node hashes are computed lazily and cached in the nodes, so calling
+// RootHash again on an unchanged tree takes constant time, and after
+// Insert or Delete only the nodes along the changed path are rehashed.
+// Because Insert and Delete replace those nodes rather than modifying
+// them, the cache can never be stale, including in copies of t.
 func (t *Tree) RootHash() [32]byte {
 	root := t.root
 	if root == nil {
-		return [32]byte{}
+		return EmptyRootHash
 	}
 	return root.Hash()
 }
@@ -252,6 +552,15 @@ func hasPrefix(s, prefix []byte, bit byte) bool {
 	return mask(s[len(prefix)-1], bit) == mask(prefix[len(prefix)-1], bit)
 }
 
+// prefixBits returns the length in bits of the prefix shared by all
+// items under n.
+func prefixBits(n *node) int {
+	if len(n.key) == 0 {
+		return 0
+	}
+	return (len(n.key)-1)*8 + int(n.keybit) + 1
+}
+
 func mask(b, bits byte) byte {
 	return b >> (7 - bits) << (7 - bits)
 }
@@ -277,28 +586,32 @@ type node struct {
 	hash     *[32]byte
 	isLeaf   bool
 	children [2]*node
+
+	// stub is true for a node of a StoredTree that has not yet
+	// been loaded from its store. Only its hash is set.
+	stub bool
 }
 
 // Hash will return the hash for this node.
+// The hash is computed on first use and cached in n.
+// Concurrent calls are safe: the cache is accessed atomically,
+// and racing callers compute and store the same value.
 func (n *node) Hash() [32]byte {
-	n.calcHash()
-	return *n.hash
-}
-
-func (n *node) calcHash() {
-	if n.hash != nil {
-		return
+	if hash := n.cachedHash(); hash != nil {
+		return *hash
 	}
 
-	h := sha3pool.Get256()
-	h.Write(interiorPrefix)
-	for _, c := range n.children {
-		c.calcHash()
-		h.Write(c.hash[:])
-	}
+	hash := hashInterior(n.children[0].Hash(), n.children[1].Hash())
+	atomic.StorePointer((*unsafe.Pointer)(unsafe.Pointer(&n.hash)), unsafe.Pointer(&hash))
+	return hash
+}
+
+// hashInterior computes the hash of an interior node from its
+// children's hashes. It is a variable so that tests can count
+// the hashes computed.
+var hashInterior = interiorHash
 
-	var hash [32]byte
-	io.ReadFull(h, hash[:])
-	n.hash = &hash
-	sha3pool.Put256(h)
+// cachedHash returns n.hash, which may be concurrently set by Hash.
+func (n *node) cachedHash() *[32]byte {
+	return (*[32]byte)(atomic.LoadPointer((*unsafe.Pointer)(unsafe.Pointer(&n.hash))))
 }
@@ -1,13 +1,21 @@
 package patricia
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"log"
+	"math"
+	"math/rand"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"testing/quick"
 
@@ -228,6 +236,9 @@ func TestContains(t *testing.T) {
 	if v := []byte{1}; tr.Contains(v) {
 		t.Errorf("expected tree to not contain %x, but did", v)
 	}
+	if v := []byte{1, 0, 0}; tr.Contains(v) {
+		t.Errorf("expected tree to not contain %x, but did", v)
+	}
 }
 
 func TestInsert(t *testing.T) {
@@ -464,7 +475,9 @@ func TestDelete(t *testing.T) {
 		},
 	}
 
-	tr.Delete(bits("11111110"))
+	if !tr.Delete(bits("11111110")) {
+		t.Errorf("Delete(%x) = false, want true", bits("11111110"))
+	}
 	tr.RootHash()
 	want := &Tree{
 		root: &node{
@@ -492,7 +505,9 @@ func TestDelete(t *testing.T) {
 		t.Fatalf("got:\n%swant:\n%s", pretty(tr), pretty(want))
 	}
 
-	tr.Delete(bits("11111100"))
+	if !tr.Delete(bits("11111100")) {
+		t.Errorf("Delete(%x) = false, want true", bits("11111100"))
+	}
 	tr.RootHash()
 	want = &Tree{
 		root: &node{
@@ -509,13 +524,17 @@ func TestDelete(t *testing.T) {
 		t.Fatalf("got:\n%swant:\n%s", pretty(tr), pretty(want))
 	}
 
-	tr.Delete(bits("11110011")) // nonexistent value
+	if tr.Delete(bits("11110011")) { // nonexistent value
+		t.Errorf("Delete(%x) = true, want false", bits("11110011"))
+	}
 	tr.RootHash()
 	if !testutil.DeepEqual(tr.root, want.root) {
 		t.Fatalf("got:\n%swant:\n%s", pretty(tr), pretty(want))
 	}
 
-	tr.Delete(bits("11110000"))
+	if !tr.Delete(bits("11110000")) {
+		t.Errorf("Delete(%x) = false, want true", bits("11110000"))
+	}
 	tr.RootHash()
 	want = &Tree{
 		root: &node{key: bits("11111111"), hash: hashPtr(hashForLeaf(bits("11111111"))), isLeaf: true, keybit: 7},
@@ -524,7 +543,9 @@ func TestDelete(t *testing.T) {
 		t.Fatalf("got:\n%swant:\n%s", pretty(tr), pretty(want))
 	}
 
-	tr.Delete(bits("11111111"))
+	if !tr.Delete(bits("11111111")) {
+		t.Errorf("Delete(%x) = false, want true", bits("11111111"))
+	}
 	tr.RootHash()
 	want = &Tree{}
 	if !testutil.DeepEqual(tr.root, want.root) {
@@ -544,19 +565,273 @@ func TestDeletePrefix(t *testing.T) {
 	}
 
 	got := delete(root, []byte{1})
-	got.calcHash()
+	got.Hash()
 	if !testutil.DeepEqual(got, root) {
 		t.Fatalf("got:\n%swant:\n%s", prettyNode(got, 0), prettyNode(root, 0))
 	}
 
 	got = delete(root, []byte{1, 1})
-	got.calcHash()
+	got.Hash()
 	if !testutil.DeepEqual(got, root) {
 		t.Fatalf("got:\n%swant:\n%s", prettyNode(got, 0), prettyNode(root, 0))
 	}
 
 }
 
+func TestTreeDeletePrefix(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	fixed := [][]byte{
+		{0x00, 0x01},
+		{0x01, 0x00, 0x00},
+		{0x01, 0x00, 0x01},
+		{0x01, 0x01},
+		{0x01, 0xff, 0x00},
+		{0x02},
+		{0xf0, 0x00},
+	}
+	prefixes := [][]byte{
+		{}, {0x00}, {0x01}, {0x01, 0x00}, {0x01, 0x00, 0x01}, {0x01, 0xff},
+		{0x02}, {0x02, 0x00}, {0x03}, {0xf0}, {0xf0, 0x00, 0x00},
+	}
+	for i := 0; i < 100; i++ {
+		items := fixed
+		if i > 0 {
+			items = nil
+			for j := rng.Intn(200); j > 0; j-- {
+				item := make([]byte, 3)
+				rng.Read(item)
+				item[0] &= 0x03 // share prefixes
+				items = append(items, item)
+			}
+			prefix := make([]byte, rng.Intn(3))
+			rng.Read(prefix)
+			if len(prefix) > 0 {
+				prefix[0] &= 0x03
+			}
+			prefixes = append(prefixes[:0], prefix)
+		}
+		orig := new(Tree)
+		orig.InsertMany(items)
+		origRoot := orig.RootHash()
+
+		for _, prefix := range prefixes {
+			want := *orig
+			var wantN int
+			for _, item := range items {
+				if bytes.HasPrefix(item, prefix) && want.Delete(item) {
+					wantN++
+				}
+			}
+
+			got := *orig
+			n := got.DeletePrefix(prefix)
+			if n != wantN || got.Len() != want.Len() {
+				t.Errorf("case %d, prefix %x: removed %d items, leaving %d; want %d, leaving %d", i, prefix, n, got.Len(), wantN, want.Len())
+			}
+			if got.RootHash() != want.RootHash() {
+				t.Errorf("case %d, prefix %x: root hash differs from deleting items individually", i, prefix)
+			}
+			if orig.RootHash() != origRoot {
+				t.Fatalf("case %d, prefix %x: DeletePrefix modified a copy of the tree", i, prefix)
+			}
+		}
+	}
+
+	tr := new(Tree)
+	tr.InsertMany(fixed)
+	if n := tr.DeletePrefix(nil); n != len(fixed) || tr.Len() != 0 || tr.RootHash() != [32]byte{} {
+		t.Errorf("empty prefix: removed %d items, leaving %d; want all %d", n, tr.Len(), len(fixed))
+	}
+	if n := tr.DeletePrefix(nil); n != 0 {
+		t.Errorf("empty tree: removed %d items", n)
+	}
+}
+
+func TestCopyOnWrite(t *testing.T) {
+	orig := new(Tree)
+	for i := byte(0); i < 16; i++ {
+		orig.Insert([]byte{i})
+	}
+	wantRoot := orig.RootHash()
+
+	cp := new(Tree)
+	*cp = *orig
+	cp.Delete([]byte{3})
+	cp.Delete([]byte{12})
+	cp.Insert([]byte{16})
+	cp.Insert([]byte{200})
+
+	if orig.RootHash() != wantRoot {
+		t.Error("mutating a copy changed the original's root hash")
+	}
+	for i := byte(0); i < 16; i++ {
+		if !orig.Contains([]byte{i}) {
+			t.Errorf("original lost item %d", i)
+		}
+	}
+	for _, item := range [][]byte{{16}, {200}} {
+		if orig.Contains(item) {
+			t.Errorf("original gained item %x", item)
+		}
+	}
+	if cp.Contains([]byte{3}) || !cp.Contains([]byte{200}) {
+		t.Error("copy was not updated")
+	}
+}
+
+// debugChecksum returns a hash of the addresses and contents of t's
+// nodes. It changes if t gains or loses a node, or if one of its
+// nodes is modified in place, so a test can check that updating one
+// tree left the nodes it shares with another alone.
+func (t *Tree) debugChecksum() uint64 {
+	h := fnv.New64a()
+	var sum func(n *node)
+	sum = func(n *node) {
+		if n == nil {
+			h.Write([]byte{0})
+			return
+		}
+		fmt.Fprintf(h, "%p %x %d %t;", n, n.key, n.keybit, n.isLeaf)
+		sum(n.children[0])
+		sum(n.children[1])
+	}
+	sum(t.root)
+	return h.Sum64()
+}
+
+func TestDebugChecksum(t *testing.T) {
+	orig := new(Tree)
+	for i := byte(0); i < 16; i++ {
+		orig.Insert([]byte{i})
+	}
+	want := orig.debugChecksum()
+
+	cp := new(Tree)
+	*cp = *orig
+	if cp.debugChecksum() != want {
+		t.Error("copy has a different checksum before any update")
+	}
+	cp.Delete([]byte{3})
+	cp.Insert([]byte{200})
+	if cp.debugChecksum() == want {
+		t.Error("updating a copy left its checksum unchanged")
+	}
+	if orig.debugChecksum() != want {
+		t.Error("updating a copy changed the original's nodes")
+	}
+
+	c := orig.Clone()
+	if c.debugChecksum() == want {
+		t.Error("clone has the original's nodes")
+	}
+	c.Insert([]byte{201})
+	if orig.debugChecksum() != want {
+		t.Error("updating a clone changed the original's nodes")
+	}
+
+	// Modifying a shared node in place, as a buggy Insert might,
+	// is caught.
+	*cp = *orig
+	cp.root.children[0].keybit ^= 1
+	if orig.debugChecksum() == want {
+		t.Error("checksum missed a node modified in place")
+	}
+}
+
+func TestClone(t *testing.T) {
+	orig := new(Tree)
+	for i := byte(0); i < 16; i++ {
+		orig.Insert([]byte{i})
+	}
+	orig.RootHash() // cache some hashes
+	orig.Insert([]byte{16})
+
+	c := orig.Clone()
+	if c.RootHash() != orig.RootHash() || c.Len() != orig.Len() {
+		t.Fatal("clone differs from original")
+	}
+	var shared func(a, b *node) bool
+	shared = func(a, b *node) bool {
+		if a == nil || b == nil {
+			return false
+		}
+		if a == b || (len(a.key) > 0 && &a.key[0] == &b.key[0]) {
+			return true
+		}
+		return shared(a.children[0], b.children[0]) || shared(a.children[1], b.children[1])
+	}
+	if shared(orig.root, c.root) {
+		t.Error("clone shares memory with original")
+	}
+
+	wantRoot := orig.RootHash()
+	c.Delete([]byte{3})
+	c.Insert([]byte{200})
+	if orig.RootHash() != wantRoot || orig.Contains([]byte{200}) {
+		t.Error("mutating a clone changed the original")
+	}
+	if (&Tree{}).Clone().RootHash() != [32]byte{} {
+		t.Error("clone of empty tree is not empty")
+	}
+}
+
+func TestCompact(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	tr := new(Tree)
+	var items [][]byte
+	for i := 0; i < 2000; i++ {
+		item := make([]byte, 8)
+		rng.Read(item)
+		tr.Insert(item)
+		items = append(items, item)
+	}
+	for _, item := range items[:1800] {
+		tr.Delete(item)
+	}
+	root := tr.RootHash()
+	old := *tr
+
+	before := tr.Stats()
+	tr.Compact()
+	if tr.RootHash() != root || tr.Len() != 200 {
+		t.Fatalf("got root %x with %d items, want %x with 200", tr.RootHash(), tr.Len(), root)
+	}
+	if n := countHashes(func() { tr.RootHash() }); n != 0 {
+		t.Errorf("compacted tree recomputed %d hashes", n)
+	}
+	for i, item := range items {
+		if got, want := tr.Contains(item), i >= 1800; got != want {
+			t.Errorf("Contains(%x) = %t, want %t", item, got, want)
+		}
+	}
+	if after := tr.Stats(); after != before || after.Nodes != 2*tr.Len()-1 {
+		t.Errorf("got stats %+v before and %+v after compacting %d items", before, after, tr.Len())
+	}
+
+	var shared func(a, b *node) bool
+	shared = func(a, b *node) bool {
+		if a == nil || b == nil {
+			return false
+		}
+		if a == b || (len(a.key) > 0 && &a.key[0] == &b.key[0]) {
+			return true
+		}
+		return shared(a.children[0], b.children[0]) || shared(a.children[1], b.children[1])
+	}
+	if shared(old.root, tr.root) {
+		t.Error("compacted tree shares memory with its earlier copy")
+	}
+	if old.RootHash() != root {
+		t.Error("compacting changed an earlier copy")
+	}
+
+	empty := new(Tree)
+	empty.Compact()
+	if empty.Len() != 0 || empty.RootHash() != [32]byte{} {
+		t.Error("compacted empty tree is not empty")
+	}
+}
+
 func TestWalk(t *testing.T) {
 	var found [][]byte
 	f := func(item []byte) error {
@@ -593,6 +868,563 @@ func TestWalk(t *testing.T) {
 	}
 }
 
+func TestWalkOrder(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	tr := new(Tree)
+	var want [][]byte
+	for i := 0; i < 500; i++ {
+		k := make([]byte, 1+rng.Intn(3))
+		rng.Read(k)
+		if tr.Insert(k) != nil {
+			continue // k is a prefix of an existing item, or vice versa
+		}
+		if !tr.Contains(k) {
+			t.Fatalf("tree does not contain inserted item %x", k)
+		}
+		want = append(want, k)
+	}
+	sort.Slice(want, func(i, j int) bool { return bytes.Compare(want[i], want[j]) < 0 })
+	want = dedupe(want)
+
+	var got [][]byte
+	err := Walk(tr, func(item []byte) error {
+		got = append(got, item)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !testutil.DeepEqual(got, want) {
+		t.Errorf("Walk visited %x, want %x", got, want)
+	}
+
+	stop := errors.New("stop")
+	var n int
+	err = Walk(tr, func(item []byte) error {
+		n++
+		if n == 3 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop {
+		t.Errorf("Walk returned %v, want %v", err, stop)
+	}
+	if n != 3 {
+		t.Errorf("Walk called walkFn %d times, want 3", n)
+	}
+}
+
+func dedupe(sorted [][]byte) [][]byte {
+	var result [][]byte
+	for i, item := range sorted {
+		if i == 0 || !bytes.Equal(item, sorted[i-1]) {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+func TestWalkContext(t *testing.T) {
+	tr := new(Tree)
+	for i := 0; i < 5*ctxCheckInterval; i++ {
+		tr.Insert([]byte{byte(i >> 8), byte(i)})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var visited int
+	err := WalkContext(ctx, tr, func(item []byte) error {
+		visited++
+		if visited == 10 {
+			cancel()
+		}
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+	if visited != ctxCheckInterval {
+		t.Errorf("visited %d items after canceling at 10, want %d", visited, ctxCheckInterval)
+	}
+
+	// An uncanceled walk visits everything.
+	visited = 0
+	err = WalkContext(context.Background(), tr, func([]byte) error {
+		visited++
+		return nil
+	})
+	if err != nil || visited != tr.Len() {
+		t.Errorf("got error %v after %d items, want nil after %d", err, visited, tr.Len())
+	}
+
+	// And an already-canceled one visits nothing.
+	visited = 0
+	err = WalkContext(ctx, tr, func([]byte) error {
+		visited++
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) || visited != 0 {
+		t.Errorf("got error %v after %d items, want %v after 0", err, visited, context.Canceled)
+	}
+}
+
+func TestWalkPrefix(t *testing.T) {
+	items := [][]byte{
+		{0x00, 0x01},
+		{0x01, 0x00, 0x00},
+		{0x01, 0x00, 0x01},
+		{0x01, 0x01},
+		{0x01, 0xff, 0x00},
+		{0x02},
+		{0xf0, 0x00},
+	}
+	tr := new(Tree)
+	for _, item := range items {
+		err := tr.Insert(item)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		prefix []byte
+		want   [][]byte
+	}{
+		{nil, items},
+		{[]byte{}, items},
+		{[]byte{0x01}, items[1:5]},
+		{[]byte{0x01, 0x00}, items[1:3]},
+		{[]byte{0x01, 0x00, 0x01}, items[2:3]},      // a full item
+		{[]byte{0x01, 0x00, 0x01, 0x00}, nil},       // extends an item
+		{[]byte{0x01, 0x02}, nil},                   // between items
+		{[]byte{0x03}, nil},                         // past the end
+		{[]byte{0xf0}, items[6:]},                   // single item under prefix
+		{[]byte{0x00, 0x01, 0x02, 0x03, 0x04}, nil}, // extends the first item
+	}
+	for _, c := range cases {
+		var got [][]byte
+		err := tr.WalkPrefix(c.prefix, func(item []byte) error {
+			got = append(got, item)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !testutil.DeepEqual(got, c.want) {
+			t.Errorf("WalkPrefix(%x) visited %x, want %x", c.prefix, got, c.want)
+		}
+	}
+
+	// Random items, checked against a filtered Walk.
+	rng := rand.New(rand.NewSource(1))
+	tr = new(Tree)
+	for i := 0; i < 500; i++ {
+		item := make([]byte, 1+rng.Intn(4))
+		rng.Read(item)
+		item[0] &= 0x03
+		tr.Insert(item)
+	}
+	for i := 0; i < 200; i++ {
+		prefix := make([]byte, rng.Intn(3))
+		rng.Read(prefix)
+		if len(prefix) > 0 {
+			prefix[0] &= 0x03
+		}
+		var want, got [][]byte
+		Walk(tr, func(item []byte) error {
+			if bytes.HasPrefix(item, prefix) {
+				want = append(want, item)
+			}
+			return nil
+		})
+		tr.WalkPrefix(prefix, func(item []byte) error {
+			got = append(got, item)
+			return nil
+		})
+		if !testutil.DeepEqual(got, want) {
+			t.Errorf("WalkPrefix(%x) visited %x, want %x", prefix, got, want)
+		}
+	}
+
+	stop := errors.New("stop")
+	err := tr.WalkPrefix(nil, func([]byte) error { return stop })
+	if err != stop {
+		t.Errorf("WalkPrefix returned %v, want %v", err, stop)
+	}
+	err = new(Tree).WalkPrefix([]byte{1}, func([]byte) error { return stop })
+	if err != nil {
+		t.Errorf("WalkPrefix on empty tree returned %v", err)
+	}
+}
+
+func TestFind(t *testing.T) {
+	tr := new(Tree)
+	for _, item := range [][]byte{{0x03}, {0x01, 0x02}, {0x02, 0x05}, {0x01, 0x00}, {0x04}} {
+		tr.Insert(item)
+	}
+
+	var visited [][]byte
+	key, ok := tr.Find(func(key []byte) bool {
+		visited = append(visited, key)
+		return key[0] >= 0x02
+	})
+	if !ok || !bytes.Equal(key, []byte{0x02, 0x05}) {
+		t.Errorf("Find = %x, %v, want 0205, true", key, ok)
+	}
+	want := [][]byte{{0x01, 0x00}, {0x01, 0x02}, {0x02, 0x05}}
+	if !reflect.DeepEqual(visited, want) {
+		t.Errorf("visited %x, want %x", visited, want)
+	}
+
+	key, ok = tr.Find(func(key []byte) bool { return key[0] == 0xff })
+	if ok || key != nil {
+		t.Errorf("Find(absent) = %x, %v, want nil, false", key, ok)
+	}
+	if _, ok := new(Tree).Find(func([]byte) bool { return true }); ok {
+		t.Error("found an item in an empty tree")
+	}
+}
+
+func TestWalkFunc(t *testing.T) {
+	items := [][]byte{
+		{0x00, 0x01},
+		{0x01, 0x00, 0x00},
+		{0x01, 0x00, 0x01},
+		{0x01, 0x01},
+		{0x01, 0xff, 0x00},
+		{0x02},
+		{0xf0, 0x00},
+	}
+	tr := new(Tree)
+	for _, item := range items {
+		err := tr.Insert(item)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var all [][]byte
+	err := tr.WalkFunc(func(key []byte) (bool, error) {
+		if tr.Contains(key) {
+			all = append(all, key)
+		}
+		return false, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !testutil.DeepEqual(all, items) {
+		t.Errorf("WalkFunc visited %x, want %x", all, items)
+	}
+
+	// Skip the subtree holding the items beginning with 0x01.
+	var visited, skipped [][]byte
+	err = tr.WalkFunc(func(key []byte) (bool, error) {
+		if tr.Contains(key) {
+			visited = append(visited, key)
+			return false, nil
+		}
+		if bytes.Equal(key, []byte{0x01}) {
+			skipped = append(skipped, key)
+			return true, nil
+		}
+		return false, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]byte{items[0], items[5], items[6]}
+	if !testutil.DeepEqual(visited, want) {
+		t.Errorf("WalkFunc with skip visited %x, want %x", visited, want)
+	}
+	if len(skipped) != 1 {
+		t.Errorf("skipped %d subtrees with prefix 01, want 1", len(skipped))
+	}
+
+	stop := errors.New("stop")
+	err = tr.WalkFunc(func([]byte) (bool, error) { return false, stop })
+	if err != stop {
+		t.Errorf("WalkFunc returned %v, want %v", err, stop)
+	}
+}
+
+func TestLen(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	tr := new(Tree)
+	var keys [][]byte
+	for i := 0; i < 1000; i++ {
+		var k []byte
+		if len(keys) > 0 && rng.Intn(3) == 0 {
+			k = keys[rng.Intn(len(keys))] // duplicate or already-deleted key
+		} else {
+			k = make([]byte, 1+rng.Intn(2))
+			rng.Read(k)
+			keys = append(keys, k)
+		}
+		if rng.Intn(2) == 0 {
+			tr.Insert(k) // may fail on a prefix conflict
+		} else {
+			tr.Delete(k)
+		}
+
+		var want int
+		Walk(tr, func([]byte) error {
+			want++
+			return nil
+		})
+		if got := tr.Len(); got != want {
+			t.Fatalf("step %d: Len() = %d, want %d", i, got, want)
+		}
+	}
+
+	tr = new(Tree)
+	tr.InsertMany([][]byte{{1}, {2}, {2}, {3}})
+	if got := tr.Len(); got != 3 {
+		t.Errorf("after InsertMany, Len() = %d, want 3", got)
+	}
+}
+
+func TestIsEmpty(t *testing.T) {
+	tr := new(Tree)
+	if !tr.IsEmpty() || tr.RootHash() != EmptyRootHash {
+		t.Errorf("new tree: IsEmpty() = %v, root %x", tr.IsEmpty(), tr.RootHash())
+	}
+	tr.Insert([]byte{1})
+	if tr.IsEmpty() || tr.RootHash() == EmptyRootHash {
+		t.Errorf("populated tree: IsEmpty() = %v, root %x", tr.IsEmpty(), tr.RootHash())
+	}
+	tr.Delete([]byte{1})
+	if !tr.IsEmpty() || tr.RootHash() != EmptyRootHash {
+		t.Errorf("emptied tree: IsEmpty() = %v, root %x", tr.IsEmpty(), tr.RootHash())
+	}
+}
+
+// TestConcurrentReaders checks, when run with -race, that reading
+// a tree from many goroutines does not race, even while a copy of it
+// is being modified.
+func TestConcurrentReaders(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	var items [][]byte
+	for i := 0; i < 1000; i++ {
+		item := make([]byte, 32)
+		rng.Read(item)
+		items = append(items, item)
+	}
+	tr, ref := new(Tree), new(Tree)
+	for _, item := range items {
+		tr.Insert(item)
+		ref.Insert(item)
+	}
+	want := ref.RootHash()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			if got := tr.RootHash(); got != want {
+				t.Errorf("reader %d: RootHash() = %x, want %x", g, got, want)
+			}
+			for i, item := range items {
+				if i%8 == g && !tr.Contains(item) {
+					t.Errorf("reader %d: tree does not contain %x", g, item)
+				}
+			}
+			var n int
+			Walk(tr, func([]byte) error {
+				n++
+				return nil
+			})
+			if n != len(items) {
+				t.Errorf("reader %d: Walk visited %d items, want %d", g, n, len(items))
+			}
+			p, ok := tr.Proof(items[g])
+			if !ok || !VerifyProof(want, items[g], p) {
+				t.Errorf("reader %d: bad proof for %x", g, items[g])
+			}
+		}(g)
+	}
+
+	// Modify a copy sharing tr's nodes, as PruneNoncesImmutable does.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		cp := *tr
+		for _, item := range items[:100] {
+			cp.Delete(item)
+		}
+		cp.Insert([]byte("extra item, not a prefix of others"))
+		cp.RootHash()
+	}()
+	wg.Wait()
+}
+
+func TestRootHashCache(t *testing.T) {
+	tr := new(Tree)
+	for i := 0; i < 100; i++ {
+		tr.Insert([]byte{byte(i)})
+	}
+	root1 := tr.RootHash()
+	cp := *tr
+
+	tr.Insert([]byte{200})
+	root2 := tr.RootHash()
+	if root2 == root1 {
+		t.Error("root did not change after Insert")
+	}
+	if tr.RootHash() != root2 {
+		t.Error("root changed without mutation")
+	}
+
+	tr.Delete([]byte{200})
+	if got := tr.RootHash(); got != root1 {
+		t.Errorf("root after Delete = %x, want %x", got, root1)
+	}
+	tr.Delete([]byte{5})
+	if tr.RootHash() == root1 {
+		t.Error("root did not change after Delete")
+	}
+
+	if got := cp.RootHash(); got != root1 {
+		t.Errorf("copy's root = %x, want %x", got, root1)
+	}
+	cp.Insert([]byte{201})
+	if got := cp.RootHash(); got == root1 || got == tr.RootHash() {
+		t.Error("copy's root did not change after Insert")
+	}
+}
+
+func BenchmarkRootHash(b *testing.B) {
+	tr := new(Tree)
+	err := tr.InsertMany(bulkItems(100000))
+	if err != nil {
+		b.Fatal(err)
+	}
+	tr.RootHash()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tr.RootHash()
+	}
+}
+
+// countHashes returns the number of interior node hashes computed
+// by f.
+func countHashes(f func()) int {
+	var n int
+	orig := hashInterior
+	hashInterior = func(left, right [32]byte) [32]byte {
+		n++
+		return orig(left, right)
+	}
+	defer func() { hashInterior = orig }()
+	f()
+	return n
+}
+
+// depth returns the number of interior nodes above item's leaf.
+func depth(t *Tree, item []byte) int {
+	var d int
+	for n := t.root; !n.isLeaf; d++ {
+		n = n.children[childIdx(item, len(n.key), n.keybit)]
+	}
+	return d
+}
+
+func TestStats(t *testing.T) {
+	cases := []struct {
+		items [][]byte
+		want  TreeStats
+	}{
+		{nil, TreeStats{}},
+		{[][]byte{{1}}, TreeStats{Nodes: 1, MaxDepth: 0, AvgLeafDepth: 0}},
+		{[][]byte{{0}, {1}}, TreeStats{Nodes: 3, MaxDepth: 1, AvgLeafDepth: 1}},
+		// 0x00 and 0x01 share 7 bits; 0x80 branches off at the root.
+		{[][]byte{{0x00}, {0x01}, {0x80}}, TreeStats{Nodes: 5, MaxDepth: 2, AvgLeafDepth: 5.0 / 3}},
+		// Each item branches off the path to the next: a chain.
+		{[][]byte{{0x80}, {0x40}, {0x20}, {0x10}}, TreeStats{Nodes: 7, MaxDepth: 3, AvgLeafDepth: 9.0 / 4}},
+		{[][]byte{{0x00}, {0x40}, {0x80}, {0xc0}}, TreeStats{Nodes: 7, MaxDepth: 2, AvgLeafDepth: 2}},
+	}
+	for _, c := range cases {
+		tr := new(Tree)
+		tr.InsertMany(c.items)
+		if got := tr.Stats(); got != c.want {
+			t.Errorf("items %x: got %+v, want %+v", c.items, got, c.want)
+		}
+		var maxDepth int
+		for _, item := range c.items {
+			if d := depth(tr, item); d > maxDepth {
+				maxDepth = d
+			}
+		}
+		if got := tr.Stats(); got.MaxDepth != maxDepth {
+			t.Errorf("items %x: max depth %d, depth finds %d", c.items, got.MaxDepth, maxDepth)
+		}
+	}
+}
+
+func TestIncrementalRootHash(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	item := func() []byte {
+		b := make([]byte, 32)
+		rng.Read(b)
+		return b
+	}
+	tr := new(Tree)
+	for i := 0; i < 100000; i++ {
+		tr.Insert(item())
+	}
+	tr.RootHash()
+
+	for i := 0; i < 100; i++ {
+		it := item()
+		got := countHashes(func() {
+			tr.Insert(it)
+			tr.RootHash()
+		})
+		// Only the interior nodes on the new leaf's path are new.
+		if want := depth(tr, it); got != want {
+			t.Errorf("insert computed %d hashes, want %d", got, want)
+		}
+
+		want := depth(tr, it) - 1
+		got = countHashes(func() {
+			tr.Delete(it)
+			tr.RootHash()
+		})
+		if got != want {
+			t.Errorf("delete computed %d hashes, want %d", got, want)
+		}
+	}
+}
+
+func BenchmarkIncrementalRootHash(b *testing.B) {
+	const size = 1000000
+	tr := new(Tree)
+	err := tr.InsertMany(bulkItems(size))
+	if err != nil {
+		b.Fatal(err)
+	}
+	tr.RootHash()
+	rng := rand.New(rand.NewSource(1))
+	items := make([][]byte, b.N)
+	for i := range items {
+		items[i] = make([]byte, 32)
+		rng.Read(items[i])
+	}
+	b.ResetTimer()
+	hashes := countHashes(func() {
+		for _, item := range items {
+			tr.Insert(item)
+			tr.RootHash()
+		}
+	})
+	perOp := float64(hashes) / float64(b.N)
+	b.ReportMetric(perOp, "hashes/op")
+	if max := 3 * math.Log2(size); perOp > max {
+		b.Fatalf("%.1f hashes per insert, want at most %.1f", perOp, max)
+	}
+}
+
 func TestHasPrefix(t *testing.T) {
 	cases := []struct {
 		s, pref string
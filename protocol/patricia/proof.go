@@ -0,0 +1,181 @@
+package patricia
+
+import "bytes"
+
+// Proof shows that an item is, or is not, in a tree with a given
+// root hash. It is produced by Tree.Proof and checked by
+// VerifyProof, which needs only the tree's root hash.
+//
+// A membership proof consists of the path from the root to the
+// item's leaf. A non-membership proof consists of the paths to the
+// item's neighbors: the greatest item less than it (Before) and the
+// least item greater than it (After), in the sorted order of Walk.
+// Either neighbor may be nil if the item sorts before or after every
+// item in the tree; both are nil for the empty tree.
+type Proof struct {
+	Member bool
+
+	// Leaf is set for a membership proof.
+	Leaf *ProofPath
+
+	// Before and After are set for a non-membership proof.
+	Before, After *ProofPath
+}
+
+// ProofPath is the path from the root of a tree to one of its
+// leaves.
+type ProofPath struct {
+	Key []byte
+
+	// Steps lists, from the root downward, the interior nodes
+	// passed through on the way to Key.
+	Steps []ProofStep
+}
+
+// ProofStep is one step along a ProofPath.
+type ProofStep struct {
+	// Right tells whether the path goes to the right child (the
+	// one whose next bit is 1).
+	Right bool
+
+	// Sibling is the hash of the child not taken.
+	Sibling [32]byte
+}
+
+// Proof produces a proof that key is, or is not, in t. The boolean
+// result tells which.
+func (t *Tree) Proof(key []byte) (*Proof, bool) {
+	if t.root == nil {
+		return new(Proof), false
+	}
+
+	var (
+		steps         []ProofStep
+		before, after *ProofPath
+		n             = t.root
+	)
+	for {
+		if n.isLeaf {
+			switch c := bytes.Compare(key, n.key); {
+			case c == 0:
+				return &Proof{Member: true, Leaf: &ProofPath{Key: n.key, Steps: steps}}, true
+			case c < 0:
+				after = &ProofPath{Key: n.key, Steps: steps}
+			default:
+				before = &ProofPath{Key: n.key, Steps: steps}
+			}
+			break
+		}
+
+		if !hasPrefix(key, n.key, n.keybit) || (bytes.Equal(key, n.key) && n.keybit == 7) {
+			// All of n's leaves are on one side of key.
+			first := extremePath(n, steps, false)
+			if bytes.Compare(key, first.Key) < 0 {
+				after = first
+			} else {
+				before = extremePath(n, steps, true)
+			}
+			break
+		}
+
+		bit := childIdx(key, len(n.key), n.keybit)
+		if bit == 1 {
+			before = extremePath(n.children[0], withStep(steps, false, n.children[1].Hash()), true)
+		} else {
+			after = extremePath(n.children[1], withStep(steps, true, n.children[0].Hash()), false)
+		}
+		steps = withStep(steps, bit == 1, n.children[1-bit].Hash())
+		n = n.children[bit]
+	}
+
+	return &Proof{Before: before, After: after}, false
+}
+
+// extremePath returns the path to the rightmost leaf under n if
+// right is true, otherwise to the leftmost. The path to n is given
+// by steps.
+func extremePath(n *node, steps []ProofStep, right bool) *ProofPath {
+	var (
+		take  = 0
+		other = 1
+	)
+	if right {
+		take, other = 1, 0
+	}
+	for !n.isLeaf {
+		steps = withStep(steps, right, n.children[other].Hash())
+		n = n.children[take]
+	}
+	return &ProofPath{Key: n.key, Steps: steps}
+}
+
+// withStep returns a copy of steps with a new step appended.
+func withStep(steps []ProofStep, right bool, sibling [32]byte) []ProofStep {
+	result := make([]ProofStep, len(steps), len(steps)+1)
+	copy(result, steps)
+	return append(result, ProofStep{Right: right, Sibling: sibling})
+}
+
+// VerifyProof reports whether p is a valid proof, against the given
+// tree root hash, that key is in the tree (if p.Member is true) or
+// is not in the tree (if p.Member is false).
+func VerifyProof(root [32]byte, key []byte, p *Proof) bool {
+	if p == nil {
+		return false
+	}
+	if p.Member {
+		return p.Leaf != nil && bytes.Equal(p.Leaf.Key, key) && p.Leaf.rootHash() == root
+	}
+
+	before, after := p.Before, p.After
+	if before == nil && after == nil {
+		return root == [32]byte{}
+	}
+	if before != nil && (bytes.Compare(before.Key, key) >= 0 || before.rootHash() != root) {
+		return false
+	}
+	if after != nil && (bytes.Compare(after.Key, key) <= 0 || after.rootHash() != root) {
+		return false
+	}
+
+	// The neighbors must be adjacent in the tree, with nothing
+	// between them.
+	switch {
+	case before == nil:
+		return allSteps(after.Steps, false)
+	case after == nil:
+		return allSteps(before.Steps, true)
+	}
+	var i int
+	for i < len(before.Steps) && i < len(after.Steps) && before.Steps[i].Right == after.Steps[i].Right {
+		i++
+	}
+	if i == len(before.Steps) || i == len(after.Steps) {
+		return false
+	}
+	return !before.Steps[i].Right && after.Steps[i].Right &&
+		allSteps(before.Steps[i+1:], true) && allSteps(after.Steps[i+1:], false)
+}
+
+func allSteps(steps []ProofStep, right bool) bool {
+	for _, s := range steps {
+		if s.Right != right {
+			return false
+		}
+	}
+	return true
+}
+
+// rootHash computes the root hash of a tree containing the path.
+func (p *ProofPath) rootHash() [32]byte {
+	h := leafHash(p.Key)
+	for i := len(p.Steps) - 1; i >= 0; i-- {
+		s := p.Steps[i]
+		if s.Right {
+			h = interiorHash(s.Sibling, h)
+		} else {
+			h = interiorHash(h, s.Sibling)
+		}
+	}
+	return h
+}
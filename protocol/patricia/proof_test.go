@@ -0,0 +1,122 @@
+package patricia
+
+import (
+	"bytes"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestProof(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	tr := new(Tree)
+	var keys [][]byte
+	for i := 0; i < 200; i++ {
+		k := make([]byte, 4)
+		rng.Read(k)
+		keys = append(keys, k)
+		tr.Insert(k)
+	}
+	root := tr.RootHash()
+
+	for _, k := range keys {
+		p, ok := tr.Proof(k)
+		if !ok || !p.Member {
+			t.Fatalf("Proof(%x) is not a membership proof", k)
+		}
+		if !VerifyProof(root, k, p) {
+			t.Errorf("membership proof for %x does not verify", k)
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+	absent := [][]byte{
+		{0, 0, 0, 0},
+		{255, 255, 255, 255},
+		{keys[0][0], keys[0][1], keys[0][2]}, // a prefix of an item
+	}
+	for i := 0; i < 100; i++ {
+		k := make([]byte, 4)
+		rng.Read(k)
+		absent = append(absent, k)
+	}
+	for _, k := range absent {
+		if tr.Contains(k) {
+			continue
+		}
+		p, ok := tr.Proof(k)
+		if ok || p.Member {
+			t.Fatalf("Proof(%x) is a membership proof", k)
+		}
+		if !VerifyProof(root, k, p) {
+			t.Errorf("non-membership proof for %x does not verify", k)
+		}
+	}
+}
+
+func TestProofTampered(t *testing.T) {
+	tr := new(Tree)
+	for i := byte(0); i < 16; i++ {
+		tr.Insert([]byte{i * 2})
+	}
+	root := tr.RootHash()
+
+	p, _ := tr.Proof([]byte{6})
+	p.Leaf.Steps[1].Sibling[0] ^= 1
+	if VerifyProof(root, []byte{6}, p) {
+		t.Error("membership proof with tampered sibling verifies")
+	}
+
+	p, _ = tr.Proof([]byte{6})
+	if VerifyProof(root, []byte{8}, p) {
+		t.Error("membership proof verifies for a different key")
+	}
+	p.Member = false
+	if VerifyProof(root, []byte{6}, p) {
+		t.Error("membership proof verifies as non-membership")
+	}
+
+	p, _ = tr.Proof([]byte{7})
+	p.After.Steps[0].Sibling[0] ^= 1
+	if VerifyProof(root, []byte{7}, p) {
+		t.Error("non-membership proof with tampered sibling verifies")
+	}
+
+	// Neighbors that are present but not adjacent.
+	before, _ := tr.Proof([]byte{4})
+	after, _ := tr.Proof([]byte{10})
+	p = &Proof{Before: before.Leaf, After: after.Leaf}
+	if VerifyProof(root, []byte{7}, p) {
+		t.Error("non-membership proof with non-adjacent neighbors verifies")
+	}
+
+	p, _ = tr.Proof([]byte{7})
+	p.Before = nil
+	if VerifyProof(root, []byte{7}, p) {
+		t.Error("non-membership proof with a missing neighbor verifies")
+	}
+}
+
+func TestProofSmallTrees(t *testing.T) {
+	tr := new(Tree)
+	p, ok := tr.Proof([]byte{1})
+	if ok || !VerifyProof(tr.RootHash(), []byte{1}, p) {
+		t.Error("bad non-membership proof for empty tree")
+	}
+
+	tr.Insert([]byte{1})
+	root := tr.RootHash()
+	p, ok = tr.Proof([]byte{1})
+	if !ok || !VerifyProof(root, []byte{1}, p) {
+		t.Error("bad membership proof for single-item tree")
+	}
+	for _, k := range [][]byte{{0}, {2}} {
+		p, ok = tr.Proof(k)
+		if ok || !VerifyProof(root, k, p) {
+			t.Errorf("bad non-membership proof for %x in single-item tree", k)
+		}
+	}
+	if VerifyProof([32]byte{}, []byte{1}, p) {
+		t.Error("proof verifies against the wrong root")
+	}
+}
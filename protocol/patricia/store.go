@@ -0,0 +1,359 @@
+package patricia
+
+import (
+	"bytes"
+
+	"github.com/chain/txvm/crypto/sha3pool"
+	"github.com/chain/txvm/errors"
+)
+
+// ErrNodeNotFound is returned by MemStore.Get for a hash that is not
+// in the store.
+var ErrNodeNotFound = errors.New("node not found")
+
+// NodeStore is persistent storage for the nodes of a tree, keyed by
+// node hash. It is used by StoredTree. Implementations may be backed
+// by a database such as LevelDB.
+//
+// Put may be called more than once with the same hash and data.
+type NodeStore interface {
+	Get(hash [32]byte) ([]byte, error)
+	Put(hash [32]byte, data []byte) error
+}
+
+// MemStore is the default, in-memory implementation of NodeStore.
+type MemStore map[[32]byte][]byte
+
+// Get implements NodeStore.
+func (m MemStore) Get(hash [32]byte) ([]byte, error) {
+	data, ok := m[hash]
+	if !ok {
+		return nil, errors.WithDetailf(ErrNodeNotFound, "hash %x", hash[:])
+	}
+	return data, nil
+}
+
+// Put implements NodeStore.
+func (m MemStore) Put(hash [32]byte, data []byte) error {
+	m[hash] = data
+	return nil
+}
+
+// NewPrefixStore returns a NodeStore keeping its nodes in store,
+// separate from those of any NodeStore over the same store with a
+// different prefix. This lets several trees share one backend.
+//
+// Since keys are fixed-size hashes, the prefix is not prepended to
+// them directly; instead each node is stored under the SHA3-256 hash
+// of the prefix and its own hash. Node hashes themselves, and so the
+// trees' root hashes, are unaffected.
+func NewPrefixStore(store NodeStore, prefix string) NodeStore {
+	return &prefixStore{store: store, prefix: prefix}
+}
+
+type prefixStore struct {
+	store  NodeStore
+	prefix string
+}
+
+func (p *prefixStore) key(hash [32]byte) [32]byte {
+	var key [32]byte
+	sha3pool.Sum256(key[:], append([]byte(p.prefix), hash[:]...))
+	return key
+}
+
+func (p *prefixStore) Get(hash [32]byte) ([]byte, error) {
+	return p.store.Get(p.key(hash))
+}
+
+func (p *prefixStore) Put(hash [32]byte, data []byte) error {
+	return p.store.Put(p.key(hash), data)
+}
+
+// Save writes the nodes of t to store, so that LoadTree (or
+// NewStoredTree) can recover t from its root hash.
+func (t *Tree) Save(store NodeStore) error {
+	if t.root == nil {
+		return nil
+	}
+	st := &StoredTree{store: store, root: t.root}
+	return st.put(t.root)
+}
+
+// LoadTree loads the tree with the given root hash from store, as
+// saved by Tree.Save or StoredTree.Commit, reading all of its nodes.
+// The zero hash gives an empty tree.
+func LoadTree(store NodeStore, root [32]byte) (*Tree, error) {
+	st := NewStoredTree(store, root)
+	var n int
+	err := st.Walk(func([]byte) error {
+		n++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Tree{root: st.root, n: n}, nil
+}
+
+// StoredTree is a patricia tree whose nodes are kept in a NodeStore
+// and loaded only as needed. It has the same contents and root hash
+// as a Tree holding the same items.
+//
+// Changes made by Insert and Delete are held in memory until Commit
+// writes them to the store. Copying a StoredTree gives a new tree
+// with the same contents, as with Tree, but unlike Tree a
+// StoredTree is not safe for concurrent use, since reads may load
+// nodes.
+type StoredTree struct {
+	store NodeStore
+	root  *node
+}
+
+// NewStoredTree returns a tree backed by store with the given root
+// hash, which must be the zero hash (for an empty tree) or the
+// result of an earlier call to RootHash followed by Commit.
+func NewStoredTree(store NodeStore, root [32]byte) *StoredTree {
+	t := &StoredTree{store: store}
+	if root != [32]byte{} {
+		t.root = &node{hash: &root, stub: true}
+	}
+	return t
+}
+
+// RootHash returns the Merkle root of the tree.
+func (t *StoredTree) RootHash() [32]byte {
+	if t.root == nil {
+		return [32]byte{}
+	}
+	return t.root.Hash()
+}
+
+// Contains tells whether t contains item.
+func (t *StoredTree) Contains(item []byte) (bool, error) {
+	if t.root == nil {
+		return false, nil
+	}
+	err := t.loadPath(item, false)
+	if err != nil {
+		return false, err
+	}
+	return lookup(t.root, item) != nil, nil
+}
+
+// Insert inserts item into t, with the same rules as Tree.Insert.
+// On error, t is unchanged.
+func (t *StoredTree) Insert(item []byte) error {
+	hash := leafHash(item)
+	if t.root == nil {
+		t.root = &node{key: item, keybit: 7, hash: &hash, isLeaf: true}
+		return nil
+	}
+	err := t.loadPath(item, false)
+	if err != nil {
+		return err
+	}
+	root, err := insert(t.root, item, &hash)
+	if err != nil {
+		return err
+	}
+	t.root = root
+	return nil
+}
+
+// Delete removes item from t, if present,
+// and reports whether it was present.
+// On error, t is unchanged.
+func (t *StoredTree) Delete(item []byte) (bool, error) {
+	if t.root == nil {
+		return false, nil
+	}
+	// Deleting a leaf replaces its parent with its sibling,
+	// so siblings must be loaded too.
+	err := t.loadPath(item, true)
+	if err != nil {
+		return false, err
+	}
+	root := delete(t.root, item)
+	if root == t.root {
+		return false, nil
+	}
+	t.root = root
+	return true, nil
+}
+
+// Walk calls walkFn for each item in t, in the same order as the
+// function Walk. It loads every node of t.
+func (t *StoredTree) Walk(walkFn WalkFunc) error {
+	if t.root == nil {
+		return nil
+	}
+	return t.walk(t.root, walkFn)
+}
+
+func (t *StoredTree) walk(n *node, walkFn WalkFunc) error {
+	err := t.load(n)
+	if err != nil {
+		return err
+	}
+	if n.isLeaf {
+		return walkFn(n.key)
+	}
+	for _, c := range n.children {
+		err = t.walk(c, walkFn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Commit writes the nodes added to t since it was created or last
+// committed to the store. Afterward, the nodes held in memory are
+// released, and the state of t can be recovered with
+// NewStoredTree(store, t.RootHash()).
+func (t *StoredTree) Commit() error {
+	if t.root == nil {
+		return nil
+	}
+	err := t.put(t.root)
+	if err != nil {
+		return err
+	}
+	hash := t.root.Hash()
+	t.root = &node{hash: &hash, stub: true}
+	return nil
+}
+
+func (t *StoredTree) put(n *node) error {
+	if n.stub {
+		return nil
+	}
+	if !n.isLeaf {
+		for _, c := range n.children {
+			err := t.put(c)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err := t.store.Put(n.Hash(), encodeNode(n))
+	return errors.Wrapf(err, "storing node %x", n.key)
+}
+
+// loadPath loads the nodes of t on the path to key and, if
+// siblings is true, their immediate siblings.
+func (t *StoredTree) loadPath(key []byte, siblings bool) error {
+	n := t.root
+	for {
+		err := t.load(n)
+		if err != nil {
+			return err
+		}
+		if n.isLeaf || !hasPrefix(key, n.key, n.keybit) || (bytes.Equal(key, n.key) && n.keybit == 7) {
+			return nil
+		}
+		bit := childIdx(key, len(n.key), n.keybit)
+		if siblings {
+			err = t.load(n.children[1-bit])
+			if err != nil {
+				return err
+			}
+		}
+		n = n.children[bit]
+	}
+}
+
+// load fills in a stub node from the store, checking its hash, and
+// if it is an interior node, fills in its children too. The hash of
+// an interior node does not cover its key, so its children are then
+// checked to extend its key on the correct sides, as UnmarshalBinary
+// checks a decoded node; otherwise a corrupted store could give a
+// tree that the tree operations misread, or panic on. Nodes already
+// filled in are not loaded again.
+func (t *StoredTree) load(n *node) error {
+	err := t.fetch(n)
+	if err != nil || n.isLeaf {
+		return err
+	}
+	for i, c := range n.children {
+		if !c.stub {
+			continue
+		}
+		stub := *c
+		err = t.fetch(c)
+		if err != nil {
+			return err
+		}
+		if prefixBits(c) <= prefixBits(n) || !hasPrefix(c.key, n.key, n.keybit) || int(childIdx(c.key, len(n.key), n.keybit)) != i {
+			*c = stub
+			return errors.WithDetailf(errors.New("node key mismatch"), "loading node %x", stub.hash[:])
+		}
+	}
+	return nil
+}
+
+// fetch fills in a stub node from the store, checking its hash.
+// It does nothing if n is already filled in.
+func (t *StoredTree) fetch(n *node) error {
+	if !n.stub {
+		return nil
+	}
+	hash := *n.hash
+	data, err := t.store.Get(hash)
+	if err != nil {
+		return errors.Wrapf(err, "loading node %x", hash[:])
+	}
+	loaded, err := decodeNode(data)
+	if err != nil {
+		return errors.Wrapf(err, "loading node %x", hash[:])
+	}
+	if loaded.Hash() != hash {
+		return errors.WithDetailf(errors.New("node hash mismatch"), "loading node %x", hash[:])
+	}
+	*n = *loaded
+	return nil
+}
+
+// encodeNode returns the storage encoding of n:
+// 0x00 followed by the item for a leaf,
+// or 0x01, keybit, the key, and the two child hashes
+// for an interior node.
+func encodeNode(n *node) []byte {
+	if n.isLeaf {
+		return append([]byte{0x00}, n.key...)
+	}
+	b := append([]byte{0x01, n.keybit}, n.key...)
+	for _, c := range n.children {
+		h := c.Hash()
+		b = append(b, h[:]...)
+	}
+	return b
+}
+
+func decodeNode(data []byte) (*node, error) {
+	switch {
+	case len(data) > 0 && data[0] == 0x00:
+		key := append([]byte(nil), data[1:]...)
+		hash := leafHash(key)
+		return &node{key: key, keybit: 7, hash: &hash, isLeaf: true}, nil
+
+	case len(data) >= 2+64 && data[0] == 0x01:
+		// With an empty key, there is no byte for keybit to select
+		// bits of, so it must be 7, meaning the whole key.
+		if data[1] > 7 || len(data) == 2+64 && data[1] != 7 {
+			return nil, errors.New("malformed node encoding")
+		}
+		n := &node{
+			keybit: data[1],
+			key:    append([]byte(nil), data[2:len(data)-64]...),
+		}
+		for i := range n.children {
+			var h [32]byte
+			copy(h[:], data[len(data)-64+32*i:])
+			n.children[i] = &node{hash: &h, stub: true}
+		}
+		return n, nil
+	}
+	return nil, errors.New("malformed node encoding")
+}
@@ -0,0 +1,305 @@
+package patricia
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/chain/txvm/errors"
+)
+
+func TestStoredTree(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	store := make(MemStore)
+	mem := new(Tree)
+	st := NewStoredTree(store, [32]byte{})
+
+	var items [][]byte
+	for i := 0; i < 2000; i++ {
+		var item []byte
+		if len(items) > 0 && rng.Intn(3) == 0 {
+			item = items[rng.Intn(len(items))]
+		} else {
+			item = make([]byte, 1+rng.Intn(3))
+			rng.Read(item)
+			items = append(items, item)
+		}
+		if rng.Intn(2) == 0 {
+			wantErr := mem.Insert(item)
+			gotErr := st.Insert(item)
+			if (gotErr == nil) != (wantErr == nil) {
+				t.Fatalf("step %d: Insert(%x) error %v, want %v", i, item, gotErr, wantErr)
+			}
+		} else {
+			want := mem.Delete(item)
+			got, err := st.Delete(item)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != want {
+				t.Fatalf("step %d: Delete(%x) = %t, want %t", i, item, got, want)
+			}
+		}
+		if got, want := st.RootHash(), mem.RootHash(); got != want {
+			t.Fatalf("step %d: stored root %x, in-memory root %x", i, got, want)
+		}
+		if rng.Intn(10) == 0 {
+			err := st.Commit()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rng.Intn(2) == 0 {
+				st = NewStoredTree(store, st.RootHash())
+			}
+		}
+	}
+
+	err := st.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	st = NewStoredTree(store, mem.RootHash())
+	for _, item := range items {
+		got, err := st.Contains(item)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := mem.Contains(item); got != want {
+			t.Errorf("Contains(%x) = %t, want %t", item, got, want)
+		}
+	}
+
+	var want, got [][]byte
+	Walk(mem, func(item []byte) error {
+		want = append(want, item)
+		return nil
+	})
+	err = st.Walk(func(item []byte) error {
+		got = append(got, item)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Walk visited %d items, want %d", len(got), len(want))
+	}
+	for i := range got {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Fatalf("Walk item %d = %x, want %x", i, got[i], want[i])
+		}
+	}
+}
+
+// faultyStore is a NodeStore whose Get fails after a given number of
+// successful calls.
+type faultyStore struct {
+	MemStore
+	gets  int
+	limit int
+}
+
+var errInjected = errors.New("injected read error")
+
+func (s *faultyStore) Get(hash [32]byte) ([]byte, error) {
+	s.gets++
+	if s.gets > s.limit {
+		return nil, errInjected
+	}
+	return s.MemStore.Get(hash)
+}
+
+func TestStoredTreeErrors(t *testing.T) {
+	store := &faultyStore{MemStore: make(MemStore)}
+	st := NewStoredTree(store, [32]byte{})
+	for i := 0; i < 100; i++ {
+		st.Insert([]byte{byte(2 * i)})
+	}
+	root := st.RootHash()
+	err := st.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ops := []struct {
+		name string
+		f    func(*StoredTree) error
+	}{
+		{"Contains", func(st *StoredTree) error {
+			_, err := st.Contains([]byte{50})
+			return err
+		}},
+		{"Insert", func(st *StoredTree) error { return st.Insert([]byte{51}) }},
+		{"Delete", func(st *StoredTree) error {
+			_, err := st.Delete([]byte{50})
+			return err
+		}},
+		{"Walk", func(st *StoredTree) error { return st.Walk(func([]byte) error { return nil }) }},
+	}
+	for _, op := range ops {
+		for limit := 0; limit < 3; limit++ {
+			store.gets, store.limit = 0, limit
+			st := NewStoredTree(store, root)
+			err := op.f(st)
+			if errors.Root(err) != errInjected {
+				t.Errorf("%s with %d successful reads: got error %v, want %v", op.name, limit, err, errInjected)
+			}
+			if st.RootHash() != root {
+				t.Errorf("%s with %d successful reads: failed operation changed root", op.name, limit)
+			}
+		}
+	}
+
+	store.limit = 1 << 30
+	st = NewStoredTree(make(MemStore), root)
+	_, err = st.Contains([]byte{50})
+	if errors.Root(err) != ErrNodeNotFound {
+		t.Errorf("Contains with empty store: got error %v, want %v", err, ErrNodeNotFound)
+	}
+
+	bad := make(MemStore)
+	bad.Put(root, []byte{0x00, 1, 2, 3})
+	st = NewStoredTree(bad, root)
+	_, err = st.Contains([]byte{50})
+	if err == nil {
+		t.Error("expected error loading node with wrong hash")
+	}
+}
+
+// TestStoredTreeCorrupt checks that interior nodes whose keys, which
+// their hashes do not cover, are corrupted in the store give errors
+// rather than panics or wrong results.
+func TestStoredTreeCorrupt(t *testing.T) {
+	items := [][]byte{{0x10}, {0x11}, {0x90}, {0x91}}
+	good := make(MemStore)
+	st := NewStoredTree(good, [32]byte{})
+	for _, item := range items {
+		st.Insert(item)
+	}
+	root := st.RootHash()
+	err := st.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The root has an empty key, and its children one-byte keys with
+	// keybit 6, covering 0x10-0x11 and 0x90-0x91.
+	err = st.loadPath([]byte{0x10}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	left := st.root.children[0]
+	leftHash := left.Hash()
+	if len(st.root.key) != 0 || len(left.key) != 1 || left.keybit != 6 {
+		t.Fatalf("root key %x, left child key %x and keybit %d", st.root.key, left.key, left.keybit)
+	}
+
+	cases := []struct {
+		name   string
+		hash   [32]byte
+		modify func([]byte) []byte
+	}{
+		{"keybit out of range", root, func(b []byte) []byte { b[1] = 9; return b }},
+		{"partial keybit with empty key", root, func(b []byte) []byte { b[1] = 3; return b }},
+		{"root key not a prefix", root, func(b []byte) []byte {
+			return append([]byte{0x01, 7, 0x20}, b[2:]...)
+		}},
+		{"child key not a prefix", leftHash, func(b []byte) []byte { b[2] = 0x30; return b }},
+		{"child on the wrong side", leftHash, func(b []byte) []byte { b[2] = 0x90; return b }},
+		{"child prefix too short", leftHash, func(b []byte) []byte { return append([]byte{0x01, 7}, b[3:]...) }},
+	}
+	for _, c := range cases {
+		store := make(MemStore)
+		for h, b := range good {
+			store[h] = append([]byte(nil), b...)
+		}
+		store[c.hash] = c.modify(store[c.hash])
+
+		ops := []struct {
+			name string
+			f    func(*StoredTree) error
+		}{
+			{"Contains", func(st *StoredTree) error {
+				_, err := st.Contains([]byte{0x11})
+				return err
+			}},
+			{"Insert", func(st *StoredTree) error { return st.Insert([]byte{0x12}) }},
+			{"Delete", func(st *StoredTree) error {
+				_, err := st.Delete([]byte{0x11})
+				return err
+			}},
+			{"Walk", func(st *StoredTree) error { return st.Walk(func([]byte) error { return nil }) }},
+		}
+		for _, op := range ops {
+			st := NewStoredTree(store, root)
+			err := op.f(st)
+			if err == nil {
+				t.Errorf("%s: %s succeeded, want error", c.name, op.name)
+			}
+			if st.RootHash() != root {
+				t.Errorf("%s: failed %s changed root", c.name, op.name)
+			}
+		}
+	}
+}
+
+func TestSaveLoadTree(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	store := make(MemStore)
+	a, b := new(Tree), new(Tree)
+	for i := 0; i < 500; i++ {
+		item := make([]byte, 32)
+		rng.Read(item)
+		a.Insert(item)
+		if i%2 == 0 {
+			b.Insert(item) // nodes in common with a
+		}
+	}
+	storeA, storeB := NewPrefixStore(store, "a"), NewPrefixStore(store, "b")
+	for _, c := range []struct {
+		tree  *Tree
+		store NodeStore
+	}{{a, storeA}, {b, storeB}} {
+		err := c.tree.Save(c.store)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, c := range []struct {
+		name  string
+		tree  *Tree
+		store NodeStore
+	}{{"a", a, storeA}, {"b", b, storeB}} {
+		got, err := LoadTree(c.store, c.tree.RootHash())
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		if got.RootHash() != c.tree.RootHash() || got.Len() != c.tree.Len() {
+			t.Errorf("%s: loaded root %x with %d items, want %x with %d", c.name, got.RootHash(), got.Len(), c.tree.RootHash(), c.tree.Len())
+		}
+		item := []byte{1}
+		got.Insert(item)
+		c.tree.Insert(item)
+		if got.RootHash() != c.tree.RootHash() {
+			t.Errorf("%s: roots differ after insert into loaded tree", c.name)
+		}
+	}
+
+	// Each prefix keeps its trees apart, as does the unprefixed store.
+	_, err := LoadTree(storeB, a.RootHash())
+	if errors.Root(err) != ErrNodeNotFound {
+		t.Errorf("loading a with prefix b: got error %v, want %v", err, ErrNodeNotFound)
+	}
+	_, err = LoadTree(store, a.RootHash())
+	if errors.Root(err) != ErrNodeNotFound {
+		t.Errorf("loading a without a prefix: got error %v, want %v", err, ErrNodeNotFound)
+	}
+
+	empty, err := LoadTree(storeA, [32]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if empty.Len() != 0 || empty.RootHash() != [32]byte{} {
+		t.Errorf("zero root: got %d items, root %x; want an empty tree", empty.Len(), empty.RootHash())
+	}
+}
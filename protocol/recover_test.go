@@ -83,14 +83,18 @@ func TestRecoverSnapshotAdditionalBlocks(t *testing.T) {
 		testutil.FatalErr(t, err)
 	}
 
+	prev := b.BlockHeader
 	for i := 0; i < 5; i++ {
-		store.SaveBlock(context.Background(), &bc.Block{
-			BlockHeader: &bc.BlockHeader{
-				Height:        uint64(i + 2),
-				NextPredicate: &bc.Predicate{},
-				ContractsRoot: &bc.Hash{},
-			},
-		})
+		prevID := prev.Hash()
+		next := &bc.BlockHeader{
+			Height:          uint64(i + 2),
+			TimestampMs:     b.TimestampMs + uint64(i+1),
+			PreviousBlockId: &prevID,
+			NextPredicate:   &bc.Predicate{},
+			ContractsRoot:   &bc.Hash{},
+		}
+		store.SaveBlock(context.Background(), &bc.Block{BlockHeader: next})
+		prev = next
 	}
 
 	c2, err := NewChain(context.Background(), b, store, nil)
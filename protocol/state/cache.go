@@ -0,0 +1,116 @@
+package state
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/chain/txvm/protocol/bc"
+)
+
+// Cache holds snapshots by block height, evicting the least recently
+// used when it is full. It is safe for concurrent use.
+//
+// Snapshots are copied on the way in and out (see Copy), so callers
+// may freely update the ones they get from, or put in, a Cache.
+// Copying shares the snapshots' trees, so it takes time independent
+// of their size.
+type Cache struct {
+	mu      sync.Mutex
+	size    int
+	lru     *list.List // of *Snapshot, most recently used first
+	entries map[uint64]*list.Element
+	pinned  map[uint64]*Snapshot
+}
+
+// NewCache returns a Cache holding up to size snapshots, not counting
+// pinned ones.
+func NewCache(size int) *Cache {
+	return &Cache{
+		size:    size,
+		lru:     list.New(),
+		entries: make(map[uint64]*list.Element),
+		pinned:  make(map[uint64]*Snapshot),
+	}
+}
+
+// Get returns a copy of the snapshot with the given height, if
+// present, and marks it as recently used.
+func (c *Cache) Get(height uint64) (*Snapshot, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s, ok := c.pinned[height]; ok {
+		return cacheCopy(s), true
+	}
+	e, ok := c.entries[height]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return cacheCopy(e.Value.(*Snapshot)), true
+}
+
+// Put adds a copy of s to the cache, replacing any snapshot with the
+// same height. If the cache is full, the least recently used
+// snapshot is evicted.
+func (c *Cache) Put(s *Snapshot) {
+	s = cacheCopy(s)
+	height := s.Height()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.pinned[height]; ok {
+		c.pinned[height] = s
+		return
+	}
+	if e, ok := c.entries[height]; ok {
+		e.Value = s
+		c.lru.MoveToFront(e)
+		return
+	}
+	if c.size <= 0 {
+		return
+	}
+	if c.lru.Len() >= c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*Snapshot).Height())
+	}
+	c.entries[height] = c.lru.PushFront(s)
+}
+
+// Pin adds a copy of s to the cache permanently, such as the
+// snapshot at the initial block. Pinned snapshots are never evicted
+// and do not count against the cache's size.
+func (c *Cache) Pin(s *Snapshot) {
+	s = cacheCopy(s)
+	height := s.Height()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[height]; ok {
+		c.lru.Remove(e)
+		delete(c.entries, height)
+	}
+	c.pinned[height] = s
+}
+
+// Len returns the number of snapshots in the cache, including pinned
+// ones.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len() + len(c.pinned)
+}
+
+// cacheCopy is Copy, but also copies RefIDs and the header's nested
+// fields, so that no part of the result can be modified through s.
+func cacheCopy(s *Snapshot) *Snapshot {
+	c := Copy(s)
+	c.RefIDs = append([]bc.Hash(nil), s.RefIDs...)
+	if s.Header != nil {
+		c.Header = proto.Clone(s.Header).(*bc.BlockHeader)
+	}
+	return c
+}
@@ -0,0 +1,127 @@
+package state
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/chain/txvm/protocol/bc"
+)
+
+// chain returns snapshots at heights 1 through n, each adding an
+// output.
+func chain(t *testing.T, n int) []*Snapshot {
+	snap := empty(t)
+	snaps := []*Snapshot{Copy(snap)}
+	for height := uint64(2); height <= uint64(n); height++ {
+		block := &bc.Block{
+			BlockHeader: &bc.BlockHeader{
+				Height:          height,
+				TimestampMs:     height,
+				PreviousBlockId: prevID(snap),
+				NextPredicate:   &bc.Predicate{},
+			},
+			Transactions: []*bc.Tx{{Contracts: []bc.Contract{{Type: bc.OutputType, ID: bc.NewHash([32]byte{byte(height)})}}}},
+		}
+		err := snap.ApplyBlock(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		snaps = append(snaps, Copy(snap))
+	}
+	return snaps
+}
+
+func TestCacheEviction(t *testing.T) {
+	snaps := chain(t, 6)
+	c := NewCache(3)
+	for _, s := range snaps[:3] {
+		c.Put(s)
+	}
+	c.Get(1) // height 2 is now least recently used
+	c.Put(snaps[3])
+
+	for height, want := range map[uint64]bool{1: true, 2: false, 3: true, 4: true} {
+		if _, ok := c.Get(height); ok != want {
+			t.Errorf("Get(%d) found %t, want %t", height, ok, want)
+		}
+	}
+	if c.Len() != 3 {
+		t.Errorf("Len() = %d, want 3", c.Len())
+	}
+
+	c = NewCache(2)
+	c.Pin(snaps[0])
+	for _, s := range snaps[1:] {
+		c.Put(s)
+	}
+	for height, want := range map[uint64]bool{1: true, 2: false, 5: true, 6: true} {
+		if _, ok := c.Get(height); ok != want {
+			t.Errorf("with pinning: Get(%d) found %t, want %t", height, ok, want)
+		}
+	}
+	if c.Len() != 3 {
+		t.Errorf("with pinning: Len() = %d, want 3", c.Len())
+	}
+}
+
+func TestCacheCopies(t *testing.T) {
+	snaps := chain(t, 3)
+	want := cacheCopy(snaps[2])
+	c := NewCache(2)
+	c.Put(snaps[2])
+
+	// Modifying the snapshot put in the cache does not affect it.
+	snaps[2].ApplyTx(3, &bc.Tx{Contracts: []bc.Contract{{Type: bc.OutputType, ID: bc.NewHash([32]byte{100})}}})
+	snaps[2].Header.NextPredicate.Quorum = 7
+
+	got, ok := c.Get(3)
+	if !ok {
+		t.Fatal("snapshot not found")
+	}
+	if !got.Equal(want) || got.Header.NextPredicate.Quorum != 0 {
+		t.Fatalf("cached snapshot changed: %s", Diff(got, want))
+	}
+
+	// Nor does modifying one obtained from it.
+	got.ApplyTx(3, &bc.Tx{Contracts: []bc.Contract{{Type: bc.OutputType, ID: bc.NewHash([32]byte{101})}}})
+	got.Header.NextPredicate.Quorum = 8
+	got.RefIDs[0] = bc.Hash{}
+	got, _ = c.Get(3)
+	if !got.Equal(want) || got.Header.NextPredicate.Quorum != 0 {
+		t.Errorf("cached snapshot changed: %s", Diff(got, want))
+	}
+}
+
+func TestCacheConcurrent(t *testing.T) {
+	snaps := chain(t, 10)
+	c := NewCache(4)
+	c.Pin(snaps[0])
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				s := snaps[(w+i)%len(snaps)]
+				if i%2 == 0 {
+					c.Put(s)
+					continue
+				}
+				got, ok := c.Get(s.Height())
+				if ok {
+					if !got.Equal(s) {
+						t.Errorf("Get(%d) returned the wrong snapshot", s.Height())
+					}
+					got.Header.Height = 0
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	if _, ok := c.Get(1); !ok {
+		t.Error("pinned snapshot evicted")
+	}
+	if c.Len() != 5 {
+		t.Errorf("Len() = %d, want 5", c.Len())
+	}
+}
@@ -0,0 +1,163 @@
+package state
+
+import (
+	"sync"
+
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
+)
+
+// ApplyBlockConcurrent is like ApplyBlock, but validates the block's
+// transactions using up to workers goroutines.
+//
+// It runs in two phases. First, each transaction is checked in
+// parallel against the state as it is before any of the block's
+// transactions are applied: its time ranges and nonce block IDs are
+// checked, and its nonces and prevouts are looked up in the trees.
+// Then the transactions are applied to the trees in order, using
+// those lookups along with the block's changes so far, and making
+// the remaining checks in the same order as ApplyBlock.
+//
+// The result is the same as for ApplyBlock, including the error
+// returned, if any. If any transaction fails, s is left unchanged.
+//
+// Since the first phase runs on the worker goroutines, s's
+// ContractPolicy and NonceBlockIDValidator are called from several
+// goroutines at once, and not in the order in which ApplyBlock calls
+// them. If set, they must be safe for concurrent use.
+func (s *Snapshot) ApplyBlockConcurrent(block *bc.Block, workers int) error {
+	s.checkUnsealed()
+	if workers < 1 {
+		workers = 1
+	}
+
+	c, _ := s.pruneNonces(block.TimestampMs, true)
+
+	err := c.applyBlockHeader(block.BlockHeader)
+	if err != nil {
+		return errors.Wrap(err, "applying block header")
+	}
+
+	checks := make([]txCheck, len(block.Transactions))
+	var wg sync.WaitGroup
+	indexes := make(chan int)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				checks[i] = c.precheckTx(block.TimestampMs, block.Transactions[i])
+			}
+		}()
+	}
+	for i := range block.Transactions {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	var (
+		// Nonce commitments added by the block so far, with the
+		// index of the transaction adding each.
+		added = make(map[string]int)
+
+		// Whether each contract touched by the block so far is
+		// currently present. Contracts absent from this map have
+		// their pre-block presence.
+		present = make(map[bc.Hash]bool)
+	)
+	for i, tx := range block.Transactions {
+		if checks[i].err != nil {
+			return errors.Wrapf(checks[i].err, "applying block transaction %d", i)
+		}
+		err = c.commitTx(i, tx, checks[i], added, present)
+		if err != nil {
+			return errors.Wrapf(err, "applying block transaction %d", i)
+		}
+	}
+
+	*s = *c
+	s.dropStaleRefIDs()
+	s.notifyTxs(block.Transactions)
+	return nil
+}
+
+// txCheck is the result of checking a single transaction in the
+// parallel phase of ApplyBlockConcurrent.
+type txCheck struct {
+	err error
+
+	// nonces[k] tells whether tx.Nonces[k] was present in the nonce
+	// tree before the block.
+	nonces []bool
+
+	// prevouts[i] tells whether tx.Contracts[i], if an input, was
+	// present in the contracts tree before the block.
+	prevouts []bool
+}
+
+// precheckTx checks tx with checkTx and looks up its nonces and
+// prevouts. Conflicts found by the lookups are reported by
+// commitTx, so that they are found in the same order as by
+// ApplyBlock.
+func (s *Snapshot) precheckTx(blockTimeMS uint64, tx *bc.Tx) txCheck {
+	err := s.checkTx(blockTimeMS, tx)
+	if err != nil {
+		return txCheck{err: err}
+	}
+	nonces := make([]bool, len(tx.Nonces))
+	for k, n := range tx.Nonces {
+		nonces[k] = s.NonceTree.Contains(NonceCommitment(n.ID, n.ExpMS))
+	}
+	prevouts := make([]bool, len(tx.Contracts))
+	for i, con := range tx.Contracts {
+		if con.Type == bc.InputType {
+			prevouts[i] = s.ContractsTree.Contains(con.ID.Bytes())
+		}
+	}
+	return txCheck{nonces: nonces, prevouts: prevouts}
+}
+
+// commitTx is the sequential counterpart to precheckTx. It updates
+// s's trees in place like updateTrees, but consults the results of
+// precheckTx and the block's accumulated changes instead of
+// searching the trees. The block's transaction i is tx.
+func (s *Snapshot) commitTx(i int, tx *bc.Tx, check txCheck, added map[string]int, present map[bc.Hash]bool) error {
+	for k, n := range tx.Nonces {
+		nc := NonceCommitment(n.ID, n.ExpMS)
+		if j, ok := added[string(nc)]; ok {
+			return blockNonceConflict(n, j)
+		}
+		if check.nonces[k] {
+			return stateNonceConflict(n)
+		}
+		added[string(nc)] = i
+		s.NonceTree.Insert(nc)
+	}
+
+	for i, con := range tx.Contracts {
+		switch con.Type {
+		case bc.InputType:
+			ok, touched := present[con.ID]
+			if !touched {
+				ok = check.prevouts[i]
+			}
+			if !ok {
+				return errors.WithDetailf(ErrInvalidPrevout, "prevout %x", con.ID.Bytes())
+			}
+			present[con.ID] = false
+			s.ContractsTree.Delete(con.ID.Bytes())
+			s.forgetContractHeight(con.ID)
+
+		case bc.OutputType:
+			err := insertOutput(s.ContractsTree, con.ID)
+			if err != nil {
+				return err
+			}
+			present[con.ID] = true
+			s.recordContractHeight(con.ID)
+		}
+	}
+
+	return s.checkContractsLen()
+}
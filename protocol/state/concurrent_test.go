@@ -0,0 +1,292 @@
+package state
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
+)
+
+func TestApplyBlockConcurrent(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+
+	var valid int
+	for i := 0; i < 200; i++ {
+		snap, block := randomBlock(t, rng, 20, 50)
+
+		want := Copy(snap)
+		wantErr := want.ApplyBlock(block)
+		if wantErr == nil {
+			valid++
+		}
+
+		for _, workers := range []int{1, 4} {
+			got := Copy(snap)
+			gotErr := got.ApplyBlockConcurrent(block, workers)
+			if (gotErr == nil) != (wantErr == nil) {
+				t.Fatalf("case %d, %d workers: got error %v, want %v", i, workers, gotErr, wantErr)
+			}
+			if gotErr != nil {
+				if gotErr.Error() != wantErr.Error() || errors.Detail(gotErr) != errors.Detail(wantErr) {
+					t.Errorf("case %d, %d workers: got error %v (%s), want %v (%s)", i, workers, gotErr, errors.Detail(gotErr), wantErr, errors.Detail(wantErr))
+				}
+				if !got.Equal(snap) {
+					t.Errorf("case %d, %d workers: failed block modified snapshot: %s", i, workers, Diff(got, snap))
+				}
+				continue
+			}
+			if !got.Equal(want) {
+				t.Errorf("case %d, %d workers: %s", i, workers, Diff(got, want))
+			}
+		}
+	}
+	if valid == 0 {
+		t.Error("no valid blocks generated")
+	}
+}
+
+func BenchmarkApplyBlock(b *testing.B) {
+	snap, block := randomValidBlock(b, 5000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := Copy(snap).ApplyBlock(block)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkApplyBlockConcurrent(b *testing.B) {
+	snap, block := randomValidBlock(b, 5000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := Copy(snap).ApplyBlockConcurrent(block, 8)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// TestContainsAllocs checks that looking up a contract ID does not
+// allocate: the slice of the ID's bytes passed to the tree stays on
+// the stack.
+func TestContainsAllocs(t *testing.T) {
+	snap := Empty()
+	id := bc.NewHash([32]byte{1})
+	snap.ContractsTree.Insert(id.Bytes())
+	allocs := testing.AllocsPerRun(100, func() {
+		if !snap.ContainsContract(id) {
+			t.Fatal("contract not found")
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("ContainsContract made %.1f allocations, want 0", allocs)
+	}
+}
+
+// BenchmarkApplyBlockInputs applies a block spending 5000
+// preexisting contracts, isolating the cost of looking up and
+// removing inputs.
+func BenchmarkApplyBlockInputs(b *testing.B) {
+	const inputs = 5000
+	snap := Empty()
+	err := snap.ApplyBlock(&bc.Block{BlockHeader: &bc.BlockHeader{Height: 1, TimestampMs: 1, NextPredicate: &bc.Predicate{}}})
+	if err != nil {
+		b.Fatal(err)
+	}
+	block := &bc.Block{BlockHeader: &bc.BlockHeader{
+		Height:          2,
+		TimestampMs:     2,
+		PreviousBlockId: prevID(snap),
+		NextPredicate:   &bc.Predicate{},
+	}}
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < inputs; i++ {
+		var id [32]byte
+		rng.Read(id[:])
+		snap.ContractsTree.Insert(id[:])
+		block.Transactions = append(block.Transactions, &bc.Tx{
+			Contracts: []bc.Contract{{Type: bc.InputType, ID: bc.NewHash(id)}},
+		})
+	}
+	for _, concurrent := range []bool{false, true} {
+		name := "sequential"
+		if concurrent {
+			name = "concurrent"
+		}
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var err error
+				if concurrent {
+					err = Copy(snap).ApplyBlockConcurrent(block, 8)
+				} else {
+					err = Copy(snap).ApplyBlock(block)
+				}
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// randomBlock returns a snapshot with preexisting contracts and
+// nonces and a block of txs transactions to apply to it. Roughly one
+// in maxFaults transactions is invalid, either by itself or because
+// it conflicts with an earlier one.
+func randomBlock(tb testing.TB, rng *rand.Rand, txs, maxFaults int) (*Snapshot, *bc.Block) {
+	randHash := func() bc.Hash {
+		var b [32]byte
+		rng.Read(b[:])
+		return bc.NewHash(b)
+	}
+
+	snap := Empty()
+	err := snap.ApplyBlockHeader(&bc.BlockHeader{Height: 1, NextPredicate: &bc.Predicate{}})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	var live, spent []bc.Hash
+	var nonces []bc.Nonce
+	for i := 0; i < txs; i++ {
+		id := randHash()
+		snap.ContractsTree.Insert(id.Bytes())
+		live = append(live, id)
+		n := bc.Nonce{ID: randHash(), ExpMS: 1000}
+		snap.NonceTree.Insert(NonceCommitment(n.ID, n.ExpMS))
+		nonces = append(nonces, n)
+	}
+
+	block := &bc.Block{
+		BlockHeader: &bc.BlockHeader{
+			Height:          2,
+			TimestampMs:     100,
+			PreviousBlockId: prevID(snap),
+			NextPredicate:   &bc.Predicate{},
+		},
+	}
+	var future []bc.Hash
+	for i := 0; i < txs; i++ {
+		tx := new(bc.Tx)
+		// A faulty transaction may have several faults, and which
+		// one is reported depends on the order of checks.
+		for fault := maxFaults > 0 && rng.Intn(maxFaults) == 0; fault; fault = rng.Intn(2) == 0 {
+			switch rng.Intn(6) {
+			case 0: // spend a missing or already-spent contract
+				id := randHash()
+				if len(spent) > 0 && rng.Intn(2) == 0 {
+					id = spent[rng.Intn(len(spent))]
+				}
+				tx.Contracts = append(tx.Contracts, bc.Contract{Type: bc.InputType, ID: id})
+			case 1: // reuse a nonce
+				tx.Nonces = append(tx.Nonces, nonces[rng.Intn(len(nonces))])
+			case 2: // spend an output created later in the block
+				id := randHash()
+				tx.Contracts = append(tx.Contracts, bc.Contract{Type: bc.InputType, ID: id})
+				future = append(future, id)
+			case 3: // bad time range
+				tx.Timeranges = append(tx.Timeranges, bc.Timerange{MinMS: 200})
+			case 4: // bad nonce block ID
+				tx.Nonces = append(tx.Nonces, bc.Nonce{ID: randHash(), BlockID: randHash(), ExpMS: 1000})
+			case 5: // recreate an existing contract
+				tx.Contracts = append(tx.Contracts, bc.Contract{Type: bc.OutputType, ID: live[rng.Intn(len(live))]})
+			}
+		}
+		if len(live) > 0 && rng.Intn(2) == 0 {
+			j := rng.Intn(len(live))
+			tx.Contracts = append(tx.Contracts, bc.Contract{Type: bc.InputType, ID: live[j]})
+			spent = append(spent, live[j])
+			live = append(live[:j], live[j+1:]...)
+		}
+		for k := rng.Intn(3); k > 0; k-- {
+			id := randHash()
+			if len(future) > 0 && rng.Intn(2) == 0 {
+				id, future = future[0], future[1:]
+			}
+			tx.Contracts = append(tx.Contracts, bc.Contract{Type: bc.OutputType, ID: id})
+			live = append(live, id)
+		}
+		n := bc.Nonce{ID: randHash(), ExpMS: 1000}
+		tx.Nonces = append(tx.Nonces, n)
+		nonces = append(nonces, n)
+		block.Transactions = append(block.Transactions, tx)
+	}
+	return snap, block
+}
+
+func randomValidBlock(tb testing.TB, txs int) (*Snapshot, *bc.Block) {
+	snap, block := randomBlock(tb, rand.New(rand.NewSource(1)), txs, 0)
+	err := Copy(snap).ApplyBlock(block)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return snap, block
+}
+
+// BenchmarkApplyBlockNonces applies two consecutive blocks, each
+// adding 1000 nonces to a snapshot holding 100000 and pruning 1000.
+// Applying the second block includes bringing the nonce expiration
+// index up to date with the first.
+func BenchmarkApplyBlockNonces(b *testing.B) {
+	const existing, perBlock = 100000, 1000
+	rng := rand.New(rand.NewSource(1))
+	randHash := func() bc.Hash {
+		var h [32]byte
+		rng.Read(h[:])
+		return bc.NewHash(h)
+	}
+
+	snap := Empty()
+	err := snap.ApplyBlock(&bc.Block{BlockHeader: &bc.BlockHeader{Height: 1, TimestampMs: 1, NextPredicate: &bc.Predicate{}}})
+	if err != nil {
+		b.Fatal(err)
+	}
+	var ncs [][]byte
+	for i := 0; i < existing; i++ {
+		expMS := uint64(1000)
+		if i < 2*perBlock {
+			expMS = uint64(50 + 100*(i/perBlock)) // expire before one of the blocks
+		}
+		ncs = append(ncs, NonceCommitment(randHash(), expMS))
+	}
+	err = snap.NonceTree.InsertMany(ncs)
+	if err != nil {
+		b.Fatal(err)
+	}
+	snap.PruneNonces(1) // build the expiration index
+
+	var blocks []*bc.Block
+	prev := Copy(snap)
+	for height := uint64(2); height <= 3; height++ {
+		block := &bc.Block{BlockHeader: &bc.BlockHeader{
+			Height:          height,
+			TimestampMs:     100 * (height - 1),
+			PreviousBlockId: prevID(prev),
+			NextPredicate:   &bc.Predicate{},
+		}}
+		for i := 0; i < perBlock; i++ {
+			block.Transactions = append(block.Transactions, &bc.Tx{
+				Nonces: []bc.Nonce{{ID: randHash(), ExpMS: 1000}},
+			})
+		}
+		err := prev.ApplyBlock(block)
+		if err != nil {
+			b.Fatal(err)
+		}
+		blocks = append(blocks, block)
+	}
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		c := Copy(snap)
+		for _, block := range blocks {
+			err := c.ApplyBlock(block)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
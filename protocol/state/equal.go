@@ -0,0 +1,89 @@
+package state
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/chain/txvm/crypto/sha3pool"
+)
+
+// Equal reports whether s and other hold the same blockchain state:
+// the same contracts and nonce trees (compared by root hash), the
+// same latest header, the same initial block ID, and the same RefIDs.
+// A nil Header is not equal to a zero-valued one, but a nil RefIDs
+// slice is equal to an empty one.
+//
+// Snapshots with different Fingerprints are unequal, so Equal
+// compares those first.
+func (s *Snapshot) Equal(other *Snapshot) bool {
+	if s != nil && other != nil && s.Fingerprint() != other.Fingerprint() {
+		return false
+	}
+	return Diff(s, other) == ""
+}
+
+// Fingerprint returns a hash of the root hashes of s's trees, its
+// initial block ID, the height of its latest header, and the number
+// of its RefIDs. Equal snapshots have equal fingerprints, and
+// unequal ones almost always differ in one of these. Once the tree
+// roots are cached (see patricia.Tree.RootHash), it takes constant
+// time. It is not a commitment to the whole state and is not part
+// of the protocol; see Root for the state commitment.
+func (s *Snapshot) Fingerprint() [32]byte {
+	contractsRoot, noncesRoot := s.ContractsTree.RootHash(), s.NonceTree.RootHash()
+	b := make([]byte, 0, 128)
+	b = append(b, "snapshot fingerprint"...)
+	b = append(b, contractsRoot[:]...)
+	b = append(b, noncesRoot[:]...)
+	b = append(b, s.InitialBlockID.Bytes()...)
+	b = appendUint64(b, s.Height())
+	b = appendUint64(b, uint64(len(s.RefIDs)))
+
+	var fp [32]byte
+	sha3pool.Sum256(fp[:], b)
+	return fp
+}
+
+func appendUint64(b []byte, x uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], x)
+	return append(b, buf[:]...)
+}
+
+// Diff returns a human-readable description of the first difference
+// found between a and b, or the empty string if they are Equal.
+func Diff(a, b *Snapshot) string {
+	if a == nil || b == nil {
+		if a == nil && b == nil {
+			return ""
+		}
+		return fmt.Sprintf("snapshot is nil: a %t, b %t", a == nil, b == nil)
+	}
+	if aRoot, bRoot := a.ContractsTree.RootHash(), b.ContractsTree.RootHash(); aRoot != bRoot {
+		return fmt.Sprintf("contracts root: a %x, b %x", aRoot[:], bRoot[:])
+	}
+	if aRoot, bRoot := a.NonceTree.RootHash(), b.NonceTree.RootHash(); aRoot != bRoot {
+		return fmt.Sprintf("nonces root: a %x, b %x", aRoot[:], bRoot[:])
+	}
+	if a.Header == nil || b.Header == nil {
+		if a.Header != nil || b.Header != nil {
+			return fmt.Sprintf("header is nil: a %t, b %t", a.Header == nil, b.Header == nil)
+		}
+	} else if !proto.Equal(a.Header, b.Header) {
+		return fmt.Sprintf("header: a %v, b %v", a.Header, b.Header)
+	}
+	if a.InitialBlockID != b.InitialBlockID {
+		return fmt.Sprintf("initial block ID: a %x, b %x", a.InitialBlockID.Bytes(), b.InitialBlockID.Bytes())
+	}
+	if len(a.RefIDs) != len(b.RefIDs) {
+		return fmt.Sprintf("RefIDs length: a %d, b %d", len(a.RefIDs), len(b.RefIDs))
+	}
+	for i := range a.RefIDs {
+		if a.RefIDs[i] != b.RefIDs[i] {
+			return fmt.Sprintf("RefIDs[%d]: a %x, b %x", i, a.RefIDs[i].Bytes(), b.RefIDs[i].Bytes())
+		}
+	}
+	return ""
+}
@@ -0,0 +1,135 @@
+package state
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/chain/txvm/protocol/bc"
+)
+
+func TestEqual(t *testing.T) {
+	base := empty(t)
+	base.ContractsTree.Insert(bc.NewHash([32]byte{1}).Bytes())
+
+	cases := []struct {
+		name   string
+		modify func(*Snapshot)
+		want   string // substring of Diff; empty means equal
+	}{{
+		name:   "identical",
+		modify: func(*Snapshot) {},
+	}, {
+		name:   "contracts",
+		modify: func(s *Snapshot) { s.ContractsTree.Insert(bc.NewHash([32]byte{2}).Bytes()) },
+		want:   "contracts root",
+	}, {
+		name:   "nonces",
+		modify: func(s *Snapshot) { s.NonceTree.Insert(NonceCommitment(bc.Hash{}, 1)) },
+		want:   "nonces root",
+	}, {
+		name:   "nil header",
+		modify: func(s *Snapshot) { s.Header = nil },
+		want:   "header is nil",
+	}, {
+		name:   "header field",
+		modify: func(s *Snapshot) { s.Header.TimestampMs++ },
+		want:   "header",
+	}, {
+		name:   "initial block ID",
+		modify: func(s *Snapshot) { s.InitialBlockID = bc.NewHash([32]byte{3}) },
+		want:   "initial block ID",
+	}, {
+		name:   "RefIDs length",
+		modify: func(s *Snapshot) { s.RefIDs = append(s.RefIDs, bc.Hash{}) },
+		want:   "RefIDs length",
+	}, {
+		name:   "RefIDs element",
+		modify: func(s *Snapshot) { s.RefIDs = append([]bc.Hash{bc.NewHash([32]byte{4})}, s.RefIDs[1:]...) },
+		want:   "RefIDs[0]",
+	}}
+
+	for _, c := range cases {
+		other := Copy(base)
+		c.modify(other)
+		got := Diff(base, other)
+		if c.want == "" {
+			if got != "" || !base.Equal(other) {
+				t.Errorf("%s: got difference %q, want equal", c.name, got)
+			}
+			continue
+		}
+		if !strings.Contains(got, c.want) {
+			t.Errorf("%s: Diff = %q, want it to mention %q", c.name, got, c.want)
+		}
+		if base.Equal(other) {
+			t.Errorf("%s: got equal, want unequal", c.name)
+		}
+	}
+}
+
+func TestEqualEdgeCases(t *testing.T) {
+	a, b := Empty(), Empty()
+	a.Header = &bc.BlockHeader{}
+	if a.Equal(b) || b.Equal(a) {
+		t.Error("nil header equals zero-valued header")
+	}
+
+	a, b = Empty(), Empty()
+	a.RefIDs = []bc.Hash{}
+	if !a.Equal(b) {
+		t.Errorf("empty RefIDs not equal to nil RefIDs: %s", Diff(a, b))
+	}
+
+	var nilSnap *Snapshot
+	if !nilSnap.Equal(nil) {
+		t.Error("nil snapshots are not equal")
+	}
+	if nilSnap.Equal(Empty()) {
+		t.Error("nil snapshot equals empty snapshot")
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	base := empty(t)
+	base.ContractsTree.Insert(bc.NewHash([32]byte{1}).Bytes())
+	fp := base.Fingerprint()
+
+	if got := Copy(base).Fingerprint(); got != fp {
+		t.Errorf("Copy changed the fingerprint from %x to %x", fp, got)
+	}
+	if got := base.Clone().Fingerprint(); got != fp {
+		t.Errorf("Clone changed the fingerprint from %x to %x", fp, got)
+	}
+
+	cases := []struct {
+		name   string
+		modify func(*Snapshot)
+		same   bool // fingerprint unaffected, though the snapshots differ
+	}{
+		{"contracts", func(s *Snapshot) { s.ContractsTree.Insert(bc.NewHash([32]byte{2}).Bytes()) }, false},
+		{"nonces", func(s *Snapshot) { s.NonceTree.Insert(NonceCommitment(bc.Hash{}, 1)) }, false},
+		{"initial block ID", func(s *Snapshot) { s.InitialBlockID = bc.NewHash([32]byte{3}) }, false},
+		{"height", func(s *Snapshot) { s.Header.Height++ }, false},
+		{"RefIDs length", func(s *Snapshot) { s.RefIDs = append(s.RefIDs, bc.Hash{}) }, false},
+		{"header timestamp", func(s *Snapshot) { s.Header.TimestampMs++ }, true},
+		{"RefIDs element", func(s *Snapshot) { s.RefIDs = append([]bc.Hash{bc.NewHash([32]byte{4})}, s.RefIDs[1:]...) }, true},
+	}
+	seen := map[[32]byte]string{fp: "base"}
+	for _, c := range cases {
+		other := Copy(base)
+		c.modify(other)
+		got := other.Fingerprint()
+		if c.same {
+			if got != fp {
+				t.Errorf("%s: fingerprint changed", c.name)
+			}
+		} else if prev, ok := seen[got]; ok {
+			t.Errorf("%s: same fingerprint as %s", c.name, prev)
+		} else {
+			seen[got] = c.name
+		}
+		if base.Equal(other) {
+			t.Errorf("%s: got equal, want unequal", c.name)
+		}
+	}
+}
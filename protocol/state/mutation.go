@@ -0,0 +1,133 @@
+package state
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/chain/txvm/protocol/patricia"
+)
+
+// MutationKind identifies the type of a Mutation.
+type MutationKind byte
+
+// The kinds of Mutation.
+const (
+	NoncePruned MutationKind = iota + 1
+	NonceAdded
+	ContractSpent
+	ContractCreated
+)
+
+func (k MutationKind) String() string {
+	switch k {
+	case NoncePruned:
+		return "NoncePruned"
+	case NonceAdded:
+		return "NonceAdded"
+	case ContractSpent:
+		return "ContractSpent"
+	case ContractCreated:
+		return "ContractCreated"
+	}
+	return fmt.Sprintf("MutationKind(%d)", byte(k))
+}
+
+// Mutation is a single change to a snapshot's trees. ID is the nonce
+// or contract ID. ExpMS is the nonce's expiration time, and is zero
+// for contract mutations.
+type Mutation struct {
+	Kind  MutationKind
+	ID    bc.Hash
+	ExpMS uint64
+}
+
+// Bytes returns the canonical 41-byte encoding of m: its kind, ID,
+// and big-endian expiration time.
+func (m Mutation) Bytes() []byte {
+	b := make([]byte, 41)
+	b[0] = byte(m.Kind)
+	copy(b[1:33], m.ID.Bytes())
+	binary.BigEndian.PutUint64(b[33:], m.ExpMS)
+	return b
+}
+
+// ApplyBlockLogged is like ApplyBlock, but also returns the changes
+// applying block made to s's trees. Their order depends only on s
+// and block: first the nonces removed by PruneNonces, in order of
+// expiration time and then ID; then the changes made by each
+// transaction in turn, its nonces added followed by its contracts,
+// in the order they appear in the transaction.
+// If any phase fails, s is left unchanged.
+func (s *Snapshot) ApplyBlockLogged(block *bc.Block) ([]Mutation, error) {
+	s.checkUnsealed()
+	c, expired, err := s.applyBlock(block, nil, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var log []Mutation
+	for _, item := range expired {
+		log = append(log, Mutation{
+			Kind:  NoncePruned,
+			ID:    bc.HashFromBytes(item[8:]),
+			ExpMS: binary.BigEndian.Uint64(item),
+		})
+	}
+	for _, tx := range block.Transactions {
+		for _, n := range tx.Nonces {
+			log = append(log, Mutation{Kind: NonceAdded, ID: n.ID, ExpMS: n.ExpMS})
+		}
+		for _, con := range tx.Contracts {
+			switch con.Type {
+			case bc.InputType:
+				log = append(log, Mutation{Kind: ContractSpent, ID: con.ID})
+			case bc.OutputType:
+				log = append(log, Mutation{Kind: ContractCreated, ID: con.ID})
+			}
+		}
+	}
+
+	*s = *c
+	s.dropStaleRefIDs()
+	s.notifyTxs(block.Transactions)
+	return log, nil
+}
+
+// BlockDelta is the net effect of a block on a snapshot's trees, as
+// computed by SimulateBlock. Each list is in ascending order of the
+// trees' items (see patricia.Walk).
+type BlockDelta struct {
+	ContractsCreated, ContractsSpent []bc.Hash
+	NoncesAdded, NoncesPruned        []bc.Hash
+}
+
+// SimulateBlock returns the net changes that applying block would
+// make to s's trees, as ApplyBlock does, but leaves s unchanged.
+// Unlike the log of ApplyBlockLogged, the delta omits a contract
+// created and then spent within the block, since its net effect is
+// none.
+func (s *Snapshot) SimulateBlock(block *bc.Block) (BlockDelta, error) {
+	c, _, err := s.applyBlock(block, nil, false)
+	if err != nil {
+		return BlockDelta{}, err
+	}
+	var d BlockDelta
+	created, spent := patricia.Diff(s.ContractsTree, c.ContractsTree)
+	for _, item := range created {
+		d.ContractsCreated = append(d.ContractsCreated, bc.HashFromBytes(item))
+	}
+	for _, item := range spent {
+		d.ContractsSpent = append(d.ContractsSpent, bc.HashFromBytes(item))
+	}
+	added, pruned := patricia.Diff(s.NonceTree, c.NonceTree)
+	for _, nc := range added {
+		id, _ := idTime(nc)
+		d.NoncesAdded = append(d.NoncesAdded, id)
+	}
+	for _, nc := range pruned {
+		id, _ := idTime(nc)
+		d.NoncesPruned = append(d.NoncesPruned, id)
+	}
+	return d, nil
+}
@@ -0,0 +1,151 @@
+package state
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/chain/txvm/protocol/patricia"
+)
+
+func TestApplyBlockLogged(t *testing.T) {
+	h := func(b byte) bc.Hash { return bc.NewHash([32]byte{b}) }
+	snap := empty(t)
+	snap.ContractsTree.Insert(h(1).Bytes())
+	for _, n := range []bc.Nonce{{ID: h(20), ExpMS: 5}, {ID: h(10), ExpMS: 5}, {ID: h(30), ExpMS: 3}, {ID: h(40), ExpMS: 50}} {
+		snap.NonceTree.Insert(NonceCommitment(n.ID, n.ExpMS))
+	}
+
+	block := &bc.Block{
+		BlockHeader: &bc.BlockHeader{
+			Height:          2,
+			TimestampMs:     10,
+			PreviousBlockId: prevID(snap),
+			NextPredicate:   &bc.Predicate{},
+		},
+		Transactions: []*bc.Tx{
+			{
+				Contracts: []bc.Contract{{Type: bc.InputType, ID: h(1)}, {Type: bc.OutputType, ID: h(2)}},
+				Nonces:    []bc.Nonce{{ID: h(50), ExpMS: 60}},
+			},
+			{
+				Contracts: []bc.Contract{{Type: bc.InputType, ID: h(2)}, {Type: bc.OutputType, ID: h(3)}, {Type: bc.OutputType, ID: h(4)}},
+			},
+		},
+	}
+	want := []Mutation{
+		{NoncePruned, h(30), 3},
+		{NoncePruned, h(10), 5},
+		{NoncePruned, h(20), 5},
+		{NonceAdded, h(50), 60},
+		{ContractSpent, h(1), 0},
+		{ContractCreated, h(2), 0},
+		{ContractSpent, h(2), 0},
+		{ContractCreated, h(3), 0},
+		{ContractCreated, h(4), 0},
+	}
+
+	other := Copy(snap)
+	full := Copy(snap)
+	log, err := snap.ApplyBlockLogged(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(log, want) {
+		t.Errorf("got log %v, want %v", log, want)
+	}
+	err = full.ApplyBlock(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !snap.Equal(full) {
+		t.Errorf("ApplyBlockLogged and ApplyBlock differ: %s", Diff(snap, full))
+	}
+
+	// Another node applying the same block gets the same encoded log.
+	otherLog, err := other.ApplyBlockLogged(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(encodeLog(log), encodeLog(otherLog)) {
+		t.Error("logs from identical snapshots differ")
+	}
+
+	before := Copy(snap)
+	log, err = snap.ApplyBlockLogged(block)
+	if err == nil || log != nil {
+		t.Errorf("reapplying block: got %v, %v; want error", log, err)
+	}
+	if !snap.Equal(before) {
+		t.Errorf("failed ApplyBlockLogged changed the snapshot: %s", Diff(snap, before))
+	}
+}
+
+func encodeLog(log []Mutation) []byte {
+	var b []byte
+	for _, m := range log {
+		b = append(b, m.Bytes()...)
+	}
+	return b
+}
+
+func TestSimulateBlock(t *testing.T) {
+	base, block := randomValidBlock(t, 50)
+	before := Copy(base)
+	got, err := base.SimulateBlock(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !base.Equal(before) {
+		t.Errorf("SimulateBlock modified the snapshot: %s", Diff(base, before))
+	}
+
+	after := Copy(base)
+	err = after.ApplyBlock(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want BlockDelta
+	for _, id := range treeIDs(after.ContractsTree) {
+		if !base.ContainsContract(id) {
+			want.ContractsCreated = append(want.ContractsCreated, id)
+		}
+	}
+	for _, id := range treeIDs(base.ContractsTree) {
+		if !after.ContainsContract(id) {
+			want.ContractsSpent = append(want.ContractsSpent, id)
+		}
+	}
+	for _, nc := range treeItems(after.NonceTree) {
+		if !base.NonceTree.Contains(nc) {
+			id, _ := idTime(nc)
+			want.NoncesAdded = append(want.NoncesAdded, id)
+		}
+	}
+	for _, nc := range treeItems(base.NonceTree) {
+		if !after.NonceTree.Contains(nc) {
+			id, _ := idTime(nc)
+			want.NoncesPruned = append(want.NoncesPruned, id)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got delta %+v, want %+v", got, want)
+	}
+
+	bad := *block.BlockHeader
+	bad.Height++
+	_, err = base.SimulateBlock(&bc.Block{BlockHeader: &bad})
+	if errors.Root(err) != ErrBlockHeight {
+		t.Errorf("got error %v, want %v", err, ErrBlockHeight)
+	}
+}
+
+func treeIDs(tree *patricia.Tree) []bc.Hash {
+	var ids []bc.Hash
+	for _, item := range treeItems(tree) {
+		ids = append(ids, bc.HashFromBytes(item))
+	}
+	return ids
+}
@@ -0,0 +1,214 @@
+package state
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/chain/txvm/protocol/patricia"
+)
+
+// ErrBadPatch is returned by ApplyPatch for a patch that is malformed
+// or does not apply to the snapshot.
+var ErrBadPatch = errors.New("bad snapshot patch")
+
+// maxPatchHead bounds the encoded header and RefIDs of a patch, so
+// that a corrupt length cannot cause a huge allocation.
+const maxPatchHead = 64 << 20
+
+// StreamDiff writes to w a patch that transforms base into s when
+// applied to it with ApplyPatch, for bringing a peer that holds base
+// up to date. The patch holds the leaves of s's trees that base
+// lacks and the leaves of base's trees that s lacks (see
+// patricia.Diff), along with s's Header, InitialBlockID, and RefIDs.
+//
+// The base is a snapshot, not just a state root (see Root): a root
+// commits to base's trees but does not determine their leaves,
+// which the diff is made from, so a root alone could only identify
+// a base that the caller must still supply. Instead the patch
+// records base's tree roots, which ApplyPatch checks against the
+// snapshot it is applied to.
+//
+// The patch begins with the root hashes of base's contracts and
+// nonce trees, then those of s, each 32 bytes. Next is a RawSnapshot
+// holding only s's header, initial block ID, and ref IDs, preceded
+// by its length as a uvarint. Last is the number of changes, as a
+// uvarint, followed by each change as a Mutation (see
+// Mutation.Bytes): first the nonces and contracts to remove, then the
+// ones to add, each in ascending order.
+func (s *Snapshot) StreamDiff(base *Snapshot, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, tree := range []*patricia.Tree{base.ContractsTree, base.NonceTree, s.ContractsTree, s.NonceTree} {
+		root := tree.RootHash()
+		bw.Write(root[:])
+	}
+
+	rs := RawSnapshot{Header: s.Header}
+	if !s.InitialBlockID.IsZero() {
+		rs.InitialBlockId = &s.InitialBlockID
+	}
+	for i := range s.RefIDs {
+		rs.RefIds = append(rs.RefIds, &s.RefIDs[i])
+	}
+	head, err := proto.Marshal(&rs)
+	if err != nil {
+		return errors.Wrap(err, "marshaling patch header")
+	}
+	var buf [binary.MaxVarintLen64]byte
+	bw.Write(buf[:binary.PutUvarint(buf[:], uint64(len(head)))])
+	bw.Write(head)
+
+	contractsAdded, contractsRemoved := patricia.Diff(base.ContractsTree, s.ContractsTree)
+	noncesAdded, noncesRemoved := patricia.Diff(base.NonceTree, s.NonceTree)
+	var muts []Mutation
+	for _, nc := range noncesRemoved {
+		id, expMS := idTime(nc)
+		muts = append(muts, Mutation{Kind: NoncePruned, ID: id, ExpMS: expMS})
+	}
+	for _, item := range contractsRemoved {
+		muts = append(muts, Mutation{Kind: ContractSpent, ID: bc.HashFromBytes(item)})
+	}
+	for _, nc := range noncesAdded {
+		id, expMS := idTime(nc)
+		muts = append(muts, Mutation{Kind: NonceAdded, ID: id, ExpMS: expMS})
+	}
+	for _, item := range contractsAdded {
+		muts = append(muts, Mutation{Kind: ContractCreated, ID: bc.HashFromBytes(item)})
+	}
+	bw.Write(buf[:binary.PutUvarint(buf[:], uint64(len(muts)))])
+	for _, m := range muts {
+		bw.Write(m.Bytes())
+	}
+	return errors.Wrap(bw.Flush(), "writing patch")
+}
+
+// ApplyPatch reads a patch written by StreamDiff from r and applies
+// it to s, which must be the patch's base snapshot. Afterward s is
+// Equal to the snapshot the patch was made from; in particular, its
+// trees have the same root hashes, which ApplyPatch checks. Fields
+// not carried by the patch, such as MaxRefIDs, are kept, and
+// s.Observer is not notified.
+// If it fails, s is left unchanged.
+func (s *Snapshot) ApplyPatch(r io.Reader) error {
+	s.checkUnsealed()
+	br := bufio.NewReader(r)
+	var roots [4][32]byte
+	for i := range roots {
+		_, err := io.ReadFull(br, roots[i][:])
+		if err != nil {
+			return errors.Wrap(err, "reading patch roots")
+		}
+	}
+	if s.ContractsTree.RootHash() != roots[0] || s.NonceTree.RootHash() != roots[1] {
+		return errors.WithDetail(ErrBadPatch, "patch is for a different base snapshot")
+	}
+
+	size, err := binary.ReadUvarint(br)
+	if err != nil {
+		return errors.Wrap(err, "reading patch header length")
+	}
+	if size > maxPatchHead {
+		return errors.WithDetailf(ErrBadPatch, "header length %d", size)
+	}
+	head := make([]byte, size)
+	_, err = io.ReadFull(br, head)
+	if err != nil {
+		return errors.Wrap(err, "reading patch header")
+	}
+	var rs RawSnapshot
+	err = proto.Unmarshal(head, &rs)
+	if err != nil {
+		return errors.Wrap(err, "unmarshaling patch header")
+	}
+
+	c := s.deriveInPlace()
+	c.Header, c.InitialBlockID = rs.Header, bc.Hash{}
+	if rs.InitialBlockId != nil {
+		c.InitialBlockID = *rs.InitialBlockId
+	}
+	var refIDs []bc.Hash
+	for _, id := range rs.RefIds {
+		refIDs = append(refIDs, *id)
+	}
+	err = checkHead(c.Header, c.InitialBlockID, refIDs)
+	if err != nil {
+		return errors.Wrap(err, "checking patch header")
+	}
+	c.setRefIDs(refIDs)
+
+	count, err := binary.ReadUvarint(br)
+	if err != nil {
+		return errors.Wrap(err, "reading patch length")
+	}
+	var b [41]byte
+	for i := uint64(0); i < count; i++ {
+		_, err := io.ReadFull(br, b[:])
+		if err != nil {
+			return errors.Wrapf(err, "reading patch change %d", i)
+		}
+		m := Mutation{
+			Kind:  MutationKind(b[0]),
+			ID:    bc.HashFromBytes(b[1:33]),
+			ExpMS: binary.BigEndian.Uint64(b[33:]),
+		}
+		err = c.applyMutation(m)
+		if err != nil {
+			return errors.Wrapf(err, "applying patch change %d", i)
+		}
+	}
+	if _, err := br.ReadByte(); err != io.EOF {
+		return errors.WithDetail(ErrBadPatch, "trailing data")
+	}
+	if c.ContractsTree.RootHash() != roots[2] || c.NonceTree.RootHash() != roots[3] {
+		return errors.WithDetail(ErrBadPatch, "patched trees do not match the patch's roots")
+	}
+
+	*s = *c
+	s.dropStaleRefIDs()
+	return nil
+}
+
+// applyMutation makes the change m to s's trees, requiring an item
+// removed to be present and an item added to be absent.
+func (s *Snapshot) applyMutation(m Mutation) error {
+	var (
+		tree *patricia.Tree
+		item []byte
+	)
+	switch m.Kind {
+	case NoncePruned, NonceAdded:
+		tree, item = s.NonceTree, NonceCommitment(m.ID, m.ExpMS)
+	case ContractSpent, ContractCreated:
+		if m.ExpMS != 0 {
+			return errors.WithDetailf(ErrBadPatch, "contract %x has expiration time %d", m.ID.Bytes(), m.ExpMS)
+		}
+		tree, item = s.ContractsTree, m.ID.Bytes()
+	default:
+		return errors.WithDetailf(ErrBadPatch, "unknown change %s", m.Kind)
+	}
+
+	if m.Kind == ContractSpent || m.Kind == ContractCreated {
+		// A patch does not say at what height its contracts
+		// were created.
+		s.forgetContractHeight(m.ID)
+	}
+	switch m.Kind {
+	case NoncePruned, ContractSpent:
+		if !tree.Delete(item) {
+			return errors.WithDetailf(ErrBadPatch, "%s %x is not present", m.Kind, m.ID.Bytes())
+		}
+	default:
+		if tree.Contains(item) {
+			return errors.WithDetailf(ErrBadPatch, "%s %x is already present", m.Kind, m.ID.Bytes())
+		}
+		err := tree.Insert(item)
+		if err != nil {
+			return errors.Wrapf(err, "%s %x", m.Kind, m.ID.Bytes())
+		}
+	}
+	return nil
+}
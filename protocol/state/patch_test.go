@@ -0,0 +1,87 @@
+package state
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
+)
+
+func TestStreamDiff(t *testing.T) {
+	base, block := randomValidBlock(t, 50)
+	s := Copy(base)
+	err := s.ApplyBlock(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The next block prunes every nonce.
+	err = s.ApplyBlock(&bc.Block{
+		BlockHeader: &bc.BlockHeader{
+			Height:          3,
+			TimestampMs:     2000,
+			PreviousBlockId: prevID(s),
+			NextPredicate:   &bc.Predicate{},
+		},
+		Transactions: []*bc.Tx{{Nonces: []bc.Nonce{{ID: bc.NewHash([32]byte{1}), ExpMS: 3000}}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var patch bytes.Buffer
+	err = s.StreamDiff(base, &patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := Copy(base)
+	err = got.ApplyPatch(bytes.NewReader(patch.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equal(s) {
+		t.Errorf("patched snapshot: %s", Diff(got, s))
+	}
+	// The patched snapshot's nonce index is still usable.
+	want := Copy(s)
+	if got.PruneNonces(5000) != want.PruneNonces(5000) || !got.Equal(want) {
+		t.Errorf("pruning the patched snapshot: %s", Diff(got, want))
+	}
+
+	var empty bytes.Buffer
+	err = s.StreamDiff(s, &empty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	same := Copy(s)
+	err = same.ApplyPatch(&empty)
+	if err != nil || !same.Equal(s) {
+		t.Errorf("patch from a snapshot to itself: error %v, %s", err, Diff(same, s))
+	}
+
+	b := patch.Bytes()
+	corrupt := append([]byte(nil), b...)
+	corrupt[len(corrupt)-1] ^= 1 // the last change's expiration time or ID
+	bad := []struct {
+		name  string
+		base  *Snapshot
+		patch []byte
+	}{
+		{"wrong base", s, b},
+		{"truncated", base, b[:len(b)-1]},
+		{"trailing data", base, append(append([]byte(nil), b...), 0)},
+		{"corrupt change", base, corrupt},
+	}
+	for _, c := range bad {
+		before := Copy(c.base)
+		err := c.base.ApplyPatch(bytes.NewReader(c.patch))
+		if err == nil {
+			t.Errorf("%s: expected error", c.name)
+		} else if c.name != "truncated" && errors.Root(err) != ErrBadPatch {
+			t.Errorf("%s: got error %v, want %v", c.name, err, ErrBadPatch)
+		}
+		if !c.base.Equal(before) {
+			t.Errorf("%s: failed patch modified the snapshot: %s", c.name, Diff(c.base, before))
+		}
+	}
+}
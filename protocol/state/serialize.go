@@ -1,38 +1,87 @@
 package state
 
 import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+
 	"github.com/golang/protobuf/proto"
 
 	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
 	"github.com/chain/txvm/protocol/patricia"
 )
 
+// FromBytes decodes a snapshot produced by Bytes.
+// See the FromBytes method.
+func FromBytes(b []byte) (*Snapshot, error) {
+	s := new(Snapshot)
+	err := s.FromBytes(b)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// FromBytes decodes a snapshot produced by Bytes into s, replacing
+// its contents; a header or initial block ID absent from the
+// encoding is absent from s afterward, and so are s's reservations
+// and any partially applied block. It is an error for the encoded
+// trees to contain anything but contract IDs and nonce commitments,
+// or for the header, initial block ID, and ref IDs to be inconsistent
+// (see New). If it fails, s is left unchanged.
 func (s *Snapshot) FromBytes(b []byte) error {
+	s.checkUnsealed()
 	var rs RawSnapshot
 	err := proto.Unmarshal(b, &rs)
 	if err != nil {
 		return errors.Wrap(err, "unmarshaling state snapshot proto")
 	}
-	s.ContractsTree, err = treeFromBytes(rs.ContractNodes)
+	err = checkItems(rs.ContractNodes, rs.NonceNodes)
+	if err != nil {
+		return errors.Wrap(err, "checking state snapshot trees")
+	}
+	contracts, err := treeFromBytes(rs.ContractNodes)
 	if err != nil {
 		return errors.Wrap(err, "reconstructing contracts tree")
 	}
-	s.NonceTree, err = treeFromBytes(rs.NonceNodes)
+	nonces, err := treeFromBytes(rs.NonceNodes)
 	if err != nil {
 		return errors.Wrap(err, "reconstructing nonce tree")
 	}
-	if rs.Header != nil {
-		s.Header = rs.Header
-	}
+	var initialBlockID bc.Hash
 	if rs.InitialBlockId != nil {
-		s.InitialBlockID = *rs.InitialBlockId
+		initialBlockID = *rs.InitialBlockId
 	}
+	var refIDs []bc.Hash
 	for _, id := range rs.RefIds {
-		s.RefIDs = append(s.RefIDs, *id)
+		refIDs = append(refIDs, *id)
 	}
+	err = checkHead(rs.Header, initialBlockID, refIDs)
+	if err != nil {
+		return errors.Wrap(err, "checking state snapshot header")
+	}
+
+	s.ContractsTree, s.NonceTree = contracts, nonces
+	s.Header, s.InitialBlockID = rs.Header, initialBlockID
+	s.setRefIDs(refIDs)
+	s.dropStaleRefIDs()
+	s.contractHeights = nil
+	s.reserved = nil
+	s.partial, s.partialNext = false, 0
 	return nil
 }
 
+// Bytes encodes s as a RawSnapshot protobuf. Both trees are encoded
+// as their complete lists of leaves, so decoding with FromBytes
+// reproduces identical tree roots.
+//
+// The encoding is deterministic: it depends only on the contents of
+// s, not on the order in which they were added. The leaves are listed
+// in ascending order (see patricia.Walk), RefIDs keeps its own order,
+// and RawSnapshot has no map fields, which are the one part of a
+// protobuf encoding whose order is unspecified. The unexported
+// lookup indexes are not encoded.
 func (s *Snapshot) Bytes() ([]byte, error) {
 	rs := RawSnapshot{
 		ContractNodes: treeToBytes(s.ContractsTree),
@@ -44,10 +93,115 @@ func (s *Snapshot) Bytes() ([]byte, error) {
 	if !s.InitialBlockID.IsZero() {
 		rs.InitialBlockId = &s.InitialBlockID
 	}
+	for i := range s.RefIDs {
+		rs.RefIds = append(rs.RefIds, &s.RefIDs[i])
+	}
 	b, err := proto.Marshal(&rs)
 	return b, errors.Wrap(err, "marshaling state snapshot")
 }
 
+// MarshalJSON encodes a summary of s, not its full contents: the
+// height and timestamp of its latest header (zero if there is none),
+// its initial block ID, the sizes of its trees, and their root
+// hashes. Hashes are hex-encoded.
+func (s *Snapshot) MarshalJSON() ([]byte, error) {
+	summary := struct {
+		Height         uint64  `json:"height"`
+		TimestampMS    uint64  `json:"timestampMS"`
+		InitialBlockID bc.Hash `json:"initialBlockID"`
+		ContractCount  int     `json:"contractCount"`
+		NonceCount     int     `json:"nonceCount"`
+		ContractsRoot  bc.Hash `json:"contractsRoot"`
+		NoncesRoot     bc.Hash `json:"noncesRoot"`
+	}{
+		Height:        s.Height(),
+		TimestampMS:   s.TimestampMS(),
+		ContractCount: s.ContractCount(),
+		NonceCount:    s.NonceCount(),
+	}
+	if s != nil {
+		summary.InitialBlockID = s.InitialBlockID
+	}
+	if s != nil && s.ContractsTree != nil {
+		summary.ContractsRoot = bc.NewHash(s.ContractsTree.RootHash())
+	}
+	if s != nil && s.NonceTree != nil {
+		summary.NoncesRoot = bc.NewHash(s.NonceTree.RootHash())
+	}
+	return json.Marshal(summary)
+}
+
+// ExportContracts writes to w the ID of each contract in s for which
+// match returns true, or of every contract if match is nil, and
+// returns the number written. The IDs are written in ascending order,
+// each preceded by its length as a uvarint, with one call to w.Write
+// per ID.
+func (s *Snapshot) ExportContracts(match func(id bc.Hash) bool, w io.Writer) (int, error) {
+	var (
+		n   int
+		buf [binary.MaxVarintLen64 + 32]byte
+	)
+	err := s.EachContract(func(id bc.Hash) error {
+		if match != nil && !match(id) {
+			return nil
+		}
+		k := binary.PutUvarint(buf[:], 32)
+		k += copy(buf[k:], id.Bytes())
+		_, err := w.Write(buf[:k])
+		if err != nil {
+			return errors.Wrapf(err, "writing contract %x", id.Bytes())
+		}
+		n++
+		return nil
+	})
+	return n, err
+}
+
+// Prefixes keeping the nodes of a snapshot's two trees apart in a
+// shared NodeStore. See SaveTrees.
+const (
+	contractsStorePrefix = "state contracts"
+	noncesStorePrefix    = "state nonces"
+)
+
+// SaveTrees writes the nodes of s's contracts and nonce trees to
+// store, so that LoadTrees can restore them from their root hashes.
+// Both trees share the one store, each under its own key prefix (see
+// patricia.NewPrefixStore). The rest of s, such as its header, is not
+// saved; use Bytes for a complete encoding.
+func (s *Snapshot) SaveTrees(store patricia.NodeStore) error {
+	err := s.ContractsTree.Save(patricia.NewPrefixStore(store, contractsStorePrefix))
+	if err != nil {
+		return errors.Wrap(err, "saving contracts tree")
+	}
+	err = s.NonceTree.Save(patricia.NewPrefixStore(store, noncesStorePrefix))
+	return errors.Wrap(err, "saving nonce tree")
+}
+
+// LoadTrees replaces s's contracts and nonce trees with the ones
+// with the given root hashes, as saved to store by SaveTrees, and
+// checks that their items are well formed, as FromBytes does.
+// If it fails, s is left unchanged.
+func (s *Snapshot) LoadTrees(store patricia.NodeStore, contractsRoot, noncesRoot bc.Hash) error {
+	s.checkUnsealed()
+	contracts, err := patricia.LoadTree(patricia.NewPrefixStore(store, contractsStorePrefix), contractsRoot.Byte32())
+	if err != nil {
+		return errors.Wrap(err, "loading contracts tree")
+	}
+	nonces, err := patricia.LoadTree(patricia.NewPrefixStore(store, noncesStorePrefix), noncesRoot.Byte32())
+	if err != nil {
+		return errors.Wrap(err, "loading nonce tree")
+	}
+	err = checkItems(treeToBytes(contracts), treeToBytes(nonces))
+	if err != nil {
+		return err
+	}
+	s.ContractsTree, s.NonceTree = contracts, nonces
+	s.nonceExp, s.nonceBase = nil, nil
+	s.contractHeights = nil
+	return nil
+}
+
 func treeToBytes(tree *patricia.Tree) [][]byte {
 	var nodes [][]byte
 	patricia.Walk(tree, func(item []byte) error {
@@ -59,11 +213,9 @@ func treeToBytes(tree *patricia.Tree) [][]byte {
 
 func treeFromBytes(keys [][]byte) (*patricia.Tree, error) {
 	tree := new(patricia.Tree)
-	for _, k := range keys {
-		err := tree.Insert(k)
-		if err != nil {
-			return nil, err
-		}
+	err := tree.InsertMany(keys)
+	if err != nil {
+		return nil, err
 	}
 	return tree, nil
 }
@@ -0,0 +1,399 @@
+package state
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/chain/txvm/protocol/patricia"
+)
+
+func TestSnapshotBytesRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	randHash := func() bc.Hash {
+		var b [32]byte
+		rng.Read(b[:])
+		return bc.NewHash(b)
+	}
+
+	snap := empty(t)
+	var live []bc.Hash
+	timestampMS := uint64(1)
+	// reused is decoded into at each height, so that it holds the
+	// previous height's state first.
+	reused := new(Snapshot)
+	for height := uint64(2); height < 20; height++ {
+		timestampMS += uint64(rng.Intn(10))
+		block := &bc.Block{
+			BlockHeader: &bc.BlockHeader{
+				Height:          height,
+				TimestampMs:     timestampMS,
+				PreviousBlockId: prevID(snap),
+				NextPredicate:   &bc.Predicate{},
+			},
+		}
+		for i := rng.Intn(5); i > 0; i-- {
+			tx := new(bc.Tx)
+			if len(live) > 0 && rng.Intn(2) == 0 {
+				j := rng.Intn(len(live))
+				tx.Contracts = append(tx.Contracts, bc.Contract{Type: bc.InputType, ID: live[j]})
+				live = append(live[:j], live[j+1:]...)
+			}
+			for k := rng.Intn(3); k > 0; k-- {
+				id := randHash()
+				tx.Contracts = append(tx.Contracts, bc.Contract{Type: bc.OutputType, ID: id})
+				live = append(live, id)
+			}
+			if rng.Intn(2) == 0 {
+				tx.Nonces = append(tx.Nonces, bc.Nonce{ID: randHash(), ExpMS: timestampMS + uint64(rng.Intn(50))})
+			}
+			block.Transactions = append(block.Transactions, tx)
+		}
+		err := snap.ApplyBlock(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := snap.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := FromBytes(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.Equal(snap) {
+			t.Fatalf("height %d: round trip mismatch: %s", height, Diff(got, snap))
+		}
+		// Decoding also drops reused's reservations and its
+		// partially applied block, which belong to its old
+		// contents.
+		for _, id := range live {
+			reused.Reserve(id)
+		}
+		reused.partial, reused.partialNext = true, 1
+		err = reused.FromBytes(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reused.Equal(snap) {
+			t.Fatalf("height %d: round trip into a non-empty snapshot mismatch: %s", height, Diff(reused, snap))
+		}
+		if reused.reserved != nil || reused.partial || reused.partialNext != 0 {
+			t.Fatalf("height %d: decoded snapshot kept reservations %v or partial block (%t, %d)", height, reused.reserved, reused.partial, reused.partialNext)
+		}
+	}
+
+	// Decoding a snapshot without a header or initial block ID
+	// removes those of the snapshot decoded into.
+	b, err := Empty().Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = reused.FromBytes(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reused.Equal(Empty()) {
+		t.Errorf("round trip of an empty snapshot into a non-empty one: %s", Diff(reused, Empty()))
+	}
+}
+
+// TestSnapshotBytesDeterministic checks that Bytes depends only on
+// a snapshot's contents, not on how it was built.
+func TestSnapshotBytesDeterministic(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	snap, block := randomValidBlock(t, 200)
+	err := snap.ApplyBlockConcurrent(block, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := snap.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rebuild the same snapshot, inserting the tree items in a
+	// different order and adding and removing extra items along the
+	// way.
+	rebuilt := Empty()
+	rebuilt.Header = proto.Clone(snap.Header).(*bc.BlockHeader)
+	rebuilt.InitialBlockID = snap.InitialBlockID
+	rebuilt.RefIDs = append([]bc.Hash(nil), snap.RefIDs...)
+	for _, pair := range []struct{ from, to *patricia.Tree }{
+		{snap.ContractsTree, rebuilt.ContractsTree},
+		{snap.NonceTree, rebuilt.NonceTree},
+	} {
+		items := treeToBytes(pair.from)
+		rng.Shuffle(len(items), func(i, j int) { items[i], items[j] = items[j], items[i] })
+		for i, item := range items {
+			extra := make([]byte, len(item))
+			rng.Read(extra)
+			pair.to.Insert(extra)
+			pair.to.Insert(item)
+			if i%2 == 0 {
+				pair.to.Delete(extra)
+			}
+		}
+		patricia.Walk(pair.to, func(item []byte) error {
+			if !pair.from.Contains(item) {
+				pair.to.Delete(item)
+			}
+			return nil
+		})
+	}
+
+	decoded := new(Snapshot)
+	err = decoded.FromBytes(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name string
+		snap *Snapshot
+	}{
+		{"rebuilt", rebuilt},
+		{"decoded", decoded},
+		{"cloned", snap.Clone()},
+	} {
+		got, err := c.snap.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s snapshot: Bytes differ (%s)", c.name, Diff(c.snap, snap))
+		}
+	}
+}
+
+func TestSaveLoadTrees(t *testing.T) {
+	snap, block := randomValidBlock(t, 100)
+	err := snap.ApplyBlock(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contractsRoot := bc.NewHash(snap.ContractsTree.RootHash())
+	noncesRoot := bc.NewHash(snap.NonceTree.RootHash())
+
+	store := make(patricia.MemStore)
+	err = snap.SaveTrees(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bc.NewHash(snap.ContractsTree.RootHash()) != contractsRoot || bc.NewHash(snap.NonceTree.RootHash()) != noncesRoot {
+		t.Error("saving changed the root hashes")
+	}
+
+	got := Copy(snap)
+	got.ContractsTree, got.NonceTree = new(patricia.Tree), new(patricia.Tree)
+	err = got.LoadTrees(store, contractsRoot, noncesRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equal(snap) {
+		t.Errorf("reloaded snapshot: %s", Diff(got, snap))
+	}
+	if got.ContractCount() != snap.ContractCount() || got.NonceCount() != snap.NonceCount() {
+		t.Errorf("reloaded %d contracts and %d nonces, want %d and %d", got.ContractCount(), got.NonceCount(), snap.ContractCount(), snap.NonceCount())
+	}
+
+	// The trees are kept apart in the store, so neither root can be
+	// loaded as the other tree.
+	before := Copy(got)
+	err = got.LoadTrees(store, noncesRoot, contractsRoot)
+	if errors.Root(err) != patricia.ErrNodeNotFound {
+		t.Errorf("swapped roots: got error %v, want %v", err, patricia.ErrNodeNotFound)
+	}
+	if !got.Equal(before) {
+		t.Errorf("failed load modified the snapshot: %s", Diff(got, before))
+	}
+}
+
+func TestFromBytesMalformed(t *testing.T) {
+	cases := []struct {
+		name      string
+		contracts [][]byte
+		nonces    [][]byte
+	}{
+		{"short contract", [][]byte{make([]byte, 31)}, nil},
+		{"long contract", [][]byte{make([]byte, 33)}, nil},
+		{"empty contract", [][]byte{{}}, nil},
+		{"short nonce", nil, [][]byte{make([]byte, 39)}},
+	}
+	for _, c := range cases {
+		b, err := proto.Marshal(&RawSnapshot{ContractNodes: c.contracts, NonceNodes: c.nonces})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = new(Snapshot).FromBytes(b)
+		if err == nil {
+			t.Errorf("%s: expected error", c.name)
+		}
+	}
+
+	// The header, initial block ID, and ref IDs are checked as by
+	// New, and a failed decoding leaves the snapshot unchanged.
+	snap := empty(t)
+	want := Copy(snap)
+	id := bc.NewHash([32]byte{1})
+	heads := []struct {
+		name string
+		rs   *RawSnapshot
+	}{
+		{"initial block ID without a header", &RawSnapshot{InitialBlockId: &id}},
+		{"header without an initial block ID", &RawSnapshot{Header: snap.Header}},
+		{"ref IDs without a header", &RawSnapshot{RefIds: []*bc.Hash{&id}}},
+		{"last ref ID not the header's", &RawSnapshot{Header: snap.Header, InitialBlockId: &snap.InitialBlockID, RefIds: []*bc.Hash{&id}}},
+		{"more ref IDs than blocks", &RawSnapshot{Header: snap.Header, InitialBlockId: &snap.InitialBlockID, RefIds: []*bc.Hash{&id, &snap.RefIDs[0]}}},
+	}
+	for _, c := range heads {
+		b, err := proto.Marshal(c.rs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = snap.FromBytes(b)
+		if errors.Root(err) != ErrInvalidSnapshot {
+			t.Errorf("%s: got error %v, want %v", c.name, err, ErrInvalidSnapshot)
+		}
+		if !snap.Equal(want) {
+			t.Errorf("%s: failed FromBytes changed the snapshot: %s", c.name, Diff(snap, want))
+		}
+	}
+
+	// Trees set directly are checked as they are walked.
+	snap = Empty()
+	snap.ContractsTree.Insert(make([]byte, 31))
+	err := snap.EachContract(func(bc.Hash) error { return nil })
+	if err == nil {
+		t.Error("EachContract with a short contract ID: expected error")
+	}
+}
+
+func TestExportContracts(t *testing.T) {
+	snap := Empty()
+	var want []bc.Hash
+	for i := 0; i < 20; i++ {
+		id := bc.NewHash([32]byte{byte(i), 1})
+		snap.ContractsTree.Insert(id.Bytes())
+		if i%3 == 0 {
+			want = append(want, id)
+		}
+	}
+	match := func(id bc.Hash) bool { return id.Bytes()[0]%3 == 0 }
+
+	decode := func(b []byte) []bc.Hash {
+		var ids []bc.Hash
+		r := bytes.NewReader(b)
+		for r.Len() > 0 {
+			size, err := binary.ReadUvarint(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			item := make([]byte, size)
+			_, err = io.ReadFull(r, item)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, bc.HashFromBytes(item))
+		}
+		return ids
+	}
+
+	var buf bytes.Buffer
+	n, err := snap.ExportContracts(match, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := decode(buf.Bytes())
+	if n != len(want) || !reflect.DeepEqual(got, want) {
+		t.Errorf("got %d IDs %x, want %x", n, got, want)
+	}
+
+	buf.Reset()
+	n, err = snap.ExportContracts(nil, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := decode(buf.Bytes()); n != 20 || len(got) != 20 {
+		t.Errorf("nil predicate: exported %d IDs and decoded %d, want 20", n, len(got))
+	}
+
+	// Write errors are returned, with the count written before them.
+	n, err = snap.ExportContracts(nil, &limitWriter{n: 5})
+	if errors.Root(err) != io.ErrShortWrite || n != 5 {
+		t.Errorf("failing writer: got %d, %v; want 5, %v", n, errors.Root(err), io.ErrShortWrite)
+	}
+}
+
+// limitWriter accepts n writes and fails the rest.
+type limitWriter struct{ n int }
+
+func (w *limitWriter) Write(p []byte) (int, error) {
+	if w.n == 0 {
+		return 0, io.ErrShortWrite
+	}
+	w.n--
+	return len(p), nil
+}
+
+func TestSnapshotMarshalJSON(t *testing.T) {
+	zero := "0000000000000000000000000000000000000000000000000000000000000000"
+	b, err := json.Marshal(Empty())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"height":0,"timestampMS":0,"initialBlockID":"` + zero + `","contractCount":0,"nonceCount":0,"contractsRoot":"` + zero + `","noncesRoot":"` + zero + `"}`
+	if string(b) != want {
+		t.Errorf("empty snapshot: got %s, want %s", b, want)
+	}
+
+	snap := empty(t)
+	err = snap.ApplyTx(1, &bc.Tx{
+		Contracts: []bc.Contract{{Type: bc.OutputType, ID: bc.NewHash([32]byte{1})}},
+		Nonces:    []bc.Nonce{{ID: bc.NewHash([32]byte{2}), ExpMS: 10}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = json.Marshal(snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]interface{}
+	err = json.Unmarshal(b, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contractsRoot, _ := bc.NewHash(snap.ContractsTree.RootHash()).MarshalText()
+	noncesRoot, _ := bc.NewHash(snap.NonceTree.RootHash()).MarshalText()
+	initialID, _ := snap.InitialBlockID.MarshalText()
+	wantFields := map[string]interface{}{
+		"height":         1.0,
+		"timestampMS":    1.0,
+		"initialBlockID": string(initialID),
+		"contractCount":  1.0,
+		"nonceCount":     1.0,
+		"contractsRoot":  string(contractsRoot),
+		"noncesRoot":     string(noncesRoot),
+	}
+	if !reflect.DeepEqual(got, wantFields) {
+		t.Errorf("got %v, want %v", got, wantFields)
+	}
+
+	copied, err := json.Marshal(Copy(snap))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(copied) != string(b) {
+		t.Errorf("copy: got %s, want %s", copied, b)
+	}
+}
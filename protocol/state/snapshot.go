@@ -5,60 +5,414 @@ blockchain's state.
 package state
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
 	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/protobuf/proto"
 
 	"github.com/chain/txvm/errors"
 	"github.com/chain/txvm/protocol/bc"
 	"github.com/chain/txvm/protocol/patricia"
 )
 
+// Errors returned when applying blocks and transactions. They are
+// wrapped with details of the failure; use errors.Root, or the
+// standard library's errors.Is, to compare against them.
+var (
+	// ErrBadStateRoot is returned when a snapshot's state root
+	// disagrees with the one committed to by a block header.
+	ErrBadStateRoot = errors.New("invalid state root")
+
+	ErrBlockHeight      = errors.New("invalid block height")
+	ErrBlockTimestamp   = errors.New("block timestamp before previous block")
+	ErrPrevBlockID      = errors.New("previous block ID does not match state")
+	ErrEmptyState       = errors.New("cannot apply a transaction to an empty state")
+	ErrTimeRange        = errors.New("block timestamp outside transaction time range")
+	ErrNonceBlockID     = errors.New("nonce must refer to the initial block, a recent block, or have a zero block ID")
+	ErrNonceExpiration  = errors.New("nonce expiration time out of range")
+	ErrNonceExpired     = errors.New("nonce already expired")
+	ErrConflictingNonce = errors.New("conflicting nonce")
+	ErrInvalidPrevout   = errors.New("invalid prevout")
+	ErrDuplicateOutput  = errors.New("duplicate output")
+	ErrTooManyContracts = errors.New("contract limit exceeded")
+
+	// ErrInvalidSnapshot is returned by New and Verify for
+	// inconsistent snapshot contents.
+	ErrInvalidSnapshot = errors.New("invalid snapshot")
+
+	// ErrPartialBlock is returned for a call of ApplyBlockPartial
+	// that does not continue from where the last one left off, and
+	// for applying another block before the partially applied one
+	// is finished.
+	ErrPartialBlock = errors.New("invalid partial block application")
+
+	// ErrSealed is the value of the panic caused by modifying a
+	// sealed snapshot in place. See Snapshot.Seal.
+	ErrSealed = errors.New("snapshot is sealed")
+)
+
 // Snapshot contains a blockchain's state.
 //
-// TODO: consider making type Snapshot truly immutable.  We already
-// handle it that way in many places (with explicit calls to Copy to
-// get the right behavior).  PruneNonces and the Apply functions would
-// have to produce new Snapshots rather than updating Snapshots in
-// place.
+// The Immutable variants of PruneNonces, ApplyBlock, and ApplyTx
+// produce new Snapshots and never modify their receivers. The
+// remaining methods update the Snapshot in place and are implemented
+// in terms of the Immutable ones.
 type Snapshot struct {
 	ContractsTree *patricia.Tree
 	NonceTree     *patricia.Tree
 
 	Header         *bc.BlockHeader
 	InitialBlockID bc.Hash
-	RefIDs         []bc.Hash
+
+	// RefIDs holds the IDs of recent blocks, oldest first. It is
+	// indexed internally for nonce validation, so it should be
+	// updated only by ApplyBlockHeader. Copies of a Snapshot share
+	// its backing array (see Copy), so its elements must never be
+	// modified in place. For the same reason, a Snapshot should be
+	// copied with Copy rather than by assigning the struct.
+	RefIDs []bc.Hash
+
+	// MaxRefIDs, if positive, limits the number of recent block IDs
+	// retained in RefIDs. ApplyBlockHeader discards the oldest
+	// entries beyond the limit. The initial block ID is stored
+	// separately and is never discarded.
+	MaxRefIDs int
+
+	// NonceMaxLookback, if positive, limits how far back a nonce's
+	// block ID may refer: the block must be at most this many blocks
+	// before the latest one (which is itself 0 blocks back), even if
+	// RefIDs retains older IDs. Nonces referring to the initial
+	// block are always accepted. It does not apply when
+	// NonceBlockIDValidator is set.
+	NonceMaxLookback uint64
+
+	// MaxContracts, if positive, limits the number of contracts in
+	// ContractsTree. A transaction that would leave more, after
+	// its inputs are spent, is rejected with ErrTooManyContracts.
+	MaxContracts int
+
+	// AnyTimerange, if true, accepts a transaction whose block
+	// timestamp falls within any one of its time ranges, instead of
+	// requiring it to fall within all of them. This departs from the
+	// protocol's rule (the intersection of the ranges), so it is only
+	// for applications that validate transactions by their own
+	// rules. A transaction with no time ranges is accepted either
+	// way.
+	AnyTimerange bool
+
+	// RejectExpiredNonces, if true, rejects with ErrNonceExpired a
+	// transaction adding a nonce whose expiration time is earlier
+	// than the block timestamp, which the next PruneNonces would
+	// remove. This is a policy check, not a protocol rule: such a
+	// nonce is otherwise accepted (though the time range txvm
+	// records for each nonce excludes it).
+	RejectExpiredNonces bool
+
+	// ContractPolicy, if set, is called for each output of a
+	// transaction before the transaction is applied. If it returns
+	// an error, the transaction is rejected with that error (wrapped)
+	// and s is left unchanged. It is for deployments enforcing rules
+	// of their own on the contracts they accept. ApplyBlockConcurrent
+	// calls it from several goroutines at once.
+	ContractPolicy func(con bc.Contract) error
+
+	// TrackContractHeights, if true, records the height of s.Header
+	// when each contract is created in s, for ContractHeight. It
+	// costs memory in proportion to the number of contracts, so it
+	// is off by default. Contracts created while it is false, or
+	// restored by FromBytes, LoadTrees, or ApplyPatch, have no
+	// recorded height.
+	TrackContractHeights bool
+
+	// NonceBlockIDValidator, if set, decides whether a nonce may
+	// refer to the given block ID. It is consulted for nonces
+	// whose block ID is neither zero nor the initial block ID,
+	// replacing the default check that the ID is in RefIDs. Like
+	// ContractPolicy, it is called concurrently by
+	// ApplyBlockConcurrent.
+	NonceBlockIDValidator func(bc.Hash) bool
+
+	// Observer, if set, is notified of the nonces added and the
+	// contracts spent and created by each transaction applied to s
+	// in place, in the order they appear in the transaction (nonces
+	// first). Notifications are made only once the update succeeds:
+	// for ApplyBlock, after the whole block has been applied. The
+	// Immutable variants, which leave s unchanged, make none, nor
+	// does PruneNonces.
+	Observer Observer
+
+	// refIDset maps each element of RefIDs to its (last) position
+	// in the sequence of IDs appended to RefIDs, for quick lookup:
+	// RefIDs[i] is at position refIDBase+i. Entries whose position is
+	// outside RefIDs, or holds a different ID, are stale and ignored.
+	// If nil, RefIDs is searched instead.
+	//
+	// ApplyBlockHeader updates refIDset, and appends to RefIDs'
+	// backing array, in place unless refIDsShared is set, meaning
+	// that another Snapshot may be using them; then it copies both
+	// first. Other snapshots may read refIDset meanwhile, such as in
+	// Store.Commit, so it is locked. refIDStale holds the IDs trimmed
+	// from the front of RefIDs whose entries are yet to be deleted
+	// (see dropStaleRefIDs).
+	refIDset   *refIDSet
+	refIDBase  uint64
+	refIDStale []bc.Hash
+
+	// refIDsShared is set, on both snapshots, by derive and Copy. It
+	// is accessed atomically, since concurrent Immutable calls on
+	// one Snapshot may each set it.
+	refIDsShared uint32
+
+	// nonceExp indexes the nonces in nonceBase by expiration time,
+	// so PruneNonces can find expired nonces without walking the
+	// whole nonce tree. Its items are the expiration time
+	// (big-endian) followed by the nonce ID. nonceBase is a copy of
+	// NonceTree as of the last time nonceExp was updated; later
+	// changes to NonceTree are found with patricia.Diff. Neither is
+	// modified once created, so copies of a Snapshot may share them.
+	// Both are nil until first needed.
+	nonceExp, nonceBase *patricia.Tree
+
+	// contractHeights holds, for each contract created while
+	// TrackContractHeights is true, the contract ID followed by the
+	// height (big-endian) at which it was created. Like NonceTree,
+	// it is copied, not shared, by derive and Copy. It is nil until
+	// first needed.
+	contractHeights *patricia.Tree
+
+	// reserved holds the IDs of the contracts reserved with Reserve.
+	// It is copied like contractHeights, and is nil until first
+	// needed.
+	reserved *patricia.Tree
+
+	// partial, if true, means that ApplyBlockPartial has applied
+	// the block of s.Header only up to transaction partialNext. It
+	// is false for a snapshot at a block boundary.
+	partial     bool
+	partialNext int
+
+	// sealed is set by Seal. Copies of s do not inherit it.
+	sealed bool
+}
+
+// Observer receives notifications of changes to a Snapshot's trees.
+// See Snapshot.Observer.
+type Observer interface {
+	OnContractCreated(id bc.Hash)
+	OnContractSpent(id bc.Hash)
+	OnNonceAdded(id bc.Hash, expMS uint64)
+}
+
+// Seal marks s as not to be modified in place, such as once it is
+// the canonical head of a blockchain, to catch code that updates it
+// by mistake. Afterward the methods that update s in place, such as
+// ApplyBlock, ApplyTx, and PruneNonces, panic with ErrSealed instead.
+// The Immutable methods, Copy, and Clone may still be used, and
+// their results are not sealed. Seal does not prevent assignments
+// to s's exported fields.
+func (s *Snapshot) Seal() {
+	s.sealed = true
+}
+
+// Unseal undoes Seal, allowing s to be modified in place again.
+func (s *Snapshot) Unseal() {
+	s.sealed = false
+}
+
+// Sealed reports whether s is sealed. See Seal.
+func (s *Snapshot) Sealed() bool {
+	return s.sealed
+}
+
+// checkUnsealed panics with ErrSealed if s is sealed. It is called
+// by each method that updates s in place.
+func (s *Snapshot) checkUnsealed() {
+	if s.sealed {
+		panic(ErrSealed)
+	}
 }
 
 // PruneNonces modifies a Snapshot, removing all nonce IDs with
 // expiration times earlier than the provided timestamp.
-func (s *Snapshot) PruneNonces(timestampMS uint64) {
-	newTree := new(patricia.Tree)
-	*newTree = *s.NonceTree
+// It returns the number of nonce commitments removed.
+func (s *Snapshot) PruneNonces(timestampMS uint64) int {
+	s.checkUnsealed()
+	c, expired := s.pruneNonces(timestampMS, true)
+	*s = *c
+	return len(expired)
+}
+
+// PruneNoncesCollect is like PruneNonces but returns the IDs of the
+// nonces removed, ordered by expiration time, for auditing.
+func (s *Snapshot) PruneNoncesCollect(timestampMS uint64) []bc.Hash {
+	s.checkUnsealed()
+	c, expired := s.pruneNonces(timestampMS, true)
+	*s = *c
+	var ids []bc.Hash
+	for _, item := range expired {
+		ids = append(ids, bc.HashFromBytes(item[8:])) // see nonceExpKey
+	}
+	return ids
+}
+
+// PruneNoncesImmutable is like PruneNonces but leaves s unchanged,
+// returning the pruned state as a new Snapshot.
+func (s *Snapshot) PruneNoncesImmutable(timestampMS uint64) *Snapshot {
+	c, _ := s.pruneNonces(timestampMS, false)
+	return c
+}
+
+// ConsumeNonce removes the nonce with the given ID and expiration
+// time from s's nonce tree before it expires, reporting whether it
+// was present. Like ApplyTx, it replaces s's trees rather than
+// modifying them, so copies of s are unaffected.
+func (s *Snapshot) ConsumeNonce(id bc.Hash, expMS uint64) bool {
+	s.checkUnsealed()
+	c := s.deriveInPlace()
+	if !c.NonceTree.Delete(NonceCommitment(id, expMS)) {
+		return false
+	}
+	*s = *c
+	return true
+}
+
+// CompactNonces compacts s's nonce tree (see patricia.Tree.Compact),
+// such as after pruning many nonces, so that it no longer shares
+// memory with other snapshots. It also brings the index used to find
+// expired nonces up to date and compacts it, releasing the nonces it
+// still held from before the last block. The nonce tree's contents
+// and root hash are unchanged, and copies of s are unaffected.
+func (s *Snapshot) CompactNonces() {
+	s.checkUnsealed()
+	c := s.deriveInPlace()
+	exp := c.syncNonceExp()
+	exp.Compact()
+	c.NonceTree.Compact()
+	base := new(patricia.Tree)
+	*base = *c.NonceTree
+	c.nonceExp, c.nonceBase = exp, base
+	*s = *c
+}
+
+// pruneNonces implements PruneNoncesImmutable, also returning the
+// expired nonces as items of the expiration index (see nonceExpKey),
+// in increasing order. The result is derived with deriveFor(inPlace).
+func (s *Snapshot) pruneNonces(timestampMS uint64, inPlace bool) (*Snapshot, [][]byte) {
+	c := s.deriveFor(inPlace)
+	exp := c.syncNonceExp()
+	expired := expiredNonces(exp, timestampMS)
+	for _, item := range expired {
+		exp.Delete(item)
+		c.NonceTree.Delete(expNonceCommitment(item))
+	}
+
+	base := new(patricia.Tree)
+	*base = *c.NonceTree
+	c.nonceExp, c.nonceBase = exp, base
+	return c, expired
+}
 
-	patricia.Walk(s.NonceTree, func(item []byte) error {
-		_, t := idTime(item)
-		if timestampMS > t {
-			newTree.Delete(item)
+// expiredNonces returns the items of the expiration index exp for
+// nonces expiring before timestampMS, in increasing order.
+func expiredNonces(exp *patricia.Tree, timestampMS uint64) [][]byte {
+	var expired [][]byte
+	patricia.Walk(exp, func(item []byte) error {
+		if binary.BigEndian.Uint64(item) >= timestampMS {
+			return errStopWalk
 		}
+		expired = append(expired, item)
 		return nil
 	})
+	return expired
+}
+
+var errStopWalk = errors.New("stop walk")
+
+// syncNonceExp returns a new copy of s.nonceExp, updated to index
+// the current contents of s.NonceTree.
+func (s *Snapshot) syncNonceExp() *patricia.Tree {
+	exp, base := new(patricia.Tree), new(patricia.Tree)
+	if s.nonceExp != nil {
+		*exp, *base = *s.nonceExp, *s.nonceBase
+	}
+	added, removed := patricia.Diff(base, s.NonceTree)
+	for i, nc := range removed {
+		removed[i] = nonceExpKey(nc)
+	}
+	for i, nc := range added {
+		added[i] = nonceExpKey(nc)
+	}
+	exp.Update(removed, added) // index items are all 40 bytes, so prefix-free
+	return exp
+}
+
+// nonceExpKey returns the nonceExp item for a nonce commitment.
+func nonceExpKey(nc []byte) []byte {
+	id, expMS := idTime(nc)
+	b := make([]byte, 40)
+	binary.BigEndian.PutUint64(b, expMS)
+	copy(b[8:], id.Bytes())
+	return b
+}
 
-	s.NonceTree = newTree
+// expNonceCommitment is the inverse of nonceExpKey.
+func expNonceCommitment(item []byte) []byte {
+	return NonceCommitment(bc.HashFromBytes(item[8:]), binary.BigEndian.Uint64(item))
 }
 
-// Copy makes a copy of provided snapshot. Copying a snapshot is an
-// O(n) operation where n is the number of nonces in the snapshot's
-// nonce set.
+// Copy makes a copy of provided snapshot. The copy's trees share
+// their nodes with the original's, which is safe because
+// patricia.Tree never modifies a node once it is part of a tree:
+// Insert and Delete build new nodes along the updated path instead.
+// Likewise the copy's RefIDs shares the original's backing array
+// and index, and both are marked as shared, so that the next
+// ApplyBlockHeader on either one copies them rather than writing
+// where the other can see it. Copying a snapshot therefore takes
+// constant time, independent of the size of the trees and of
+// RefIDs.
 func Copy(original *Snapshot) *Snapshot {
+	atomic.StoreUint32(&original.refIDsShared, 1)
 	c := &Snapshot{
 		ContractsTree:  new(patricia.Tree),
 		NonceTree:      new(patricia.Tree),
 		InitialBlockID: original.InitialBlockID,
-		RefIDs:         append([]bc.Hash{}, original.RefIDs...),
+		RefIDs:         original.RefIDs,
+		MaxRefIDs:      original.MaxRefIDs,
+		MaxContracts:   original.MaxContracts,
+		AnyTimerange:   original.AnyTimerange,
+
+		RejectExpiredNonces:   original.RejectExpiredNonces,
+		ContractPolicy:        original.ContractPolicy,
+		TrackContractHeights:  original.TrackContractHeights,
+		NonceMaxLookback:      original.NonceMaxLookback,
+		NonceBlockIDValidator: original.NonceBlockIDValidator,
+		Observer:              original.Observer,
+
+		refIDset:     original.refIDset,
+		refIDBase:    original.refIDBase,
+		refIDsShared: 1,
+		nonceExp:     original.nonceExp,
+		nonceBase:    original.nonceBase,
+
+		partial:     original.partial,
+		partialNext: original.partialNext,
 	}
 	*c.ContractsTree = *original.ContractsTree
 	*c.NonceTree = *original.NonceTree
+	if original.contractHeights != nil {
+		c.contractHeights = new(patricia.Tree)
+		*c.contractHeights = *original.contractHeights
+	}
+	if original.reserved != nil {
+		c.reserved = new(patricia.Tree)
+		*c.reserved = *original.reserved
+	}
 	if original.Header != nil {
 		c.Header = new(bc.BlockHeader)
 		*c.Header = *original.Header
@@ -66,6 +420,127 @@ func Copy(original *Snapshot) *Snapshot {
 	return c
 }
 
+// Clone returns a deep copy of s. Unlike Copy, which shares the
+// trees' immutable nodes and the header's fields with s, Clone
+// shares no memory with s except its ContractPolicy,
+// NonceBlockIDValidator, and Observer. It takes time and memory
+// proportional to the size of s's trees, so Copy is usually
+// preferable; both results may be used on a different goroutine
+// from s.
+func (s *Snapshot) Clone() *Snapshot {
+	c := &Snapshot{
+		ContractsTree:  s.ContractsTree.Clone(),
+		NonceTree:      s.NonceTree.Clone(),
+		InitialBlockID: s.InitialBlockID,
+		RefIDs:         append([]bc.Hash(nil), s.RefIDs...),
+		MaxRefIDs:      s.MaxRefIDs,
+		MaxContracts:   s.MaxContracts,
+		AnyTimerange:   s.AnyTimerange,
+
+		RejectExpiredNonces:   s.RejectExpiredNonces,
+		ContractPolicy:        s.ContractPolicy,
+		TrackContractHeights:  s.TrackContractHeights,
+		NonceMaxLookback:      s.NonceMaxLookback,
+		NonceBlockIDValidator: s.NonceBlockIDValidator,
+		Observer:              s.Observer,
+
+		partial:     s.partial,
+		partialNext: s.partialNext,
+	}
+	if s.Header != nil {
+		c.Header = proto.Clone(s.Header).(*bc.BlockHeader)
+	}
+	if s.refIDset != nil {
+		c.refIDset = s.refIDset.clone()
+		c.refIDBase = s.refIDBase
+		c.refIDStale = append([]bc.Hash(nil), s.refIDStale...)
+	}
+	if s.nonceExp != nil {
+		c.nonceExp = s.nonceExp.Clone()
+	}
+	if s.nonceBase != nil {
+		c.nonceBase = s.nonceBase.Clone()
+	}
+	if s.contractHeights != nil {
+		c.contractHeights = s.contractHeights.Clone()
+	}
+	if s.reserved != nil {
+		c.reserved = s.reserved.Clone()
+	}
+	return c
+}
+
+// derive returns a new Snapshot with the same contents as s. Its
+// trees may be updated freely without affecting s. Its RefIDs
+// shares s's backing array and index, and both s and the result are
+// marked as sharing them, so that appending to either copies them.
+func (s *Snapshot) derive() *Snapshot {
+	atomic.StoreUint32(&s.refIDsShared, 1)
+	c := &Snapshot{
+		ContractsTree:  new(patricia.Tree),
+		NonceTree:      new(patricia.Tree),
+		InitialBlockID: s.InitialBlockID,
+		RefIDs:         s.RefIDs,
+		MaxRefIDs:      s.MaxRefIDs,
+		MaxContracts:   s.MaxContracts,
+		AnyTimerange:   s.AnyTimerange,
+
+		RejectExpiredNonces:   s.RejectExpiredNonces,
+		ContractPolicy:        s.ContractPolicy,
+		TrackContractHeights:  s.TrackContractHeights,
+		NonceMaxLookback:      s.NonceMaxLookback,
+		NonceBlockIDValidator: s.NonceBlockIDValidator,
+		Observer:              s.Observer,
+
+		refIDset:     s.refIDset,
+		refIDBase:    s.refIDBase,
+		refIDStale:   s.refIDStale,
+		refIDsShared: 1,
+		nonceExp:     s.nonceExp,
+		nonceBase:    s.nonceBase,
+
+		partial:     s.partial,
+		partialNext: s.partialNext,
+	}
+	*c.ContractsTree = *s.ContractsTree
+	*c.NonceTree = *s.NonceTree
+	if s.contractHeights != nil {
+		c.contractHeights = new(patricia.Tree)
+		*c.contractHeights = *s.contractHeights
+	}
+	if s.reserved != nil {
+		c.reserved = new(patricia.Tree)
+		*c.reserved = *s.reserved
+	}
+	if s.Header != nil {
+		c.Header = new(bc.BlockHeader)
+		*c.Header = *s.Header
+	}
+	return c
+}
+
+// deriveInPlace is derive for methods that update s in place, which
+// replace s with the result on success and otherwise discard it.
+// Since only one of them survives, the result takes over s's RefIDs
+// backing array and index if s has them to itself, rather than
+// marking them shared.
+func (s *Snapshot) deriveInPlace() *Snapshot {
+	shared := atomic.LoadUint32(&s.refIDsShared)
+	c := s.derive()
+	atomic.StoreUint32(&s.refIDsShared, shared)
+	c.refIDsShared = shared
+	return c
+}
+
+// deriveFor returns s.deriveInPlace() if inPlace is true and
+// s.derive() otherwise.
+func (s *Snapshot) deriveFor(inPlace bool) *Snapshot {
+	if inPlace {
+		return s.deriveInPlace()
+	}
+	return s.derive()
+}
+
 // Empty returns an empty state snapshot.
 func Empty() *Snapshot {
 	return &Snapshot{
@@ -74,146 +549,1626 @@ func Empty() *Snapshot {
 	}
 }
 
+// EmptyWithInitialBlock returns an empty state snapshot whose
+// InitialBlockID is id, so that transactions may be applied to it
+// directly. It has no Header. This bypasses applying an initial
+// block and is meant for tests and bootstrapping.
+func EmptyWithInitialBlock(id bc.Hash) *Snapshot {
+	s := Empty()
+	s.InitialBlockID = id
+	return s
+}
+
+// Genesis returns the state of a new blockchain: an Empty snapshot
+// with bh, which must have height 1, applied as its initial block,
+// followed by txs. The snapshot's InitialBlockID is bh's hash.
+// Genesis does not check the header's other fields; a PreviousBlockId,
+// for instance, is kept as given.
+func Genesis(bh *bc.BlockHeader, txs []*bc.Tx) (*Snapshot, error) {
+	if bh.Height != 1 {
+		return nil, errors.WithDetailf(ErrBlockHeight, "genesis block has height %d", bh.Height)
+	}
+	s := Empty()
+	err := s.ApplyBlockHeader(bh)
+	if err != nil {
+		return nil, errors.Wrap(err, "applying genesis block header")
+	}
+	err = s.ApplyTxs(bh.TimestampMs, txs)
+	if err != nil {
+		return nil, errors.Wrap(err, "applying genesis transactions")
+	}
+	return s, nil
+}
+
+// New returns a snapshot with the given contents, as produced by
+// EachContract, EachNonce (via NonceCommitment), and the Header,
+// InitialBlockID, and RefIDs fields of an existing snapshot. It is
+// meant for restoring a snapshot from a trusted export. The items
+// need not be sorted, but sorted input is fastest.
+//
+// New checks that the header and initial block ID are consistent
+// (either both are set or neither is; a height-1 header must be the
+// initial block), that the last of refIDs is the header's block and
+// there are no more of them than blocks up to the header's height,
+// and that each contract ID and nonce commitment is well formed.
+func New(contracts, nonces [][]byte, header *bc.BlockHeader, initialBlockID bc.Hash, refIDs []bc.Hash) (*Snapshot, error) {
+	err := checkHead(header, initialBlockID, refIDs)
+	if err != nil {
+		return nil, err
+	}
+	err = checkItems(contracts, nonces)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Snapshot{
+		Header:         header,
+		InitialBlockID: initialBlockID,
+		RefIDs:         append([]bc.Hash(nil), refIDs...),
+	}
+	s.ContractsTree, err = treeFromBytes(contracts)
+	if err != nil {
+		return nil, errors.Wrap(err, "building contracts tree")
+	}
+	s.NonceTree, err = treeFromBytes(nonces)
+	if err != nil {
+		return nil, errors.Wrap(err, "building nonce tree")
+	}
+	s.refIDset = makeRefIDSet(s.RefIDs)
+	return s, nil
+}
+
+// checkHead checks that header, initialBlockID, and refIDs are
+// consistent, as described for New.
+func checkHead(header *bc.BlockHeader, initialBlockID bc.Hash, refIDs []bc.Hash) error {
+	switch {
+	case header == nil && !initialBlockID.IsZero():
+		return errors.WithDetail(ErrInvalidSnapshot, "initial block ID without a header")
+	case header != nil && initialBlockID.IsZero():
+		return errors.WithDetail(ErrInvalidSnapshot, "header without an initial block ID")
+	case header != nil && header.Height == 0:
+		return errors.WithDetail(ErrInvalidSnapshot, "header with height 0")
+	case header != nil && header.Height == 1 && header.Hash() != initialBlockID:
+		return errors.WithDetail(ErrInvalidSnapshot, "height-1 header is not the initial block")
+	case header == nil && len(refIDs) > 0:
+		return errors.WithDetail(ErrInvalidSnapshot, "ref IDs without a header")
+	case len(refIDs) > 0 && refIDs[len(refIDs)-1] != header.Hash():
+		return errors.WithDetail(ErrInvalidSnapshot, "last ref ID is not the header's block ID")
+	case header != nil && uint64(len(refIDs)) > header.Height:
+		return errors.WithDetailf(ErrInvalidSnapshot, "%d ref IDs at height %d", len(refIDs), header.Height)
+	}
+	return nil
+}
+
+// Verify checks that s is internally consistent, returning an error
+// describing the first problem found. It is meant for snapshots
+// loaded from storage, to detect corruption before they are used.
+//
+// Besides the checks of New, Verify requires s's RefIDs to be
+// distinct, and its trees to contain only contract IDs and nonce
+// commitments and to have the root hashes implied by their items.
+// This takes time proportional to the size of the trees.
+func (s *Snapshot) Verify() error {
+	if s.ContractsTree == nil || s.NonceTree == nil {
+		return errors.WithDetail(ErrInvalidSnapshot, "missing tree")
+	}
+	err := checkHead(s.Header, s.InitialBlockID, s.RefIDs)
+	if err != nil {
+		return err
+	}
+	seen := make(map[bc.Hash]bool, len(s.RefIDs))
+	for _, id := range s.RefIDs {
+		if seen[id] {
+			return errors.WithDetailf(ErrInvalidSnapshot, "duplicate ref ID %x", id.Bytes())
+		}
+		seen[id] = true
+	}
+	if s.refIDset != nil {
+		for i, id := range s.RefIDs {
+			if j, ok := s.refIDIndex(id); !ok || j != i {
+				return errors.WithDetail(ErrInvalidSnapshot, "ref ID index does not match RefIDs")
+			}
+		}
+	}
+
+	contracts, nonces := treeToBytes(s.ContractsTree), treeToBytes(s.NonceTree)
+	err = checkItems(contracts, nonces)
+	if err != nil {
+		return errors.WithDetail(ErrInvalidSnapshot, err.Error())
+	}
+	err = verifyTree("contracts", s.ContractsTree, contracts)
+	if err != nil {
+		return err
+	}
+	return verifyTree("nonce", s.NonceTree, nonces)
+}
+
+// verifyTree checks that tree is the tree holding items, as
+// returned by Walk, by building that tree afresh.
+func verifyTree(name string, tree *patricia.Tree, items [][]byte) error {
+	rebuilt, err := treeFromBytes(items)
+	if err != nil || rebuilt.Len() != tree.Len() || rebuilt.RootHash() != tree.RootHash() {
+		return errors.WithDetailf(ErrInvalidSnapshot, "%s tree does not match its items", name)
+	}
+	return nil
+}
+
+// checkItems checks that each of contracts is a contract ID and
+// each of nonces is a nonce commitment.
+func checkItems(contracts, nonces [][]byte) error {
+	for _, c := range contracts {
+		_, err := bc.HashFromBytesChecked(c)
+		if err != nil {
+			return errors.Wrapf(err, "contract ID %x", c)
+		}
+	}
+	for _, n := range nonces {
+		_, _, err := DecodeNonceCommitment(n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // ApplyBlock updates s in place. It runs in three phases:
 // PruneNonces, ApplyBlockHeader, and ApplyTx
 // (the latter called in a loop for each transaction). Callers
-// are free to invoke those phases separately.
+// are free to invoke those phases separately; ApplyBlock gives the
+// same result, though it updates the nonce tree only once for the
+// whole block.
+// If any phase fails, s is left unchanged.
 func (s *Snapshot) ApplyBlock(block *bc.Block) error {
-	s.PruneNonces(block.TimestampMs)
+	return s.ApplyBlockChecked(block, false)
+}
 
-	err := s.ApplyBlockHeader(block.BlockHeader)
+// ApplyBlockChecked is like ApplyBlock. If checkRoot is true, it
+// additionally requires the resulting state to match the block
+// header's state root (see ValidateAgainst).
+func (s *Snapshot) ApplyBlockChecked(block *bc.Block, checkRoot bool) error {
+	s.checkUnsealed()
+	c, _, err := s.applyBlock(block, nil, true)
 	if err != nil {
-		return errors.Wrap(err, "applying block header")
+		return err
 	}
-
-	for i, tx := range block.Transactions {
-		err = s.ApplyTx(block.TimestampMs, tx)
+	if checkRoot {
+		err = c.ValidateAgainst(block.BlockHeader)
 		if err != nil {
-			return errors.Wrapf(err, "applying block transaction %d", i)
+			return err
 		}
 	}
+	*s = *c
+	s.dropStaleRefIDs()
+	s.notifyTxs(block.Transactions)
+	return nil
+}
 
+// ApplyBlockUnordered is like ApplyBlock, but allows a transaction
+// to spend an output created by a later transaction in the block. It
+// applies the transactions in dependency order: each after the
+// transactions creating the outputs it spends, and otherwise in
+// their order in the block. A spend of a contract already in s
+// refers to that contract, not to a later transaction recreating it,
+// so a block spending and then recreating a contract applies as it
+// does with ApplyBlock. The result is the same as ApplyBlock's
+// for the block with its transactions in that order, so a prevout
+// spent twice is still an error. It is also an error for two
+// transactions to create the same output, since which of them a
+// spend refers to would be ambiguous, and for transactions to spend
+// each other's outputs in a cycle. s.Observer is notified of the
+// transactions in the order they were applied.
+// If it fails, s is left unchanged.
+func (s *Snapshot) ApplyBlockUnordered(block *bc.Block) error {
+	s.checkUnsealed()
+	order, err := dependencyOrder(s.ContractsTree, block.Transactions)
+	if err != nil {
+		return err
+	}
+	c, _, err := s.applyBlockOrder(block, order, nil, true)
+	if err != nil {
+		return err
+	}
+	*s = *c
+	s.dropStaleRefIDs()
+	txs := make([]*bc.Tx, len(order))
+	for k, i := range order {
+		txs[k] = block.Transactions[i]
+	}
+	s.notifyTxs(txs)
 	return nil
 }
 
-// ApplyBlockHeader is the header-specific phase of applying a block
-// to the blockchain state. (See ApplyBlock.)
-func (s *Snapshot) ApplyBlockHeader(bh *bc.BlockHeader) error {
-	bHash := bh.Hash()
+// dependencyOrder returns the indices of txs in the order in which
+// ApplyBlockUnordered applies them to a state with the given
+// contracts tree.
+func dependencyOrder(contracts *patricia.Tree, txs []*bc.Tx) ([]int, error) {
+	creator := make(map[bc.Hash]int)
+	for i, tx := range txs {
+		for _, con := range tx.Contracts {
+			if con.Type != bc.OutputType {
+				continue
+			}
+			if j, ok := creator[con.ID]; ok && j != i {
+				return nil, errors.WithDetailf(ErrDuplicateOutput, "output %x created by block transactions %d and %d", con.ID.Bytes(), j, i)
+			}
+			creator[con.ID] = i
+		}
+	}
 
-	if s.InitialBlockID.IsZero() {
-		if bh.Height != 1 {
-			return fmt.Errorf("cannot apply block with height %d to an empty state", bh.Height)
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	var (
+		state = make([]int, len(txs))
+		order = make([]int, 0, len(txs))
+		visit func(i int) error
+	)
+	visit = func(i int) error {
+		switch state[i] {
+		case visiting:
+			return errors.WithDetailf(ErrInvalidPrevout, "block transactions spend each other's outputs in a cycle through transaction %d", i)
+		case done:
+			return nil
 		}
-		s.InitialBlockID = bHash
-	} else if bh.Height == 1 {
-		return fmt.Errorf("cannot apply block with height = 1 to an initialized state")
+		state[i] = visiting
+		for _, con := range txs[i].Contracts {
+			if con.Type != bc.InputType {
+				continue
+			}
+			// A later transaction's output is spent only if no
+			// contract with its ID exists before the block.
+			if j, ok := creator[con.ID]; ok && (j < i || j > i && !contracts.Contains(con.ID.Bytes())) {
+				err := visit(j)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		state[i] = done
+		order = append(order, i)
+		return nil
 	}
+	for i := range txs {
+		err := visit(i)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
 
-	s.Header = bh
-	s.RefIDs = append(s.RefIDs, bHash)
+// ApplyBlockImmutable is like ApplyBlock but leaves s unchanged,
+// returning the updated state as a new Snapshot.
+func (s *Snapshot) ApplyBlockImmutable(block *bc.Block) (*Snapshot, error) {
+	c, _, err := s.applyBlock(block, nil, false)
+	return c, err
+}
 
-	return nil
+// applyBlock implements ApplyBlockImmutable, also returning the
+// nonces pruned, as pruneNonces does. If stats is not nil and the
+// block is applied, it fills in *stats. The result is derived with
+// deriveFor(inPlace); callers replacing s with it must then call
+// dropStaleRefIDs.
+func (s *Snapshot) applyBlock(block *bc.Block, stats *BlockStats, inPlace bool) (*Snapshot, [][]byte, error) {
+	return s.applyBlockOrder(block, nil, stats, inPlace)
 }
 
-// ApplyTx updates s in place.
-func (s *Snapshot) ApplyTx(blockTimeMS uint64, tx *bc.Tx) error {
-	if s.InitialBlockID.IsZero() {
-		return fmt.Errorf("cannot apply a transaction to an empty state")
+// applyBlockOrder is applyBlock, but applies the block's
+// transactions in the given order, a permutation of their indices,
+// if it is not nil. Errors still give each transaction's index in
+// the block.
+//
+// Rather than pruning the nonce tree and then inserting each
+// transaction's nonces in turn, it checks the nonces against the
+// tree as it would be after pruning, then makes all the block's
+// changes to the nonce tree at once with patricia.Tree.Update. The
+// result is the same, but each changed node is copied once per block
+// instead of once per nonce.
+func (s *Snapshot) applyBlockOrder(block *bc.Block, order []int, stats *BlockStats, inPlace bool) (*Snapshot, [][]byte, error) {
+	start := time.Now()
+	c := s.deriveFor(inPlace)
+	exp := c.syncNonceExp()
+	expired := expiredNonces(exp, block.TimestampMs)
+	removed := make([][]byte, len(expired))
+	pruned := make(map[string]bool, len(expired))
+	for i, item := range expired {
+		removed[i] = expNonceCommitment(item)
+		pruned[string(removed[i])] = true
 	}
+	pruneDone := time.Now()
 
-	if blockTimeMS > math.MaxInt64 {
-		return fmt.Errorf("block timestamp %d out of int64 range", blockTimeMS)
+	err := c.applyBlockHeader(block.BlockHeader)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "applying block header")
 	}
 
-	for _, tr := range tx.Timeranges {
-		if tr.MaxMS > 0 && int64(blockTimeMS) > tr.MaxMS {
-			return fmt.Errorf("block timestamp %d outside transaction time range %d-%d", blockTimeMS, tr.MinMS, tr.MaxMS)
+	var (
+		added [][]byte
+		adder = make(map[string]int) // index of the tx adding each nonce
+	)
+	for k := range block.Transactions {
+		i := k
+		if order != nil {
+			i = order[k]
+		}
+		tx := block.Transactions[i]
+		err := c.checkTx(block.TimestampMs, tx)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "applying block transaction %d", i)
 		}
-		if tr.MinMS > 0 && int64(blockTimeMS) > 0 && int64(blockTimeMS) < tr.MinMS {
-			return fmt.Errorf("block timestamp %d outside transaction time range %d-%d", blockTimeMS, tr.MinMS, tr.MaxMS)
+		for _, n := range tx.Nonces {
+			nc := NonceCommitment(n.ID, n.ExpMS)
+			if j, ok := adder[string(nc)]; ok {
+				return nil, nil, errors.Wrapf(blockNonceConflict(n, j), "applying block transaction %d", i)
+			}
+			if !pruned[string(nc)] && c.NonceTree.Contains(nc) {
+				return nil, nil, errors.Wrapf(stateNonceConflict(n), "applying block transaction %d", i)
+			}
+			adder[string(nc)] = i
+			added = append(added, nc)
+		}
+		err = c.updateContracts(tx, nil)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "applying block transaction %d", i)
 		}
 	}
 
-	nonceTree := new(patricia.Tree)
-	*nonceTree = *s.NonceTree
+	txsDone := time.Now()
 
-	for _, n := range tx.Nonces {
-		// Add new nonces. They must not conflict with nonces already
-		// present.
-		nc := NonceCommitment(n.ID, n.ExpMS)
-		if nonceTree.Contains(nc) {
-			return fmt.Errorf("conflicting nonce %x", n.ID.Bytes())
-		}
+	// The expiration index is left as of the start of the block.
+	// The next sync finds both the pruned and the added nonces.
+	base := new(patricia.Tree)
+	*base = *c.NonceTree
+	c.nonceExp, c.nonceBase = exp, base
 
-		if n.BlockID.IsZero() || n.BlockID == s.InitialBlockID {
-			// ok
-		} else {
-			var found bool
-			for _, id := range s.RefIDs {
-				if id == n.BlockID {
-					found = true
-					break
+	err = c.NonceTree.Update(removed, added)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "updating nonce tree")
+	}
+	if stats != nil {
+		*stats = BlockStats{
+			PruneTime:    pruneDone.Sub(start),
+			TxTime:       txsDone.Sub(pruneDone),
+			Time:         time.Since(start),
+			NoncesPruned: len(expired),
+			NoncesAdded:  len(added),
+		}
+		for _, tx := range block.Transactions {
+			for _, con := range tx.Contracts {
+				switch con.Type {
+				case bc.InputType:
+					stats.ContractsSpent++
+				case bc.OutputType:
+					stats.ContractsCreated++
 				}
 			}
-			if !found {
-				return fmt.Errorf("nonce must refer to the initial block, a recent block, or have a zero block ID")
-			}
 		}
-		nonceTree.Insert(nc)
 	}
+	return c, expired, nil
+}
 
-	conTree := new(patricia.Tree)
-	*conTree = *s.ContractsTree
+// stateNonceConflict and blockNonceConflict return the errors for a
+// nonce added by a block's transaction that is already in the state
+// before the block, or that was added by the block's transaction j.
+func stateNonceConflict(n bc.Nonce) error {
+	return errors.WithDetailf(ErrConflictingNonce, "nonce %x is already in the state", n.ID.Bytes())
+}
 
-	// Add or remove contracts, depending on if it is an input or output
-	for _, con := range tx.Contracts {
-		switch con.Type {
-		case bc.InputType:
-			if !conTree.Contains(con.ID.Bytes()) {
-				return fmt.Errorf("invalid prevout %x", con.ID.Bytes())
-			}
-			conTree.Delete(con.ID.Bytes())
+func blockNonceConflict(n bc.Nonce, j int) error {
+	return errors.WithDetailf(ErrConflictingNonce, "nonce %x was added by block transaction %d", n.ID.Bytes(), j)
+}
 
-		case bc.OutputType:
-			err := conTree.Insert(con.ID.Bytes())
-			if err != nil {
-				return err
-			}
-		}
-	}
+// ApplyBlocks applies blocks to s in order, as with ApplyBlock.
+// The blocks must form a contiguous chain, each following and
+// linking to the one before it; this is checked before any block is
+// applied. Either all of them are applied or, if any fails, none is
+// and s is left unchanged.
+func (s *Snapshot) ApplyBlocks(blocks []*bc.Block) error {
+	return s.ApplyBlocksContext(context.Background(), blocks)
+}
 
-	s.NonceTree = nonceTree
-	s.ContractsTree = conTree
+// ApplyBlocksContext is like ApplyBlocks, but stops early if ctx is
+// canceled, returning ctx.Err() (wrapped) and leaving s unchanged.
+// It checks ctx before applying each block.
+func (s *Snapshot) ApplyBlocksContext(ctx context.Context, blocks []*bc.Block) error {
+	s.checkUnsealed()
+	headers := make([]*bc.BlockHeader, len(blocks))
+	for i, block := range blocks {
+		headers[i] = block.BlockHeader
+	}
+	_, err := checkChain(headers)
+	if err != nil {
+		return errors.Wrap(err, "checking block chain")
+	}
 
+	c := s
+	for _, block := range blocks {
+		if err := ctx.Err(); err != nil {
+			return errors.Wrapf(err, "before block at height %d", block.Height)
+		}
+		c, _, err = c.applyBlock(block, nil, true)
+		if err != nil {
+			return errors.Wrapf(err, "applying block at height %d", block.Height)
+		}
+	}
+	*s = *c
+	s.dropStaleRefIDs()
+	for _, block := range blocks {
+		s.notifyTxs(block.Transactions)
+	}
 	return nil
 }
 
-// Height returns the height from the stored latest header.
-func (s *Snapshot) Height() uint64 {
-	if s == nil || s.Header == nil {
-		return 0
+// ApplyBlockBody applies the phases of ApplyBlock other than
+// ApplyBlockHeader: PruneNonces and ApplyTx for each transaction,
+// using the block's timestamp. It is meant for headers-first sync,
+// where a chain of headers is applied with ApplyBlockHeader before
+// the blocks' transactions are available. Applying each block's body,
+// in order, then gives the same state as applying the full blocks,
+// except that nonces are checked against the RefIDs of the latest
+// header rather than of their own block.
+// If the body is invalid, s is left unchanged.
+func (s *Snapshot) ApplyBlockBody(block *bc.Block) error {
+	s.checkUnsealed()
+	c, _ := s.pruneNonces(block.TimestampMs, true)
+	err := c.applyBlockTxs(block)
+	if err != nil {
+		return err
 	}
-	return s.Header.Height
+	*s = *c
+	s.notifyTxs(block.Transactions)
+	return nil
 }
 
-// TimestampMS returns the timestamp from the stored latest header.
-func (s *Snapshot) TimestampMS() uint64 {
-	if s == nil || s.Header == nil {
-		return 0
+// ApplyBlockStream is like ApplyBlock, but takes the block's
+// transactions from txs, allowing them to be read from storage one
+// at a time rather than held in memory at once. It applies
+// transactions until txs is closed. timestampMS must be bh's
+// timestamp.
+//
+// If any transaction fails, ApplyBlockStream stops reading from txs
+// and returns an error, leaving s unchanged; senders must be
+// prepared for their sends not to be received. If s.Observer is set,
+// the transactions are retained until the block is applied, so
+// that it can be notified.
+func (s *Snapshot) ApplyBlockStream(bh *bc.BlockHeader, timestampMS uint64, txs <-chan *bc.Tx) error {
+	s.checkUnsealed()
+	if timestampMS != bh.TimestampMs {
+		return errors.WithDetailf(ErrBlockTimestamp, "timestamp %d does not match block header timestamp %d", timestampMS, bh.TimestampMs)
 	}
-	return s.Header.TimestampMs
-}
 
-// NonceCommitment returns the byte commitment
-// for the given nonce id and expiration.
-func NonceCommitment(id bc.Hash, expms uint64) []byte {
-	b := make([]byte, 40)
-	copy(b[:32], id.Bytes())
-	binary.LittleEndian.PutUint64(b[32:], expms)
+	c, _ := s.pruneNonces(timestampMS, true)
+
+	err := c.applyBlockHeader(bh)
+	if err != nil {
+		return errors.Wrap(err, "applying block header")
+	}
+
+	var (
+		i       int
+		applied []*bc.Tx
+	)
+	for tx := range txs {
+		err = c.applyTx(timestampMS, tx)
+		if err != nil {
+			return errors.Wrapf(err, "applying block transaction %d", i)
+		}
+		if s.Observer != nil {
+			applied = append(applied, tx)
+		}
+		i++
+	}
+
+	*s = *c
+	s.dropStaleRefIDs()
+	s.notifyTxs(applied)
+	return nil
+}
+
+// ApplyBlockPartial applies transactions [start, start+count) of
+// block, allowing a large block to be applied in several steps.
+// The first call, with start 0, also runs the phases of ApplyBlock
+// that precede the transactions: PruneNonces and ApplyBlockHeader.
+// Each later call must be for the same block and continue where the
+// previous one stopped; otherwise it fails with ErrPartialBlock.
+//
+// Until the last transaction is applied, s holds the block's header
+// but only some of its transactions, so its trees match no block's
+// state root. Meanwhile, ApplyBlockHeader (and so ApplyBlock and its
+// other variants) refuses to apply another block. Applying a block
+// in any number of partial steps gives the same result as applying
+// it with ApplyBlock. The progress through the block is kept only in
+// memory; Bytes does not record it.
+// If a call fails, s is left as it was before the call.
+func (s *Snapshot) ApplyBlockPartial(block *bc.Block, start, count int) error {
+	s.checkUnsealed()
+	if start < 0 || count < 0 || start+count > len(block.Transactions) {
+		return errors.WithDetailf(ErrPartialBlock, "transactions %d-%d of %d", start, start+count, len(block.Transactions))
+	}
+
+	var c *Snapshot
+	switch {
+	case s.partial:
+		if s.Header.Hash() != block.Hash() {
+			return errors.WithDetailf(ErrPartialBlock, "block at height %d is not partially applied", block.Height)
+		}
+		if start != s.partialNext {
+			return errors.WithDetailf(ErrPartialBlock, "starting at transaction %d, want %d", start, s.partialNext)
+		}
+		c = s.deriveInPlace()
+	case start == 0:
+		c, _ = s.pruneNonces(block.TimestampMs, true)
+		err := c.applyBlockHeader(block.BlockHeader)
+		if err != nil {
+			return errors.Wrap(err, "applying block header")
+		}
+	default:
+		return errors.WithDetailf(ErrPartialBlock, "block at height %d is not partially applied", block.Height)
+	}
+
+	txs := block.Transactions[start : start+count]
+	for i, tx := range txs {
+		err := c.applyTx(block.TimestampMs, tx)
+		if err != nil {
+			return errors.Wrapf(err, "applying block transaction %d", start+i)
+		}
+	}
+	c.partial, c.partialNext = start+count < len(block.Transactions), start+count
+	if !c.partial {
+		c.partialNext = 0
+	}
+
+	*s = *c
+	s.dropStaleRefIDs()
+	s.notifyTxs(txs)
+	return nil
+}
+
+func (s *Snapshot) applyBlockTxs(block *bc.Block) error {
+	for i, tx := range block.Transactions {
+		err := s.applyTx(block.TimestampMs, tx)
+		if err != nil {
+			return errors.Wrapf(err, "applying block transaction %d", i)
+		}
+	}
+	return nil
+}
+
+// notifyTxs informs s.Observer, if set, of the changes made by txs.
+func (s *Snapshot) notifyTxs(txs []*bc.Tx) {
+	if s.Observer == nil {
+		return
+	}
+	for _, tx := range txs {
+		for _, n := range tx.Nonces {
+			s.Observer.OnNonceAdded(n.ID, n.ExpMS)
+		}
+		for _, con := range tx.Contracts {
+			switch con.Type {
+			case bc.InputType:
+				s.Observer.OnContractSpent(con.ID)
+			case bc.OutputType:
+				s.Observer.OnContractCreated(con.ID)
+			}
+		}
+	}
+}
+
+// ValidateBlock reports whether block could be applied to s with
+// ApplyBlock, returning the error ApplyBlock would return. It never
+// modifies s: the updates are made to a new Snapshot sharing s's
+// trees (see ApplyBlockImmutable), which is then discarded.
+func (s *Snapshot) ValidateBlock(block *bc.Block) error {
+	_, err := s.ApplyBlockImmutable(block)
+	return err
+}
+
+// ValidateAndApply validates block against s and, only if it is
+// valid, applies it, computing the new state once. It is equivalent
+// to ApplyBlock, which already applies a block to a new Snapshot
+// sharing s's trees (see ApplyBlockImmutable) and replaces s with the
+// result only on success. Calling ValidateBlock and then ApplyBlock
+// instead computes the result twice.
+//
+// Like the rest of Snapshot, ValidateAndApply does no locking. For a
+// snapshot read and updated concurrently, use Store.
+func (s *Snapshot) ValidateAndApply(block *bc.Block) error {
+	return s.ApplyBlock(block)
+}
+
+// ValidateHeaderHeight checks that bh's height is consistent with s:
+// a block with height 1 may only be applied to an empty state (one
+// with no InitialBlockID), and any other block only to an initialized
+// state, with a height one more than that of s.Header (if s.Header is
+// set). It does not modify s.
+func (s *Snapshot) ValidateHeaderHeight(bh *bc.BlockHeader) error {
+	if s.InitialBlockID.IsZero() {
+		if bh.Height != 1 {
+			return errors.WithDetailf(ErrBlockHeight, "cannot apply block with height %d to an empty state", bh.Height)
+		}
+	} else if bh.Height == 1 {
+		return errors.WithDetail(ErrBlockHeight, "cannot apply block with height = 1 to an initialized state")
+	} else if s.Header != nil && bh.Height != s.Header.Height+1 {
+		return errors.WithDetailf(ErrBlockHeight, "cannot apply block with height %d to a state with height %d", bh.Height, s.Header.Height)
+	}
+	return nil
+}
+
+// ApplyBlockHeader is the header-specific phase of applying a block
+// to the blockchain state. (See ApplyBlock.)
+// Besides the checks of ValidateHeaderHeight, it requires a block
+// following s.Header to link to it by PreviousBlockId and to have a
+// timestamp no earlier than its own.
+func (s *Snapshot) ApplyBlockHeader(bh *bc.BlockHeader) error {
+	s.checkUnsealed()
+	err := s.applyBlockHeader(bh)
+	if err != nil {
+		return err
+	}
+	s.dropStaleRefIDs()
+	return nil
+}
+
+// applyBlockHeader implements ApplyBlockHeader for snapshots that
+// may yet be discarded, such as one derived by ApplyBlock, so it
+// leaves the index entries of any ref IDs it trims in place (see
+// dropStaleRefIDs).
+func (s *Snapshot) applyBlockHeader(bh *bc.BlockHeader) error {
+	if s.partial {
+		return errors.WithDetailf(ErrPartialBlock, "block at height %d applied only up to transaction %d", s.Height(), s.partialNext)
+	}
+	err := s.ValidateHeaderHeight(bh)
+	if err != nil {
+		return err
+	}
+	// Equal timestamps are allowed, for chains producing blocks
+	// faster than once per millisecond.
+	if s.Header != nil && bh.TimestampMs < s.Header.TimestampMs {
+		return errors.WithDetailf(ErrBlockTimestamp, "block timestamp %d, previous block timestamp %d", bh.TimestampMs, s.Header.TimestampMs)
+	}
+	if s.Header != nil {
+		var prevID bc.Hash
+		if bh.PreviousBlockId != nil {
+			prevID = *bh.PreviousBlockId
+		}
+		if prevHash := s.Header.Hash(); prevID != prevHash {
+			return errors.WithDetailf(ErrPrevBlockID, "block wants previous block ID %x, state has %x", prevID.Bytes(), prevHash.Bytes())
+		}
+	}
+
+	bHash := bh.Hash()
+	if s.InitialBlockID.IsZero() {
+		s.InitialBlockID = bHash
+	}
+
+	s.Header = bh
+	s.appendRefID(bHash)
+	if s.MaxRefIDs > 0 && len(s.RefIDs) > s.MaxRefIDs {
+		s.trimRefIDs(len(s.RefIDs) - s.MaxRefIDs)
+	}
+
+	return nil
+}
+
+// appendRefID appends id to s.RefIDs and indexes it, in place if s
+// has them to itself, so that a run of blocks takes amortized
+// constant time per block. Otherwise it first makes its own copies,
+// with room to grow. It also replaces the index if stale entries
+// make up most of it.
+func (s *Snapshot) appendRefID(id bc.Hash) {
+	if s.refIDset == nil || atomic.LoadUint32(&s.refIDsShared) != 0 {
+		ids := make([]bc.Hash, len(s.RefIDs), 2*len(s.RefIDs)+1)
+		copy(ids, s.RefIDs)
+		s.RefIDs = ids
+		s.refIDset, s.refIDBase, s.refIDStale = makeRefIDSet(ids), 0, nil
+		atomic.StoreUint32(&s.refIDsShared, 0)
+	} else if s.refIDset.len() > 2*len(s.RefIDs)+16 {
+		s.refIDset, s.refIDBase, s.refIDStale = makeRefIDSet(s.RefIDs), 0, nil
+	}
+	s.refIDset.put(id, s.refIDBase+uint64(len(s.RefIDs)))
+	s.RefIDs = append(s.RefIDs, id)
+}
+
+// trimRefIDs removes the first n IDs from s.RefIDs. Their index
+// entries are kept until dropStaleRefIDs, since until then s may yet
+// be discarded in favor of a snapshot still holding them.
+func (s *Snapshot) trimRefIDs(n int) {
+	if len(s.refIDStale) == 0 {
+		s.refIDStale = s.RefIDs[:n:n]
+	} else {
+		s.refIDStale = append(s.refIDStale, s.RefIDs[:n]...)
+	}
+	s.RefIDs = s.RefIDs[n:]
+	s.refIDBase += uint64(n)
+}
+
+// dropStaleRefIDs deletes the index entries of the IDs trimmed from
+// s.RefIDs, if s has its index to itself. It is called once the
+// update trimming them has succeeded and replaced the snapshot
+// it was applied to.
+func (s *Snapshot) dropStaleRefIDs() {
+	if s.refIDset != nil && atomic.LoadUint32(&s.refIDsShared) == 0 {
+		s.refIDset.deleteAt(s.refIDStale, s.refIDBase-uint64(len(s.refIDStale)))
+	}
+	s.refIDStale = nil
+}
+
+// setRefIDs sets s.RefIDs to ids and indexes them. If ids continues
+// s's current RefIDs, as when catching up to a later snapshot, and s
+// has its index to itself, only the IDs trimmed and added are
+// reindexed. Otherwise s takes ownership of ids.
+func (s *Snapshot) setRefIDs(ids []bc.Hash) {
+	if len(ids) > 0 && s.refIDset != nil && atomic.LoadUint32(&s.refIDsShared) == 0 {
+		if i, ok := s.refIDIndex(ids[0]); ok && len(s.RefIDs)-i <= len(ids) && equalHashes(s.RefIDs[i:], ids[:len(s.RefIDs)-i]) {
+			s.trimRefIDs(i)
+			for _, id := range ids[len(s.RefIDs):] {
+				s.appendRefID(id)
+			}
+			return
+		}
+	}
+	s.RefIDs = ids
+	s.refIDset, s.refIDBase, s.refIDStale = makeRefIDSet(ids), 0, nil
+	atomic.StoreUint32(&s.refIDsShared, 0)
+}
+
+func equalHashes(a, b []bc.Hash) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// RebuildRefIDs sets s.RefIDs to the IDs of headers, which must be
+// a contiguous chain of recent blocks, oldest first, ending with
+// s.Header. It is for snapshots restored without their RefIDs (such
+// as by New), so that nonces referring to recent blocks can be
+// validated again. As in ApplyBlockHeader, only the latest
+// s.MaxRefIDs IDs are kept, if that is positive.
+// If headers is not such a chain, s is left unchanged.
+func (s *Snapshot) RebuildRefIDs(headers []*bc.BlockHeader) error {
+	s.checkUnsealed()
+	if len(headers) == 0 {
+		if s.Header != nil {
+			return errors.WithDetail(ErrPrevBlockID, "no headers given")
+		}
+		s.RefIDs, s.refIDset, s.refIDBase, s.refIDStale = nil, nil, 0, nil
+		return nil
+	}
+	if s.Header == nil {
+		return errors.WithDetail(ErrBlockHeight, "headers given for a state with no header")
+	}
+
+	ids, err := checkChain(headers)
+	if err != nil {
+		return err
+	}
+	if last, want := ids[len(ids)-1], s.Header.Hash(); last != want {
+		return errors.WithDetailf(ErrPrevBlockID, "last header %x is not the state's header %x", last.Bytes(), want.Bytes())
+	}
+
+	if s.MaxRefIDs > 0 && len(ids) > s.MaxRefIDs {
+		ids = ids[len(ids)-s.MaxRefIDs:]
+	}
+	s.setRefIDs(ids)
+	s.dropStaleRefIDs()
+	return nil
+}
+
+// checkChain checks that headers form a contiguous chain, each
+// following and linking to the one before it, and returns their
+// IDs.
+func checkChain(headers []*bc.BlockHeader) ([]bc.Hash, error) {
+	ids := make([]bc.Hash, len(headers))
+	for i, bh := range headers {
+		ids[i] = bh.Hash()
+		if i == 0 {
+			continue
+		}
+		prev := headers[i-1]
+		if bh.Height != prev.Height+1 {
+			return nil, errors.WithDetailf(ErrBlockHeight, "header %d has height %d, previous header %d", i, bh.Height, prev.Height)
+		}
+		if bh.PreviousBlockId == nil || *bh.PreviousBlockId != ids[i-1] {
+			return nil, errors.WithDetailf(ErrPrevBlockID, "header %d does not link to header %d", i, i-1)
+		}
+	}
+	return ids, nil
+}
+
+// ApplyTx updates s in place.
+// If the transaction is invalid, s is left unchanged.
+func (s *Snapshot) ApplyTx(blockTimeMS uint64, tx *bc.Tx) error {
+	err := s.applyTx(blockTimeMS, tx)
+	if err != nil {
+		return err
+	}
+	s.notifyTxs([]*bc.Tx{tx})
+	return nil
+}
+
+// applyTx is ApplyTx without notifying s.Observer.
+func (s *Snapshot) applyTx(blockTimeMS uint64, tx *bc.Tx) error {
+	s.checkUnsealed()
+	c, err := s.deriveTx(blockTimeMS, tx, true)
+	if err != nil {
+		return err
+	}
+	*s = *c
+	return nil
+}
+
+// ApplyTxWithUndo is like ApplyTx, but also returns a function that
+// restores s to its state before the call. Calling undo after s has
+// been further updated discards those updates too.
+// s.Observer is not notified of the undo.
+func (s *Snapshot) ApplyTxWithUndo(blockTimeMS uint64, tx *bc.Tx) (undo func(), err error) {
+	s.checkUnsealed()
+	atomic.StoreUint32(&s.refIDsShared, 1) // old shares s's ref ID index
+	old := *s
+	err = s.ApplyTx(blockTimeMS, tx)
+	if err != nil {
+		return nil, err
+	}
+	return func() { *s = old }, nil
+}
+
+// ApplyTxs applies each of txs to s in order. Either all of them
+// are applied or, if any fails, none is and s is left unchanged.
+func (s *Snapshot) ApplyTxs(blockTimeMS uint64, txs []*bc.Tx) error {
+	s.checkUnsealed()
+	c := s
+	for i, tx := range txs {
+		var err error
+		c, err = c.deriveTx(blockTimeMS, tx, true)
+		if err != nil {
+			return errors.Wrapf(err, "applying transaction %d", i)
+		}
+	}
+	*s = *c
+	s.notifyTxs(txs)
+	return nil
+}
+
+// ApplyTxImmutable is like ApplyTx but leaves s unchanged,
+// returning the updated state as a new Snapshot.
+func (s *Snapshot) ApplyTxImmutable(blockTimeMS uint64, tx *bc.Tx) (*Snapshot, error) {
+	return s.deriveTx(blockTimeMS, tx, false)
+}
+
+// deriveTx implements ApplyTxImmutable, deriving the result with
+// deriveFor(inPlace).
+func (s *Snapshot) deriveTx(blockTimeMS uint64, tx *bc.Tx, inPlace bool) (*Snapshot, error) {
+	err := s.checkTx(blockTimeMS, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	c := s.deriveFor(inPlace)
+	err = c.updateTrees(tx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// ApplyTxDelta is like ApplyTx, but also returns the IDs of the
+// contracts the transaction spent and created, in the order they
+// appear in the transaction. On error it returns no IDs, and s is
+// left unchanged.
+func (s *Snapshot) ApplyTxDelta(blockTimeMS uint64, tx *bc.Tx) (spent, created []bc.Hash, err error) {
+	err = s.ApplyTx(blockTimeMS, tx)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, con := range tx.Contracts {
+		switch con.Type {
+		case bc.InputType:
+			spent = append(spent, con.ID)
+		case bc.OutputType:
+			created = append(created, con.ID)
+		}
+	}
+	return spent, created, nil
+}
+
+// ApplyTxSpeculative is like ApplyTx, but tolerates inputs that are
+// not in s's contracts tree, such as ones spent by another pending
+// transaction. It skips them, applying the rest of the transaction,
+// and returns their IDs in the order they appear in the
+// transaction. Any other failure is an error, as for ApplyTx, and
+// leaves s unchanged.
+//
+// The result is generally not a valid blockchain state, so
+// s.Observer is not notified.
+func (s *Snapshot) ApplyTxSpeculative(blockTimeMS uint64, tx *bc.Tx) (missing []bc.Hash, err error) {
+	s.checkUnsealed()
+	err = s.checkTx(blockTimeMS, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	c := s.deriveInPlace()
+	err = c.updateTrees(tx, &missing)
+	if err != nil {
+		return nil, err
+	}
+	*s = *c
+	return missing, nil
+}
+
+// CheckConflicts returns the indices, in increasing order, of the
+// transactions in txs that conflict with s or with an earlier
+// transaction in txs, as when packing a block from a mempool. A
+// transaction conflicts if it
+//
+//   - spends a contract that is not in s and is not created by an
+//     earlier transaction, or that an earlier transaction spends;
+//   - creates a contract already in s or created by an earlier
+//     transaction (and not spent since); or
+//   - adds a nonce already in s or added by an earlier transaction.
+//
+// Conflicting transactions are treated as dropped: they are not
+// compared against the transactions after them. So dropping every
+// reported transaction leaves a list that applies to s without
+// conflicts, in order. CheckConflicts does not check anything else,
+// such as time ranges or nonce block IDs (see ApplyTx), and does not
+// prune expired nonces from s first (see PruneNoncesImmutable).
+// It does not modify s.
+func (s *Snapshot) CheckConflicts(txs []*bc.Tx) []int {
+	c := &Snapshot{ContractsTree: new(patricia.Tree), NonceTree: new(patricia.Tree)}
+	*c.ContractsTree, *c.NonceTree = *s.ContractsTree, *s.NonceTree
+
+	var conflicts []int
+	for i, tx := range txs {
+		contracts, nonces := *c.ContractsTree, *c.NonceTree
+		if c.updateTrees(tx, nil) != nil {
+			*c.ContractsTree, *c.NonceTree = contracts, nonces
+			conflicts = append(conflicts, i)
+		}
+	}
+	return conflicts
+}
+
+// ApplyTxNoTime is like ApplyTx, but skips checking the block
+// timestamp against the transaction's time ranges. It is meant for
+// admitting transactions to a mempool before the timestamp of the
+// block that will contain them is known. Such a transaction must
+// still be checked with ApplyTx (or ApplyBlock) when the block is
+// assembled.
+// If the transaction is invalid, s is left unchanged.
+func (s *Snapshot) ApplyTxNoTime(tx *bc.Tx) error {
+	s.checkUnsealed()
+	if s.InitialBlockID.IsZero() {
+		return ErrEmptyState
+	}
+	err := s.checkNonces(tx)
+	if err != nil {
+		return err
+	}
+	err = s.checkContracts(tx)
+	if err != nil {
+		return err
+	}
+
+	c := s.deriveInPlace()
+	err = c.updateTrees(tx, nil)
+	if err != nil {
+		return err
+	}
+	*s = *c
+	s.notifyTxs([]*bc.Tx{tx})
+	return nil
+}
+
+// checkTx performs the parts of transaction validation that do not
+// depend on s's trees: the state must be initialized, the block
+// time must fall within the transaction's time ranges (and, with
+// RejectExpiredNonces, its nonces' expiration times), its nonces must
+// have valid expiration times and refer to acceptable block IDs, and
+// its outputs must satisfy ContractPolicy.
+func (s *Snapshot) checkTx(blockTimeMS uint64, tx *bc.Tx) error {
+	if s.InitialBlockID.IsZero() {
+		return ErrEmptyState
+	}
+	err := checkTimeRanges(blockTimeMS, tx, s.AnyTimerange)
+	if err != nil {
+		return err
+	}
+	if s.RejectExpiredNonces {
+		for _, n := range tx.Nonces {
+			if n.ExpMS < blockTimeMS {
+				return errors.WithDetailf(ErrNonceExpired, "nonce %x expires at %d, block timestamp %d", n.ID.Bytes(), n.ExpMS, blockTimeMS)
+			}
+		}
+	}
+	err = s.checkNonces(tx)
+	if err != nil {
+		return err
+	}
+	return s.checkContracts(tx)
+}
+
+// checkContracts checks tx's outputs against s.ContractPolicy.
+func (s *Snapshot) checkContracts(tx *bc.Tx) error {
+	if s.ContractPolicy == nil {
+		return nil
+	}
+	for _, con := range tx.Contracts {
+		if con.Type != bc.OutputType {
+			continue
+		}
+		err := s.ContractPolicy(con)
+		if err != nil {
+			return errors.Wrapf(err, "output %x rejected by contract policy", con.ID.Bytes())
+		}
+	}
+	return nil
+}
+
+// ValidateTxTimeRanges checks tx's time ranges against nowMS, as
+// ApplyTx checks them against the block timestamp, honoring
+// s.AnyTimerange. It checks nothing else, so a mempool can use it to
+// reject transactions that have expired, or are not yet valid,
+// without applying them.
+func (s *Snapshot) ValidateTxTimeRanges(tx *bc.Tx, nowMS uint64) error {
+	return checkTimeRanges(nowMS, tx, s.AnyTimerange)
+}
+
+// checkTimeRanges checks that blockTimeMS falls within all of tx's
+// time ranges or, if union is true, within at least one of them.
+func checkTimeRanges(blockTimeMS uint64, tx *bc.Tx, union bool) error {
+	if blockTimeMS > math.MaxInt64 {
+		return errors.WithDetailf(ErrTimeRange, "block timestamp %d out of int64 range", blockTimeMS)
+	}
+
+	for _, tr := range tx.Timeranges {
+		if inTimerange(int64(blockTimeMS), tr) {
+			if union {
+				return nil
+			}
+		} else if !union {
+			return errors.WithDetailf(ErrTimeRange, "block timestamp %d, transaction time range %d-%d", blockTimeMS, tr.MinMS, tr.MaxMS)
+		}
+	}
+	if union && len(tx.Timeranges) > 0 {
+		return errors.WithDetailf(ErrTimeRange, "block timestamp %d outside all %d transaction time ranges", blockTimeMS, len(tx.Timeranges))
+	}
+	return nil
+}
+
+// inTimerange reports whether t falls within tr. Both bounds are
+// inclusive. A MaxMS of zero (or less) means no upper bound, and a
+// MinMS of zero (or less) no lower bound, since block timestamps are
+// never negative.
+func inTimerange(t int64, tr bc.Timerange) bool {
+	return (tr.MaxMS <= 0 || t <= tr.MaxMS) && t >= tr.MinMS
+}
+
+// checkNonces checks that tx's nonces have expiration times in the
+// range of block timestamps, [0, math.MaxInt64], and refer to
+// acceptable block IDs. A larger expiration time could never be
+// reached, so the nonce would never be pruned; it can only come from
+// a negative txvm integer in the transaction log.
+func (s *Snapshot) checkNonces(tx *bc.Tx) error {
+	for _, n := range tx.Nonces {
+		if n.ExpMS > math.MaxInt64 {
+			return errors.WithDetailf(ErrNonceExpiration, "nonce %x has expiration time %d", n.ID.Bytes(), n.ExpMS)
+		}
+		if n.BlockID.IsZero() || n.BlockID == s.InitialBlockID {
+			continue
+		}
+		if !s.validNonceBlockID(n.BlockID) {
+			return errors.WithDetailf(ErrNonceBlockID, "nonce %x has block ID %x", n.ID.Bytes(), n.BlockID.Bytes())
+		}
+	}
+	return nil
+}
+
+func (s *Snapshot) validNonceBlockID(blockID bc.Hash) bool {
+	if s.NonceBlockIDValidator != nil {
+		return s.NonceBlockIDValidator(blockID)
+	}
+	i, ok := s.refIDIndex(blockID)
+	if !ok {
+		return false
+	}
+	// RefIDs ends with the latest block, so the block at index i is
+	// this many blocks before it.
+	age := uint64(len(s.RefIDs) - 1 - i)
+	return s.NonceMaxLookback == 0 || age <= s.NonceMaxLookback
+}
+
+// RefIDAt returns the ID of the block at the given height, if it is
+// among s.RefIDs. Since ApplyBlockHeader and RebuildRefIDs keep
+// RefIDs a contiguous chain of blocks ending with s.Header, the
+// height of each ID follows from its position, so no heights need to
+// be stored. RefIDs restored by New, FromBytes, or ApplyPatch, or
+// given to Verify, are checked to end with s.Header and to be no
+// more than its height in number, but cannot be checked to form a
+// chain without the blocks' headers, so they are trusted to.
+func (s *Snapshot) RefIDAt(height uint64) (bc.Hash, bool) {
+	head := s.Height()
+	n := uint64(len(s.RefIDs))
+	if height > head || n == 0 || head-height >= n {
+		return bc.Hash{}, false
+	}
+	return s.RefIDs[n-1-(head-height)], true
+}
+
+// NonceReferenceCandidates returns the block IDs that a nonce added
+// to s may currently refer to, as checked by ApplyTx: the initial
+// block's, followed by those in RefIDs within NonceMaxLookback
+// blocks of the latest, oldest first, each listed once. A nonce may
+// also have the zero block ID, which refers to no block. If
+// NonceBlockIDValidator is set, the result holds those of the
+// initial block and RefIDs that it accepts, though it may accept
+// others too. An empty state has none.
+func (s *Snapshot) NonceReferenceCandidates() []bc.Hash {
+	if s.InitialBlockID.IsZero() {
+		return nil
+	}
+	ids := []bc.Hash{s.InitialBlockID}
+	seen := map[bc.Hash]bool{s.InitialBlockID: true}
+	for _, id := range s.RefIDs {
+		if !seen[id] && s.validNonceBlockID(id) {
+			ids = append(ids, id)
+			seen[id] = true
+		}
+	}
+	return ids
+}
+
+// refIDIndex returns the index of the last occurrence of id in
+// s.RefIDs, if any.
+func (s *Snapshot) refIDIndex(id bc.Hash) (int, bool) {
+	if s.refIDset == nil {
+		for i := len(s.RefIDs) - 1; i >= 0; i-- {
+			if s.RefIDs[i] == id {
+				return i, true
+			}
+		}
+		return 0, false
+	}
+	pos, ok := s.refIDset.get(id)
+	if !ok || pos < s.refIDBase || pos-s.refIDBase >= uint64(len(s.RefIDs)) {
+		return 0, false
+	}
+	i := int(pos - s.refIDBase)
+	return i, s.RefIDs[i] == id
+}
+
+// A refIDSet maps ref IDs to their positions (see
+// Snapshot.refIDset). Its lock lets the snapshot owning it add to it
+// while the others sharing it look IDs up.
+type refIDSet struct {
+	mu  sync.RWMutex
+	pos map[bc.Hash]uint64
+}
+
+// makeRefIDSet returns an index of refIDs, for a refIDBase of 0.
+func makeRefIDSet(refIDs []bc.Hash) *refIDSet {
+	set := &refIDSet{pos: make(map[bc.Hash]uint64, len(refIDs)+1)}
+	for i, id := range refIDs {
+		set.pos[id] = uint64(i)
+	}
+	return set
+}
+
+func (set *refIDSet) get(id bc.Hash) (uint64, bool) {
+	set.mu.RLock()
+	pos, ok := set.pos[id]
+	set.mu.RUnlock()
+	return pos, ok
+}
+
+func (set *refIDSet) put(id bc.Hash, pos uint64) {
+	set.mu.Lock()
+	set.pos[id] = pos
+	set.mu.Unlock()
+}
+
+// deleteAt deletes the entries of ids, which were at consecutive
+// positions starting at pos, unless they have since moved.
+func (set *refIDSet) deleteAt(ids []bc.Hash, pos uint64) {
+	set.mu.Lock()
+	for i, id := range ids {
+		if set.pos[id] == pos+uint64(i) {
+			delete(set.pos, id)
+		}
+	}
+	set.mu.Unlock()
+}
+
+func (set *refIDSet) len() int {
+	set.mu.RLock()
+	defer set.mu.RUnlock()
+	return len(set.pos)
+}
+
+func (set *refIDSet) clone() *refIDSet {
+	set.mu.RLock()
+	defer set.mu.RUnlock()
+	c := &refIDSet{pos: make(map[bc.Hash]uint64, len(set.pos))}
+	for id, pos := range set.pos {
+		c.pos[id] = pos
+	}
+	return c
+}
+
+// updateTrees adds tx's nonces and outputs to s's trees and removes its
+// inputs, checking for conflicting nonces and missing prevouts. It
+// updates s's trees in place; callers must ensure they are not
+// shared (see derive). On error, s's trees are left partially
+// updated.
+//
+// If missing is not nil, inputs absent from the contracts tree are
+// appended to it instead of causing an error.
+func (s *Snapshot) updateTrees(tx *bc.Tx, missing *[]bc.Hash) error {
+	for _, n := range tx.Nonces {
+		// Add new nonces. They must not conflict with nonces already
+		// present.
+		nc := NonceCommitment(n.ID, n.ExpMS)
+		if s.NonceTree.Contains(nc) {
+			return errors.WithDetailf(ErrConflictingNonce, "nonce %x", n.ID.Bytes())
+		}
+		s.NonceTree.Insert(nc)
+	}
+	return s.updateContracts(tx, missing)
+}
+
+// updateContracts is the part of updateTrees updating the contracts
+// tree.
+func (s *Snapshot) updateContracts(tx *bc.Tx, missing *[]bc.Hash) error {
+
+	// Add or remove contracts, depending on if it is an input or output.
+	// Contracts are processed in order, so a transaction may spend a
+	// contract and then create an output with the same ID, but may not
+	// create an output that already exists.
+	for _, con := range tx.Contracts {
+		switch con.Type {
+		case bc.InputType:
+			if !s.ContractsTree.Delete(con.ID.Bytes()) {
+				if missing != nil {
+					*missing = append(*missing, con.ID)
+					continue
+				}
+				return errors.WithDetailf(ErrInvalidPrevout, "prevout %x", con.ID.Bytes())
+			}
+			s.forgetContractHeight(con.ID)
+
+		case bc.OutputType:
+			err := insertOutput(s.ContractsTree, con.ID)
+			if err != nil {
+				return err
+			}
+			s.recordContractHeight(con.ID)
+		}
+	}
+
+	return s.checkContractsLen()
+}
+
+// checkContractsLen checks s's contracts tree against MaxContracts.
+func (s *Snapshot) checkContractsLen() error {
+	if s.MaxContracts > 0 && s.ContractsTree.Len() > s.MaxContracts {
+		return errors.WithDetailf(ErrTooManyContracts, "%d contracts, limit %d", s.ContractsTree.Len(), s.MaxContracts)
+	}
+	return nil
+}
+
+// insertOutput adds an output contract ID to tree, which must not
+// already contain it.
+func insertOutput(tree *patricia.Tree, id bc.Hash) error {
+	n := tree.Len()
+	err := tree.Insert(id.Bytes())
+	if err != nil {
+		return err
+	}
+	if tree.Len() == n {
+		return errors.WithDetailf(ErrDuplicateOutput, "output %x", id.Bytes())
+	}
+	return nil
+}
+
+// recordContractHeight records, if s.TrackContractHeights is true,
+// that the contract with the given ID was created at s's height.
+func (s *Snapshot) recordContractHeight(id bc.Hash) {
+	s.forgetContractHeight(id)
+	if !s.TrackContractHeights {
+		return
+	}
+	if s.contractHeights == nil {
+		s.contractHeights = new(patricia.Tree)
+	}
+	item := make([]byte, 40)
+	copy(item, id.Bytes())
+	binary.BigEndian.PutUint64(item[32:], s.Height())
+	s.contractHeights.Insert(item) // items are all 40 bytes, so prefix-free
+}
+
+// forgetContractHeight removes any recorded height of the contract
+// with the given ID.
+func (s *Snapshot) forgetContractHeight(id bc.Hash) {
+	if s.contractHeights != nil {
+		s.contractHeights.DeletePrefix(id.Bytes())
+	}
+}
+
+// ContractHeight returns the height of the block in which the
+// contract with the given ID was created, if it is in s's contracts
+// tree and its height was recorded (see TrackContractHeights).
+func (s *Snapshot) ContractHeight(id bc.Hash) (uint64, bool) {
+	if s == nil || s.contractHeights == nil || !s.ContainsContract(id) {
+		return 0, false
+	}
+	var (
+		height uint64
+		ok     bool
+	)
+	s.contractHeights.WalkPrefix(id.Bytes(), func(item []byte) error {
+		height, ok = binary.BigEndian.Uint64(item[32:]), true
+		return nil
+	})
+	return height, ok
+}
+
+// Height returns the height from the stored latest header.
+func (s *Snapshot) Height() uint64 {
+	if s == nil || s.Header == nil {
+		return 0
+	}
+	return s.Header.Height
+}
+
+// TimestampMS returns the timestamp from the stored latest header.
+func (s *Snapshot) TimestampMS() uint64 {
+	if s == nil || s.Header == nil {
+		return 0
+	}
+	return s.Header.TimestampMs
+}
+
+// HeadInfo returns the height, timestamp, and block ID of the
+// stored latest header, with ok false if there is none.
+func (s *Snapshot) HeadInfo() (height, timestampMS uint64, blockID bc.Hash, ok bool) {
+	if s == nil || s.Header == nil {
+		return 0, 0, bc.Hash{}, false
+	}
+	return s.Header.Height, s.Header.TimestampMs, s.Header.Hash(), true
+}
+
+// ContainsContract reports whether the contract with the given
+// snapshot ID is in s's contracts tree.
+func (s *Snapshot) ContainsContract(id bc.Hash) bool {
+	if s == nil || s.ContractsTree == nil {
+		return false
+	}
+	return s.ContractsTree.Contains(id.Bytes())
+}
+
+// Reserve marks the contract with the given ID as reserved, such as
+// by a mempool for a transaction being built that spends it, so that
+// ContainsUnreservedContract excludes it. It reports whether the
+// contract is in s's contracts tree and was not already reserved.
+//
+// Reservations are not part of the blockchain state: a reserved
+// contract is still in s's contracts tree, so ContainsContract and
+// ApplyTx treat it as present, and reservations do not affect Equal,
+// Root, or Bytes. For the same reason, Reserve and Release may be
+// used on a sealed snapshot. Copies of s have s's reservations,
+// but are reserved and released independently.
+func (s *Snapshot) Reserve(id bc.Hash) bool {
+	if !s.ContainsContract(id) || s.reserved != nil && s.reserved.Contains(id.Bytes()) {
+		return false
+	}
+	if s.reserved == nil {
+		s.reserved = new(patricia.Tree)
+	}
+	s.reserved.Insert(id.Bytes())
+	return true
+}
+
+// Release removes the reservation, if any, of the contract with the
+// given ID. Call it when the transaction that reserved the contract
+// is abandoned or confirmed.
+func (s *Snapshot) Release(id bc.Hash) {
+	if s.reserved != nil {
+		s.reserved.Delete(id.Bytes())
+	}
+}
+
+// ContainsUnreservedContract reports whether the contract with the
+// given ID is in s's contracts tree and is not reserved (see
+// Reserve).
+func (s *Snapshot) ContainsUnreservedContract(id bc.Hash) bool {
+	if !s.ContainsContract(id) {
+		return false
+	}
+	return s.reserved == nil || !s.reserved.Contains(id.Bytes())
+}
+
+// ContainsContracts reports, for each of ids, whether the contract
+// with that ID is in s's contracts tree. It is equivalent to calling
+// ContainsContract for each ID, but looks them up in a single pass
+// over the tree (see patricia.Tree.ContainsMany), such as for the
+// inputs of a block.
+func (s *Snapshot) ContainsContracts(ids []bc.Hash) []bool {
+	if s == nil || s.ContractsTree == nil {
+		return make([]bool, len(ids))
+	}
+	items := make([][]byte, len(ids))
+	for i, id := range ids {
+		items[i] = id.Bytes()
+	}
+	return s.ContractsTree.ContainsMany(items)
+}
+
+// ContainsNonce reports whether the nonce with the given ID and
+// expiration time is in s's nonce tree.
+func (s *Snapshot) ContainsNonce(id bc.Hash, expMS uint64) bool {
+	if s == nil || s.NonceTree == nil {
+		return false
+	}
+	return s.NonceTree.Contains(NonceCommitment(id, expMS))
+}
+
+// NonceProof returns a proof that the nonce with the given ID and
+// expiration time is, or is not, in s's nonce tree, as
+// ContainsNonce reports. The boolean result tells which. The proof
+// can be checked with VerifyNonceProof against the nonce tree's
+// root hash alone.
+func (s *Snapshot) NonceProof(id bc.Hash, expMS uint64) (*patricia.Proof, bool) {
+	tree := new(patricia.Tree)
+	if s != nil && s.NonceTree != nil {
+		tree = s.NonceTree
+	}
+	return tree.Proof(NonceCommitment(id, expMS))
+}
+
+// VerifyNonceProof reports whether p, as produced by NonceProof, is
+// a valid proof that the nonce with the given ID and expiration time
+// is in (if p.Member is true) or is not in (if p.Member is false) a
+// nonce tree with the given root hash.
+func VerifyNonceProof(root bc.Hash, id bc.Hash, expMS uint64, p *patricia.Proof) bool {
+	return patricia.VerifyProof(root.Byte32(), NonceCommitment(id, expMS), p)
+}
+
+// ContractCount returns the number of contracts in s's contracts
+// tree.
+func (s *Snapshot) ContractCount() int {
+	if s == nil || s.ContractsTree == nil {
+		return 0
+	}
+	return s.ContractsTree.Len()
+}
+
+// NonceCount returns the number of nonces in s's nonce tree.
+func (s *Snapshot) NonceCount() int {
+	if s == nil || s.NonceTree == nil {
+		return 0
+	}
+	return s.NonceTree.Len()
+}
+
+// EachContract calls f with the snapshot ID of each contract in s's
+// contracts tree. If f returns an error, iteration stops and the
+// error is returned.
+func (s *Snapshot) EachContract(f func(id bc.Hash) error) error {
+	if s == nil || s.ContractsTree == nil {
+		return nil
+	}
+	return patricia.Walk(s.ContractsTree, func(item []byte) error {
+		id, err := bc.HashFromBytesChecked(item)
+		if err != nil {
+			return errors.Wrapf(err, "contract ID %x", item)
+		}
+		return f(id)
+	})
+}
+
+// EachNonce calls f with the ID and expiration time of each nonce in
+// s's nonce tree. If f returns an error, iteration stops and the
+// error is returned.
+func (s *Snapshot) EachNonce(f func(id bc.Hash, expMS uint64) error) error {
+	if s == nil || s.NonceTree == nil {
+		return nil
+	}
+	return patricia.Walk(s.NonceTree, func(item []byte) error {
+		return f(idTime(item))
+	})
+}
+
+// NonceExpiryHistogram counts the nonces in s's nonce tree by
+// expiration time, in buckets of bucketMS milliseconds. The result
+// maps expMS/bucketMS to the number of nonces in that bucket; empty
+// buckets are omitted. A bucketMS of 0 is treated as 1.
+func (s *Snapshot) NonceExpiryHistogram(bucketMS uint64) map[uint64]int {
+	if bucketMS == 0 {
+		bucketMS = 1
+	}
+	hist := make(map[uint64]int)
+	s.EachNonce(func(_ bc.Hash, expMS uint64) error {
+		hist[expMS/bucketMS]++
+		return nil
+	})
+	return hist
+}
+
+// ContractCountByPrefix counts the contracts in s's contracts tree
+// by the first prefixLen bytes of their IDs. The result maps each
+// prefix, as a string, to the number of contracts with that prefix;
+// prefixes with no contracts are omitted. A prefixLen of 0 or less
+// gives a single bucket, the empty prefix, holding the total; one of
+// more than 32 is treated as 32.
+func (s *Snapshot) ContractCountByPrefix(prefixLen int) map[string]int {
+	if prefixLen <= 0 {
+		return map[string]int{"": s.ContractCount()}
+	}
+	if prefixLen > 32 {
+		prefixLen = 32
+	}
+	counts := make(map[string]int)
+	s.EachContract(func(id bc.Hash) error {
+		counts[string(id.Bytes()[:prefixLen])]++
+		return nil
+	})
+	return counts
+}
+
+// Root returns the state root of s, a single commitment to its
+// contracts tree, nonce tree, and initial block ID.
+// See bc.StateRoot.
+func (s *Snapshot) Root() bc.Hash {
+	return bc.StateRoot(s.InitialBlockID, bc.NewHash(s.ContractsTree.RootHash()), bc.NewHash(s.NonceTree.RootHash()))
+}
+
+// ValidateAgainst checks that s's state root matches the state root
+// committed to by bh, as it should after bh's block is applied.
+func (s *Snapshot) ValidateAgainst(bh *bc.BlockHeader) error {
+	got, want := s.Root(), bh.StateRoot(s.InitialBlockID)
+	if got == want {
+		return nil
+	}
+	var which []string
+	if bh.ContractsRoot == nil || bh.ContractsRoot.Byte32() != s.ContractsTree.RootHash() {
+		which = append(which, "contracts")
+	}
+	if bh.NoncesRoot == nil || bh.NoncesRoot.Byte32() != s.NonceTree.RootHash() {
+		which = append(which, "nonces")
+	}
+	return errors.WithDetailf(ErrBadStateRoot, "computed %x, block header wants %x (mismatched %s)", got.Bytes(), want.Bytes(), strings.Join(which, ", "))
+}
+
+// NonceCommitment returns the byte commitment
+// for the given nonce id and expiration.
+func NonceCommitment(id bc.Hash, expms uint64) []byte {
+	b := make([]byte, 40)
+	copy(b[:32], id.Bytes())
+	binary.LittleEndian.PutUint64(b[32:], expms)
 	return b
 }
 
+// DecodeNonceCommitment decodes a nonce commitment produced by
+// NonceCommitment into its id and expiration. It is an error for b
+// not to be a 40-byte commitment.
+func DecodeNonceCommitment(b []byte) (id bc.Hash, expMS uint64, err error) {
+	if len(b) != 40 {
+		return bc.Hash{}, 0, fmt.Errorf("nonce commitment has length %d, want 40", len(b))
+	}
+	id, expMS = idTime(b)
+	return id, expMS, nil
+}
+
+// idTime is DecodeNonceCommitment for commitments known to be
+// well-formed, such as those in a nonce tree.
 func idTime(b []byte) (bc.Hash, uint64) {
 	h := bc.HashFromBytes(b[:32])
 	t := binary.LittleEndian.Uint64(b[32:])
@@ -1,10 +1,21 @@
 package state
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
 	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 
+	"github.com/chain/txvm/errors"
 	"github.com/chain/txvm/protocol/bc"
+	"github.com/chain/txvm/protocol/patricia"
 )
 
 func empty(t *testing.T) *Snapshot {
@@ -24,6 +35,16 @@ func empty(t *testing.T) *Snapshot {
 	return s
 }
 
+// prevID returns the ID of the latest block applied to s, to use as
+// the PreviousBlockId of the next block, or nil if there is none.
+func prevID(s *Snapshot) *bc.Hash {
+	if s.Header == nil {
+		return nil
+	}
+	h := s.Header.Hash()
+	return &h
+}
+
 func TestApplyTxSpend(t *testing.T) {
 	snap := empty(t)
 	spentOutputID := bc.NewHash([32]byte{1})
@@ -39,9 +60,13 @@ func TestApplyTxSpend(t *testing.T) {
 	if snap.ContractsTree.Contains(spentOutputID.Bytes()) {
 		t.Error("snapshot contains spent prevout")
 	}
+	root := snap.Root()
 	err = snap.ApplyTx(0, tx)
-	if err == nil {
-		t.Error("expected error applying spend twice, got nil")
+	if err == nil || !strings.Contains(err.Error(), "invalid prevout") {
+		t.Errorf("applying spend twice: got error %v, want invalid prevout", err)
+	}
+	if snap.Root() != root {
+		t.Error("failed spend changed the snapshot")
 	}
 }
 
@@ -73,6 +98,183 @@ func TestCopySnapshot(t *testing.T) {
 	}
 }
 
+// TestCopySharedRefIDs extends a snapshot and its copy with
+// different headers at once. Run it with -race.
+func TestCopySharedRefIDs(t *testing.T) {
+	snap := empty(t)
+	for i := 0; i < 3; i++ {
+		err := snap.ApplyBlockHeader(&bc.BlockHeader{
+			Height:          snap.Height() + 1,
+			TimestampMs:     snap.Header.TimestampMs + 1,
+			PreviousBlockId: prevID(snap),
+			NextPredicate:   &bc.Predicate{},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := append([]bc.Hash(nil), snap.RefIDs...)
+
+	// The two snapshots get headers with different timestamps, and
+	// so different IDs.
+	dupe := Copy(snap)
+	var wg sync.WaitGroup
+	for i, s := range []*Snapshot{snap, dupe} {
+		wg.Add(1)
+		go func(i int, s *Snapshot) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				err := s.ApplyBlockHeader(&bc.BlockHeader{
+					Height:          s.Height() + 1,
+					TimestampMs:     s.Header.TimestampMs + uint64(i) + 1,
+					PreviousBlockId: prevID(s),
+					NextPredicate:   &bc.Predicate{},
+				})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i, s)
+	}
+	wg.Wait()
+
+	for _, s := range []*Snapshot{snap, dupe} {
+		if !reflect.DeepEqual(s.RefIDs[:len(want)], want) {
+			t.Errorf("got ref IDs %x, want them to begin with %x", s.RefIDs, want)
+		}
+		if s.RefIDs[len(s.RefIDs)-1] != s.Header.Hash() {
+			t.Error("latest ref ID is not the header's")
+		}
+	}
+	if snap.Header.Hash() == dupe.Header.Hash() {
+		t.Error("snapshot and copy have the same header")
+	}
+}
+
+func TestSeal(t *testing.T) {
+	base, block := randomValidBlock(t, 20)
+	base.Seal()
+	want := Copy(base)
+
+	mutators := []struct {
+		name string
+		f    func(s *Snapshot)
+	}{
+		{"ApplyBlock", func(s *Snapshot) { s.ApplyBlock(block) }},
+		{"ApplyBlockHeader", func(s *Snapshot) { s.ApplyBlockHeader(block.BlockHeader) }},
+		{"ApplyTx", func(s *Snapshot) { s.ApplyTx(block.TimestampMs, block.Transactions[0]) }},
+		{"ApplyTxs", func(s *Snapshot) { s.ApplyTxs(block.TimestampMs, block.Transactions) }},
+		{"PruneNonces", func(s *Snapshot) { s.PruneNonces(math.MaxUint64) }},
+		{"ConsumeNonce", func(s *Snapshot) { s.ConsumeNonce(bc.Hash{}, 0) }},
+	}
+	for _, m := range mutators {
+		func() {
+			defer func() {
+				if r := recover(); r != ErrSealed {
+					t.Errorf("%s on a sealed snapshot: got panic %v, want %v", m.name, r, ErrSealed)
+				}
+			}()
+			m.f(base)
+		}()
+	}
+	if !base.Equal(want) {
+		t.Errorf("sealed snapshot was modified: %s", Diff(base, want))
+	}
+
+	// Immutable methods and copies are unaffected.
+	applied, err := base.ApplyBlockImmutable(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if applied.Sealed() {
+		t.Error("ApplyBlockImmutable returned a sealed snapshot")
+	}
+	for name, c := range map[string]*Snapshot{"Copy": Copy(base), "Clone": base.Clone()} {
+		if c.Sealed() {
+			t.Errorf("%s returned a sealed snapshot", name)
+		}
+		err := c.ApplyBlock(block)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if !c.Equal(applied) {
+			t.Errorf("%s: %s", name, Diff(c, applied))
+		}
+	}
+
+	base.Unseal()
+	err = base.ApplyBlock(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !base.Equal(applied) {
+		t.Errorf("unsealed snapshot: %s", Diff(base, applied))
+	}
+}
+
+// TestApplyBlockAllocs checks that applying a block in place
+// appends to RefIDs and its index rather than copying them, so
+// neither the number nor the size of its allocations grows with the
+// number of ref IDs.
+func TestApplyBlockAllocs(t *testing.T) {
+	const runs = 100
+	allocs := func(n, max int) (count float64, size uint64) {
+		snap := empty(t)
+		ids := make([]bc.Hash, n-1, n)
+		for i := range ids {
+			ids[i] = bc.NewHash([32]byte{1, byte(i), byte(i >> 8), byte(i >> 16)})
+		}
+		snap.RefIDs = append(ids, snap.RefIDs...)
+		snap.MaxRefIDs = max
+		apply := func() {
+			err := snap.ApplyBlock(&bc.Block{BlockHeader: &bc.BlockHeader{
+				Height:          snap.Height() + 1,
+				TimestampMs:     snap.Height() + 1,
+				PreviousBlockId: prevID(snap),
+				NextPredicate:   &bc.Predicate{},
+			}})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		apply() // the first block indexes RefIDs
+		count = testing.AllocsPerRun(runs, apply)
+
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		for i := 0; i < runs; i++ {
+			apply()
+		}
+		runtime.ReadMemStats(&after)
+		return count, (after.TotalAlloc - before.TotalAlloc) / runs
+	}
+	smallCount, smallBytes := allocs(10, 0)
+	for _, c := range []struct{ n, max int }{{100000, 0}, {100000, 100000}} {
+		count, size := allocs(c.n, c.max)
+		if count > smallCount {
+			t.Errorf("ApplyBlock with %d ref IDs (MaxRefIDs %d): %v allocations, want at most %v as with 10", c.n, c.max, count, smallCount)
+		}
+		// Copying RefIDs alone would take 32 bytes per ref ID.
+		if size > 2*smallBytes {
+			t.Errorf("ApplyBlock with %d ref IDs (MaxRefIDs %d): %d bytes allocated, want at most %d", c.n, c.max, size, 2*smallBytes)
+		}
+	}
+}
+
+func BenchmarkCopy(b *testing.B) {
+	snap := Empty()
+	snap.RefIDs = make([]bc.Hash, 100000)
+	for i := range snap.RefIDs {
+		snap.RefIDs[i] = bc.NewHash([32]byte{byte(i), byte(i >> 8), byte(i >> 16)})
+	}
+	snap.refIDset = makeRefIDSet(snap.RefIDs)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Copy(snap)
+	}
+}
+
 func TestApplyBlock(t *testing.T) {
 	maxTime := uint64(10)
 	// Setup a snapshot with a nonce with a known expiry.
@@ -82,9 +284,10 @@ func TestApplyBlock(t *testing.T) {
 	// Land a block later than the issuance's max time.
 	block := &bc.Block{
 		BlockHeader: &bc.BlockHeader{
-			Height:        2,
-			TimestampMs:   maxTime + 1,
-			NextPredicate: &bc.Predicate{},
+			Height:          2,
+			TimestampMs:     maxTime + 1,
+			PreviousBlockId: prevID(snap),
+			NextPredicate:   &bc.Predicate{},
 		},
 	}
 	err := snap.ApplyBlock(block)
@@ -116,8 +319,10 @@ func TestApplyBlock(t *testing.T) {
 	snap = empty(t)
 	block = &bc.Block{
 		BlockHeader: &bc.BlockHeader{
-			Height:        2,
-			NextPredicate: &bc.Predicate{},
+			Height:          2,
+			TimestampMs:     2,
+			PreviousBlockId: prevID(snap),
+			NextPredicate:   &bc.Predicate{},
 		},
 		Transactions: []*bc.Tx{{
 			Contracts: []bc.Contract{{
@@ -132,134 +337,3219 @@ func TestApplyBlock(t *testing.T) {
 	}
 }
 
-func TestApplyTx(t *testing.T) {
-	tx := &bc.Tx{}
-	snap := Empty()
+// TestApplyBlockPhases checks that ApplyBlock, which updates the
+// nonce tree once for the whole block, gives the same result as
+// applying its phases one at a time.
+func TestApplyBlockPhases(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	randHash := func() bc.Hash {
+		var b [32]byte
+		rng.Read(b[:])
+		return bc.NewHash(b)
+	}
 
-	err := snap.ApplyTx(0, tx)
-	if err == nil {
-		t.Error("expected uninitialized error")
+	var valid, invalid int
+	for i := 0; i < 300; i++ {
+		snap := empty(t)
+		var existing []bc.Nonce
+		for j := rng.Intn(50); j > 0; j-- {
+			n := bc.Nonce{ID: randHash(), ExpMS: uint64(rng.Intn(20))}
+			snap.NonceTree.Insert(NonceCommitment(n.ID, n.ExpMS))
+			existing = append(existing, n)
+		}
+		if rng.Intn(2) == 0 {
+			snap.PruneNonces(0) // build the expiration index first
+		}
+
+		const timestampMS = 10
+		block := &bc.Block{BlockHeader: &bc.BlockHeader{
+			Height:          2,
+			TimestampMs:     timestampMS,
+			PreviousBlockId: prevID(snap),
+			NextPredicate:   &bc.Predicate{},
+		}}
+		var added []bc.Nonce
+		for j := rng.Intn(10); j > 0; j-- {
+			tx := &bc.Tx{
+				Contracts: []bc.Contract{{Type: bc.OutputType, ID: randHash()}},
+			}
+			for k := rng.Intn(3); k > 0; k-- {
+				n := bc.Nonce{ID: randHash(), ExpMS: timestampMS + uint64(rng.Intn(10))}
+				switch r := rng.Intn(20); {
+				case r == 0 && len(existing) > 0:
+					// Re-add an existing nonce, which conflicts
+					// unless it is pruned by this block.
+					n = existing[rng.Intn(len(existing))]
+				case r == 1 && len(added) > 0:
+					n = added[rng.Intn(len(added))]
+				}
+				tx.Nonces = append(tx.Nonces, n)
+				added = append(added, n)
+			}
+			block.Transactions = append(block.Transactions, tx)
+		}
+
+		// Apply the phases separately.
+		want := Copy(snap)
+		want.PruneNonces(timestampMS)
+		wantErr := want.ApplyBlockHeader(block.BlockHeader)
+		if wantErr != nil {
+			t.Fatal(wantErr)
+		}
+		failing := -1
+		for j, tx := range block.Transactions {
+			wantErr = want.ApplyTx(timestampMS, tx)
+			if wantErr != nil {
+				failing = j
+				break
+			}
+		}
+
+		got := Copy(snap)
+		err := got.ApplyBlock(block)
+		if errors.Root(err) != errors.Root(wantErr) {
+			t.Fatalf("case %d: got error %v, want %v", i, err, wantErr)
+		}
+		if err != nil {
+			invalid++
+			if want := fmt.Sprintf("transaction %d", failing); !strings.Contains(err.Error(), want) {
+				t.Errorf("case %d: got error %v, want failure in %s", i, err, want)
+			}
+			if !got.Equal(snap) {
+				t.Errorf("case %d: failed block changed the snapshot: %s", i, Diff(got, snap))
+			}
+			continue
+		}
+		valid++
+		if !got.Equal(want) {
+			t.Fatalf("case %d: %s", i, Diff(got, want))
+		}
+
+		// The expiration index must be up to date too.
+		for _, ts := range []uint64{timestampMS + 5, timestampMS + 10} {
+			if g, w := got.PruneNonces(ts), want.PruneNonces(ts); g != w {
+				t.Errorf("case %d: pruning at %d removed %d nonces, want %d", i, ts, g, w)
+			}
+			if !got.Equal(want) {
+				t.Errorf("case %d: after pruning at %d: %s", i, ts, Diff(got, want))
+			}
+		}
+	}
+	if valid == 0 || invalid == 0 {
+		t.Errorf("%d valid and %d invalid blocks, want some of each", valid, invalid)
 	}
+}
 
-	snap = empty(t)
-	tx = &bc.Tx{Timeranges: []bc.Timerange{{MinMS: 100, MaxMS: 200}}}
-	err = snap.ApplyTx(50, tx)
-	if err == nil {
-		t.Error("expected mintime error")
+func TestValidateBlock(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	var valid int
+	for i := 0; i < 100; i++ {
+		snap, block := randomBlock(t, rng, 10, 20)
+		before := Copy(snap)
+
+		err := snap.ValidateBlock(block)
+		if !snap.Equal(before) {
+			t.Fatalf("case %d: ValidateBlock changed the snapshot: %s", i, Diff(snap, before))
+		}
+		applyErr := snap.ApplyBlock(block)
+		if (err == nil) != (applyErr == nil) || (err != nil && err.Error() != applyErr.Error()) {
+			t.Fatalf("case %d: ValidateBlock error %v, ApplyBlock error %v", i, err, applyErr)
+		}
+		if err == nil {
+			valid++
+		}
 	}
-	err = snap.ApplyTx(300, tx)
+	if valid == 0 {
+		t.Error("no valid blocks generated")
+	}
+}
+
+func TestValidateAndApply(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	var valid int
+	for i := 0; i < 100; i++ {
+		snap, block := randomBlock(t, rng, 10, 20)
+		want := Copy(snap)
+		wantErr := want.ApplyBlock(block)
+
+		before := Copy(snap)
+		err := snap.ValidateAndApply(block)
+		if (err == nil) != (wantErr == nil) {
+			t.Fatalf("case %d: got error %v, want %v", i, err, wantErr)
+		}
+		if err != nil {
+			if !snap.Equal(before) {
+				t.Errorf("case %d: invalid block changed the snapshot: %s", i, Diff(snap, before))
+			}
+			continue
+		}
+		valid++
+		if !snap.Equal(want) {
+			t.Errorf("case %d: %s", i, Diff(snap, want))
+		}
+	}
+	if valid == 0 {
+		t.Error("no valid blocks generated")
+	}
+}
+
+func TestNonceConflictOrigin(t *testing.T) {
+	h := func(b byte) bc.Hash { return bc.NewHash([32]byte{b}) }
+	snap := empty(t)
+	snap.NonceTree.Insert(NonceCommitment(h(1), 100))
+	block := func(nonces ...bc.Nonce) *bc.Block {
+		b := &bc.Block{BlockHeader: &bc.BlockHeader{
+			Height:          2,
+			TimestampMs:     10,
+			PreviousBlockId: prevID(snap),
+			NextPredicate:   &bc.Predicate{},
+		}}
+		for _, n := range nonces {
+			b.Transactions = append(b.Transactions, &bc.Tx{Nonces: []bc.Nonce{n}})
+		}
+		return b
+	}
+
+	cases := []struct {
+		name  string
+		block *bc.Block
+		want  string
+	}{
+		{"existing state", block(bc.Nonce{ID: h(2), ExpMS: 100}, bc.Nonce{ID: h(1), ExpMS: 100}), fmt.Sprintf("transaction 1: nonce %x is already in the state", h(1).Bytes())},
+		{"earlier tx", block(bc.Nonce{ID: h(3), ExpMS: 100}, bc.Nonce{ID: h(2), ExpMS: 100}, bc.Nonce{ID: h(3), ExpMS: 100}), fmt.Sprintf("transaction 2: nonce %x was added by block transaction 0", h(3).Bytes())},
+	}
+	for _, c := range cases {
+		for _, apply := range []struct {
+			name string
+			f    func(*Snapshot, *bc.Block) error
+		}{
+			{"ApplyBlock", (*Snapshot).ApplyBlock},
+			{"ApplyBlockConcurrent", func(s *Snapshot, b *bc.Block) error { return s.ApplyBlockConcurrent(b, 2) }},
+		} {
+			err := apply.f(Copy(snap), c.block)
+			if errors.Root(err) != ErrConflictingNonce {
+				t.Errorf("%s, %s: got error %v, want %v", c.name, apply.name, err, ErrConflictingNonce)
+				continue
+			}
+			if !strings.Contains(err.Error(), c.want) {
+				t.Errorf("%s, %s: got error %q, want it to mention %q", c.name, apply.name, err, c.want)
+			}
+		}
+	}
+}
+
+func TestHeadersFirst(t *testing.T) {
+	h := func(b byte) bc.Hash { return bc.NewHash([32]byte{b}) }
+	full := empty(t)
+	var blocks []*bc.Block
+	for height := uint64(2); height <= 6; height++ {
+		b := byte(height)
+		block := &bc.Block{
+			BlockHeader: &bc.BlockHeader{
+				Height:          height,
+				TimestampMs:     10 * height,
+				PreviousBlockId: prevID(full),
+				NextPredicate:   &bc.Predicate{},
+			},
+			Transactions: []*bc.Tx{{
+				Contracts: []bc.Contract{{Type: bc.OutputType, ID: h(b)}},
+				Nonces:    []bc.Nonce{{ID: h(b + 100), ExpMS: 10*height + 15}},
+			}},
+		}
+		if height > 2 {
+			// Spend the previous block's output, with a nonce
+			// referring to the previous block.
+			block.Transactions = append(block.Transactions, &bc.Tx{
+				Contracts: []bc.Contract{{Type: bc.InputType, ID: h(b - 1)}},
+				Nonces:    []bc.Nonce{{ID: h(b + 200), BlockID: *prevID(full), ExpMS: 10*height + 5}},
+			})
+		}
+		err := full.ApplyBlock(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blocks = append(blocks, block)
+	}
+
+	headers := empty(t)
+	for _, block := range blocks {
+		err := headers.ApplyBlockHeader(block.BlockHeader)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if headers.Height() != full.Height() || !reflect.DeepEqual(headers.RefIDs, full.RefIDs) {
+		t.Fatalf("after headers, height %d and RefIDs %x, want %d and %x", headers.Height(), headers.RefIDs, full.Height(), full.RefIDs)
+	}
+	for _, block := range blocks {
+		err := headers.ApplyBlockBody(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !headers.Equal(full) {
+		t.Errorf("headers first: %s", Diff(headers, full))
+	}
+
+	// A body that fails leaves the snapshot unchanged.
+	before := Copy(headers)
+	err := headers.ApplyBlockBody(blocks[len(blocks)-1])
 	if err == nil {
-		t.Error("expected maxtime error")
+		t.Error("expected error applying a body twice")
 	}
-	err = snap.ApplyTx(150, tx)
-	if err != nil {
-		t.Fatal(err)
+	if !headers.Equal(before) {
+		t.Errorf("failed ApplyBlockBody changed the snapshot: %s", Diff(headers, before))
 	}
 }
 
-func TestRefIDNonce(t *testing.T) {
+func TestApplyBlockUnordered(t *testing.T) {
+	h := func(b byte) bc.Hash { return bc.NewHash([32]byte{b}) }
+	in := func(b byte) bc.Contract { return bc.Contract{Type: bc.InputType, ID: h(b)} }
+	out := func(b byte) bc.Contract { return bc.Contract{Type: bc.OutputType, ID: h(b)} }
 	snap := empty(t)
-	b1 := &bc.Block{
-		BlockHeader: &bc.BlockHeader{
-			Height:        2,
-			NextPredicate: &bc.Predicate{},
-		},
+	snap.ContractsTree.Insert(h(1).Bytes())
+	block := func(txs ...*bc.Tx) *bc.Block {
+		return &bc.Block{
+			BlockHeader: &bc.BlockHeader{
+				Height:          2,
+				TimestampMs:     10,
+				PreviousBlockId: prevID(snap),
+				NextPredicate:   &bc.Predicate{},
+			},
+			Transactions: txs,
+		}
 	}
-	err := snap.ApplyBlock(b1)
+
+	// Transaction 0 spends transaction 2's output, which spends
+	// transaction 1's.
+	tx0 := &bc.Tx{Contracts: []bc.Contract{in(3), out(4)}, Nonces: []bc.Nonce{{ID: h(10), ExpMS: 20}}}
+	tx1 := &bc.Tx{Contracts: []bc.Contract{in(1), out(2)}}
+	tx2 := &bc.Tx{Contracts: []bc.Contract{in(2), out(3)}}
+	unordered := block(tx0, tx1, tx2)
+	err := Copy(snap).ApplyBlock(unordered)
+	if errors.Root(err) != ErrInvalidPrevout {
+		t.Errorf("ApplyBlock: got error %v, want %v", err, ErrInvalidPrevout)
+	}
+	got := Copy(snap)
+	err = got.ApplyBlockUnordered(unordered)
 	if err != nil {
 		t.Fatal(err)
 	}
-	tx := &bc.Tx{
-		Nonces: []bc.Nonce{{
-			ID:      bc.NewHash([32]byte{1}),
-			BlockID: b1.Hash(),
-			ExpMS:   10000,
-		}},
+	want := Copy(snap)
+	err = want.ApplyBlock(block(tx1, tx2, tx0))
+	if err != nil {
+		t.Fatal(err)
 	}
-	err = snap.ApplyTx(100, tx)
+	if !got.Equal(want) {
+		t.Errorf("ApplyBlockUnordered: %s", Diff(got, want))
+	}
+
+	// Transaction 0 spends a contract that exists before the block
+	// and transaction 1 recreates it.
+	recreate := block(&bc.Tx{Contracts: []bc.Contract{in(1)}}, &bc.Tx{Contracts: []bc.Contract{out(1)}})
+	got = Copy(snap)
+	err = got.ApplyBlockUnordered(recreate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = Copy(snap)
+	err = want.ApplyBlock(recreate)
 	if err != nil {
 		t.Fatal(err)
 	}
+	if !got.Equal(want) {
+		t.Errorf("ApplyBlockUnordered(spend then recreate): %s", Diff(got, want))
+	}
 
-	tx = &bc.Tx{
-		Nonces: []bc.Nonce{{
-			ID:      bc.NewHash([32]byte{2}),
-			BlockID: bc.NewHash([32]byte{255}),
-			ExpMS:   10000,
-		}},
+	bad := []struct {
+		name    string
+		txs     []*bc.Tx
+		wantErr error
+	}{
+		{"double spend", []*bc.Tx{{Contracts: []bc.Contract{in(2)}}, tx1, {Contracts: []bc.Contract{in(2), out(5)}}}, ErrInvalidPrevout},
+		{"cycle", []*bc.Tx{{Contracts: []bc.Contract{in(6), out(5)}}, {Contracts: []bc.Contract{in(5), out(6)}}}, ErrInvalidPrevout},
+		{"duplicate output", []*bc.Tx{tx1, {Contracts: []bc.Contract{out(2)}}}, ErrDuplicateOutput},
 	}
-	err = snap.ApplyTx(100, tx)
-	if err == nil {
-		t.Error("expected error for applying tx with invalid block id")
+	for _, c := range bad {
+		s := Copy(snap)
+		err := s.ApplyBlockUnordered(block(c.txs...))
+		if errors.Root(err) != c.wantErr {
+			t.Errorf("%s: got error %v, want %v", c.name, err, c.wantErr)
+		}
+		if !s.Equal(snap) {
+			t.Errorf("%s: failed block modified the snapshot: %s", c.name, Diff(s, snap))
+		}
 	}
 }
 
-func TestAtomicApplyTx(t *testing.T) {
+func TestApplyBlocks(t *testing.T) {
+	h := func(b byte) bc.Hash { return bc.NewHash([32]byte{b}) }
+	full := empty(t)
+	var blocks []*bc.Block
+	for height := uint64(2); height <= 6; height++ {
+		b := byte(height)
+		block := &bc.Block{
+			BlockHeader: &bc.BlockHeader{
+				Height:          height,
+				TimestampMs:     10 * height,
+				PreviousBlockId: prevID(full),
+				NextPredicate:   &bc.Predicate{},
+			},
+			Transactions: []*bc.Tx{{
+				Contracts: []bc.Contract{{Type: bc.OutputType, ID: h(b)}},
+				Nonces:    []bc.Nonce{{ID: h(b + 100), ExpMS: 10*height + 15}},
+			}},
+		}
+		err := full.ApplyBlock(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blocks = append(blocks, block)
+	}
+
 	snap := empty(t)
-	missingSpend := &bc.Tx{
-		Nonces: []bc.Nonce{{
-			ID:      bc.NewHash([32]byte{1}),
-			BlockID: bc.Hash{},
-			ExpMS:   1000,
-		}},
-		Contracts: []bc.Contract{{
-			Type: bc.OutputType,
-			ID:   bc.NewHash([32]byte{2}),
-		}, {
-			Type: bc.InputType,
-			ID:   bc.NewHash([32]byte{3}),
-		}},
+	err := snap.ApplyBlocks(blocks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !snap.Equal(full) {
+		t.Errorf("ApplyBlocks: %s", Diff(snap, full))
 	}
 
-	wantCSRoot := snap.ContractsTree.RootHash()
-	wantNonceRoot := snap.NonceTree.RootHash()
+	// A block that fails after others have been applied.
+	invalid := *blocks[3]
+	invalid.Transactions = []*bc.Tx{{Contracts: []bc.Contract{{Type: bc.InputType, ID: h(99)}}}}
 
-	err := snap.ApplyTx(0, missingSpend)
-	if err == nil {
-		t.Fatal("expected err")
+	cases := []struct {
+		name    string
+		blocks  []*bc.Block
+		wantErr error
+		detail  string
+	}{
+		{"gap", []*bc.Block{blocks[0], blocks[1], blocks[3]}, ErrBlockHeight, "header 2 has height 5"},
+		{"reordered", []*bc.Block{blocks[1], blocks[0], blocks[2]}, ErrBlockHeight, "header 1 has height 2"},
+		{"broken link", []*bc.Block{blocks[0], {BlockHeader: &bc.BlockHeader{Height: 3, NextPredicate: &bc.Predicate{}}}}, ErrPrevBlockID, "header 1 does not link"},
+		{"not following the state", blocks[1:], ErrBlockHeight, ""},
+		{"invalid block", []*bc.Block{blocks[0], blocks[1], blocks[2], &invalid}, ErrInvalidPrevout, ""},
+	}
+	for _, c := range cases {
+		snap := empty(t)
+		before := Copy(snap)
+		err := snap.ApplyBlocks(c.blocks)
+		if errors.Root(err) != c.wantErr || !strings.Contains(errors.Detail(err), c.detail) {
+			t.Errorf("%s: got error %v, want %v with %q", c.name, err, c.wantErr, c.detail)
+		}
+		if !snap.Equal(before) {
+			t.Errorf("%s: failed ApplyBlocks changed the snapshot: %s", c.name, Diff(snap, before))
+		}
 	}
 
-	gotCSRoot := snap.ContractsTree.RootHash()
-	gotNonceRoot := snap.NonceTree.RootHash()
+	err = empty(t).ApplyBlocks([]*bc.Block{blocks[0], blocks[1], blocks[2], &invalid})
+	if want := "applying block at height 5"; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("got error %v, want it to mention %q", err, want)
+	}
 
-	if wantCSRoot != gotCSRoot {
-		t.Fatal("invalid tx affected contracts state tree")
+	// Canceling partway through leaves the snapshot unchanged.
+	snap = empty(t)
+	ctx := &countdownContext{Context: context.Background(), n: 2}
+	err = snap.ApplyBlocksContext(ctx, blocks)
+	if errors.Root(err) != context.Canceled {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
 	}
+	if !snap.Equal(empty(t)) {
+		t.Errorf("canceled ApplyBlocksContext changed the snapshot: %s", Diff(snap, empty(t)))
+	}
+}
 
-	if wantNonceRoot != gotNonceRoot {
-		t.Fatal("invalid tx affected nonces state tree")
+// countdownContext is a context that is canceled once its Err
+// method has been called n times.
+type countdownContext struct {
+	context.Context
+	n int
+}
+
+func (c *countdownContext) Err() error {
+	if c.n <= 0 {
+		return context.Canceled
 	}
+	c.n--
+	return nil
 }
 
-func TestHeaderAccessors(t *testing.T) {
-	cases := []struct {
-		snap          *Snapshot
-		wantHeight    uint64
-		wantTimestamp uint64
-	}{{
-		snap: nil,
-	}, {
-		snap: Empty(),
-	}, {
-		snap: &Snapshot{
-			Header: &bc.BlockHeader{
-				Height:      5,
-				TimestampMs: 1000,
-			},
-		},
-		wantHeight:    5,
-		wantTimestamp: 1000,
-	}}
+func TestApplyBlockPartial(t *testing.T) {
+	snap, block := randomValidBlock(t, 50)
+	want := Copy(snap)
+	err := want.ApplyBlock(block)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	for i, c := range cases {
-		gotHeight := c.snap.Height()
-		if gotHeight != c.wantHeight {
-			t.Errorf("height(%d) = %d want %d", i, gotHeight, c.wantHeight)
+	for _, steps := range [][]int{{50}, {20, 30}, {0, 10, 0, 39, 1}} {
+		got := Copy(snap)
+		var start int
+		for _, count := range steps {
+			err := got.ApplyBlockPartial(block, start, count)
+			if err != nil {
+				t.Fatalf("steps %v: applying %d transactions at %d: %v", steps, count, start, err)
+			}
+			start += count
 		}
+		if !got.Equal(want) {
+			t.Errorf("steps %v: %s", steps, Diff(got, want))
+		}
+		if got.partial {
+			t.Errorf("steps %v: still partial after the last transaction", steps)
+		}
+	}
 
-		gotTimestamp := c.snap.TimestampMS()
-		if gotTimestamp != c.wantTimestamp {
-			t.Errorf("timestamp(%d) = %d want %d", i, gotTimestamp, c.wantTimestamp)
+	next := &bc.Block{BlockHeader: &bc.BlockHeader{
+		Height:          3,
+		TimestampMs:     block.TimestampMs,
+		PreviousBlockId: prevID(want),
+		NextPredicate:   &bc.Predicate{},
+	}}
+	partial := Copy(snap)
+	err = partial.ApplyBlockPartial(block, 0, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := []struct {
+		name  string
+		apply func(*Snapshot) error
+	}{
+		{"restart", func(s *Snapshot) error { return s.ApplyBlockPartial(block, 0, 10) }},
+		{"skip ahead", func(s *Snapshot) error { return s.ApplyBlockPartial(block, 25, 10) }},
+		{"go back", func(s *Snapshot) error { return s.ApplyBlockPartial(block, 10, 10) }},
+		{"past the end", func(s *Snapshot) error { return s.ApplyBlockPartial(block, 20, 31) }},
+		{"negative count", func(s *Snapshot) error { return s.ApplyBlockPartial(block, 20, -1) }},
+		{"other block", func(s *Snapshot) error { return s.ApplyBlockPartial(next, 20, 0) }},
+		{"next block", func(s *Snapshot) error { return s.ApplyBlock(next) }},
+	}
+	for _, c := range bad {
+		s := Copy(partial)
+		err := c.apply(s)
+		if errors.Root(err) != ErrPartialBlock {
+			t.Errorf("%s: got error %v, want %v", c.name, err, ErrPartialBlock)
+		}
+		if !s.Equal(partial) || s.partialNext != 20 {
+			t.Errorf("%s: failed call changed the snapshot", c.name)
+		}
+	}
+
+	// Continuing a block that is not partially applied fails too.
+	err = Copy(snap).ApplyBlockPartial(block, 20, 10)
+	if errors.Root(err) != ErrPartialBlock {
+		t.Errorf("continuing an unstarted block: got error %v, want %v", err, ErrPartialBlock)
+	}
+	done := Copy(want)
+	err = done.ApplyBlockPartial(block, 50, 0)
+	if errors.Root(err) != ErrPartialBlock {
+		t.Errorf("continuing a finished block: got error %v, want %v", err, ErrPartialBlock)
+	}
+
+	// A failing transaction is reported by its index in the block.
+	dup := *block
+	dup.Transactions = append([]*bc.Tx(nil), block.Transactions...)
+	dup.Transactions[30] = &bc.Tx{Nonces: block.Transactions[0].Nonces}
+	s := Copy(snap)
+	err = s.ApplyBlockPartial(&dup, 0, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.ApplyBlockPartial(&dup, 20, 30)
+	if err == nil || !strings.Contains(err.Error(), "transaction 30") {
+		t.Errorf("got error %v, want failure in transaction 30", err)
+	}
+	if s.partialNext != 20 {
+		t.Errorf("after failure, next transaction is %d, want 20", s.partialNext)
+	}
+
+	// Once the block is finished, the next may be applied.
+	err = partial.ApplyBlockPartial(block, 20, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = partial.ApplyBlock(next)
+	if err != nil {
+		t.Errorf("applying the next block: %v", err)
+	}
+}
+
+func TestApplyBlockStream(t *testing.T) {
+	h := func(b byte) bc.Hash { return bc.NewHash([32]byte{b}) }
+	stream := func(txs []*bc.Tx) <-chan *bc.Tx {
+		ch := make(chan *bc.Tx)
+		go func() {
+			defer close(ch)
+			for _, tx := range txs {
+				ch <- tx
+			}
+		}()
+		return ch
+	}
+
+	full, streamed := empty(t), empty(t)
+	for height := uint64(2); height <= 4; height++ {
+		b := byte(height)
+		block := &bc.Block{
+			BlockHeader: &bc.BlockHeader{
+				Height:          height,
+				TimestampMs:     10 * height,
+				PreviousBlockId: prevID(full),
+				NextPredicate:   &bc.Predicate{},
+			},
+			Transactions: []*bc.Tx{
+				{
+					Contracts: []bc.Contract{{Type: bc.OutputType, ID: h(b)}},
+					Nonces:    []bc.Nonce{{ID: h(b + 100), ExpMS: 10*height + 15}},
+				},
+				{Contracts: []bc.Contract{{Type: bc.InputType, ID: h(b)}, {Type: bc.OutputType, ID: h(b + 50)}}},
+			},
+		}
+		err := full.ApplyBlock(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = streamed.ApplyBlockStream(block.BlockHeader, block.TimestampMs, stream(block.Transactions))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !streamed.Equal(full) {
+			t.Fatalf("height %d: %s", height, Diff(streamed, full))
+		}
+	}
+
+	bh := &bc.BlockHeader{
+		Height:          5,
+		TimestampMs:     50,
+		PreviousBlockId: prevID(full),
+		NextPredicate:   &bc.Predicate{},
+	}
+	before := Copy(streamed)
+
+	err := streamed.ApplyBlockStream(bh, 51, stream(nil))
+	if errors.Root(err) != ErrBlockTimestamp {
+		t.Errorf("mismatched timestamp: got error %v, want %v", err, ErrBlockTimestamp)
+	}
+
+	// The third transaction fails; the fourth is never read.
+	ch := make(chan *bc.Tx, 4)
+	ch <- &bc.Tx{Contracts: []bc.Contract{{Type: bc.OutputType, ID: h(60)}}}
+	ch <- &bc.Tx{Contracts: []bc.Contract{{Type: bc.OutputType, ID: h(61)}}}
+	ch <- &bc.Tx{Contracts: []bc.Contract{{Type: bc.InputType, ID: h(62)}}}
+	ch <- &bc.Tx{Contracts: []bc.Contract{{Type: bc.OutputType, ID: h(63)}}}
+	close(ch)
+	err = streamed.ApplyBlockStream(bh, 50, ch)
+	if errors.Root(err) != ErrInvalidPrevout || !strings.Contains(err.Error(), "transaction 2") {
+		t.Errorf("got error %v, want %v in transaction 2", err, ErrInvalidPrevout)
+	}
+	if len(ch) != 1 {
+		t.Errorf("%d transactions left unread, want 1", len(ch))
+	}
+	if !streamed.Equal(before) {
+		t.Errorf("failed ApplyBlockStream changed the snapshot: %s", Diff(streamed, before))
+	}
+}
+
+func TestNonceExpiryHistogram(t *testing.T) {
+	snap := Empty()
+	if got := snap.NonceExpiryHistogram(10); len(got) != 0 {
+		t.Errorf("empty snapshot: got %v, want empty", got)
+	}
+
+	for i, expMS := range []uint64{1, 5, 9, 10, 25, 29, 100} {
+		snap.NonceTree.Insert(NonceCommitment(bc.NewHash([32]byte{byte(i)}), expMS))
+	}
+	cases := []struct {
+		bucketMS uint64
+		want     map[uint64]int
+	}{
+		{10, map[uint64]int{0: 3, 1: 1, 2: 2, 10: 1}},
+		{100, map[uint64]int{0: 6, 1: 1}},
+		{0, map[uint64]int{1: 1, 5: 1, 9: 1, 10: 1, 25: 1, 29: 1, 100: 1}},
+	}
+	for _, c := range cases {
+		got := snap.NonceExpiryHistogram(c.bucketMS)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("NonceExpiryHistogram(%d) = %v, want %v", c.bucketMS, got, c.want)
+		}
+	}
+}
+
+func TestContractCountByPrefix(t *testing.T) {
+	snap := empty(t)
+	for _, id := range [][32]byte{
+		{1, 1, 1}, {1, 1, 2}, {1, 2}, {2, 1}, {2, 1, 1}, {2, 1, 2}, {3},
+	} {
+		snap.ContractsTree.Insert(id[:])
+	}
+	cases := []struct {
+		prefixLen int
+		want      map[string]int
+	}{
+		{0, map[string]int{"": 7}},
+		{-1, map[string]int{"": 7}},
+		{1, map[string]int{"\x01": 3, "\x02": 3, "\x03": 1}},
+		{2, map[string]int{"\x01\x01": 2, "\x01\x02": 1, "\x02\x01": 3, "\x03\x00": 1}},
+		{3, map[string]int{
+			"\x01\x01\x01": 1, "\x01\x01\x02": 1, "\x01\x02\x00": 1,
+			"\x02\x01\x00": 1, "\x02\x01\x01": 1, "\x02\x01\x02": 1, "\x03\x00\x00": 1,
+		}},
+	}
+	for _, c := range cases {
+		got := snap.ContractCountByPrefix(c.prefixLen)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("prefix length %d: got %v, want %v", c.prefixLen, got, c.want)
+		}
+	}
+	if got := snap.ContractCountByPrefix(40); len(got) != 7 {
+		t.Errorf("prefix length 40: got %d buckets, want 7 (one per contract)", len(got))
+	}
+	if got := Empty().ContractCountByPrefix(1); len(got) != 0 {
+		t.Errorf("empty snapshot: got %v, want no buckets", got)
+	}
+}
+
+func TestClone(t *testing.T) {
+	h := func(b byte) bc.Hash { return bc.NewHash([32]byte{b}) }
+	block := func(snap *Snapshot, out byte) *bc.Block {
+		height := snap.Height() + 1
+		return &bc.Block{
+			BlockHeader: &bc.BlockHeader{
+				Height:          height,
+				TimestampMs:     10 * height,
+				PreviousBlockId: prevID(snap),
+				NextPredicate:   &bc.Predicate{},
+			},
+			Transactions: []*bc.Tx{{
+				Contracts: []bc.Contract{{Type: bc.OutputType, ID: h(out)}},
+				Nonces:    []bc.Nonce{{ID: h(out), ExpMS: 10*height + 5}},
+			}},
+		}
+	}
+
+	orig := empty(t)
+	for i := byte(1); i <= 3; i++ {
+		err := orig.ApplyBlock(block(orig, i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := orig.Clone()
+	if !c.Equal(orig) {
+		t.Fatalf("clone differs: %s", Diff(c, orig))
+	}
+
+	// Mutate both concurrently; run with -race.
+	apply := func(snap *Snapshot, first byte) error {
+		snap.Header.NextPredicate.Version++
+		snap.Header.NextPredicate.Version--
+		for i := first; i < first+5; i++ {
+			err := snap.ApplyBlock(block(snap, i))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	errs := make(chan error, 2)
+	go func() { errs <- apply(orig, 10) }()
+	go func() { errs <- apply(c, 20) }()
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if orig.Height() != 9 || c.Height() != 9 {
+		t.Errorf("heights %d and %d, want 9", orig.Height(), c.Height())
+	}
+	if orig.Equal(c) {
+		t.Error("original and clone did not diverge")
+	}
+	for i := byte(1); i < 30; i++ {
+		inOrig := i <= 3 || (i >= 10 && i < 15)
+		inClone := i <= 3 || (i >= 20 && i < 25)
+		if orig.ContractsTree.Contains(h(i).Bytes()) != inOrig {
+			t.Errorf("original contains contract %d: %t, want %t", i, !inOrig, inOrig)
+		}
+		if c.ContractsTree.Contains(h(i).Bytes()) != inClone {
+			t.Errorf("clone contains contract %d: %t, want %t", i, !inClone, inClone)
+		}
+	}
+}
+
+type recordingObserver []string
+
+func (r *recordingObserver) OnContractCreated(id bc.Hash) {
+	*r = append(*r, fmt.Sprintf("created %d", id.Bytes()[0]))
+}
+
+func (r *recordingObserver) OnContractSpent(id bc.Hash) {
+	*r = append(*r, fmt.Sprintf("spent %d", id.Bytes()[0]))
+}
+
+func (r *recordingObserver) OnNonceAdded(id bc.Hash, expMS uint64) {
+	*r = append(*r, fmt.Sprintf("nonce %d %d", id.Bytes()[0], expMS))
+}
+
+func TestObserver(t *testing.T) {
+	h := func(b byte) bc.Hash { return bc.NewHash([32]byte{b}) }
+	snap := empty(t)
+	snap.ContractsTree.Insert(h(1).Bytes())
+	snap.ContractsTree.Insert(h(2).Bytes())
+	var rec recordingObserver
+	snap.Observer = &rec
+
+	tx := &bc.Tx{
+		Contracts: []bc.Contract{
+			{Type: bc.InputType, ID: h(1)},
+			{Type: bc.OutputType, ID: h(3)},
+			{Type: bc.InputType, ID: h(2)},
+			{Type: bc.OutputType, ID: h(1)},
+		},
+		Nonces: []bc.Nonce{{ID: h(9), ExpMS: 100}, {ID: h(8), ExpMS: 50}},
+	}
+	err := snap.ApplyTx(1, tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := recordingObserver{"nonce 9 100", "nonce 8 50", "spent 1", "created 3", "spent 2", "created 1"}
+	if !reflect.DeepEqual(rec, want) {
+		t.Errorf("got notifications %q, want %q", rec, want)
+	}
+
+	// Failing transactions, and blocks whose later transactions fail,
+	// cause no notifications.
+	rec = nil
+	err = snap.ApplyTx(1, &bc.Tx{Contracts: []bc.Contract{{Type: bc.OutputType, ID: h(4)}, {Type: bc.InputType, ID: h(2)}}})
+	if err == nil {
+		t.Error("expected error")
+	}
+	block := &bc.Block{
+		BlockHeader: &bc.BlockHeader{
+			Height:          2,
+			TimestampMs:     2,
+			PreviousBlockId: prevID(snap),
+			NextPredicate:   &bc.Predicate{},
+		},
+		Transactions: []*bc.Tx{
+			{Contracts: []bc.Contract{{Type: bc.OutputType, ID: h(5)}}},
+			{Contracts: []bc.Contract{{Type: bc.InputType, ID: h(2)}}},
+		},
+	}
+	err = snap.ApplyBlock(block)
+	if err == nil {
+		t.Error("expected error")
+	}
+	_, err = snap.ApplyTxImmutable(1, &bc.Tx{Contracts: []bc.Contract{{Type: bc.OutputType, ID: h(6)}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rec) != 0 {
+		t.Errorf("got notifications %q, want none", rec)
+	}
+
+	block.Transactions = block.Transactions[:1]
+	err = snap.ApplyBlock(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (recordingObserver{"created 5"}); !reflect.DeepEqual(rec, want) {
+		t.Errorf("got notifications %q, want %q", rec, want)
+	}
+}
+
+func TestNonceProof(t *testing.T) {
+	snap := empty(t)
+	var nonces []bc.Nonce
+	for i := byte(1); i <= 10; i++ {
+		nonces = append(nonces, bc.Nonce{ID: bc.NewHash([32]byte{i}), ExpMS: 100 + uint64(i)})
+	}
+	err := snap.ApplyTx(1, &bc.Tx{Nonces: nonces})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := bc.NewHash(snap.NonceTree.RootHash())
+
+	for _, n := range nonces {
+		p, ok := snap.NonceProof(n.ID, n.ExpMS)
+		if !ok || !p.Member {
+			t.Errorf("nonce %x: got non-membership proof", n.ID.Bytes())
+		}
+		if !VerifyNonceProof(root, n.ID, n.ExpMS, p) {
+			t.Errorf("nonce %x: membership proof does not verify", n.ID.Bytes())
+		}
+		if VerifyNonceProof(root, n.ID, n.ExpMS+1, p) {
+			t.Errorf("nonce %x: membership proof verifies for another expiration time", n.ID.Bytes())
+		}
+	}
+
+	absent := []bc.Nonce{
+		{ID: bc.NewHash([32]byte{0}), ExpMS: 100},
+		{ID: nonces[3].ID, ExpMS: 1},
+		{ID: bc.NewHash([32]byte{5, 1}), ExpMS: 105},
+		{ID: bc.NewHash([32]byte{0xff}), ExpMS: 1000},
+	}
+	for _, n := range absent {
+		p, ok := snap.NonceProof(n.ID, n.ExpMS)
+		if ok || p.Member {
+			t.Errorf("nonce %x/%d: got membership proof", n.ID.Bytes(), n.ExpMS)
+		}
+		if !VerifyNonceProof(root, n.ID, n.ExpMS, p) {
+			t.Errorf("nonce %x/%d: non-membership proof does not verify", n.ID.Bytes(), n.ExpMS)
+		}
+		if VerifyNonceProof(root, nonces[0].ID, nonces[0].ExpMS, p) {
+			t.Errorf("nonce %x/%d: non-membership proof verifies for a present nonce", n.ID.Bytes(), n.ExpMS)
+		}
+	}
+
+	// Against an empty nonce tree, every nonce is absent.
+	p, ok := Empty().NonceProof(nonces[0].ID, nonces[0].ExpMS)
+	if ok || !VerifyNonceProof(bc.NewHash(new(patricia.Tree).RootHash()), nonces[0].ID, nonces[0].ExpMS, p) {
+		t.Error("empty snapshot: bad non-membership proof")
+	}
+}
+
+func TestCounts(t *testing.T) {
+	h := func(b byte) bc.Hash { return bc.NewHash([32]byte{b}) }
+	var nilSnap *Snapshot
+	if nilSnap.ContractCount() != 0 || nilSnap.NonceCount() != 0 {
+		t.Error("nil snapshot has nonzero counts")
+	}
+	if (&Snapshot{}).ContractCount() != 0 || (&Snapshot{}).NonceCount() != 0 {
+		t.Error("snapshot without trees has nonzero counts")
+	}
+
+	snap := empty(t)
+	txs := []*bc.Tx{
+		{
+			Contracts: []bc.Contract{{Type: bc.OutputType, ID: h(1)}, {Type: bc.OutputType, ID: h(2)}},
+			Nonces:    []bc.Nonce{{ID: h(1), ExpMS: 10}},
+		},
+		{
+			Contracts: []bc.Contract{{Type: bc.InputType, ID: h(1)}, {Type: bc.OutputType, ID: h(3)}, {Type: bc.OutputType, ID: h(4)}},
+			Nonces:    []bc.Nonce{{ID: h(2), ExpMS: 10}, {ID: h(3), ExpMS: 20}},
+		},
+	}
+	wants := [][2]int{{2, 1}, {3, 3}}
+	for i, tx := range txs {
+		err := snap.ApplyTx(1, tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := [2]int{snap.ContractCount(), snap.NonceCount()}; got != wants[i] {
+			t.Errorf("after tx %d: got contract and nonce counts %v, want %v", i, got, wants[i])
+		}
+	}
+	snap.PruneNonces(15)
+	if got := snap.NonceCount(); got != 1 {
+		t.Errorf("after pruning: got %d nonces, want 1", got)
+	}
+}
+
+func TestNonceMaxLookback(t *testing.T) {
+	snap := empty(t)
+	for height := uint64(2); height <= 6; height++ {
+		err := snap.ApplyBlockHeader(&bc.BlockHeader{
+			Height:          height,
+			TimestampMs:     height,
+			PreviousBlockId: prevID(snap),
+			NextPredicate:   &bc.Predicate{},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	snap.NonceMaxLookback = 2
+
+	cases := []struct {
+		name    string
+		blockID bc.Hash
+		wantErr error
+	}{
+		{"latest block", snap.RefIDs[5], nil},
+		{"just inside", snap.RefIDs[3], nil},
+		{"just outside", snap.RefIDs[2], ErrNonceBlockID},
+		{"initial block", snap.InitialBlockID, nil},
+		{"unknown block", bc.NewHash([32]byte{1}), ErrNonceBlockID},
+	}
+	for _, c := range cases {
+		tx := &bc.Tx{Nonces: []bc.Nonce{{ID: bc.NewHash([32]byte{2}), BlockID: c.blockID, ExpMS: 100}}}
+		unindexed := Copy(snap)
+		unindexed.refIDset = nil
+		for _, s := range []*Snapshot{Copy(snap), unindexed} {
+			err := s.ApplyTx(6, tx)
+			if errors.Root(err) != c.wantErr {
+				t.Errorf("%s (indexed %t): got error %v, want %v", c.name, s.refIDset != nil, err, c.wantErr)
+			}
+		}
+	}
+
+	// With no limit, any retained block may be referred to.
+	s := Copy(snap)
+	s.NonceMaxLookback = 0
+	err := s.ApplyTx(6, &bc.Tx{Nonces: []bc.Nonce{{ID: bc.NewHash([32]byte{2}), BlockID: snap.RefIDs[2], ExpMS: 100}}})
+	if err != nil {
+		t.Errorf("without a limit: %v", err)
+	}
+}
+
+func TestRefIDAt(t *testing.T) {
+	snap := empty(t)
+	snap.MaxRefIDs = 3
+	ids := map[uint64]bc.Hash{1: snap.Header.Hash()}
+	if id, ok := snap.RefIDAt(1); !ok || id != ids[1] {
+		t.Errorf("RefIDAt(1) = %x, %v, want %x, true", id.Bytes(), ok, ids[1].Bytes())
+	}
+	for height := uint64(2); height <= 6; height++ {
+		err := snap.ApplyBlockHeader(&bc.BlockHeader{
+			Height:          height,
+			TimestampMs:     height,
+			PreviousBlockId: prevID(snap),
+			NextPredicate:   &bc.Predicate{},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[height] = snap.Header.Hash()
+	}
+
+	for height := uint64(0); height <= 7; height++ {
+		inWindow := height >= 4 && height <= 6
+		id, ok := snap.RefIDAt(height)
+		if ok != inWindow || inWindow && id != ids[height] {
+			t.Errorf("RefIDAt(%d) = %x, %v, want %x, %v", height, id.Bytes(), ok, ids[height].Bytes(), inWindow)
+		}
+	}
+	if _, ok := Empty().RefIDAt(0); ok {
+		t.Error("empty snapshot has a ref ID")
+	}
+}
+
+func TestNonceReferenceCandidates(t *testing.T) {
+	snap := empty(t)
+	for height := uint64(2); height <= 6; height++ {
+		err := snap.ApplyBlockHeader(&bc.BlockHeader{
+			Height:          height,
+			TimestampMs:     height,
+			PreviousBlockId: prevID(snap),
+			NextPredicate:   &bc.Predicate{},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	refs := snap.RefIDs // refs[0] is the initial block
+
+	lookback := Copy(snap)
+	lookback.NonceMaxLookback = 2
+	validator := Copy(snap)
+	validator.NonceBlockIDValidator = func(id bc.Hash) bool { return id == refs[4] }
+	unindexed := Copy(snap)
+	unindexed.refIDset = nil
+
+	cases := []struct {
+		name string
+		snap *Snapshot
+		want []bc.Hash
+	}{
+		{"all retained", snap, refs},
+		{"unindexed", unindexed, refs},
+		{"lookback", lookback, []bc.Hash{refs[0], refs[3], refs[4], refs[5]}},
+		{"validator", validator, []bc.Hash{refs[0], refs[4]}},
+		{"empty", Empty(), nil},
+	}
+	for _, c := range cases {
+		got := c.snap.NonceReferenceCandidates()
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %x, want %x", c.name, got, c.want)
+		}
+
+		// Exactly the candidates are accepted by ApplyTx.
+		if c.snap.InitialBlockID.IsZero() {
+			continue
+		}
+		candidate := make(map[bc.Hash]bool)
+		for _, id := range got {
+			candidate[id] = true
+		}
+		for i, id := range append(append([]bc.Hash(nil), refs...), bc.NewHash([32]byte{1})) {
+			tx := &bc.Tx{Nonces: []bc.Nonce{{ID: bc.NewHash([32]byte{byte(i), 2}), BlockID: id, ExpMS: 100}}}
+			err := Copy(c.snap).ApplyTx(6, tx)
+			if (err == nil) != candidate[id] {
+				t.Errorf("%s: block %x: ApplyTx error %v, candidate %t", c.name, id.Bytes(), err, candidate[id])
+			}
+		}
+	}
+}
+
+func TestRebuildRefIDs(t *testing.T) {
+	snap := empty(t)
+	headers := []*bc.BlockHeader{snap.Header}
+	for height := uint64(2); height <= 5; height++ {
+		bh := &bc.BlockHeader{
+			Height:          height,
+			TimestampMs:     height,
+			PreviousBlockId: prevID(snap),
+			NextPredicate:   &bc.Predicate{},
+		}
+		err := snap.ApplyBlockHeader(bh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		headers = append(headers, bh)
+	}
+	recent := *prevID(snap)
+
+	// Restore without RefIDs, as from a leaf-only export.
+	var contracts, nonces [][]byte
+	snap.EachContract(func(id bc.Hash) error {
+		contracts = append(contracts, id.Bytes())
+		return nil
+	})
+	snap.EachNonce(func(id bc.Hash, expMS uint64) error {
+		nonces = append(nonces, NonceCommitment(id, expMS))
+		return nil
+	})
+	restored, err := New(contracts, nonces, snap.Header, snap.InitialBlockID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := &bc.Tx{Nonces: []bc.Nonce{{ID: bc.NewHash([32]byte{1}), BlockID: recent, ExpMS: 100}}}
+	if err := Copy(restored).ApplyTx(5, tx); errors.Root(err) != ErrNonceBlockID {
+		t.Fatalf("before rebuilding: got error %v, want %v", err, ErrNonceBlockID)
+	}
+
+	bad := []struct {
+		name    string
+		headers []*bc.BlockHeader
+	}{
+		{"none", nil},
+		{"not ending at the state's header", headers[:4]},
+		{"gap", []*bc.BlockHeader{headers[2], headers[4]}},
+		{"out of order", []*bc.BlockHeader{headers[4], headers[3]}},
+		{"broken link", []*bc.BlockHeader{{Height: 4, NextPredicate: &bc.Predicate{}}, headers[4]}},
+	}
+	for _, c := range bad {
+		err := restored.RebuildRefIDs(c.headers)
+		if err == nil {
+			t.Errorf("%s: expected error", c.name)
+		}
+		if len(restored.RefIDs) != 0 {
+			t.Errorf("%s: RefIDs changed on error", c.name)
+		}
+	}
+
+	err = restored.RebuildRefIDs(headers[2:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(restored.RefIDs, snap.RefIDs[2:]) {
+		t.Errorf("rebuilt RefIDs %x, want %x", restored.RefIDs, snap.RefIDs[2:])
+	}
+	err = restored.ApplyTx(5, tx)
+	if err != nil {
+		t.Errorf("after rebuilding: %v", err)
+	}
+
+	restored.MaxRefIDs = 2
+	err = restored.RebuildRefIDs(headers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(restored.RefIDs, snap.RefIDs[3:]) {
+		t.Errorf("with MaxRefIDs: rebuilt RefIDs %x, want %x", restored.RefIDs, snap.RefIDs[3:])
+	}
+}
+
+func TestApplyTxSpeculative(t *testing.T) {
+	h := func(b byte) bc.Hash { return bc.NewHash([32]byte{b}) }
+	snap := empty(t)
+	snap.ContractsTree.Insert(h(1).Bytes())
+	snap.ContractsTree.Insert(h(3).Bytes())
+	var rec recordingObserver
+	snap.Observer = &rec
+
+	tx := &bc.Tx{
+		Contracts: []bc.Contract{
+			{Type: bc.InputType, ID: h(1)},
+			{Type: bc.InputType, ID: h(2)}, // absent
+			{Type: bc.InputType, ID: h(3)},
+			{Type: bc.OutputType, ID: h(4)},
+		},
+		Nonces: []bc.Nonce{{ID: h(9), ExpMS: 100}},
+	}
+	missing, err := snap.ApplyTxSpeculative(1, tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []bc.Hash{h(2)}; !reflect.DeepEqual(missing, want) {
+		t.Errorf("got missing %x, want %x", missing, want)
+	}
+	if snap.ContainsContract(h(1)) || snap.ContainsContract(h(3)) || !snap.ContainsContract(h(4)) {
+		t.Error("other inputs and outputs not applied")
+	}
+	if !snap.ContainsNonce(h(9), 100) {
+		t.Error("nonce not applied")
+	}
+	if len(rec) != 0 {
+		t.Errorf("got notifications %q, want none", rec)
+	}
+
+	missing, err = snap.ApplyTxSpeculative(1, &bc.Tx{Contracts: []bc.Contract{{Type: bc.OutputType, ID: h(5)}}})
+	if err != nil || missing != nil {
+		t.Errorf("with no missing inputs: got %x, %v", missing, err)
+	}
+
+	before := Copy(snap)
+	cases := []struct {
+		name string
+		tx   *bc.Tx
+		want error
+	}{
+		{"time range", &bc.Tx{Contracts: []bc.Contract{{Type: bc.InputType, ID: h(6)}}, Timeranges: []bc.Timerange{{MinMS: 10}}}, ErrTimeRange},
+		{"nonce conflict", &bc.Tx{Contracts: []bc.Contract{{Type: bc.InputType, ID: h(6)}}, Nonces: []bc.Nonce{{ID: h(9), ExpMS: 100}}}, ErrConflictingNonce},
+		{"duplicate output", &bc.Tx{Contracts: []bc.Contract{{Type: bc.InputType, ID: h(6)}, {Type: bc.OutputType, ID: h(4)}}}, ErrDuplicateOutput},
+	}
+	for _, c := range cases {
+		missing, err := snap.ApplyTxSpeculative(1, c.tx)
+		if errors.Root(err) != c.want || missing != nil {
+			t.Errorf("%s: got %x, %v; want error %v", c.name, missing, err, c.want)
+		}
+		if !snap.Equal(before) {
+			t.Errorf("%s: snapshot changed on error: %s", c.name, Diff(snap, before))
+		}
+	}
+}
+
+func TestCheckConflicts(t *testing.T) {
+	h := func(b byte) bc.Hash { return bc.NewHash([32]byte{b}) }
+	in := func(b byte) bc.Contract { return bc.Contract{Type: bc.InputType, ID: h(b)} }
+	out := func(b byte) bc.Contract { return bc.Contract{Type: bc.OutputType, ID: h(b)} }
+	nonce := func(b byte) bc.Nonce { return bc.Nonce{ID: h(b), ExpMS: 10} }
+
+	snap := empty(t)
+	err := snap.ApplyTx(1, &bc.Tx{Contracts: []bc.Contract{out(1), out(2)}, Nonces: []bc.Nonce{nonce(1)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name string
+		txs  []*bc.Tx
+		want []int
+	}{
+		{"independent", []*bc.Tx{
+			{Contracts: []bc.Contract{in(1)}},
+			{Contracts: []bc.Contract{in(2), out(3)}},
+			{Nonces: []bc.Nonce{nonce(2)}},
+		}, nil},
+		{"double spend", []*bc.Tx{
+			{Contracts: []bc.Contract{in(1)}},
+			{Contracts: []bc.Contract{in(2)}},
+			{Contracts: []bc.Contract{in(1)}},
+		}, []int{2}},
+		{"missing prevout", []*bc.Tx{{Contracts: []bc.Contract{in(9)}}}, []int{0}},
+		{"spend earlier output", []*bc.Tx{
+			{Contracts: []bc.Contract{out(3)}},
+			{Contracts: []bc.Contract{in(3)}},
+		}, nil},
+		{"spend later output", []*bc.Tx{
+			{Contracts: []bc.Contract{in(3)}},
+			{Contracts: []bc.Contract{out(3)}},
+		}, []int{0}},
+		{"existing output", []*bc.Tx{{Contracts: []bc.Contract{out(1)}}}, []int{0}},
+		{"duplicate output", []*bc.Tx{
+			{Contracts: []bc.Contract{out(3)}},
+			{Contracts: []bc.Contract{out(3)}},
+		}, []int{1}},
+		{"spend and recreate", []*bc.Tx{{Contracts: []bc.Contract{in(1), out(1)}}}, nil},
+		{"existing nonce", []*bc.Tx{{Nonces: []bc.Nonce{nonce(1)}}}, []int{0}},
+		{"duplicate nonce", []*bc.Tx{
+			{Nonces: []bc.Nonce{nonce(2)}},
+			{Nonces: []bc.Nonce{nonce(2)}},
+			{Nonces: []bc.Nonce{nonce(3)}},
+			{Nonces: []bc.Nonce{nonce(2), nonce(4)}},
+		}, []int{1, 3}},
+		{"same nonce, different expiration", []*bc.Tx{
+			{Nonces: []bc.Nonce{nonce(2)}},
+			{Nonces: []bc.Nonce{{ID: h(2), ExpMS: 11}}},
+		}, nil},
+		// A dropped transaction's changes do not count against later
+		// ones, even the parts that would not conflict by themselves.
+		{"dropped", []*bc.Tx{
+			{Contracts: []bc.Contract{in(1), out(3), in(9)}, Nonces: []bc.Nonce{nonce(2)}},
+			{Contracts: []bc.Contract{in(1), out(3)}, Nonces: []bc.Nonce{nonce(2)}},
+		}, []int{0}},
+	}
+	for _, c := range cases {
+		before := Copy(snap)
+		got := snap.CheckConflicts(c.txs)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got conflicts %v, want %v", c.name, got, c.want)
+		}
+		if !snap.Equal(before) {
+			t.Errorf("%s: CheckConflicts modified the snapshot: %s", c.name, Diff(snap, before))
+		}
+
+		// The rest apply in order.
+		var packed []*bc.Tx
+		for i, tx := range c.txs {
+			if len(got) > 0 && got[0] == i {
+				got = got[1:]
+				continue
+			}
+			packed = append(packed, tx)
+		}
+		err := Copy(snap).ApplyTxs(1, packed)
+		if err != nil {
+			t.Errorf("%s: applying the transactions without conflicts: %v", c.name, err)
+		}
+	}
+}
+
+func TestNonceExpirationRange(t *testing.T) {
+	id := bc.NewHash([32]byte{1})
+	for _, c := range []struct {
+		expMS uint64
+		ok    bool
+	}{
+		{math.MaxUint64, false},
+		{math.MaxInt64 + 1, false},
+		{math.MaxInt64, true},
+		{0, true},
+	} {
+		tx := &bc.Tx{Nonces: []bc.Nonce{{ID: id, ExpMS: c.expMS}}}
+		snap := empty(t)
+		err := snap.ApplyTx(1, tx)
+		if c.ok && err != nil {
+			t.Errorf("expMS %d: unexpected error %v", c.expMS, err)
+		}
+		if !c.ok && errors.Root(err) != ErrNonceExpiration {
+			t.Errorf("expMS %d: got error %v, want %v", c.expMS, err, ErrNonceExpiration)
+		}
+		if !c.ok && snap.NonceCount() != 0 {
+			t.Errorf("expMS %d: nonce added", c.expMS)
+		}
+		err = empty(t).ApplyTxNoTime(tx)
+		if !c.ok && errors.Root(err) != ErrNonceExpiration {
+			t.Errorf("expMS %d: ApplyTxNoTime got error %v, want %v", c.expMS, err, ErrNonceExpiration)
+		}
+	}
+
+	// The largest expiration time is pruned at the largest block time.
+	snap := empty(t)
+	err := snap.ApplyTx(1, &bc.Tx{Nonces: []bc.Nonce{{ID: id, ExpMS: math.MaxInt64 - 1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := snap.PruneNonces(math.MaxInt64); n != 1 {
+		t.Errorf("pruned %d nonces, want 1", n)
+	}
+}
+
+func TestHeadInfo(t *testing.T) {
+	var nilSnap *Snapshot
+	for _, s := range []*Snapshot{nilSnap, Empty()} {
+		height, ts, id, ok := s.HeadInfo()
+		if ok || height != 0 || ts != 0 || !id.IsZero() {
+			t.Errorf("HeadInfo() = %d, %d, %x, %t; want zeros and false", height, ts, id.Bytes(), ok)
+		}
+	}
+
+	snap := empty(t)
+	bh := &bc.BlockHeader{
+		Height:          2,
+		TimestampMs:     42,
+		PreviousBlockId: prevID(snap),
+		NextPredicate:   &bc.Predicate{},
+	}
+	err := snap.ApplyBlockHeader(bh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	height, ts, id, ok := snap.HeadInfo()
+	if !ok || height != 2 || ts != 42 || id != bh.Hash() {
+		t.Errorf("HeadInfo() = %d, %d, %x, %t; want 2, 42, %x, true", height, ts, id.Bytes(), ok, bh.Hash().Bytes())
+	}
+	if id != snap.RefIDs[len(snap.RefIDs)-1] {
+		t.Error("HeadInfo block ID is not the latest ref ID")
+	}
+}
+
+func TestEmptyWithInitialBlock(t *testing.T) {
+	initialID := bc.NewHash([32]byte{9})
+	snap := EmptyWithInitialBlock(initialID)
+	if snap.InitialBlockID != initialID || snap.Header != nil || snap.Height() != 0 {
+		t.Fatalf("got initial block %x, header %v", snap.InitialBlockID.Bytes(), snap.Header)
+	}
+	tx := &bc.Tx{
+		Contracts: []bc.Contract{{Type: bc.OutputType, ID: bc.NewHash([32]byte{1})}},
+		Nonces: []bc.Nonce{
+			{ID: bc.NewHash([32]byte{2}), ExpMS: 10},
+			{ID: bc.NewHash([32]byte{3}), BlockID: initialID, ExpMS: 10},
+		},
+	}
+	err := snap.ApplyTx(1, tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.ContractCount() != 1 || snap.NonceCount() != 2 {
+		t.Errorf("got %d contracts and %d nonces, want 1 and 2", snap.ContractCount(), snap.NonceCount())
+	}
+}
+
+func TestGenesis(t *testing.T) {
+	bh := &bc.BlockHeader{Version: 3, Height: 1, TimestampMs: 1, NextPredicate: &bc.Predicate{}}
+	txs := []*bc.Tx{{
+		Contracts: []bc.Contract{{Type: bc.OutputType, ID: bc.NewHash([32]byte{1})}},
+		Nonces:    []bc.Nonce{{ID: bc.NewHash([32]byte{2}), ExpMS: 10}},
+	}}
+	snap, err := Genesis(bh, txs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.InitialBlockID != bh.Hash() {
+		t.Errorf("got initial block ID %x, want %x", snap.InitialBlockID.Bytes(), bh.Hash().Bytes())
+	}
+	if snap.Height() != 1 || len(snap.RefIDs) != 1 || snap.RefIDs[0] != bh.Hash() {
+		t.Errorf("got height %d and ref IDs %x, want height 1 and the genesis block ID", snap.Height(), snap.RefIDs)
+	}
+	if snap.ContractCount() != 1 || snap.NonceCount() != 1 {
+		t.Errorf("got %d contracts and %d nonces, want 1 and 1", snap.ContractCount(), snap.NonceCount())
+	}
+
+	want := Empty()
+	err = want.ApplyBlock(&bc.Block{BlockHeader: bh, Transactions: txs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !snap.Equal(want) {
+		t.Errorf("Genesis differs from applying the block: %s", Diff(snap, want))
+	}
+
+	_, err = Genesis(&bc.BlockHeader{Height: 2, NextPredicate: &bc.Predicate{}}, nil)
+	if errors.Root(err) != ErrBlockHeight {
+		t.Errorf("height 2: got error %v, want %v", err, ErrBlockHeight)
+	}
+	_, err = Genesis(bh, append(txs, txs[0]))
+	if errors.Root(err) != ErrConflictingNonce {
+		t.Errorf("repeated transaction: got error %v, want %v", err, ErrConflictingNonce)
+	}
+}
+
+func TestValidateHeaderHeight(t *testing.T) {
+	header := func(height uint64) *bc.BlockHeader {
+		return &bc.BlockHeader{Height: height, TimestampMs: height, NextPredicate: &bc.Predicate{}}
+	}
+	cases := []struct {
+		name    string
+		snap    *Snapshot
+		bh      *bc.BlockHeader
+		wantErr bool
+	}{
+		{"height 1 on empty state", Empty(), header(1), false},
+		{"height 1 on initialized state", empty(t), header(1), true},
+		{"height 2 on empty state", Empty(), header(2), true},
+		{"height 2 on initialized state", empty(t), header(2), false},
+	}
+	for _, c := range cases {
+		c.bh.PreviousBlockId = prevID(c.snap)
+		before := Copy(c.snap)
+		err := c.snap.ValidateHeaderHeight(c.bh)
+		if (err != nil) != c.wantErr {
+			t.Errorf("%s: got error %v, want error %t", c.name, err, c.wantErr)
+		}
+		if !c.snap.Equal(before) {
+			t.Errorf("%s: ValidateHeaderHeight changed the snapshot: %s", c.name, Diff(c.snap, before))
+		}
+		if applyErr := Copy(c.snap).ApplyBlockHeader(c.bh); (applyErr == nil) != (err == nil) {
+			t.Errorf("%s: ApplyBlockHeader error %v, ValidateHeaderHeight error %v", c.name, applyErr, err)
+		}
+	}
+}
+
+func TestApplyBlockHeaderOrder(t *testing.T) {
+	cases := []struct {
+		name      string
+		height    uint64
+		timestamp uint64
+		wantErr   bool
+	}{
+		{"next block", 3, 20, false},
+		{"equal timestamp", 3, 10, false},
+		{"height gap", 4, 20, true},
+		{"same height", 2, 20, true},
+		{"height regression", 1, 20, true},
+		{"backwards timestamp", 3, 9, true},
+	}
+	for _, c := range cases {
+		snap := empty(t)
+		err := snap.ApplyBlockHeader(&bc.BlockHeader{Height: 2, TimestampMs: 10, PreviousBlockId: prevID(snap), NextPredicate: &bc.Predicate{}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		before := Copy(snap)
+		err = snap.ApplyBlock(&bc.Block{BlockHeader: &bc.BlockHeader{
+			Height:          c.height,
+			TimestampMs:     c.timestamp,
+			PreviousBlockId: prevID(snap),
+			NextPredicate:   &bc.Predicate{},
+		}})
+		if (err != nil) != c.wantErr {
+			t.Errorf("%s: got error %v, want error %t", c.name, err, c.wantErr)
+		}
+		if err != nil && !snap.Equal(before) {
+			t.Errorf("%s: failed ApplyBlock changed the snapshot: %s", c.name, Diff(snap, before))
+		}
+	}
+}
+
+func TestApplyBlockHeaderLinkage(t *testing.T) {
+	snap := empty(t)
+	wrongID := bc.NewHash([32]byte{1})
+	cases := []struct {
+		name    string
+		prevID  *bc.Hash
+		wantErr bool
+	}{
+		{"linked", prevID(snap), false},
+		{"wrong previous block ID", &wrongID, true},
+		{"missing previous block ID", nil, true},
+	}
+	for _, c := range cases {
+		got := Copy(snap)
+		err := got.ApplyBlockHeader(&bc.BlockHeader{
+			Height:          2,
+			TimestampMs:     2,
+			PreviousBlockId: c.prevID,
+			NextPredicate:   &bc.Predicate{},
+		})
+		if (err != nil) != c.wantErr {
+			t.Errorf("%s: got error %v, want error %t", c.name, err, c.wantErr)
+		}
+	}
+
+	// The initial block has no predecessor to link to.
+	err := Empty().ApplyBlockHeader(&bc.BlockHeader{
+		Height:          1,
+		PreviousBlockId: &wrongID,
+		NextPredicate:   &bc.Predicate{},
+	})
+	if err != nil {
+		t.Errorf("initial block: got error %v", err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	snap := empty(t)
+	for height := uint64(2); height <= 4; height++ {
+		err := snap.ApplyBlock(&bc.Block{
+			BlockHeader: &bc.BlockHeader{
+				Height:          height,
+				TimestampMs:     height,
+				PreviousBlockId: prevID(snap),
+				NextPredicate:   &bc.Predicate{},
+			},
+			Transactions: []*bc.Tx{{
+				Contracts: []bc.Contract{{Type: bc.OutputType, ID: bc.NewHash([32]byte{byte(height)})}},
+				Nonces:    []bc.Nonce{{ID: bc.NewHash([32]byte{byte(height)}), ExpMS: 100}},
+			}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, s := range []*Snapshot{Empty(), snap} {
+		err := s.Verify()
+		if err != nil {
+			t.Errorf("height %d: unexpected error %v", s.Height(), err)
+		}
+	}
+
+	initial := snap.RefIDs[0]
+	cases := []struct {
+		name   string
+		modify func(s *Snapshot)
+		detail string
+	}{
+		{"missing tree", func(s *Snapshot) { s.NonceTree = nil }, "missing tree"},
+		{"no initial block ID", func(s *Snapshot) { s.InitialBlockID = bc.Hash{} }, "header without an initial block ID"},
+		{"no header", func(s *Snapshot) { s.Header = nil }, "initial block ID without a header"},
+		{"zero height", func(s *Snapshot) { s.Header = &bc.BlockHeader{NextPredicate: &bc.Predicate{}} }, "height 0"},
+		{"wrong initial block", func(s *Snapshot) {
+			s.InitialBlockID = bc.NewHash([32]byte{1})
+			s.Header = &bc.BlockHeader{Height: 1, NextPredicate: &bc.Predicate{}}
+		}, "not the initial block"},
+		{"stale ref IDs", func(s *Snapshot) { s.RefIDs = s.RefIDs[:2] }, "last ref ID"},
+		{"duplicate ref IDs", func(s *Snapshot) { s.RefIDs = append([]bc.Hash{initial, initial}, s.RefIDs[2:]...) }, "duplicate ref ID"},
+		{"too many ref IDs", func(s *Snapshot) { s.RefIDs = append([]bc.Hash{{}}, s.RefIDs...) }, "5 ref IDs at height 4"},
+		{"stale ref ID index", func(s *Snapshot) { s.refIDset, s.refIDBase = makeRefIDSet(s.RefIDs[1:]), 0 }, "index does not match"},
+		{"bad contract", func(s *Snapshot) { s.ContractsTree.Insert(make([]byte, 31)) }, "contract ID"},
+		{"bad nonce", func(s *Snapshot) { s.NonceTree.Insert(make([]byte, 32)) }, "nonce commitment"},
+	}
+	for _, c := range cases {
+		s := Copy(snap)
+		s.refIDset, s.refIDBase = snap.refIDset, snap.refIDBase
+		c.modify(s)
+		err := s.Verify()
+		if errors.Root(err) != ErrInvalidSnapshot || !strings.Contains(errors.Detail(err), c.detail) {
+			t.Errorf("%s: got error %v, want %v with %q", c.name, err, ErrInvalidSnapshot, c.detail)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	snap := Empty()
+	for height := uint64(1); height <= 5; height++ {
+		var txs []*bc.Tx
+		if height > 1 {
+			txs = []*bc.Tx{{
+				Contracts: []bc.Contract{{Type: bc.OutputType, ID: bc.NewHash([32]byte{byte(height)})}},
+				Nonces:    []bc.Nonce{{ID: bc.NewHash([32]byte{byte(height), 1}), ExpMS: 100 + height}},
+			}}
+		}
+		err := snap.ApplyBlock(&bc.Block{
+			BlockHeader: &bc.BlockHeader{
+				Height:          height,
+				TimestampMs:     height,
+				PreviousBlockId: prevID(snap),
+				NextPredicate:   &bc.Predicate{},
+			},
+			Transactions: txs,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var contracts, nonces [][]byte
+	snap.EachContract(func(id bc.Hash) error {
+		contracts = append(contracts, id.Bytes())
+		return nil
+	})
+	snap.EachNonce(func(id bc.Hash, expMS uint64) error {
+		nonces = append(nonces, NonceCommitment(id, expMS))
+		return nil
+	})
+	got, err := New(contracts, nonces, snap.Header, snap.InitialBlockID, snap.RefIDs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equal(snap) {
+		t.Errorf("New: %s", Diff(got, snap))
+	}
+	checkRefIDSet(t, got)
+
+	got, err = New(nil, nil, nil, bc.Hash{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equal(Empty()) {
+		t.Errorf("New with no contents: %s", Diff(got, Empty()))
+	}
+
+	badCases := []struct {
+		name           string
+		contracts      [][]byte
+		nonces         [][]byte
+		header         *bc.BlockHeader
+		initialBlockID bc.Hash
+		refIDs         []bc.Hash
+	}{
+		{name: "header without initial block ID", header: snap.Header},
+		{name: "initial block ID without header", initialBlockID: snap.InitialBlockID},
+		{name: "ref IDs without header", refIDs: snap.RefIDs},
+		{name: "wrong initial block", header: &bc.BlockHeader{Height: 1, NextPredicate: &bc.Predicate{}}, initialBlockID: snap.InitialBlockID},
+		{name: "stale ref IDs", header: snap.Header, initialBlockID: snap.InitialBlockID, refIDs: snap.RefIDs[:2]},
+		{name: "too many ref IDs", header: snap.Header, initialBlockID: snap.InitialBlockID, refIDs: append([]bc.Hash{{}}, snap.RefIDs...)},
+		{name: "short contract ID", contracts: [][]byte{{1}}},
+		{name: "short nonce", nonces: [][]byte{{1}}},
+	}
+	for _, c := range badCases {
+		_, err := New(c.contracts, c.nonces, c.header, c.initialBlockID, c.refIDs)
+		if err == nil {
+			t.Errorf("%s: expected error", c.name)
+		}
+	}
+}
+
+func TestMaxContracts(t *testing.T) {
+	h := func(b byte) bc.Hash { return bc.NewHash([32]byte{b}) }
+	output := func(b byte) bc.Contract { return bc.Contract{Type: bc.OutputType, ID: h(b)} }
+	input := func(b byte) bc.Contract { return bc.Contract{Type: bc.InputType, ID: h(b)} }
+
+	snap := empty(t)
+	snap.MaxContracts = 3
+	snap.ContractsTree.Insert(h(1).Bytes())
+	snap.ContractsTree.Insert(h(2).Bytes())
+
+	cases := []struct {
+		name string
+		txs  []*bc.Tx
+		ok   bool
+	}{
+		{"at the cap", []*bc.Tx{{Contracts: []bc.Contract{output(3)}}}, true},
+		{"over the cap", []*bc.Tx{{Contracts: []bc.Contract{output(3), output(4)}}}, false},
+		{"over the cap in a later tx", []*bc.Tx{
+			{Contracts: []bc.Contract{output(3)}},
+			{Contracts: []bc.Contract{output(4)}},
+		}, false},
+		{"inputs offset outputs", []*bc.Tx{
+			{Contracts: []bc.Contract{input(1), output(3), output(4)}},
+			{Contracts: []bc.Contract{input(2), input(3), output(5), output(6)}},
+		}, true},
+		{"outputs before inputs", []*bc.Tx{{Contracts: []bc.Contract{output(3), output(4), input(1)}}}, true},
+	}
+	for _, c := range cases {
+		block := &bc.Block{
+			BlockHeader: &bc.BlockHeader{
+				Height:          2,
+				TimestampMs:     2,
+				PreviousBlockId: prevID(snap),
+				NextPredicate:   &bc.Predicate{},
+			},
+			Transactions: c.txs,
+		}
+		for _, concurrent := range []bool{false, true} {
+			var err error
+			s := Copy(snap)
+			if concurrent {
+				err = s.ApplyBlockConcurrent(block, 2)
+			} else {
+				err = s.ApplyBlock(block)
+			}
+			if c.ok {
+				if err != nil {
+					t.Errorf("%s (concurrent %t): unexpected error %v", c.name, concurrent, err)
+				}
+				if s.ContractsTree.Len() > s.MaxContracts {
+					t.Errorf("%s (concurrent %t): %d contracts, limit %d", c.name, concurrent, s.ContractsTree.Len(), s.MaxContracts)
+				}
+			} else if errors.Root(err) != ErrTooManyContracts {
+				t.Errorf("%s (concurrent %t): got error %v, want %v", c.name, concurrent, err, ErrTooManyContracts)
+			}
+		}
+	}
+
+	snap.MaxContracts = 0
+	err := snap.ApplyTx(2, &bc.Tx{Contracts: []bc.Contract{output(3), output(4), output(5)}})
+	if err != nil {
+		t.Errorf("unlimited: unexpected error %v", err)
+	}
+}
+
+func TestApplyTxDuplicateOutput(t *testing.T) {
+	id := bc.NewHash([32]byte{1})
+	other := bc.NewHash([32]byte{2})
+	output := func(id bc.Hash) bc.Contract { return bc.Contract{Type: bc.OutputType, ID: id} }
+	input := func(id bc.Hash) bc.Contract { return bc.Contract{Type: bc.InputType, ID: id} }
+
+	cases := []struct {
+		name      string
+		existing  []bc.Hash
+		contracts []bc.Contract
+		wantErr   bool
+	}{
+		{"duplicate outputs in one tx", nil, []bc.Contract{output(id), output(other), output(id)}, true},
+		{"output already exists", []bc.Hash{id}, []bc.Contract{output(id)}, true},
+		{"spend then recreate", []bc.Hash{id}, []bc.Contract{input(id), output(id)}, false},
+		{"create then spend", nil, []bc.Contract{output(id), input(id)}, false},
+		{"recreate then spend", []bc.Hash{id}, []bc.Contract{output(id), input(id)}, true},
+	}
+	for _, c := range cases {
+		snap := empty(t)
+		for _, e := range c.existing {
+			snap.ContractsTree.Insert(e.Bytes())
+		}
+		before := Copy(snap)
+		err := snap.ApplyTx(0, &bc.Tx{Contracts: c.contracts})
+		if (err != nil) != c.wantErr {
+			t.Errorf("%s: got error %v, want error %t", c.name, err, c.wantErr)
+		}
+		if err != nil {
+			if !strings.Contains(err.Error(), "duplicate output") {
+				t.Errorf("%s: got error %v, want duplicate output", c.name, err)
+			}
+			if !snap.Equal(before) {
+				t.Errorf("%s: failed ApplyTx changed the snapshot: %s", c.name, Diff(snap, before))
+			}
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	existing := bc.NewHash([32]byte{1})
+	nonce := bc.Nonce{ID: bc.NewHash([32]byte{2}), ExpMS: 100}
+	setup := func() *Snapshot {
+		snap := empty(t)
+		snap.ContractsTree.Insert(existing.Bytes())
+		snap.NonceTree.Insert(NonceCommitment(nonce.ID, nonce.ExpMS))
+		return snap
+	}
+
+	txCases := []struct {
+		name        string
+		snap        *Snapshot
+		blockTimeMS uint64
+		tx          *bc.Tx
+		want        error
+	}{
+		{"empty state", Empty(), 0, &bc.Tx{}, ErrEmptyState},
+		{"int64 range", setup(), 1 << 63, &bc.Tx{}, ErrTimeRange},
+		{"after max time", setup(), 10, &bc.Tx{Timeranges: []bc.Timerange{{MaxMS: 5}}}, ErrTimeRange},
+		{"before min time", setup(), 10, &bc.Tx{Timeranges: []bc.Timerange{{MinMS: 20}}}, ErrTimeRange},
+		{"nonce block ID", setup(), 1, &bc.Tx{Nonces: []bc.Nonce{{ID: bc.NewHash([32]byte{3}), BlockID: bc.NewHash([32]byte{4})}}}, ErrNonceBlockID},
+		{"conflicting nonce", setup(), 1, &bc.Tx{Nonces: []bc.Nonce{nonce}}, ErrConflictingNonce},
+		{"invalid prevout", setup(), 1, &bc.Tx{Contracts: []bc.Contract{{Type: bc.InputType, ID: bc.NewHash([32]byte{5})}}}, ErrInvalidPrevout},
+		{"duplicate output", setup(), 1, &bc.Tx{Contracts: []bc.Contract{{Type: bc.OutputType, ID: existing}}}, ErrDuplicateOutput},
+	}
+	for _, c := range txCases {
+		err := c.snap.ApplyTx(c.blockTimeMS, c.tx)
+		if !errors.Is(err, c.want) {
+			t.Errorf("%s: got error %v, want %v", c.name, err, c.want)
+		}
+		if errors.Root(err) != c.want {
+			t.Errorf("%s: Root(%v) = %v, want %v", c.name, err, errors.Root(err), c.want)
+		}
+		if c.want != ErrEmptyState && errors.Detail(err) == "" {
+			t.Errorf("%s: error %v has no detail", c.name, err)
+		}
+
+		if c.snap.Header == nil {
+			continue
+		}
+		err = c.snap.ApplyBlock(&bc.Block{
+			BlockHeader: &bc.BlockHeader{
+				Height:          2,
+				TimestampMs:     c.blockTimeMS,
+				PreviousBlockId: prevID(c.snap),
+				NextPredicate:   &bc.Predicate{},
+			},
+			Transactions: []*bc.Tx{c.tx},
+		})
+		if c.blockTimeMS >= 1<<63 {
+			continue // fails on the timestamp check instead
+		}
+		if !errors.Is(err, c.want) {
+			t.Errorf("%s in block: got error %v, want %v", c.name, err, c.want)
+		}
+	}
+
+	snap := empty(t)
+	wrongID := bc.NewHash([32]byte{6})
+	headerCases := []struct {
+		name string
+		snap *Snapshot
+		bh   *bc.BlockHeader
+		want error
+	}{
+		{"height 2 on empty state", Empty(), &bc.BlockHeader{Height: 2}, ErrBlockHeight},
+		{"height 1 on initialized state", snap, &bc.BlockHeader{Height: 1}, ErrBlockHeight},
+		{"height gap", snap, &bc.BlockHeader{Height: 3, TimestampMs: 1, PreviousBlockId: prevID(snap)}, ErrBlockHeight},
+		{"backwards timestamp", snap, &bc.BlockHeader{Height: 2, TimestampMs: 0, PreviousBlockId: prevID(snap)}, ErrBlockTimestamp},
+		{"previous block ID", snap, &bc.BlockHeader{Height: 2, TimestampMs: 1, PreviousBlockId: &wrongID}, ErrPrevBlockID},
+	}
+	for _, c := range headerCases {
+		c.bh.NextPredicate = &bc.Predicate{}
+		err := Copy(c.snap).ApplyBlockHeader(c.bh)
+		if !errors.Is(err, c.want) {
+			t.Errorf("%s: got error %v, want %v", c.name, err, c.want)
+		}
+	}
+}
+
+func TestApplyTxNoTime(t *testing.T) {
+	snap := empty(t)
+	tx := &bc.Tx{
+		Timeranges: []bc.Timerange{{MinMS: 20, MaxMS: 10}}, // impossible
+		Contracts:  []bc.Contract{{Type: bc.OutputType, ID: bc.NewHash([32]byte{1})}},
+		Nonces:     []bc.Nonce{{ID: bc.NewHash([32]byte{2}), ExpMS: 100}},
+	}
+
+	for _, blockTimeMS := range []uint64{5, 15, 25} {
+		err := Copy(snap).ApplyTx(blockTimeMS, tx)
+		if !errors.Is(err, ErrTimeRange) {
+			t.Errorf("ApplyTx at %d: got error %v, want %v", blockTimeMS, err, ErrTimeRange)
+		}
+	}
+
+	want := Copy(snap)
+	err := want.ApplyTx(15, &bc.Tx{Contracts: tx.Contracts, Nonces: tx.Nonces})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = snap.ApplyTxNoTime(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !snap.Equal(want) {
+		t.Errorf("ApplyTxNoTime: %s", Diff(snap, want))
+	}
+
+	// Other checks still apply.
+	err = snap.ApplyTxNoTime(tx)
+	if !errors.Is(err, ErrConflictingNonce) {
+		t.Errorf("applying twice: got error %v, want %v", err, ErrConflictingNonce)
+	}
+	if !snap.Equal(want) {
+		t.Errorf("failed ApplyTxNoTime changed the snapshot: %s", Diff(snap, want))
+	}
+	err = snap.ApplyTxNoTime(&bc.Tx{Nonces: []bc.Nonce{{ID: bc.NewHash([32]byte{3}), BlockID: bc.NewHash([32]byte{4})}}})
+	if !errors.Is(err, ErrNonceBlockID) {
+		t.Errorf("bad nonce block ID: got error %v, want %v", err, ErrNonceBlockID)
+	}
+	err = Empty().ApplyTxNoTime(&bc.Tx{})
+	if !errors.Is(err, ErrEmptyState) {
+		t.Errorf("empty state: got error %v, want %v", err, ErrEmptyState)
+	}
+}
+
+func TestApplyTxDelta(t *testing.T) {
+	h := func(b byte) bc.Hash { return bc.NewHash([32]byte{b}) }
+	snap := empty(t)
+	snap.ContractsTree.Insert(h(1).Bytes())
+	snap.ContractsTree.Insert(h(2).Bytes())
+
+	tx := &bc.Tx{
+		Contracts: []bc.Contract{
+			{Type: bc.InputType, ID: h(2)},
+			{Type: bc.OutputType, ID: h(3)},
+			{Type: bc.InputType, ID: h(1)},
+			{Type: bc.OutputType, ID: h(4)},
+			{Type: bc.OutputType, ID: h(5)},
+		},
+	}
+	spent, created, err := snap.ApplyTxDelta(0, tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []bc.Hash{h(2), h(1)}; !reflect.DeepEqual(spent, want) {
+		t.Errorf("spent = %x, want %x", spent, want)
+	}
+	if want := []bc.Hash{h(3), h(4), h(5)}; !reflect.DeepEqual(created, want) {
+		t.Errorf("created = %x, want %x", created, want)
+	}
+	if snap.ContractsTree.Len() != 3 {
+		t.Errorf("contracts tree has %d items, want 3", snap.ContractsTree.Len())
+	}
+
+	before := Copy(snap)
+	spent, created, err = snap.ApplyTxDelta(0, tx)
+	if err == nil {
+		t.Error("expected error applying tx twice")
+	}
+	if spent != nil || created != nil {
+		t.Errorf("failed ApplyTxDelta returned spent %x, created %x", spent, created)
+	}
+	if !snap.Equal(before) {
+		t.Errorf("failed ApplyTxDelta changed the snapshot: %s", Diff(snap, before))
+	}
+}
+
+func TestApplyTx(t *testing.T) {
+	tx := &bc.Tx{}
+	snap := Empty()
+
+	err := snap.ApplyTx(0, tx)
+	if err == nil {
+		t.Error("expected uninitialized error")
+	}
+
+	snap = empty(t)
+	tx = &bc.Tx{Timeranges: []bc.Timerange{{MinMS: 100, MaxMS: 200}}}
+	err = snap.ApplyTx(50, tx)
+	if err == nil {
+		t.Error("expected mintime error")
+	}
+	err = snap.ApplyTx(300, tx)
+	if err == nil {
+		t.Error("expected maxtime error")
+	}
+	err = snap.ApplyTx(0, tx)
+	if err == nil {
+		t.Error("expected mintime error at block time 0")
+	}
+	err = snap.ApplyTx(150, tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckTimeRanges(t *testing.T) {
+	cases := []struct {
+		blockTimeMS uint64
+		min, max    int64
+		ok          bool
+	}{
+		{0, 1000, 0, false},
+		{0, 1000, 2000, false},
+		{0, 0, 0, true},
+		{0, 0, 10, true},
+		{0, -5, 10, true},
+		{999, 1000, 2000, false},
+		{1000, 1000, 2000, true},
+		{1500, 1000, 2000, true},
+		{2000, 1000, 2000, true},
+		{2001, 1000, 2000, false},
+		{1 << 62, 1000, 0, true},
+		{1 << 63, 0, 0, false},
+	}
+	for _, c := range cases {
+		tx := &bc.Tx{Timeranges: []bc.Timerange{{MinMS: c.min, MaxMS: c.max}}}
+		err := checkTimeRanges(c.blockTimeMS, tx, false)
+		if c.ok && err != nil {
+			t.Errorf("block time %d, range %d-%d: unexpected error %v", c.blockTimeMS, c.min, c.max, err)
+		}
+		if !c.ok && errors.Root(err) != ErrTimeRange {
+			t.Errorf("block time %d, range %d-%d: got error %v, want %v", c.blockTimeMS, c.min, c.max, err, ErrTimeRange)
+		}
+	}
+}
+
+func TestValidateTxTimeRanges(t *testing.T) {
+	tx := &bc.Tx{Timeranges: []bc.Timerange{{MinMS: 100, MaxMS: 200}, {MinMS: 150, MaxMS: 300}}}
+	cases := []struct {
+		nowMS   uint64
+		any     bool
+		wantErr error
+	}{
+		{150, false, nil},
+		{200, false, nil},
+		{201, false, ErrTimeRange}, // past the first range's max
+		{99, false, ErrTimeRange},  // before both ranges' min
+		{120, false, ErrTimeRange}, // before the second range's min
+		{250, true, nil},
+		{301, true, ErrTimeRange},
+		{99, true, ErrTimeRange},
+	}
+	for _, c := range cases {
+		snap := empty(t)
+		snap.AnyTimerange = c.any
+		err := snap.ValidateTxTimeRanges(tx, c.nowMS)
+		if errors.Root(err) != c.wantErr {
+			t.Errorf("now %d, AnyTimerange %v: got error %v, want %v", c.nowMS, c.any, err, c.wantErr)
+		}
+		// ApplyTx agrees.
+		applyErr := snap.ApplyTx(c.nowMS, tx)
+		if errors.Root(applyErr) != c.wantErr {
+			t.Errorf("now %d, AnyTimerange %v: ApplyTx error %v, want %v", c.nowMS, c.any, applyErr, c.wantErr)
+		}
+	}
+}
+
+func TestRejectExpiredNonces(t *testing.T) {
+	nonce := func(b byte, expMS uint64) *bc.Tx {
+		return &bc.Tx{Nonces: []bc.Nonce{{ID: bc.NewHash([32]byte{b}), ExpMS: expMS}}}
+	}
+	cases := []struct {
+		expMS   uint64
+		reject  bool
+		wantErr error
+	}{
+		{99, false, nil},
+		{99, true, ErrNonceExpired},
+		{100, true, nil}, // expires at the block timestamp, so not yet pruned
+		{101, true, nil},
+	}
+	for i, c := range cases {
+		snap := empty(t)
+		snap.RejectExpiredNonces = c.reject
+		err := snap.ApplyTx(100, nonce(byte(i), c.expMS))
+		if errors.Root(err) != c.wantErr {
+			t.Errorf("expiration %d, reject %t: got error %v, want %v", c.expMS, c.reject, err, c.wantErr)
+		}
+		if got, want := snap.ContainsNonce(bc.NewHash([32]byte{byte(i)}), c.expMS), c.wantErr == nil; got != want {
+			t.Errorf("expiration %d, reject %t: nonce present = %t, want %t", c.expMS, c.reject, got, want)
+		}
+	}
+
+	// The check applies to blocks too, whichever way they are applied.
+	snap := empty(t)
+	snap.RejectExpiredNonces = true
+	block := &bc.Block{
+		BlockHeader: &bc.BlockHeader{
+			Height:          2,
+			TimestampMs:     100,
+			PreviousBlockId: prevID(snap),
+			NextPredicate:   &bc.Predicate{},
+		},
+		Transactions: []*bc.Tx{nonce(1, 99)},
+	}
+	if err := Copy(snap).ApplyBlock(block); errors.Root(err) != ErrNonceExpired {
+		t.Errorf("ApplyBlock: got error %v, want %v", err, ErrNonceExpired)
+	}
+	if err := Copy(snap).ApplyBlockConcurrent(block, 2); errors.Root(err) != ErrNonceExpired {
+		t.Errorf("ApplyBlockConcurrent: got error %v, want %v", err, ErrNonceExpired)
+	}
+}
+
+func TestContractPolicy(t *testing.T) {
+	h := func(b byte) bc.Hash { return bc.NewHash([32]byte{b}) }
+	errRejected := errors.New("rejected contract")
+	policy := func(con bc.Contract) error {
+		if con.ID.Bytes()[0] == 0xff {
+			return errRejected
+		}
+		return nil
+	}
+	spends := func(in, out byte) *bc.Tx {
+		return &bc.Tx{
+			Contracts: []bc.Contract{{Type: bc.InputType, ID: h(in)}, {Type: bc.OutputType, ID: h(out)}},
+			Nonces:    []bc.Nonce{{ID: h(out), ExpMS: 1000}},
+		}
+	}
+
+	snap := empty(t)
+	snap.ContractsTree.Insert(h(1).Bytes())
+	snap.ContractsTree.Insert(h(2).Bytes())
+
+	// Without a policy, any output is accepted.
+	err := Copy(snap).ApplyTx(1, spends(1, 0xff))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snap.ContractPolicy = policy
+	if Copy(snap).ContractPolicy == nil || snap.Clone().ContractPolicy == nil {
+		t.Fatal("ContractPolicy not copied")
+	}
+	before := Copy(snap)
+	for _, apply := range []struct {
+		name string
+		f    func(*Snapshot, *bc.Tx) error
+	}{
+		{"ApplyTx", func(s *Snapshot, tx *bc.Tx) error { return s.ApplyTx(1, tx) }},
+		{"ApplyTxNoTime", (*Snapshot).ApplyTxNoTime},
+	} {
+		s := Copy(snap)
+		err := apply.f(s, spends(1, 0xff))
+		if errors.Root(err) != errRejected {
+			t.Errorf("%s: got error %v, want %v", apply.name, err, errRejected)
+		}
+		if !s.Equal(before) {
+			t.Errorf("%s: rejected transaction modified the snapshot: %s", apply.name, Diff(s, before))
+		}
+		err = apply.f(s, spends(1, 3))
+		if err != nil {
+			t.Errorf("%s: accepted output: %v", apply.name, err)
+		}
+	}
+
+	block := &bc.Block{
+		BlockHeader: &bc.BlockHeader{
+			Height:          2,
+			TimestampMs:     1,
+			PreviousBlockId: prevID(snap),
+			NextPredicate:   &bc.Predicate{},
+		},
+		Transactions: []*bc.Tx{spends(1, 3), spends(2, 0xff)},
+	}
+	for _, apply := range []struct {
+		name string
+		f    func(*Snapshot) error
+	}{
+		{"ApplyBlock", func(s *Snapshot) error { return s.ApplyBlock(block) }},
+		{"ApplyBlockConcurrent", func(s *Snapshot) error { return s.ApplyBlockConcurrent(block, 2) }},
+	} {
+		s := Copy(snap)
+		err := apply.f(s)
+		if errors.Root(err) != errRejected || !strings.Contains(err.Error(), "transaction 1") {
+			t.Errorf("%s: got error %v, want %v in transaction 1", apply.name, err, errRejected)
+		}
+		if !s.Equal(before) {
+			t.Errorf("%s: rejected block modified the snapshot: %s", apply.name, Diff(s, before))
+		}
+	}
+}
+
+func TestAnyTimerange(t *testing.T) {
+	disjoint := &bc.Tx{Timeranges: []bc.Timerange{{MinMS: 10, MaxMS: 20}, {MinMS: 30, MaxMS: 40}}}
+	overlapping := &bc.Tx{Timeranges: []bc.Timerange{{MinMS: 10, MaxMS: 30}, {MinMS: 20, MaxMS: 40}}}
+	cases := []struct {
+		tx          *bc.Tx
+		blockTimeMS uint64
+		all, any    bool
+	}{
+		{disjoint, 5, false, false},
+		{disjoint, 15, false, true},
+		{disjoint, 25, false, false},
+		{disjoint, 35, false, true},
+		{disjoint, 45, false, false},
+		{overlapping, 15, false, true},
+		{overlapping, 25, true, true},
+		{overlapping, 35, false, true},
+		{&bc.Tx{}, 25, true, true},
+	}
+	for _, c := range cases {
+		for _, union := range []bool{false, true} {
+			want := c.all
+			if union {
+				want = c.any
+			}
+			snap := empty(t)
+			snap.AnyTimerange = union
+			err := snap.ApplyTx(c.blockTimeMS, c.tx)
+			if want && err != nil {
+				t.Errorf("ranges %v, block time %d, union %t: unexpected error %v", c.tx.Timeranges, c.blockTimeMS, union, err)
+			}
+			if !want && errors.Root(err) != ErrTimeRange {
+				t.Errorf("ranges %v, block time %d, union %t: got error %v, want %v", c.tx.Timeranges, c.blockTimeMS, union, err, ErrTimeRange)
+			}
+		}
+	}
+}
+
+func TestRefIDNonce(t *testing.T) {
+	snap := empty(t)
+	b1 := &bc.Block{
+		BlockHeader: &bc.BlockHeader{
+			Height:          2,
+			TimestampMs:     2,
+			PreviousBlockId: prevID(snap),
+			NextPredicate:   &bc.Predicate{},
+		},
+	}
+	err := snap.ApplyBlock(b1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := &bc.Tx{
+		Nonces: []bc.Nonce{{
+			ID:      bc.NewHash([32]byte{1}),
+			BlockID: b1.Hash(),
+			ExpMS:   10000,
+		}},
+	}
+	err = snap.ApplyTx(100, tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx = &bc.Tx{
+		Nonces: []bc.Nonce{{
+			ID:      bc.NewHash([32]byte{2}),
+			BlockID: bc.NewHash([32]byte{255}),
+			ExpMS:   10000,
+		}},
+	}
+	err = snap.ApplyTx(100, tx)
+	if err == nil {
+		t.Error("expected error for applying tx with invalid block id")
+	}
+}
+
+func TestAtomicApplyTx(t *testing.T) {
+	snap := empty(t)
+	missingSpend := &bc.Tx{
+		Nonces: []bc.Nonce{{
+			ID:      bc.NewHash([32]byte{1}),
+			BlockID: bc.Hash{},
+			ExpMS:   1000,
+		}},
+		Contracts: []bc.Contract{{
+			Type: bc.OutputType,
+			ID:   bc.NewHash([32]byte{2}),
+		}, {
+			Type: bc.InputType,
+			ID:   bc.NewHash([32]byte{3}),
+		}},
+	}
+
+	wantCSRoot := snap.ContractsTree.RootHash()
+	wantNonceRoot := snap.NonceTree.RootHash()
+
+	err := snap.ApplyTx(0, missingSpend)
+	if err == nil {
+		t.Fatal("expected err")
+	}
+
+	gotCSRoot := snap.ContractsTree.RootHash()
+	gotNonceRoot := snap.NonceTree.RootHash()
+
+	if wantCSRoot != gotCSRoot {
+		t.Fatal("invalid tx affected contracts state tree")
+	}
+
+	if wantNonceRoot != gotNonceRoot {
+		t.Fatal("invalid tx affected nonces state tree")
+	}
+}
+
+func TestHeaderAccessors(t *testing.T) {
+	cases := []struct {
+		snap          *Snapshot
+		wantHeight    uint64
+		wantTimestamp uint64
+	}{{
+		snap: nil,
+	}, {
+		snap: Empty(),
+	}, {
+		snap: &Snapshot{
+			Header: &bc.BlockHeader{
+				Height:      5,
+				TimestampMs: 1000,
+			},
+		},
+		wantHeight:    5,
+		wantTimestamp: 1000,
+	}}
+
+	for i, c := range cases {
+		gotHeight := c.snap.Height()
+		if gotHeight != c.wantHeight {
+			t.Errorf("height(%d) = %d want %d", i, gotHeight, c.wantHeight)
+		}
+
+		gotTimestamp := c.snap.TimestampMS()
+		if gotTimestamp != c.wantTimestamp {
+			t.Errorf("timestamp(%d) = %d want %d", i, gotTimestamp, c.wantTimestamp)
+		}
+	}
+}
+
+func TestApplyTxImmutable(t *testing.T) {
+	snap := empty(t)
+	inputID := bc.NewHash([32]byte{1})
+	snap.ContractsTree.Insert(inputID.Bytes())
+	snap.NonceTree.Insert(NonceCommitment(bc.NewHash([32]byte{9}), 5))
+
+	wantContracts := treeItems(snap.ContractsTree)
+	wantNonces := treeItems(snap.NonceTree)
+	wantRefIDs := append([]bc.Hash{}, snap.RefIDs...)
+
+	tx := &bc.Tx{
+		Contracts: []bc.Contract{
+			{Type: bc.InputType, ID: inputID},
+			{Type: bc.OutputType, ID: bc.NewHash([32]byte{2})},
+		},
+		Nonces: []bc.Nonce{{ID: bc.NewHash([32]byte{3}), ExpMS: 10}},
+	}
+	got, err := snap.ApplyTxImmutable(0, tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ContractsTree.Contains(inputID.Bytes()) {
+		t.Error("new snapshot contains spent prevout")
+	}
+	if !got.ContractsTree.Contains(bc.NewHash([32]byte{2}).Bytes()) {
+		t.Error("new snapshot does not contain output")
+	}
+
+	if !reflect.DeepEqual(treeItems(snap.ContractsTree), wantContracts) {
+		t.Error("ApplyTxImmutable modified the original contracts tree")
+	}
+	if !reflect.DeepEqual(treeItems(snap.NonceTree), wantNonces) {
+		t.Error("ApplyTxImmutable modified the original nonce tree")
+	}
+
+	b2 := &bc.Block{
+		BlockHeader: &bc.BlockHeader{
+			Height:          2,
+			TimestampMs:     6,
+			PreviousBlockId: prevID(snap),
+			NextPredicate:   &bc.Predicate{},
+		},
+	}
+	got, err = snap.ApplyBlockImmutable(b2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Height() != 2 {
+		t.Errorf("new snapshot height = %d, want 2", got.Height())
+	}
+	if snap.Height() != 1 {
+		t.Errorf("original snapshot height = %d, want 1", snap.Height())
+	}
+	if !reflect.DeepEqual(snap.RefIDs, wantRefIDs) {
+		t.Errorf("ApplyBlockImmutable modified the original RefIDs: got %v, want %v", snap.RefIDs, wantRefIDs)
+	}
+	if got.NonceTree.RootHash() != ([32]byte{}) {
+		t.Error("expected new snapshot's nonces to be pruned")
+	}
+	if !reflect.DeepEqual(treeItems(snap.NonceTree), wantNonces) {
+		t.Error("ApplyBlockImmutable modified the original nonce tree")
+	}
+
+	got = snap.PruneNoncesImmutable(6)
+	if got.NonceTree.RootHash() != ([32]byte{}) {
+		t.Error("expected new snapshot's nonces to be pruned")
+	}
+	if !reflect.DeepEqual(treeItems(snap.NonceTree), wantNonces) {
+		t.Error("PruneNoncesImmutable modified the original nonce tree")
+	}
+}
+
+func treeItems(tree *patricia.Tree) [][]byte {
+	var items [][]byte
+	patricia.Walk(tree, func(item []byte) error {
+		items = append(items, append([]byte{}, item...))
+		return nil
+	})
+	return items
+}
+
+func TestRoot(t *testing.T) {
+	snap := empty(t)
+	before := snap.Root()
+	if Copy(snap).Root() != before {
+		t.Error("root changed across Copy")
+	}
+
+	snap.ContractsTree.Insert(bc.NewHash([32]byte{1}).Bytes())
+	after := snap.Root()
+	if after == before {
+		t.Error("root did not change after adding a contract")
+	}
+	if Copy(snap).Root() != after {
+		t.Error("root changed across Copy")
+	}
+
+	contractsRoot := bc.NewHash(snap.ContractsTree.RootHash())
+	noncesRoot := bc.NewHash(snap.NonceTree.RootHash())
+	bh := &bc.BlockHeader{ContractsRoot: &contractsRoot, NoncesRoot: &noncesRoot}
+	if got := bh.StateRoot(snap.InitialBlockID); got != after {
+		t.Errorf("header state root = %x, snapshot root = %x", got.Bytes(), after.Bytes())
+	}
+}
+
+func TestPruneNoncesCount(t *testing.T) {
+	snap := empty(t)
+	for i, exp := range []uint64{5, 10, 10, 15, 20} {
+		snap.NonceTree.Insert(NonceCommitment(bc.NewHash([32]byte{byte(i)}), exp))
+	}
+
+	n := snap.PruneNonces(15)
+	if n != 3 {
+		t.Errorf("PruneNonces(15) removed %d nonces, want 3", n)
+	}
+
+	var got []uint64
+	patricia.Walk(snap.NonceTree, func(item []byte) error {
+		_, exp := idTime(item)
+		got = append(got, exp)
+		return nil
+	})
+	want := []uint64{15, 20}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("surviving expirations = %v, want %v", got, want)
+	}
+
+	n = snap.PruneNonces(15)
+	if n != 0 {
+		t.Errorf("second PruneNonces(15) removed %d nonces, want 0", n)
+	}
+}
+
+func TestPruneNoncesCollect(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	snap := empty(t)
+	var want []bc.Hash
+	for i := 0; i < 200; i++ {
+		var id [32]byte
+		rng.Read(id[:])
+		exp := uint64(rng.Intn(100))
+		snap.NonceTree.Insert(NonceCommitment(bc.NewHash(id), exp))
+		if exp < 50 {
+			want = append(want, bc.NewHash(id))
+		}
+	}
+	other := Copy(snap)
+
+	got := snap.PruneNoncesCollect(50)
+	sortHashes := func(h []bc.Hash) {
+		sort.Slice(h, func(i, j int) bool { return bytes.Compare(h[i].Bytes(), h[j].Bytes()) < 0 })
+	}
+	sortHashes(got)
+	sortHashes(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %d pruned IDs %x, want %d: %x", len(got), got, len(want), want)
+	}
+	if n := other.PruneNonces(50); n != len(want) || !snap.Equal(other) {
+		t.Errorf("PruneNonces removed %d nonces, want %d: %s", n, len(want), Diff(snap, other))
+	}
+	if got := snap.PruneNoncesCollect(50); got != nil {
+		t.Errorf("second PruneNoncesCollect(50) = %x, want nil", got)
+	}
+}
+
+func TestCompactNonces(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	snap := empty(t)
+	var nonces []bc.Nonce
+	var ncs [][]byte
+	for i := 0; i < 2000; i++ {
+		var id [32]byte
+		rng.Read(id[:])
+		n := bc.Nonce{ID: bc.NewHash(id), ExpMS: uint64(10 + i%100)}
+		nonces = append(nonces, n)
+		ncs = append(ncs, NonceCommitment(n.ID, n.ExpMS))
+	}
+	err := snap.NonceTree.InsertMany(ncs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := snap.PruneNonces(100); n != 1800 {
+		t.Fatalf("pruned %d nonces, want 1800", n)
+	}
+	// Added since the expiration index was last updated.
+	err = snap.ApplyTx(100, &bc.Tx{Nonces: []bc.Nonce{{ID: bc.NewHash([32]byte{1}), ExpMS: 105}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	orig := Copy(snap)
+	root := snap.NonceTree.RootHash()
+	snap.CompactNonces()
+	if snap.NonceTree.RootHash() != root || !snap.Equal(orig) {
+		t.Fatalf("compacting changed the snapshot: %s", Diff(snap, orig))
+	}
+	for _, n := range nonces {
+		if got, want := snap.ContainsNonce(n.ID, n.ExpMS), n.ExpMS >= 100; got != want {
+			t.Errorf("ContainsNonce(%x, %d) = %t, want %t", n.ID.Bytes(), n.ExpMS, got, want)
+		}
+	}
+	if stats := snap.NonceTree.Stats(); stats.Nodes != 2*snap.NonceCount()-1 {
+		t.Errorf("got %d nodes for %d nonces", stats.Nodes, snap.NonceCount())
+	}
+
+	// Later pruning gives the same results as without compaction.
+	for _, ts := range []uint64{104, 106, 200} {
+		want := orig.PruneNonces(ts)
+		got := snap.PruneNonces(ts)
+		if got != want || !snap.Equal(orig) {
+			t.Errorf("pruning at %d: pruned %d, want %d (%s)", ts, got, want, Diff(snap, orig))
+		}
+	}
+}
+
+func TestConsumeNonce(t *testing.T) {
+	snap := empty(t)
+	id := bc.NewHash([32]byte{1})
+	err := snap.ApplyTx(1, &bc.Tx{Nonces: []bc.Nonce{{ID: id, ExpMS: 100}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig := Copy(snap)
+
+	if !snap.ConsumeNonce(id, 100) {
+		t.Error("ConsumeNonce = false, want true")
+	}
+	if snap.ContainsNonce(id, 100) {
+		t.Error("nonce still present after ConsumeNonce")
+	}
+	if !orig.ContainsNonce(id, 100) {
+		t.Error("ConsumeNonce modified a copy of the snapshot")
+	}
+	if snap.ConsumeNonce(id, 100) {
+		t.Error("second ConsumeNonce = true, want false")
+	}
+
+	// Pruning must not resurrect or double-count the consumed nonce.
+	if n := snap.PruneNonces(200); n != 0 {
+		t.Errorf("PruneNonces removed %d nonces, want 0", n)
+	}
+	if n := orig.PruneNonces(200); n != 1 {
+		t.Errorf("PruneNonces on copy removed %d nonces, want 1", n)
+	}
+}
+
+func TestPruneNoncesIndex(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	snap := empty(t)
+	want := make(map[string]bool) // nonce commitments in snap
+	var ts uint64
+	for i := 0; i < 500; i++ {
+		var id [32]byte
+		rng.Read(id[:])
+		n := bc.Nonce{ID: bc.NewHash(id), ExpMS: ts + uint64(rng.Intn(100))}
+
+		switch rng.Intn(6) {
+		case 0: // add a nonce directly to the tree
+			nc := NonceCommitment(n.ID, n.ExpMS)
+			snap.NonceTree.Insert(nc)
+			want[string(nc)] = true
+		case 1: // remove a nonce directly from the tree
+			for nc := range want {
+				snap.NonceTree.Delete([]byte(nc))
+				delete(want, nc)
+				break
+			}
+		case 2: // prune, leaving snap unchanged
+			snap.PruneNoncesImmutable(ts + uint64(rng.Intn(50)))
+		case 3: // prune
+			ts += uint64(rng.Intn(20))
+			var wantN int
+			for nc := range want {
+				if _, exp := idTime([]byte(nc)); exp < ts {
+					delete(want, nc)
+					wantN++
+				}
+			}
+			if n := snap.PruneNonces(ts); n != wantN {
+				t.Fatalf("step %d: PruneNonces(%d) removed %d nonces, want %d", i, ts, n, wantN)
+			}
+		default: // add a nonce with a transaction
+			err := snap.ApplyTx(ts, &bc.Tx{Nonces: []bc.Nonce{n}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			want[string(NonceCommitment(n.ID, n.ExpMS))] = true
+		}
+
+		got := treeItems(snap.NonceTree)
+		if len(got) != len(want) {
+			t.Fatalf("step %d: nonce tree has %d items, want %d", i, len(got), len(want))
+		}
+		for _, nc := range got {
+			if !want[string(nc)] {
+				t.Fatalf("step %d: nonce tree has unexpected item %x", i, nc)
+			}
+		}
+	}
+}
+
+func BenchmarkPruneNonces(b *testing.B) {
+	const n = 1000000
+	rng := rand.New(rand.NewSource(1))
+	items := make([][]byte, n)
+	for i := range items {
+		var id [32]byte
+		rng.Read(id[:])
+		items[i] = NonceCommitment(bc.NewHash(id), uint64(i))
+	}
+	snap := Empty()
+	err := snap.NonceTree.InsertMany(items)
+	if err != nil {
+		b.Fatal(err)
+	}
+	snap.PruneNonces(0) // builds the expiration index
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if got := snap.PruneNoncesImmutable(100).NonceTree.Len(); got != n-100 {
+			b.Fatalf("got %d nonces after pruning, want %d", got, n-100)
+		}
+	}
+}
+
+func TestApplyTxs(t *testing.T) {
+	snap := empty(t)
+	nonce := bc.Nonce{ID: bc.NewHash([32]byte{1}), ExpMS: 100}
+	txs := []*bc.Tx{{
+		Contracts: []bc.Contract{{Type: bc.OutputType, ID: bc.NewHash([32]byte{2})}},
+		Nonces:    []bc.Nonce{nonce},
+	}, {
+		Contracts: []bc.Contract{{Type: bc.OutputType, ID: bc.NewHash([32]byte{3})}},
+		Nonces:    []bc.Nonce{nonce}, // conflicts with the first tx
+	}, {
+		Contracts: []bc.Contract{{Type: bc.OutputType, ID: bc.NewHash([32]byte{4})}},
+	}}
+
+	want := Copy(snap)
+	err := snap.ApplyTxs(0, txs)
+	if err == nil {
+		t.Fatal("expected error for conflicting nonce")
+	}
+	if !strings.Contains(err.Error(), "transaction 1") {
+		t.Errorf("error %q does not identify transaction 1", err)
+	}
+	if !snap.Equal(want) {
+		t.Errorf("failed ApplyTxs modified snapshot: %s", Diff(snap, want))
+	}
+
+	err = snap.ApplyTxs(0, []*bc.Tx{txs[0], txs[2]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range []byte{2, 4} {
+		if !snap.ContractsTree.Contains(bc.NewHash([32]byte{b}).Bytes()) {
+			t.Errorf("snapshot missing output %d", b)
+		}
+	}
+}
+
+func TestContains(t *testing.T) {
+	snap := empty(t)
+	conID := bc.NewHash([32]byte{1})
+	nonceID := bc.NewHash([32]byte{2})
+	tx := &bc.Tx{
+		Contracts: []bc.Contract{{Type: bc.OutputType, ID: conID}},
+		Nonces:    []bc.Nonce{{ID: nonceID, ExpMS: 10}},
+	}
+	err := snap.ApplyTx(0, tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !snap.ContainsContract(conID) {
+		t.Error("ContainsContract(present) = false")
+	}
+	if snap.ContainsContract(nonceID) {
+		t.Error("ContainsContract(absent) = true")
+	}
+	if !snap.ContainsNonce(nonceID, 10) {
+		t.Error("ContainsNonce(present) = false")
+	}
+	if snap.ContainsNonce(nonceID, 11) {
+		t.Error("ContainsNonce(wrong expiration) = true")
+	}
+
+	var nilSnap *Snapshot
+	if nilSnap.ContainsContract(conID) || nilSnap.ContainsNonce(nonceID, 10) {
+		t.Error("nil snapshot contains items")
+	}
+	if (&Snapshot{}).ContainsContract(conID) || (&Snapshot{}).ContainsNonce(nonceID, 10) {
+		t.Error("snapshot with nil trees contains items")
+	}
+}
+
+func TestReserve(t *testing.T) {
+	snap := empty(t)
+	id, other := bc.NewHash([32]byte{1}), bc.NewHash([32]byte{2})
+	tx := &bc.Tx{Contracts: []bc.Contract{{Type: bc.OutputType, ID: id}, {Type: bc.OutputType, ID: other}}}
+	err := snap.ApplyTx(0, tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := snap.Root()
+
+	if snap.Reserve(bc.NewHash([32]byte{3})) {
+		t.Error("reserved a contract not in the state")
+	}
+	if !snap.Reserve(id) {
+		t.Fatal("could not reserve a contract")
+	}
+	if snap.Reserve(id) {
+		t.Error("reserved a contract twice")
+	}
+	if !snap.ContainsContract(id) || snap.ContainsUnreservedContract(id) {
+		t.Errorf("reserved contract: ContainsContract %v, ContainsUnreservedContract %v", snap.ContainsContract(id), snap.ContainsUnreservedContract(id))
+	}
+	if !snap.ContainsUnreservedContract(other) {
+		t.Error("unreserved contract is not reported")
+	}
+	if snap.Root() != root {
+		t.Error("reserving a contract changed the state root")
+	}
+
+	// A copy keeps the reservation but releases independently.
+	dupe := Copy(snap)
+	dupe.Release(id)
+	if !dupe.ContainsUnreservedContract(id) {
+		t.Error("released contract is still reserved")
+	}
+	if snap.ContainsUnreservedContract(id) {
+		t.Error("releasing in a copy released the original")
+	}
+
+	// A reserved contract may still be spent.
+	err = snap.ApplyTx(0, &bc.Tx{Contracts: []bc.Contract{{Type: bc.InputType, ID: id}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.ContainsContract(id) || snap.ContainsUnreservedContract(id) {
+		t.Error("spent contract is still present")
+	}
+}
+
+func TestContainsContracts(t *testing.T) {
+	snap := empty(t)
+	var ids []bc.Hash
+	var want []bool
+	for i := 0; i < 100; i++ {
+		id := bc.NewHash([32]byte{byte(i), 1})
+		if i%3 == 0 {
+			err := snap.ContractsTree.Insert(id.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		ids = append(ids, id)
+		want = append(want, i%3 == 0)
+	}
+	// Reverse the queries, so that they are not in sorted order.
+	for i, j := 0, len(ids)-1; i < j; i, j = i+1, j-1 {
+		ids[i], ids[j] = ids[j], ids[i]
+		want[i], want[j] = want[j], want[i]
+	}
+
+	got := snap.ContainsContracts(ids)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	var nilSnap *Snapshot
+	if got := nilSnap.ContainsContracts(ids[:2]); !reflect.DeepEqual(got, []bool{false, false}) {
+		t.Errorf("nil snapshot: got %v", got)
+	}
+}
+
+func TestContractHeight(t *testing.T) {
+	id1, id2, id3 := bc.NewHash([32]byte{1}), bc.NewHash([32]byte{2}), bc.NewHash([32]byte{3})
+	apply := func(s *Snapshot, cons ...bc.Contract) {
+		t.Helper()
+		err := s.ApplyBlock(&bc.Block{
+			BlockHeader: &bc.BlockHeader{
+				Height:          s.Height() + 1,
+				TimestampMs:     s.Header.TimestampMs + 1,
+				PreviousBlockId: prevID(s),
+				NextPredicate:   &bc.Predicate{},
+			},
+			Transactions: []*bc.Tx{{Contracts: cons}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(s *Snapshot, id bc.Hash, wantHeight uint64, wantOK bool) {
+		t.Helper()
+		height, ok := s.ContractHeight(id)
+		if height != wantHeight || ok != wantOK {
+			t.Errorf("ContractHeight(%x) = %d, %v, want %d, %v", id.Bytes()[:1], height, ok, wantHeight, wantOK)
+		}
+	}
+
+	snap := empty(t)
+	apply(snap, bc.Contract{Type: bc.OutputType, ID: id1}) // not tracked
+	snap.TrackContractHeights = true
+	apply(snap, bc.Contract{Type: bc.OutputType, ID: id2}) // height 3
+	apply(snap, bc.Contract{Type: bc.OutputType, ID: id3}) // height 4
+	check(snap, id1, 0, false)
+	check(snap, id2, 3, true)
+	check(snap, id3, 4, true)
+
+	dupe := Copy(snap)
+	clone := snap.Clone()
+	// Spend id2 and recreate id3 at height 5 in snap only.
+	apply(snap, bc.Contract{Type: bc.InputType, ID: id2}, bc.Contract{Type: bc.InputType, ID: id3}, bc.Contract{Type: bc.OutputType, ID: id3})
+	check(snap, id2, 0, false)
+	check(snap, id3, 5, true)
+	for _, c := range []*Snapshot{dupe, clone} {
+		if !c.TrackContractHeights {
+			t.Error("copy does not track contract heights")
+		}
+		check(c, id2, 3, true)
+		check(c, id3, 4, true)
+	}
+
+	// Contract heights do not survive serialization.
+	b, err := snap.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := Empty()
+	err = restored.FromBytes(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(restored, id3, 0, false)
+}
+
+func TestEach(t *testing.T) {
+	snap := empty(t)
+	conIDs := []bc.Hash{bc.NewHash([32]byte{1}), bc.NewHash([32]byte{2})}
+	nonces := []bc.Nonce{{ID: bc.NewHash([32]byte{3}), ExpMS: 10}, {ID: bc.NewHash([32]byte{4}), ExpMS: 20}}
+	tx := &bc.Tx{
+		Contracts: []bc.Contract{{Type: bc.OutputType, ID: conIDs[0]}, {Type: bc.OutputType, ID: conIDs[1]}},
+		Nonces:    nonces,
+	}
+	err := snap.ApplyTx(0, tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var gotIDs []bc.Hash
+	err = snap.EachContract(func(id bc.Hash) error {
+		gotIDs = append(gotIDs, id)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotIDs, conIDs) {
+		t.Errorf("EachContract visited %v, want %v", gotIDs, conIDs)
+	}
+
+	var gotNonces []bc.Nonce
+	err = snap.EachNonce(func(id bc.Hash, expMS uint64) error {
+		gotNonces = append(gotNonces, bc.Nonce{ID: id, ExpMS: expMS})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotNonces, nonces) {
+		t.Errorf("EachNonce visited %v, want %v", gotNonces, nonces)
+	}
+
+	stop := errors.New("stop")
+	var n int
+	err = snap.EachContract(func(bc.Hash) error {
+		n++
+		return stop
+	})
+	if err != stop {
+		t.Errorf("EachContract returned %v, want %v", err, stop)
+	}
+	if n != 1 {
+		t.Errorf("EachContract called f %d times after an error, want 1", n)
+	}
+
+	var nilSnap *Snapshot
+	err = nilSnap.EachContract(func(bc.Hash) error {
+		t.Error("EachContract called f on a nil snapshot")
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	err = Empty().EachNonce(func(bc.Hash, uint64) error {
+		t.Error("EachNonce called f on an empty snapshot")
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMaxRefIDs(t *testing.T) {
+	const max = 100
+
+	snap := empty(t)
+	snap.MaxRefIDs = max
+	var ids []bc.Hash
+	for height := uint64(2); height <= 3000; height++ {
+		bh := &bc.BlockHeader{
+			Height:          height,
+			TimestampMs:     height,
+			PreviousBlockId: prevID(snap),
+			NextPredicate:   &bc.Predicate{},
+		}
+		err := snap.ApplyBlockHeader(bh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(snap.RefIDs) > max {
+			t.Fatalf("height %d: len(RefIDs) = %d, want <= %d", height, len(snap.RefIDs), max)
+		}
+		ids = append(ids, bh.Hash())
+	}
+	if !reflect.DeepEqual(snap.RefIDs, ids[len(ids)-max:]) {
+		t.Error("RefIDs does not hold the most recent block IDs")
+	}
+
+	cases := []struct {
+		blockID bc.Hash
+		wantErr bool
+	}{
+		{snap.InitialBlockID, false},
+		{ids[len(ids)-1], false},
+		{ids[len(ids)-max], false},
+		{ids[len(ids)-max-1], true},
+	}
+	for i, c := range cases {
+		tx := &bc.Tx{Nonces: []bc.Nonce{{ID: bc.NewHash([32]byte{byte(i)}), BlockID: c.blockID, ExpMS: 10000}}}
+		err := snap.ApplyTx(3000, tx)
+		if (err != nil) != c.wantErr {
+			t.Errorf("case %d: got error %v, want error %t", i, err, c.wantErr)
+		}
+	}
+}
+
+func TestCopyIndependence(t *testing.T) {
+	snap := empty(t)
+	var ids []bc.Hash
+	for i := byte(0); i < 8; i++ {
+		id := bc.NewHash([32]byte{i})
+		snap.ContractsTree.Insert(id.Bytes())
+		ids = append(ids, id)
+	}
+
+	dupe := Copy(snap)
+	tx := &bc.Tx{
+		Contracts: []bc.Contract{
+			{Type: bc.InputType, ID: ids[2]},
+			{Type: bc.InputType, ID: ids[5]},
+			{Type: bc.OutputType, ID: bc.NewHash([32]byte{100})},
+		},
+		Nonces: []bc.Nonce{{ID: bc.NewHash([32]byte{101}), ExpMS: 10}},
+	}
+	err := dupe.ApplyTx(0, tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range ids {
+		if !snap.ContractsTree.Contains(id.Bytes()) {
+			t.Errorf("original lost contract %x", id.Bytes())
+		}
+	}
+	if snap.ContractsTree.Contains(bc.NewHash([32]byte{100}).Bytes()) {
+		t.Error("original gained the copy's output")
+	}
+	if snap.ContainsNonce(bc.NewHash([32]byte{101}), 10) {
+		t.Error("original gained the copy's nonce")
+	}
+	if dupe.ContainsContract(ids[2]) || !dupe.ContainsContract(bc.NewHash([32]byte{100})) {
+		t.Error("copy was not updated")
+	}
+}
+
+func TestApplyTxWithUndo(t *testing.T) {
+	snap := empty(t)
+	inputID := bc.NewHash([32]byte{1})
+	snap.ContractsTree.Insert(inputID.Bytes())
+	want := Copy(snap)
+
+	tx := &bc.Tx{
+		Contracts: []bc.Contract{
+			{Type: bc.InputType, ID: inputID},
+			{Type: bc.OutputType, ID: bc.NewHash([32]byte{2})},
+		},
+		Nonces: []bc.Nonce{{ID: bc.NewHash([32]byte{3}), ExpMS: 10}},
+	}
+	undo, err := snap.ApplyTxWithUndo(0, tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.Equal(want) {
+		t.Fatal("ApplyTxWithUndo did not change the snapshot")
+	}
+	undo()
+	if !snap.Equal(want) {
+		t.Errorf("undo did not restore the snapshot: %s", Diff(snap, want))
+	}
+
+	_, err = snap.ApplyTxWithUndo(0, &bc.Tx{Contracts: []bc.Contract{{Type: bc.InputType, ID: bc.NewHash([32]byte{4})}}})
+	if err == nil {
+		t.Error("expected error for invalid prevout")
+	}
+	if !snap.Equal(want) {
+		t.Errorf("failed ApplyTxWithUndo changed the snapshot: %s", Diff(snap, want))
+	}
+}
+
+func TestValidateAgainst(t *testing.T) {
+	snap := empty(t)
+	tx := &bc.Tx{
+		Contracts: []bc.Contract{{Type: bc.OutputType, ID: bc.NewHash([32]byte{1})}},
+		Nonces:    []bc.Nonce{{ID: bc.NewHash([32]byte{2}), ExpMS: 100}},
+	}
+	post := Copy(snap)
+	err := post.ApplyTx(2, tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contractsRoot := bc.NewHash(post.ContractsTree.RootHash())
+	noncesRoot := bc.NewHash(post.NonceTree.RootHash())
+	block := &bc.Block{
+		BlockHeader: &bc.BlockHeader{
+			Height:          2,
+			TimestampMs:     2,
+			PreviousBlockId: prevID(snap),
+			ContractsRoot:   &contractsRoot,
+			NoncesRoot:      &noncesRoot,
+			NextPredicate:   &bc.Predicate{},
+		},
+		Transactions: []*bc.Tx{tx},
+	}
+
+	good := Copy(snap)
+	err = good.ApplyBlockChecked(block, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = good.ValidateAgainst(block.BlockHeader)
+	if err != nil {
+		t.Error(err)
+	}
+
+	bad := Copy(snap)
+	bad.ContractsTree.Insert(bc.NewHash([32]byte{3}).Bytes())
+	want := Copy(bad)
+	err = bad.ApplyBlockChecked(block, true)
+	if errors.Root(err) != ErrBadStateRoot {
+		t.Errorf("got error %v, want %v", err, ErrBadStateRoot)
+	}
+	if !strings.Contains(errors.Detail(err), "contracts") {
+		t.Errorf("error detail %q does not mention the contracts tree", errors.Detail(err))
+	}
+	if !bad.Equal(want) {
+		t.Errorf("failed ApplyBlockChecked changed the snapshot: %s", Diff(bad, want))
+	}
+
+	err = bad.ApplyBlock(block)
+	if err != nil {
+		t.Fatalf("ApplyBlock without the check: %v", err)
+	}
+	if errors.Root(bad.ValidateAgainst(block.BlockHeader)) != ErrBadStateRoot {
+		t.Error("expected ValidateAgainst to fail for corrupted state")
+	}
+}
+
+func TestNonceBlockIDValidator(t *testing.T) {
+	snap := empty(t)
+	b2 := &bc.BlockHeader{Height: 2, TimestampMs: 2, PreviousBlockId: prevID(snap), NextPredicate: &bc.Predicate{}}
+	err := snap.ApplyBlockHeader(b2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recent, unknown := b2.Hash(), bc.NewHash([32]byte{255})
+
+	cases := []struct {
+		validator func(bc.Hash) bool
+		blockID   bc.Hash
+		wantErr   bool
+	}{
+		{nil, recent, false},
+		{nil, unknown, true},
+		{func(bc.Hash) bool { return false }, recent, true},
+		{func(bc.Hash) bool { return false }, bc.Hash{}, false},
+		{func(bc.Hash) bool { return false }, snap.InitialBlockID, false},
+		{func(bc.Hash) bool { return true }, unknown, false},
+	}
+	for i, c := range cases {
+		s := Copy(snap)
+		s.NonceBlockIDValidator = c.validator
+		tx := &bc.Tx{Nonces: []bc.Nonce{{ID: bc.NewHash([32]byte{1}), BlockID: c.blockID, ExpMS: 100}}}
+		err := s.ApplyTx(1, tx)
+		if (err != nil) != c.wantErr {
+			t.Errorf("case %d: got error %v, want error %t", i, err, c.wantErr)
+		}
+	}
+}
+
+func TestRefIDSet(t *testing.T) {
+	snap := empty(t)
+	snap.MaxRefIDs = 10
+	for height := uint64(2); height < 50; height++ {
+		prev := Copy(snap)
+		err := snap.ApplyBlockHeader(&bc.BlockHeader{Height: height, TimestampMs: height, PreviousBlockId: prevID(snap), NextPredicate: &bc.Predicate{}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkRefIDSet(t, snap)
+		checkRefIDSet(t, prev)
+	}
+
+	b, err := snap.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := new(Snapshot)
+	err = got.FromBytes(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRefIDSet(t, got)
+}
+
+func TestRefIDSetInPlace(t *testing.T) {
+	snap := empty(t)
+	snap.MaxRefIDs = 10
+	block := func(txs ...*bc.Tx) *bc.Block {
+		return &bc.Block{
+			BlockHeader: &bc.BlockHeader{
+				Height:          snap.Height() + 1,
+				TimestampMs:     snap.Height() + 1,
+				PreviousBlockId: prevID(snap),
+				NextPredicate:   &bc.Predicate{},
+			},
+			Transactions: txs,
+		}
+	}
+	spendMissing := &bc.Tx{Contracts: []bc.Contract{{Type: bc.InputType, ID: bc.NewHash([32]byte{1})}}}
+	for i := 0; i < 100; i++ {
+		// A block failing after its header is applied leaves the
+		// index as it was.
+		err := snap.ApplyBlock(block(spendMissing))
+		if errors.Root(err) != ErrInvalidPrevout {
+			t.Fatalf("got error %v, want %v", err, ErrInvalidPrevout)
+		}
+		checkRefIDSet(t, snap)
+
+		set := snap.refIDset
+		err = snap.ApplyBlock(block())
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkRefIDSet(t, snap)
+		if snap.refIDset.len() > 2*len(snap.RefIDs)+16 {
+			t.Fatalf("height %d: refIDset has %d elements, RefIDs has %d", snap.Height(), snap.refIDset.len(), len(snap.RefIDs))
+		}
+		if snap.refIDset != set {
+			t.Fatalf("height %d: refIDset was rebuilt", snap.Height())
+		}
+	}
+}
+
+// checkRefIDSet checks that s's index finds each of its RefIDs,
+// and no ID that is not among them.
+func checkRefIDSet(t *testing.T, s *Snapshot) {
+	t.Helper()
+	for i, id := range s.RefIDs {
+		if j, ok := s.refIDIndex(id); !ok || j != i {
+			t.Fatalf("height %d: refIDIndex(RefIDs[%d]) = %d, %t", s.Height(), i, j, ok)
+		}
+	}
+	for id := range s.refIDset.pos {
+		j, ok := s.refIDIndex(id)
+		if ok && s.RefIDs[j] != id {
+			t.Fatalf("height %d: refIDIndex(%x) = %d, RefIDs[%d] is %x", s.Height(), id.Bytes(), j, j, s.RefIDs[j].Bytes())
+		}
+	}
+}
+
+func BenchmarkNonceBlockIDs(b *testing.B) {
+	snap := Empty()
+	for height := uint64(1); height <= 10000; height++ {
+		err := snap.ApplyBlockHeader(&bc.BlockHeader{Height: height, PreviousBlockId: prevID(snap), NextPredicate: &bc.Predicate{}})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	tx := new(bc.Tx)
+	for i := 0; i < 1000; i++ {
+		tx.Nonces = append(tx.Nonces, bc.Nonce{
+			ID:      bc.NewHash([32]byte{byte(i), byte(i >> 8)}),
+			BlockID: snap.RefIDs[i*7%len(snap.RefIDs)],
+			ExpMS:   100,
+		})
+	}
+
+	scan := Copy(snap)
+	scan.refIDset = nil
+	for _, s := range []struct {
+		name string
+		snap *Snapshot
+	}{{"set", snap}, {"scan", scan}} {
+		b.Run(s.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				err := s.snap.checkTx(1, tx)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeNonceCommitment(t *testing.T) {
+	id := bc.NewHash([32]byte{1, 2, 3})
+	gotID, gotExp, err := DecodeNonceCommitment(NonceCommitment(id, 12345))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotID != id || gotExp != 12345 {
+		t.Errorf("DecodeNonceCommitment = %x, %d; want %x, 12345", gotID.Bytes(), gotExp, id.Bytes())
+	}
+
+	for _, n := range []int{0, 32, 39, 41} {
+		_, _, err = DecodeNonceCommitment(make([]byte, n))
+		if err == nil {
+			t.Errorf("expected error decoding %d-byte commitment", n)
 		}
 	}
 }
@@ -0,0 +1,48 @@
+package state
+
+import (
+	"time"
+
+	"github.com/chain/txvm/protocol/bc"
+)
+
+// BlockStats describes the work done applying a block, for
+// telemetry. See ApplyBlockStats.
+type BlockStats struct {
+	// PruneTime is the time spent finding the nonces that expire
+	// before the block, including bringing the nonce expiration
+	// index up to date.
+	PruneTime time.Duration
+
+	// TxTime is the time spent validating the block's header and
+	// transactions and updating the contracts tree.
+	TxTime time.Duration
+
+	// Time is the total time spent applying the block. Besides
+	// PruneTime and TxTime, it includes removing the expired nonces
+	// and adding the new ones, which is done once for the whole
+	// block.
+	Time time.Duration
+
+	NoncesPruned     int // expired nonces removed
+	NoncesAdded      int
+	ContractsCreated int // outputs
+	ContractsSpent   int // inputs
+}
+
+// ApplyBlockStats is like ApplyBlock, but also reports the work
+// done. The counts depend only on s and block; the times are
+// measured as the block is applied.
+// If any phase fails, s is left unchanged.
+func (s *Snapshot) ApplyBlockStats(block *bc.Block) (BlockStats, error) {
+	s.checkUnsealed()
+	var stats BlockStats
+	c, _, err := s.applyBlock(block, &stats, true)
+	if err != nil {
+		return BlockStats{}, err
+	}
+	*s = *c
+	s.dropStaleRefIDs()
+	s.notifyTxs(block.Transactions)
+	return stats, nil
+}
@@ -0,0 +1,69 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/chain/txvm/protocol/bc"
+)
+
+func TestApplyBlockStats(t *testing.T) {
+	h := func(b byte) bc.Hash { return bc.NewHash([32]byte{b}) }
+	snap := empty(t)
+	snap.ContractsTree.Insert(h(1).Bytes())
+	for _, n := range []bc.Nonce{{ID: h(10), ExpMS: 5}, {ID: h(20), ExpMS: 9}, {ID: h(30), ExpMS: 10}} {
+		snap.NonceTree.Insert(NonceCommitment(n.ID, n.ExpMS))
+	}
+
+	block := &bc.Block{
+		BlockHeader: &bc.BlockHeader{
+			Height:          2,
+			TimestampMs:     10,
+			PreviousBlockId: prevID(snap),
+			NextPredicate:   &bc.Predicate{},
+		},
+		Transactions: []*bc.Tx{
+			{
+				Contracts: []bc.Contract{{Type: bc.InputType, ID: h(1)}, {Type: bc.OutputType, ID: h(2)}},
+				Nonces:    []bc.Nonce{{ID: h(40), ExpMS: 60}, {ID: h(50), ExpMS: 60}},
+			},
+			{
+				Contracts: []bc.Contract{{Type: bc.InputType, ID: h(2)}, {Type: bc.OutputType, ID: h(3)}, {Type: bc.OutputType, ID: h(4)}},
+				Nonces:    []bc.Nonce{{ID: h(10), ExpMS: 60}},
+			},
+		},
+	}
+
+	want := Copy(snap)
+	err := want.ApplyBlock(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := snap.ApplyBlockStats(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !snap.Equal(want) {
+		t.Errorf("ApplyBlockStats differs from ApplyBlock: %s", Diff(snap, want))
+	}
+
+	// The nonces expiring at 5 and 9 are pruned; the one at 10 is not.
+	if stats.NoncesPruned != 2 || stats.NoncesAdded != 3 || stats.ContractsCreated != 3 || stats.ContractsSpent != 2 {
+		t.Errorf("got %d nonces pruned, %d added, %d contracts created, %d spent; want 2, 3, 3, 2",
+			stats.NoncesPruned, stats.NoncesAdded, stats.ContractsCreated, stats.ContractsSpent)
+	}
+	if stats.PruneTime < 0 || stats.TxTime < 0 || stats.Time < stats.PruneTime+stats.TxTime {
+		t.Errorf("got prune time %s, tx time %s, total %s", stats.PruneTime, stats.TxTime, stats.Time)
+	}
+
+	before := Copy(snap)
+	stats, err = snap.ApplyBlockStats(block)
+	if err == nil {
+		t.Fatal("reapplying the block: expected error")
+	}
+	if stats != (BlockStats{}) {
+		t.Errorf("failed block: got stats %+v, want zero", stats)
+	}
+	if !snap.Equal(before) {
+		t.Errorf("failed block modified the snapshot: %s", Diff(snap, before))
+	}
+}
@@ -0,0 +1,81 @@
+package state
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/chain/txvm/protocol/bc"
+)
+
+// Store holds the latest state of a blockchain, for serving reads
+// while blocks are applied. It is safe for concurrent use.
+//
+// The latest snapshot is replaced, never modified: Commit applies a
+// block to a copy and then swaps the copy in atomically. A snapshot
+// returned by Latest therefore stays consistent, however many blocks
+// are committed while it is in use. After the first Commit, the copy
+// takes over the latest snapshot's RefIDs and their index, appending
+// to them in place, so committing a block does not copy them.
+type Store struct {
+	mu     sync.Mutex   // serializes Commit
+	latest atomic.Value // of *Snapshot
+
+	// owned, guarded by mu, reports whether the latest snapshot's
+	// RefIDs and index were made by Commit, so that no snapshot
+	// other than its successor may write to them.
+	owned bool
+}
+
+// NewStore returns a Store whose latest snapshot is s, which must
+// not be modified afterward. Use Empty for a new blockchain.
+func NewStore(s *Snapshot) *Store {
+	st := new(Store)
+	st.latest.Store(s)
+	return st
+}
+
+// Latest returns the latest snapshot. Callers must not modify it;
+// use Copy to obtain a snapshot that may be updated.
+func (st *Store) Latest() *Snapshot {
+	return st.latest.Load().(*Snapshot)
+}
+
+// Commit applies block to the latest snapshot as ApplyBlock does,
+// making the result the latest snapshot. If it fails, the latest
+// snapshot is unchanged.
+func (st *Store) Commit(block *bc.Block) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	s, err := st.Latest().applyBlockSuccessor(block, st.owned)
+	if err != nil {
+		return err
+	}
+	st.latest.Store(s)
+	st.owned = true
+	s.notifyTxs(block.Transactions)
+	return nil
+}
+
+// applyBlockSuccessor is ApplyBlockImmutable for Commit, where s
+// stays in use by readers after the result replaces it. If owned is
+// true, the result appends to s's RefIDs and index in place, rather
+// than copying them as ApplyBlockImmutable's result would. This is
+// safe because, although readers may have marked s shared by copying
+// it, nothing writes to them but s's successor: the copies are
+// marked shared too, and s itself is never updated. Each snapshot
+// ignores what is added past its own RefIDs, and the index is
+// locked. The result keeps the index entries of the IDs it trims,
+// which s still looks up; appendRefID replaces the index once they
+// make up most of it.
+func (s *Snapshot) applyBlockSuccessor(block *bc.Block, owned bool) (*Snapshot, error) {
+	if owned {
+		atomic.StoreUint32(&s.refIDsShared, 0)
+	}
+	c, _, err := s.applyBlock(block, nil, true)
+	atomic.StoreUint32(&s.refIDsShared, 1)
+	if err != nil {
+		return nil, err
+	}
+	c.refIDStale = nil
+	return c, nil
+}
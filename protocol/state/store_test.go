@@ -0,0 +1,196 @@
+package state
+
+import (
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
+)
+
+// TestStoreConcurrent commits a chain of blocks from several
+// writers at once while readers check that each snapshot they get
+// is consistent. Run it with -race.
+func TestStoreConcurrent(t *testing.T) {
+	const n = 50
+	start := empty(t)
+	start.MaxRefIDs = 10
+	var blocks []*bc.Block
+	snap := Copy(start)
+	for height := uint64(2); height <= n; height++ {
+		block := &bc.Block{
+			BlockHeader: &bc.BlockHeader{
+				Height:          height,
+				TimestampMs:     height,
+				PreviousBlockId: prevID(snap),
+				NextPredicate:   &bc.Predicate{},
+			},
+			Transactions: []*bc.Tx{{Contracts: []bc.Contract{{Type: bc.OutputType, ID: bc.NewHash([32]byte{byte(height)})}}}},
+		}
+		err := snap.ApplyBlock(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blocks = append(blocks, block)
+	}
+
+	st := NewStore(start)
+	done := make(chan struct{})
+	var readers, writers sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			var last uint64
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				s := st.Latest()
+				height := s.Height()
+				if height < last {
+					t.Errorf("height went from %d back to %d", last, height)
+					return
+				}
+				last = height
+				// Each block after the first adds one contract.
+				if got := s.ContractCount(); got != int(height)-1 {
+					t.Errorf("height %d: got %d contracts, want %d", height, got, height-1)
+					return
+				}
+				if s.RefIDs[len(s.RefIDs)-1] != s.Header.Hash() {
+					t.Errorf("height %d: latest ref ID is not the header's", height)
+					return
+				}
+				// Commit appends to the index of RefIDs that s
+				// shares.
+				for i, id := range s.RefIDs {
+					if j, ok := s.refIDIndex(id); !ok || j != i {
+						t.Errorf("height %d: refIDIndex(RefIDs[%d]) = %d, %t", height, i, j, ok)
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	// Each writer tries every block; for each block, one writer
+	// succeeds and the rest find it already committed.
+	var mu sync.Mutex
+	committed := make(map[uint64]int)
+	for w := 0; w < 4; w++ {
+		writers.Add(1)
+		go func() {
+			defer writers.Done()
+			for _, block := range blocks {
+				err := st.Commit(block)
+				if err == nil {
+					mu.Lock()
+					committed[block.Height]++
+					mu.Unlock()
+				} else if errors.Root(err) != ErrBlockHeight {
+					t.Errorf("committing block %d: %v", block.Height, err)
+				}
+			}
+		}()
+	}
+	writers.Wait()
+	close(done)
+	readers.Wait()
+
+	for height := uint64(2); height <= n; height++ {
+		if committed[height] != 1 {
+			t.Errorf("block %d committed %d times, want once", height, committed[height])
+		}
+	}
+	if got := st.Latest(); !got.Equal(snap) {
+		t.Errorf("latest snapshot: %s", Diff(got, snap))
+	}
+	if start.Height() != 1 || start.ContractCount() != 0 {
+		t.Error("Commit modified the initial snapshot")
+	}
+}
+
+func TestStoreCommitFailure(t *testing.T) {
+	start := empty(t)
+	st := NewStore(start)
+	err := st.Commit(&bc.Block{BlockHeader: &bc.BlockHeader{Height: 3, NextPredicate: &bc.Predicate{}}})
+	if errors.Root(err) != ErrBlockHeight {
+		t.Errorf("got error %v, want %v", err, ErrBlockHeight)
+	}
+	if st.Latest() != start {
+		t.Error("failed Commit replaced the latest snapshot")
+	}
+}
+
+func TestStoreCommitAllocs(t *testing.T) {
+	const runs = 100
+	allocs := func(n, max int) uint64 {
+		snap := empty(t)
+		ids := make([]bc.Hash, n-1, n)
+		for i := range ids {
+			ids[i] = bc.NewHash([32]byte{1, byte(i), byte(i >> 8), byte(i >> 16)})
+		}
+		snap.RefIDs = append(ids, snap.RefIDs...)
+		snap.MaxRefIDs = max
+		st := NewStore(snap)
+		commit := func() {
+			latest := st.Latest()
+			err := st.Commit(&bc.Block{BlockHeader: &bc.BlockHeader{
+				Height:          latest.Height() + 1,
+				TimestampMs:     latest.Height() + 1,
+				PreviousBlockId: prevID(latest),
+				NextPredicate:   &bc.Predicate{},
+			}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// A reader copying the latest snapshot does not make
+			// the next Commit copy its RefIDs.
+			Copy(st.Latest())
+		}
+		commit() // the first block indexes RefIDs
+
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		for i := 0; i < runs; i++ {
+			commit()
+		}
+		runtime.ReadMemStats(&after)
+		return (after.TotalAlloc - before.TotalAlloc) / runs
+	}
+	small := allocs(10, 0)
+	for _, c := range []struct{ n, max int }{{100000, 0}, {100000, 100000}} {
+		// Copying RefIDs alone would take 32 bytes per ref ID.
+		if size := allocs(c.n, c.max); size > 2*small {
+			t.Errorf("Commit with %d ref IDs (MaxRefIDs %d): %d bytes allocated, want at most %d", c.n, c.max, size, 2*small)
+		}
+	}
+}
+
+func BenchmarkStoreCommit(b *testing.B) {
+	snap := Empty()
+	for height := uint64(1); height <= 10000; height++ {
+		err := snap.ApplyBlockHeader(&bc.BlockHeader{Height: height, PreviousBlockId: prevID(snap), NextPredicate: &bc.Predicate{}})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	st := NewStore(snap)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		latest := st.Latest()
+		err := st.Commit(&bc.Block{BlockHeader: &bc.BlockHeader{
+			Height:          latest.Height() + 1,
+			PreviousBlockId: prevID(latest),
+			NextPredicate:   &bc.Predicate{},
+		}})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package state
+
+import "github.com/chain/txvm/protocol/bc"
+
+// View is a read-only view of a Snapshot, for code that should be
+// able to query the blockchain state but not change it.
+//
+// A View is live, not a copy: it reflects later updates to its
+// Snapshot. Use Copy first to obtain a View of a fixed state.
+type View struct {
+	s *Snapshot
+}
+
+// View returns a read-only view of s.
+func (s *Snapshot) View() *View {
+	return &View{s: s}
+}
+
+// Height returns the height of the latest block. See Snapshot.Height.
+func (v *View) Height() uint64 {
+	return v.s.Height()
+}
+
+// TimestampMS returns the timestamp of the latest block. See
+// Snapshot.TimestampMS.
+func (v *View) TimestampMS() uint64 {
+	return v.s.TimestampMS()
+}
+
+// HeadInfo returns the height, timestamp, and block ID of the latest
+// block. See Snapshot.HeadInfo.
+func (v *View) HeadInfo() (height, timestampMS uint64, blockID bc.Hash, ok bool) {
+	return v.s.HeadInfo()
+}
+
+// InitialBlockID returns the ID of the blockchain's initial block,
+// or the zero hash for an empty state.
+func (v *View) InitialBlockID() bc.Hash {
+	if v.s == nil {
+		return bc.Hash{}
+	}
+	return v.s.InitialBlockID
+}
+
+// ContainsContract reports whether the contract with the given
+// snapshot ID is in the state. See Snapshot.ContainsContract.
+func (v *View) ContainsContract(id bc.Hash) bool {
+	return v.s.ContainsContract(id)
+}
+
+// ContainsNonce reports whether the given nonce is in the state. See
+// Snapshot.ContainsNonce.
+func (v *View) ContainsNonce(id bc.Hash, expMS uint64) bool {
+	return v.s.ContainsNonce(id, expMS)
+}
+
+// ContractCount returns the number of contracts in the state.
+func (v *View) ContractCount() int {
+	return v.s.ContractCount()
+}
+
+// NonceCount returns the number of nonces in the state.
+func (v *View) NonceCount() int {
+	return v.s.NonceCount()
+}
+
+// EachContract calls f with the snapshot ID of each contract in the
+// state. See Snapshot.EachContract.
+func (v *View) EachContract(f func(id bc.Hash) error) error {
+	return v.s.EachContract(f)
+}
+
+// EachNonce calls f with the ID and expiration time of each nonce in
+// the state. See Snapshot.EachNonce.
+func (v *View) EachNonce(f func(id bc.Hash, expMS uint64) error) error {
+	return v.s.EachNonce(f)
+}
+
+// Root returns the state root. See Snapshot.Root.
+func (v *View) Root() bc.Hash {
+	return v.s.Root()
+}
+
+// ValidateBlock reports whether block could be applied to the state.
+// See Snapshot.ValidateBlock.
+func (v *View) ValidateBlock(block *bc.Block) error {
+	return v.s.ValidateBlock(block)
+}
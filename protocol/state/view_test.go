@@ -0,0 +1,56 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/chain/txvm/protocol/bc"
+)
+
+func TestView(t *testing.T) {
+	id := bc.NewHash([32]byte{1})
+	snap := empty(t)
+	v := snap.View()
+	if v.Height() != 1 || v.ContainsContract(id) || v.InitialBlockID() != snap.InitialBlockID {
+		t.Fatal("view does not match snapshot")
+	}
+
+	// Updates to the snapshot show through the view.
+	block := &bc.Block{
+		BlockHeader: &bc.BlockHeader{
+			Height:          2,
+			TimestampMs:     5,
+			PreviousBlockId: prevID(snap),
+			NextPredicate:   &bc.Predicate{},
+		},
+		Transactions: []*bc.Tx{{
+			Contracts: []bc.Contract{{Type: bc.OutputType, ID: id}},
+			Nonces:    []bc.Nonce{{ID: id, ExpMS: 10}},
+		}},
+	}
+	err := v.ValidateBlock(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.ContainsContract(id) {
+		t.Error("ValidateBlock changed the state")
+	}
+	err = snap.ApplyBlock(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Height() != 2 || v.TimestampMS() != 5 {
+		t.Errorf("view has height %d and timestamp %d, want 2 and 5", v.Height(), v.TimestampMS())
+	}
+	if !v.ContainsContract(id) || !v.ContainsNonce(id, 10) {
+		t.Error("view does not contain new contract and nonce")
+	}
+	if v.Root() != snap.Root() {
+		t.Errorf("view root %x, snapshot root %x", v.Root().Bytes(), snap.Root().Bytes())
+	}
+	var contracts, nonces int
+	v.EachContract(func(bc.Hash) error { contracts++; return nil })
+	v.EachNonce(func(bc.Hash, uint64) error { nonces++; return nil })
+	if contracts != 1 || nonces != 1 || v.ContractCount() != 1 || v.NonceCount() != 1 {
+		t.Errorf("view has %d contracts and %d nonces, want 1 and 1", contracts, nonces)
+	}
+}